@@ -0,0 +1,385 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Before the save-the-dates go out, guests send their mailing addresses
+// through a form on the site. Each one is matched against the guest list by
+// guest code, so a household sending theirs twice replaces the first rather
+// than getting two cards, and the couple can see who they are still waiting
+// on. One sent without a code is only matched by name, which anyone could
+// type, so it is kept as a new address for the couple to confirm rather than
+// replacing the one the household sent.
+
+// Limits on what a mailing address can hold
+const (
+	maxAddressLine  = 200
+	maxAddressField = 100
+)
+
+// MailingAddress is where a household wants their stationery sent
+type MailingAddress struct {
+	ID string `json:"id"`
+	// HouseholdID is the household on the guest list the address was
+	// matched to, if it was
+	HouseholdID string `json:"householdId,omitempty"`
+	// Unconfirmed is set when the address was only matched to the household
+	// by name, until the couple confirms it
+	Unconfirmed bool `json:"unconfirmed,omitempty"`
+	// Name is who to address the envelope to, as the guest wrote it
+	Name        string    `json:"name"`
+	Email       string    `json:"email,omitempty"`
+	Street      string    `json:"street"`
+	Street2     string    `json:"street2,omitempty"`
+	City        string    `json:"city"`
+	Region      string    `json:"region,omitempty"`
+	PostalCode  string    `json:"postalCode,omitempty"`
+	Country     string    `json:"country,omitempty"`
+	SubmittedAt time.Time `json:"submittedAt"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+// addressStore keeps the mailing addresses, in the order they were first
+// sent
+type addressStore struct {
+	mu        sync.Mutex
+	path      string
+	addresses []*MailingAddress
+}
+
+// openAddressStore loads the addresses saved at path, starting with none if
+// it doesn't exist
+func openAddressStore(path string) (*addressStore, error) {
+	store := &addressStore{path: path}
+
+	if err := loadJSONFile(path, &store.addresses); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// All returns a copy of every address
+func (store *addressStore) All() []MailingAddress {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	addresses := make([]MailingAddress, 0, len(store.addresses))
+	for _, address := range store.addresses {
+		addresses = append(addresses, *address)
+	}
+	return addresses
+}
+
+// Save adds an address, or replaces the confirmed one already sent for the
+// same household, reporting whether it replaced one. Unconfirmed addresses
+// are always added.
+func (store *addressStore) Save(address MailingAddress) (MailingAddress, bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if address.HouseholdID != "" && !address.Unconfirmed {
+		for _, existing := range store.addresses {
+			if existing.HouseholdID != address.HouseholdID || existing.Unconfirmed {
+				continue
+			}
+			previous := *existing
+			address.ID, address.SubmittedAt = previous.ID, previous.SubmittedAt
+			*existing = address
+			if err := store.save(); err != nil {
+				*existing = previous
+				return MailingAddress{}, true, err
+			}
+			return address, true, nil
+		}
+	}
+
+	address.ID = newUUID()
+	store.addresses = append(store.addresses, &address)
+	if err := store.save(); err != nil {
+		store.addresses = store.addresses[:len(store.addresses)-1]
+		return MailingAddress{}, false, err
+	}
+	return address, false, nil
+}
+
+// Confirm makes the unconfirmed address with the given ID the one for its
+// household, removing the confirmed one it replaces, if there was one. It
+// returns the confirmed address, and false if there is no address with that
+// ID.
+func (store *addressStore) Confirm(id string) (MailingAddress, bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	i := slices.IndexFunc(store.addresses, func(address *MailingAddress) bool { return address.ID == id })
+	if i < 0 {
+		return MailingAddress{}, false, nil
+	}
+	address := *store.addresses[i]
+	if !address.Unconfirmed {
+		return address, true, nil
+	}
+	address.Unconfirmed = false
+	previous := store.addresses
+	store.addresses = make([]*MailingAddress, 0, len(previous))
+	for _, existing := range previous {
+		switch {
+		case existing.ID == id:
+			store.addresses = append(store.addresses, &address)
+		case existing.HouseholdID == address.HouseholdID && !existing.Unconfirmed:
+		default:
+			store.addresses = append(store.addresses, existing)
+		}
+	}
+	if err := store.save(); err != nil {
+		store.addresses = previous
+		return MailingAddress{}, true, err
+	}
+	return address, true, nil
+}
+
+// Delete removes the address with the given ID, reporting whether there was
+// one
+func (store *addressStore) Delete(id string) (bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for i, address := range store.addresses {
+		if address.ID != id {
+			continue
+		}
+		previous := store.addresses
+		store.addresses = slices.Concat(previous[:i], previous[i+1:])
+		if err := store.save(); err != nil {
+			store.addresses = previous
+			return true, err
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// save writes the addresses to disk. The caller must hold store.mu.
+func (store *addressStore) save() error {
+	return saveJSONFile(store.path, store.addresses)
+}
+
+// addressRequest is the body of a guest's mailing address. The guest code
+// can be sent as an X-Guest-Code header to match it to their household
+// without relying on the name.
+type addressRequest struct {
+	Code       string `json:"code"`
+	Name       string `json:"name"`
+	Email      string `json:"email"`
+	Street     string `json:"street"`
+	Street2    string `json:"street2"`
+	City       string `json:"city"`
+	Region     string `json:"region"`
+	PostalCode string `json:"postalCode"`
+	Country    string `json:"country"`
+}
+
+// address checks the request, returning the address it is for
+func (body *addressRequest) address() (MailingAddress, error) {
+	address := MailingAddress{
+		Name:       strings.Join(strings.Fields(body.Name), " "),
+		Email:      strings.TrimSpace(body.Email),
+		Street:     strings.TrimSpace(body.Street),
+		Street2:    strings.TrimSpace(body.Street2),
+		City:       strings.TrimSpace(body.City),
+		Region:     strings.TrimSpace(body.Region),
+		PostalCode: strings.TrimSpace(body.PostalCode),
+		Country:    strings.TrimSpace(body.Country),
+	}
+	if address.Name == "" || utf8.RuneCountInString(address.Name) > maxGuestName {
+		return address, fmt.Errorf("name must be 1 to %d characters", maxGuestName)
+	}
+	if address.Email != "" {
+		parsed, err := mail.ParseAddress(address.Email)
+		if err != nil || parsed.Address != address.Email || len(address.Email) > maxGuestEmail {
+			return address, errors.New("email must be an email address like name@example.com")
+		}
+	}
+	if address.Street == "" || address.City == "" {
+		return address, errors.New("street and city are required")
+	}
+	for _, field := range []struct {
+		name, value string
+		limit       int
+	}{
+		{"street", address.Street, maxAddressLine},
+		{"street2", address.Street2, maxAddressLine},
+		{"city", address.City, maxAddressField},
+		{"region", address.Region, maxAddressField},
+		{"postalCode", address.PostalCode, maxAddressField},
+		{"country", address.Country, maxAddressField},
+	} {
+		if utf8.RuneCountInString(field.value) > field.limit {
+			return address, fmt.Errorf("%s can be at most %d characters", field.name, field.limit)
+		}
+	}
+	return address, nil
+}
+
+// sentAddress is what a guest is told after sending their address
+type sentAddress struct {
+	MailingAddress
+	// Updated is set when it replaced an address they had sent before
+	Updated bool `json:"updated"`
+}
+
+// submitAddressHandler takes a guest's mailing address for the stationery,
+// while addresses are being collected
+func (s *server) submitAddressHandler(response http.ResponseWriter, request *http.Request) {
+	if !*collectAddresses {
+		writeJSONError(response, http.StatusNotFound, "We aren't collecting addresses right now")
+		return
+	}
+	var body addressRequest
+	if !decodeJSON(response, request, &body) {
+		return
+	}
+	address, err := body.address()
+	if err != nil {
+		writeJSONError(response, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	code := body.Code
+	if code == "" {
+		code = guestCode(request)
+	}
+	if code != "" {
+		household, ok, wait := s.lookupCode(request, code)
+		if wait > 0 {
+			writeLockedOut(response, wait)
+			return
+		}
+		if !ok {
+			writeJSONError(response, http.StatusUnauthorized, "unknown guest code")
+			return
+		}
+		address.HouseholdID = household.ID
+	} else if matches := s.guests.Match(address.Name); len(matches) == 1 {
+		address.HouseholdID, address.Unconfirmed = matches[0].ID, true
+	}
+
+	now := time.Now().UTC()
+	address.SubmittedAt, address.UpdatedAt = now, now
+	saved, updated, err := s.addresses.Save(address)
+	if err != nil {
+		slog.Error("Unable to save addresses", "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to save address")
+		return
+	}
+	status := http.StatusCreated
+	if updated {
+		status = http.StatusOK
+	}
+	// Guests aren't told which household they were matched to, or whether
+	// they were, so the form can't be used to find out who is on the guest
+	// list
+	saved.HouseholdID, saved.Unconfirmed = "", false
+	writeJSON(response, status, sentAddress{MailingAddress: saved, Updated: updated})
+}
+
+// addressList is the addresses for the couple: those sent, and the
+// households on the guest list that haven't sent one they have confirmed
+type addressList struct {
+	Addresses []addressListing `json:"addresses"`
+	Missing   []string         `json:"missing"`
+}
+
+// addressListing is a mailing address with the household it was matched to
+type addressListing struct {
+	MailingAddress
+	Household string `json:"household,omitempty"`
+}
+
+// listAddressesHandler lists the mailing addresses for the couple, or with
+// ?format=csv exports them for the stationery order
+func (s *server) listAddressesHandler(response http.ResponseWriter, request *http.Request) {
+	households := s.guests.All()
+	names := make(map[string]string, len(households))
+	for _, household := range households {
+		names[household.ID] = household.Name
+	}
+	list := addressList{Addresses: []addressListing{}, Missing: []string{}}
+	sent := map[string]bool{}
+	for _, address := range s.addresses.All() {
+		list.Addresses = append(list.Addresses, addressListing{MailingAddress: address, Household: names[address.HouseholdID]})
+		if !address.Unconfirmed {
+			sent[address.HouseholdID] = true
+		}
+	}
+	for _, household := range households {
+		if !sent[household.ID] {
+			list.Missing = append(list.Missing, household.Name)
+		}
+	}
+
+	switch request.URL.Query().Get("format") {
+	case "", "json":
+		writeJSON(response, http.StatusOK, list)
+	case "csv":
+		response.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		response.Header().Set("Content-Disposition", `attachment; filename="addresses.csv"`)
+		out := csv.NewWriter(response)
+		out.Write([]string{"Name", "Street", "Street 2", "City", "Region", "Postal code", "Country", "Email", "Household", "Confirmed"})
+		for _, address := range list.Addresses {
+			confirmed := "yes"
+			if address.Unconfirmed {
+				confirmed = "no"
+			}
+			out.Write(csvRow(address.Name, address.Street, address.Street2, address.City, address.Region, address.PostalCode, address.Country, address.Email, address.Household, confirmed))
+		}
+		out.Flush()
+		if err := out.Error(); err != nil {
+			slog.Error("Unable to write addresses", "err", err)
+		}
+	default:
+		writeJSONError(response, http.StatusBadRequest, "format must be json or csv")
+	}
+}
+
+// confirmAddressHandler confirms an address that was only matched to its
+// household by name, making it the one the household's card goes to
+func (s *server) confirmAddressHandler(response http.ResponseWriter, request *http.Request) {
+	address, ok, err := s.addresses.Confirm(request.PathValue("id"))
+	if !ok {
+		writeJSONError(response, http.StatusNotFound, "Address not found")
+		return
+	}
+	if err != nil {
+		slog.Error("Unable to save addresses", "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to confirm address")
+		return
+	}
+	writeJSON(response, http.StatusOK, address)
+}
+
+// deleteAddressHandler removes a mailing address, such as one sent by
+// someone who isn't invited
+func (s *server) deleteAddressHandler(response http.ResponseWriter, request *http.Request) {
+	ok, err := s.addresses.Delete(request.PathValue("id"))
+	if !ok {
+		writeJSONError(response, http.StatusNotFound, "Address not found")
+		return
+	}
+	if err != nil {
+		slog.Error("Unable to save addresses", "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to delete address")
+		return
+	}
+	response.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The couple manages the site with the admin token from the config, sent as
+// an "Authorization: Bearer" header. So the token itself doesn't have to be
+// kept on every device they use, it can be traded at /admin/login for a
+// session token: a JWT signed with HS256 that expires after a while. Session
+// tokens from an emailed login link are kept in a cookie instead. With
+// two-factor authentication on, a code is needed as well to start a session.
+
+// adminClaims are the claims of an admin session token
+type adminClaims struct {
+	ID        string `json:"jti"`
+	Subject   string `json:"sub"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	// Email is who logged in, for sessions from a login link
+	Email string `json:"email,omitempty"`
+	// TwoFactor is set on sessions started with a two-factor code
+	TwoFactor bool `json:"mfa,omitempty"`
+	// Pending sessions are from a login link and still need a two-factor
+	// code, which is all they can be used for
+	Pending bool `json:"pending,omitempty"`
+}
+
+// sessionOptions are what a new admin session token says about how the
+// session was started
+type sessionOptions struct {
+	Email     string
+	TwoFactor bool
+	Pending   bool
+}
+
+// adminSubject is the subject of every admin session token
+const adminSubject = "admin"
+
+// jwtHeader is the header of every admin session token, already encoded
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// sessionKey is the secret admin session tokens are signed with: the one in
+// the config, or else the admin token, so changing it ends every session
+func sessionKey() []byte {
+	if *adminJWTKey != "" {
+		return []byte(*adminJWTKey)
+	}
+	return []byte(*adminToken)
+}
+
+// jwtSignature returns the encoded signature of a token's header and claims
+func jwtSignature(unsigned string) string {
+	mac := hmac.New(sha256.New, sessionKey())
+	mac.Write([]byte(unsigned))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// issueSessionToken returns an admin session token that lasts lifetime
+// from now, started as options says
+func issueSessionToken(now time.Time, lifetime time.Duration, options sessionOptions) (string, time.Time) {
+	expires := now.Add(lifetime).Truncate(time.Second)
+	claims, _ := json.Marshal(adminClaims{
+		ID:        newUUID(),
+		Subject:   adminSubject,
+		Email:     options.Email,
+		TwoFactor: options.TwoFactor,
+		Pending:   options.Pending,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: expires.Unix(),
+	})
+	unsigned := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(claims)
+	return unsigned + "." + jwtSignature(unsigned), expires
+}
+
+// verifySessionToken returns the claims of token, reporting whether it is an
+// admin session token that hasn't expired at now
+func verifySessionToken(token string, now time.Time) (adminClaims, bool) {
+	header, rest, ok := strings.Cut(token, ".")
+	if !ok || header != jwtHeader {
+		return adminClaims{}, false
+	}
+	payload, signature, ok := strings.Cut(rest, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(jwtSignature(header+"."+payload))) {
+		return adminClaims{}, false
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return adminClaims{}, false
+	}
+	var claims adminClaims
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return adminClaims{}, false
+	}
+	return claims, claims.Subject == adminSubject && now.Unix() < claims.ExpiresAt
+}
+
+// revokedSessions keeps the IDs of admin sessions that were logged out before
+// they expired, so their tokens stop working. They are saved so a restart
+// doesn't bring them back, and forgotten once the tokens would have expired
+// anyway.
+type revokedSessions struct {
+	mu   sync.Mutex
+	path string
+	// ids are the revoked session IDs and when their tokens expire, in Unix
+	// seconds
+	ids map[string]int64
+}
+
+// openRevokedSessions loads the sessions revoked at path, starting with none
+// if it doesn't exist
+func openRevokedSessions(path string) (*revokedSessions, error) {
+	revoked := &revokedSessions{path: path, ids: make(map[string]int64)}
+
+	if err := loadJSONFile(path, &revoked.ids); err != nil {
+		return nil, err
+	}
+	return revoked, nil
+}
+
+// Revoke ends the session with claims at now
+func (revoked *revokedSessions) Revoke(claims adminClaims, now time.Time) error {
+	revoked.mu.Lock()
+	defer revoked.mu.Unlock()
+
+	for id, expires := range revoked.ids {
+		if now.Unix() >= expires {
+			delete(revoked.ids, id)
+		}
+	}
+	revoked.ids[claims.ID] = claims.ExpiresAt
+	if err := revoked.save(); err != nil {
+		delete(revoked.ids, claims.ID)
+		return err
+	}
+	return nil
+}
+
+// Revoked reports whether the session with id was ended
+func (revoked *revokedSessions) Revoked(id string) bool {
+	revoked.mu.Lock()
+	defer revoked.mu.Unlock()
+
+	_, ok := revoked.ids[id]
+	return ok
+}
+
+// save writes the revoked sessions to disk. The caller must hold revoked.mu.
+func (revoked *revokedSessions) save() error {
+	return saveJSONFile(revoked.path, revoked.ids)
+}
+
+// isAdminToken reports whether token is the admin token from the config
+func isAdminToken(token string) bool {
+	return *adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(*adminToken)) == 1
+}
+
+// adminActor names who token lets in at now for the audit log: the admin
+// token itself, or the session it is for. It is empty for any other token, and
+// for sessions still waiting on a two-factor code.
+func adminActor(token string, now time.Time) string {
+	if isAdminToken(token) {
+		return "admin token"
+	}
+	claims, ok := verifySessionToken(token, now)
+	switch {
+	case !ok || claims.Pending:
+		return ""
+	case claims.Email != "":
+		return claims.Email + " (session " + claims.ID + ")"
+	}
+	return "session " + claims.ID
+}
+
+// adminCredential returns the token a request was sent with: a bearer token,
+// or else the session cookie
+func adminCredential(request *http.Request) (string, bool) {
+	if token, ok := strings.CutPrefix(request.Header.Get("Authorization"), "Bearer "); ok {
+		return token, true
+	}
+	if cookie, err := request.Cookie(sessionCookie); err == nil {
+		return cookie.Value, true
+	}
+	return "", false
+}
+
+// admin requires the admin token or a session token on requests to a
+// management endpoint. Without a token in the config the endpoints are
+// turned off.
+func (s *server) admin(next http.HandlerFunc) http.HandlerFunc {
+	return func(response http.ResponseWriter, request *http.Request) {
+		if s.authorizeAdmin(response, request) {
+			next(response, request)
+		}
+	}
+}
+
+// Reasons checkAdmin turns a request away
+var (
+	errAdminOff       = errors.New("the admin API is turned off")
+	errAdminToken     = errors.New("a valid admin token is needed")
+	errAdminTwoFactor = errors.New("two-factor authentication is on, log in at /admin/login with a code")
+)
+
+// checkAdmin checks the admin token or session token on a request without
+// answering it, returning the token if it lets the request in. Sessions that
+// were logged out, and ones started without a code while two-factor
+// authentication is on, don't.
+func (s *server) checkAdmin(request *http.Request) (string, error) {
+	if *adminToken == "" {
+		return "", errAdminOff
+	}
+	token, ok := adminCredential(request)
+	if !ok || adminActor(token, time.Now()) == "" || s.sessionRevoked(token) {
+		return "", errAdminToken
+	}
+	if s.twoFactor.Enabled() {
+		if claims, _ := verifySessionToken(token, time.Now()); !claims.TwoFactor {
+			return "", errAdminTwoFactor
+		}
+	}
+	return token, nil
+}
+
+// isAdmin reports whether request was sent by the couple, for endpoints that
+// show them more than guests but let everyone in
+func (s *server) isAdmin(request *http.Request) bool {
+	_, err := s.checkAdmin(request)
+	return err == nil
+}
+
+// authorizeAdmin checks the admin token or session token on a request, for
+// endpoints where only some requests need it. If the token is missing or
+// wrong it answers the request and returns false. Requests it lets through
+// are marked for the audit log.
+func (s *server) authorizeAdmin(response http.ResponseWriter, request *http.Request) bool {
+	token, err := s.checkAdmin(request)
+	if errors.Is(err, errAdminOff) {
+		writeJSONError(response, http.StatusForbidden, err.Error())
+		return false
+	}
+	if err != nil {
+		response.Header().Set("WWW-Authenticate", "Bearer")
+		writeJSONError(response, http.StatusUnauthorized, err.Error())
+		return false
+	}
+	markAudited(request, token)
+	return true
+}
+
+// sessionRevoked reports whether token is for a session that was logged out
+func (s *server) sessionRevoked(token string) bool {
+	claims, ok := verifySessionToken(token, time.Now())
+	return ok && s.revoked.Revoked(claims.ID)
+}
+
+// sessionResponse is a freshly issued admin session token
+type sessionResponse struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// loginRequest is the body of a login with the admin token, which only needs
+// a code when two-factor authentication is on
+type loginRequest struct {
+	Code string `json:"code"`
+}
+
+// adminLoginHandler trades the admin token, and a two-factor code if it is
+// on, for a session token. Session tokens can't be traded for new ones, so
+// a leaked one only works until it expires.
+func (s *server) adminLoginHandler(response http.ResponseWriter, request *http.Request) {
+	if *adminToken == "" {
+		writeJSONError(response, http.StatusForbidden, "the admin API is turned off")
+		return
+	}
+	var body loginRequest
+	twoFactor := s.twoFactor.Enabled()
+	if twoFactor && !decodeJSON(response, request, &body) {
+		return
+	}
+	token, _ := strings.CutPrefix(request.Header.Get("Authorization"), "Bearer ")
+	tokenOK := false
+	ok, wait := s.guesses.guess(request, guessAdmin, func() bool {
+		tokenOK = isAdminToken(token)
+		return tokenOK && (!twoFactor || s.twoFactor.Verify(body.Code, time.Now()))
+	})
+	switch {
+	case wait > 0:
+		writeLockedOut(response, wait)
+		return
+	case !tokenOK:
+		response.Header().Set("WWW-Authenticate", "Bearer")
+		writeJSONError(response, http.StatusUnauthorized, "the admin token is needed to log in")
+		return
+	case !ok:
+		writeJSONError(response, http.StatusUnauthorized, "a current two-factor code is needed to log in")
+		return
+	}
+	options := sessionOptions{TwoFactor: twoFactor}
+	session, expires := issueSessionToken(time.Now(), *adminSessionTTL, options)
+	response.Header().Set("Cache-Control", "no-store")
+	writeJSON(response, http.StatusOK, sessionResponse{Token: session, ExpiresAt: expires})
+}
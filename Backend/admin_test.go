@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setFlag sets a string setting for the length of a test
+func setFlag(t *testing.T, setting *string, value string) {
+	previous := *setting
+	*setting = value
+	t.Cleanup(func() { *setting = previous })
+}
+
+func TestVerifySessionToken(t *testing.T) {
+	setFlag(t, adminToken, "admin-secret")
+	setFlag(t, adminJWTKey, "")
+	now := time.Unix(1_800_000_000, 0)
+	token, expires := issueSessionToken(now, time.Hour, sessionOptions{Email: "couple@example.com", TwoFactor: true})
+	header, rest, _ := strings.Cut(token, ".")
+	payload, signature, _ := strings.Cut(rest, ".")
+
+	// signed returns a token for claims signed with the current key
+	signed := func(claims string) string {
+		unsigned := jwtHeader + "." + base64.RawURLEncoding.EncodeToString([]byte(claims))
+		return unsigned + "." + jwtSignature(unsigned)
+	}
+	noneHeader := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`))
+	tampered := base64.RawURLEncoding.EncodeToString([]byte(`{"jti":"x","sub":"admin","exp":9999999999}`))
+
+	tests := []struct {
+		name  string
+		token string
+		now   time.Time
+		want  bool
+	}{
+		{name: "valid", token: token, now: now, want: true},
+		{name: "just before expiry", token: token, now: expires.Add(-time.Second), want: true},
+		{name: "at expiry", token: token, now: expires},
+		{name: "after expiry", token: token, now: expires.Add(time.Minute)},
+		{name: "empty", token: "", now: now},
+		{name: "admin token", token: "admin-secret", now: now},
+		{name: "no signature", token: header + "." + payload, now: now},
+		{name: "empty signature", token: header + "." + payload + ".", now: now},
+		{name: "wrong signature", token: header + "." + payload + "." + strings.Repeat("A", len(signature)), now: now},
+		{name: "changed claims", token: header + "." + tampered + "." + signature, now: now},
+		{name: "alg none", token: noneHeader + "." + payload + ".", now: now},
+		{name: "alg none signed", token: noneHeader + "." + payload + "." + signature, now: now},
+		{name: "other subject", token: signed(`{"jti":"x","sub":"guest","exp":9999999999}`), now: now},
+		{name: "no expiry", token: signed(`{"jti":"x","sub":"admin"}`), now: now},
+		{name: "bad payload", token: signed(`not json`), now: now},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, ok := verifySessionToken(test.token, test.now); ok != test.want {
+				t.Errorf("verifySessionToken() = %v, want %v", ok, test.want)
+			}
+		})
+	}
+
+	claims, _ := verifySessionToken(token, now)
+	if claims.Email != "couple@example.com" || !claims.TwoFactor || claims.Pending {
+		t.Errorf("verifySessionToken() claims = %+v, want the ones it was issued with", claims)
+	}
+
+	// Changing the key the tokens are signed with ends every session
+	setFlag(t, adminJWTKey, "another-key")
+	if _, ok := verifySessionToken(token, now); ok {
+		t.Error("verifySessionToken() accepted a token signed with an old key")
+	}
+}
+
+func TestAdminActor(t *testing.T) {
+	now := time.Unix(1_800_000_000, 0)
+
+	t.Run("admin API off", func(t *testing.T) {
+		setFlag(t, adminToken, "")
+		setFlag(t, adminJWTKey, "")
+		for _, token := range []string{"", "anything"} {
+			if actor := adminActor(token, now); actor != "" {
+				t.Errorf("adminActor(%q) = %q with no admin token set, want none", token, actor)
+			}
+		}
+	})
+
+	setFlag(t, adminToken, "admin-secret")
+	setFlag(t, adminJWTKey, "")
+	session, _ := issueSessionToken(now, time.Hour, sessionOptions{})
+	pending, _ := issueSessionToken(now, time.Hour, sessionOptions{Email: "couple@example.com", Pending: true})
+	tests := []struct {
+		name  string
+		token string
+		want  bool
+	}{
+		{name: "admin token", token: "admin-secret", want: true},
+		{name: "session", token: session, want: true},
+		{name: "pending session", token: pending},
+		{name: "wrong token", token: "admin-secre"},
+		{name: "empty", token: ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if actor := adminActor(test.token, now); (actor != "") != test.want {
+				t.Errorf("adminActor() = %q, want one: %v", actor, test.want)
+			}
+		})
+	}
+}
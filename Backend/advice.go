@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Guests leave advice for the couple's marriage in a time capsule: it is
+// kept sealed, even from the couple, until the release date, such as their
+// first anniversary.
+
+// maxAdviceMessage is the longest piece of advice a guest can leave
+const maxAdviceMessage = 2000
+
+// Advice is a guest's advice for the couple
+type Advice struct {
+	ID        string    `json:"id"`
+	Author    string    `json:"author"`
+	Message   string    `json:"message"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// adviceStore keeps the advice, oldest first
+type adviceStore struct {
+	mu     sync.Mutex
+	path   string
+	advice []Advice
+	// releasesAt is when the advice can be read, or zero if no release date
+	// is set and it stays sealed
+	releasesAt time.Time
+}
+
+// openAdviceStore loads the advice saved at path, starting with none if it
+// doesn't exist. It is released on the date given, or else on the first
+// anniversary of the wedding.
+func openAdviceStore(path, release, weddingDate string) (*adviceStore, error) {
+	store := &adviceStore{path: path}
+	switch {
+	case release != "":
+		releasesAt, err := time.ParseInLocation("2006-01-02", release, time.Local)
+		if err != nil {
+			return nil, fmt.Errorf("advice release date must look like 2006-01-02: %w", err)
+		}
+		store.releasesAt = releasesAt
+	case weddingDate != "":
+		wedding, err := time.ParseInLocation("2006-01-02", weddingDate, time.Local)
+		if err != nil {
+			return nil, fmt.Errorf("wedding date must look like 2006-01-02: %w", err)
+		}
+		store.releasesAt = wedding.AddDate(1, 0, 0)
+	}
+
+	if err := loadJSONFile(path, &store.advice); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// released reports whether the advice can be read at now
+func (store *adviceStore) released(now time.Time) bool {
+	return !store.releasesAt.IsZero() && !now.Before(store.releasesAt)
+}
+
+// Add seals a guest's advice in the time capsule
+func (store *adviceStore) Add(advice Advice) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.advice = append(store.advice, advice)
+	if err := store.save(); err != nil {
+		store.advice = store.advice[:len(store.advice)-1]
+		return err
+	}
+	return nil
+}
+
+// All returns a copy of the advice, oldest first
+func (store *adviceStore) All() []Advice {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	advice := make([]Advice, len(store.advice))
+	copy(advice, store.advice)
+	return advice
+}
+
+// Count returns how much advice has been left
+func (store *adviceStore) Count() int {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	return len(store.advice)
+}
+
+// save writes the advice to disk. The caller must hold store.mu.
+func (store *adviceStore) save() error {
+	return saveJSONFile(store.path, store.advice)
+}
+
+// adviceRequest is the body of a guest's advice. Guests who send their
+// guest code are named as their household.
+type adviceRequest struct {
+	Author  string `json:"author"`
+	Message string `json:"message"`
+}
+
+// timeCapsule is the advice in the time capsule: only how much there is and
+// when it opens until it is released, and then the advice itself
+type timeCapsule struct {
+	Sealed     bool       `json:"sealed"`
+	ReleasesAt *time.Time `json:"releasesAt,omitempty"`
+	Count      int        `json:"count"`
+	Advice     []Advice   `json:"advice,omitempty"`
+}
+
+// capsule returns the time capsule as it stands at now
+func (store *adviceStore) capsule(now time.Time) timeCapsule {
+	capsule := timeCapsule{Sealed: !store.released(now), Count: store.Count()}
+	if !store.releasesAt.IsZero() {
+		capsule.ReleasesAt = &store.releasesAt
+	}
+	if !capsule.Sealed {
+		capsule.Advice = store.All()
+	}
+	return capsule
+}
+
+// leaveAdviceHandler seals a guest's advice for the couple in the time
+// capsule
+func (s *server) leaveAdviceHandler(response http.ResponseWriter, request *http.Request) {
+	var body adviceRequest
+	if !decodeJSON(response, request, &body) {
+		return
+	}
+	advice := Advice{
+		ID:        newUUID(),
+		Author:    strings.TrimSpace(body.Author),
+		Message:   strings.TrimSpace(body.Message),
+		CreatedAt: time.Now().UTC(),
+	}
+	if code := guestCode(request); code != "" {
+		household, ok, wait := s.lookupCode(request, code)
+		if wait > 0 {
+			writeLockedOut(response, wait)
+			return
+		}
+		if !ok {
+			writeJSONError(response, http.StatusUnauthorized, "unknown guest code")
+			return
+		}
+		advice.Author = household.Name
+	}
+	if advice.Author == "" || utf8.RuneCountInString(advice.Author) > maxAuthorLength {
+		writeJSONError(response, http.StatusBadRequest, fmt.Sprintf("author must be 1 to %d characters", maxAuthorLength))
+		return
+	}
+	if advice.Message == "" || utf8.RuneCountInString(advice.Message) > maxAdviceMessage {
+		writeJSONError(response, http.StatusBadRequest, fmt.Sprintf("message must be 1 to %d characters", maxAdviceMessage))
+		return
+	}
+
+	if err := s.advice.Add(advice); err != nil {
+		slog.Error("Unable to save advice", "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to save advice")
+		return
+	}
+	capsule := s.advice.capsule(time.Now())
+	capsule.Advice = nil
+	writeJSON(response, http.StatusCreated, capsule)
+}
+
+// adviceHandler opens the time capsule for the couple. Until the release
+// date it only says how much advice is waiting and when it can be read.
+func (s *server) adviceHandler(response http.ResponseWriter, request *http.Request) {
+	writeJSON(response, http.StatusOK, s.advice.capsule(time.Now()))
+}
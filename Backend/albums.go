@@ -0,0 +1,543 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// maxAlbumName is the longest name an album can have
+const maxAlbumName = 100
+
+// Limits on the passphrase of a private album. bcrypt only looks at the
+// first 72 bytes.
+const (
+	minAlbumPassphrase = 4
+	maxAlbumPassphrase = 72
+)
+
+// albumTokenLifetime is how long the token a private album's passphrase is
+// exchanged for lasts
+const albumTokenLifetime = 2 * time.Hour
+
+// Album is a set of photos the couple has put together, such as the photo
+// booth or the honeymoon. A photo is in at most one album.
+type Album struct {
+	// ID is made from the name when the album is created, so it reads well
+	// in links, and stays the same if the album is renamed
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+	// Private albums, such as the honeymoon, only show their photos to
+	// guests who know the album's passphrase. PassphraseHash is its bcrypt
+	// hash, which is never sent to guests.
+	Private        bool   `json:"private,omitempty"`
+	PassphraseHash string `json:"passphraseHash,omitempty"`
+}
+
+// forGuests returns the album as guests are shown it, without its
+// passphrase hash
+func (album Album) forGuests() Album {
+	album.PassphraseHash = ""
+	return album
+}
+
+// albumStore keeps the albums, in the order they were created
+type albumStore struct {
+	mu     sync.Mutex
+	path   string
+	albums []*Album
+	// key signs the tokens private albums are unlocked with. It is made
+	// afresh on every start, so a restart means entering the passphrase
+	// again.
+	key []byte
+}
+
+// openAlbumStore loads the albums saved at path, starting with none if it
+// doesn't exist
+func openAlbumStore(path string) (*albumStore, error) {
+	store := &albumStore{path: path, key: []byte(randomHex(32))}
+
+	if err := loadJSONFile(path, &store.albums); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// All returns a copy of every album
+func (store *albumStore) All() []Album {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	albums := make([]Album, 0, len(store.albums))
+	for _, album := range store.albums {
+		albums = append(albums, *album)
+	}
+	return albums
+}
+
+// Get returns a copy of the album with the given ID
+func (store *albumStore) Get(id string) (Album, bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if album := store.find(id); album != nil {
+		return *album, true
+	}
+	return Album{}, false
+}
+
+// find returns the album with the given ID. The caller must hold store.mu.
+func (store *albumStore) find(id string) *Album {
+	for _, album := range store.albums {
+		if album.ID == id {
+			return album
+		}
+	}
+	return nil
+}
+
+// Create adds a new album, private if it is given a passphrase hash
+func (store *albumStore) Create(name, description, passphraseHash string) (Album, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	base := slug(name, "album")
+	id := base
+	for n := 2; store.find(id) != nil; n++ {
+		id = fmt.Sprintf("%s-%d", base, n)
+	}
+	album := &Album{ID: id, Name: name, Description: description, CreatedAt: time.Now().UTC(), Private: passphraseHash != "", PassphraseHash: passphraseHash}
+	store.albums = append(store.albums, album)
+	if err := store.save(); err != nil {
+		store.albums = store.albums[:len(store.albums)-1]
+		return Album{}, err
+	}
+	return *album, nil
+}
+
+// Update changes the album with the given ID, reporting whether there is one
+func (store *albumStore) Update(id string, change func(*Album)) (Album, bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	album := store.find(id)
+	if album == nil {
+		return Album{}, false, nil
+	}
+	previous := *album
+	change(album)
+	album.ID = previous.ID
+	if err := store.save(); err != nil {
+		*album = previous
+		return Album{}, true, err
+	}
+	return *album, true, nil
+}
+
+// Delete removes the album with the given ID, reporting whether there was one
+func (store *albumStore) Delete(id string) (bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for i, album := range store.albums {
+		if album.ID != id {
+			continue
+		}
+		previous := store.albums
+		store.albums = slices.Concat(previous[:i], previous[i+1:])
+		if err := store.save(); err != nil {
+			store.albums = previous
+			return true, err
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// save writes the albums to disk. The caller must hold store.mu.
+func (store *albumStore) save() error {
+	return saveJSONFile(store.path, store.albums)
+}
+
+// tokenSignature returns the signature of a token unlocking album until
+// expires. The passphrase hash is signed too, so changing the passphrase
+// locks the album again for everyone.
+func (store *albumStore) tokenSignature(album Album, expires int64) string {
+	mac := hmac.New(sha256.New, store.key)
+	fmt.Fprintf(mac, "%s\n%d\n%s", album.ID, expires, album.PassphraseHash)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Token returns a token that unlocks album for albumTokenLifetime from now
+func (store *albumStore) Token(album Album, now time.Time) (string, time.Time) {
+	expires := now.Add(albumTokenLifetime).Truncate(time.Second)
+	token := base64.RawURLEncoding.EncodeToString([]byte(album.ID)) + "." + strconv.FormatInt(expires.Unix(), 10)
+	return token + "." + store.tokenSignature(album, expires.Unix()), expires
+}
+
+// Unlocked reports whether token unlocks album at now
+func (store *albumStore) Unlocked(album Album, token string, now time.Time) bool {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return false
+	}
+	id, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || string(id) != album.ID {
+		return false
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || now.Unix() >= expires {
+		return false
+	}
+	return hmac.Equal([]byte(parts[2]), []byte(store.tokenSignature(album, expires)))
+}
+
+// albumToken returns the token a request sent to unlock a private album:
+// an X-Album-Token header, or ?albumToken= for links such as image URLs
+func albumToken(request *http.Request) string {
+	if token := request.Header.Get("X-Album-Token"); token != "" {
+		return token
+	}
+	return request.URL.Query().Get("albumToken")
+}
+
+// canSeeAlbum reports whether request can see the photos in the album with
+// the given ID: any album but a private one, which needs a token unlocking
+// it or the admin token
+func (s *server) canSeeAlbum(request *http.Request, id string) bool {
+	if id == "" {
+		return true
+	}
+	album, ok := s.albums.Get(id)
+	if !ok || !album.Private {
+		return true
+	}
+	if s.isAdmin(request) {
+		return true
+	}
+	return s.albums.Unlocked(album, albumToken(request), time.Now())
+}
+
+// hiddenAlbums returns the IDs of the private albums request can't see
+func (s *server) hiddenAlbums(request *http.Request) []string {
+	var hidden []string
+	for _, album := range s.albums.All() {
+		if album.Private && !s.canSeeAlbum(request, album.ID) {
+			hidden = append(hidden, album.ID)
+		}
+	}
+	return hidden
+}
+
+// albumSummary is how an album is listed, with how many photos are in it and
+// a thumbnail of the newest one to show on its cover
+type albumSummary struct {
+	Album
+	PhotoCount int    `json:"photoCount"`
+	CoverURL   string `json:"coverUrl,omitempty"`
+}
+
+// summarizeAlbum returns how album is listed. Private albums have no cover,
+// as it couldn't be shown to guests who haven't unlocked them.
+func (s *server) summarizeAlbum(album Album) (albumSummary, error) {
+	photos, err := s.photos.List(photoQuery{Status: photoReady, Album: album.ID})
+	if err != nil {
+		return albumSummary{}, err
+	}
+	summary := albumSummary{Album: album.forGuests(), PhotoCount: len(photos)}
+	if len(photos) > 0 && !album.Private {
+		summary.CoverURL = summarizePhoto(photos[0]).ThumbnailURL
+	}
+	return summary, nil
+}
+
+// albumRequest is the body of a request to create or change an album. Fields
+// left out of a change are kept as they are. A passphrase makes the album
+// private, and an empty one makes it public again.
+type albumRequest struct {
+	Name        *string `json:"name"`
+	Description *string `json:"description"`
+	Passphrase  *string `json:"passphrase"`
+}
+
+// validate checks the fields that were given, trimming the name
+func (body *albumRequest) validate() error {
+	if body.Name != nil {
+		name := strings.TrimSpace(*body.Name)
+		if name == "" || len(name) > maxAlbumName {
+			return fmt.Errorf("name must be 1 to %d characters", maxAlbumName)
+		}
+		body.Name = &name
+	}
+	if body.Passphrase != nil && *body.Passphrase != "" {
+		if length := len(*body.Passphrase); length < minAlbumPassphrase || length > maxAlbumPassphrase {
+			return fmt.Errorf("passphrase must be %d to %d bytes", minAlbumPassphrase, maxAlbumPassphrase)
+		}
+	}
+	return nil
+}
+
+// passphraseHash returns the hash of the passphrase given, or empty if the
+// album is to be public
+func (body *albumRequest) passphraseHash() (string, error) {
+	if body.Passphrase == nil || *body.Passphrase == "" {
+		return "", nil
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(*body.Passphrase), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// listAlbumsHandler lists every album, in the order they were created
+func (s *server) listAlbumsHandler(response http.ResponseWriter, request *http.Request) {
+	summaries := []albumSummary{}
+	for _, album := range s.albums.All() {
+		summary, err := s.summarizeAlbum(album)
+		if err != nil {
+			writeJSONError(response, http.StatusInternalServerError, "Unable to list albums")
+			return
+		}
+		summaries = append(summaries, summary)
+	}
+	writeJSON(response, http.StatusOK, summaries)
+}
+
+// albumHandler describes one album. Its photos are listed by the gallery
+// with ?album=.
+func (s *server) albumHandler(response http.ResponseWriter, request *http.Request) {
+	album, ok := s.albums.Get(request.PathValue("id"))
+	if !ok {
+		writeJSONError(response, http.StatusNotFound, "Album not found")
+		return
+	}
+	summary, err := s.summarizeAlbum(album)
+	if err != nil {
+		writeJSONError(response, http.StatusInternalServerError, "Unable to read album")
+		return
+	}
+	writeJSON(response, http.StatusOK, summary)
+}
+
+// createAlbumHandler adds an album
+func (s *server) createAlbumHandler(response http.ResponseWriter, request *http.Request) {
+	var body albumRequest
+	if !decodeJSON(response, request, &body) {
+		return
+	}
+	if body.Name == nil {
+		writeJSONError(response, http.StatusBadRequest, "name is required")
+		return
+	}
+	if err := body.validate(); err != nil {
+		writeJSONError(response, http.StatusBadRequest, err.Error())
+		return
+	}
+	var description string
+	if body.Description != nil {
+		description = strings.TrimSpace(*body.Description)
+	}
+	hash, err := body.passphraseHash()
+	if err != nil {
+		slog.Error("Unable to hash album passphrase", "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to create album")
+		return
+	}
+
+	album, err := s.albums.Create(*body.Name, description, hash)
+	if err != nil {
+		slog.Error("Unable to save albums", "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to create album")
+		return
+	}
+	writeJSON(response, http.StatusCreated, albumSummary{Album: album.forGuests()})
+}
+
+// updateAlbumHandler renames an album, changes its description, or makes it
+// private or public
+func (s *server) updateAlbumHandler(response http.ResponseWriter, request *http.Request) {
+	var body albumRequest
+	if !decodeJSON(response, request, &body) {
+		return
+	}
+	if err := body.validate(); err != nil {
+		writeJSONError(response, http.StatusBadRequest, err.Error())
+		return
+	}
+	hash, err := body.passphraseHash()
+	if err != nil {
+		slog.Error("Unable to hash album passphrase", "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to update album")
+		return
+	}
+
+	album, ok, err := s.albums.Update(request.PathValue("id"), func(album *Album) {
+		if body.Name != nil {
+			album.Name = *body.Name
+		}
+		if body.Description != nil {
+			album.Description = strings.TrimSpace(*body.Description)
+		}
+		if body.Passphrase != nil {
+			album.Private, album.PassphraseHash = hash != "", hash
+		}
+	})
+	if !ok {
+		writeJSONError(response, http.StatusNotFound, "Album not found")
+		return
+	}
+	if err != nil {
+		slog.Error("Unable to save albums", "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to update album")
+		return
+	}
+	summary, err := s.summarizeAlbum(album)
+	if err != nil {
+		writeJSONError(response, http.StatusInternalServerError, "Unable to read album")
+		return
+	}
+	writeJSON(response, http.StatusOK, summary)
+}
+
+// deleteAlbumHandler removes an album. Its photos stay in the gallery, just
+// no longer in an album.
+func (s *server) deleteAlbumHandler(response http.ResponseWriter, request *http.Request) {
+	id := request.PathValue("id")
+	if _, ok := s.albums.Get(id); !ok {
+		writeJSONError(response, http.StatusNotFound, "Album not found")
+		return
+	}
+
+	photos, err := s.photos.List(photoQuery{Album: id})
+	if err != nil {
+		writeJSONError(response, http.StatusInternalServerError, "Unable to delete album")
+		return
+	}
+	for _, photo := range photos {
+		photo.Album = ""
+		if err := s.photos.Update(photo); err != nil {
+			slog.Error("Unable to update photo", "photo", photo.ID, "err", err)
+			writeJSONError(response, http.StatusInternalServerError, "Unable to delete album")
+			return
+		}
+	}
+	if _, err := s.albums.Delete(id); err != nil {
+		slog.Error("Unable to save albums", "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to delete album")
+		return
+	}
+	response.WriteHeader(http.StatusNoContent)
+}
+
+// albumPhotosRequest is the body of a request to add photos to an album
+type albumPhotosRequest struct {
+	PhotoIDs []string `json:"photoIds"`
+}
+
+// addAlbumPhotosHandler moves photos into an album, out of any album they
+// were in before
+func (s *server) addAlbumPhotosHandler(response http.ResponseWriter, request *http.Request) {
+	id := request.PathValue("id")
+	if _, ok := s.albums.Get(id); !ok {
+		writeJSONError(response, http.StatusNotFound, "Album not found")
+		return
+	}
+	var body albumPhotosRequest
+	if !decodeJSON(response, request, &body) {
+		return
+	}
+	if len(body.PhotoIDs) == 0 {
+		writeJSONError(response, http.StatusBadRequest, "photoIds is required")
+		return
+	}
+
+	// Check every photo first so a typo doesn't leave half of them moved
+	photos := make([]*Photo, 0, len(body.PhotoIDs))
+	for _, photoID := range body.PhotoIDs {
+		photo, ok := s.photos.Get(photoID)
+		if !ok {
+			writeJSONError(response, http.StatusBadRequest, "unknown photo "+photoID)
+			return
+		}
+		photos = append(photos, photo)
+	}
+	for _, photo := range photos {
+		photo.Album = id
+		if err := s.photos.Update(photo); err != nil {
+			slog.Error("Unable to update photo", "photo", photo.ID, "err", err)
+			writeJSONError(response, http.StatusInternalServerError, "Unable to add photos to album")
+			return
+		}
+	}
+	response.WriteHeader(http.StatusNoContent)
+}
+
+// removeAlbumPhotoHandler takes a photo out of an album
+func (s *server) removeAlbumPhotoHandler(response http.ResponseWriter, request *http.Request) {
+	photo, ok := s.photos.Get(request.PathValue("photoID"))
+	if !ok || photo.Album != request.PathValue("id") {
+		writeJSONError(response, http.StatusNotFound, "Photo not in album")
+		return
+	}
+	photo.Album = ""
+	if err := s.photos.Update(photo); err != nil {
+		slog.Error("Unable to update photo", "photo", photo.ID, "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to remove photo from album")
+		return
+	}
+	response.WriteHeader(http.StatusNoContent)
+}
+
+// unlockRequest is the body of a request to unlock a private album
+type unlockRequest struct {
+	Passphrase string `json:"passphrase"`
+}
+
+// albumUnlock is the token a private album's passphrase is exchanged for.
+// It is sent as an X-Album-Token header, or ?albumToken= on photo URLs.
+type albumUnlock struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// unlockAlbumHandler exchanges a private album's passphrase for a token that
+// shows its photos for a while
+func (s *server) unlockAlbumHandler(response http.ResponseWriter, request *http.Request) {
+	album, ok := s.albums.Get(request.PathValue("id"))
+	if !ok {
+		writeJSONError(response, http.StatusNotFound, "Album not found")
+		return
+	}
+	if !album.Private {
+		writeJSONError(response, http.StatusBadRequest, "This album isn't private")
+		return
+	}
+	var body unlockRequest
+	if !decodeJSON(response, request, &body) {
+		return
+	}
+	ok, wait := s.guesses.guess(request, guessAlbums, func() bool {
+		return bcrypt.CompareHashAndPassword([]byte(album.PassphraseHash), []byte(body.Passphrase)) == nil
+	})
+	if wait > 0 {
+		writeLockedOut(response, wait)
+		return
+	}
+	if !ok {
+		writeJSONError(response, http.StatusUnauthorized, "That passphrase isn't right")
+		return
+	}
+	token, expires := s.albums.Token(album, time.Now())
+	response.Header().Set("Cache-Control", "no-store")
+	writeJSON(response, http.StatusOK, albumUnlock{Token: token, ExpiresAt: expires})
+}
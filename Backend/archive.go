@@ -0,0 +1,93 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// archiveHandler streams the couple a zip of the originals of every photo
+// and video in the gallery, or only those matching the filters the listing
+// takes. Files
+// are added as they are read from storage, so memory use stays flat however
+// big the gallery is. Photos are already compressed, so they are stored in
+// the zip as they are.
+func (s *server) archiveHandler(response http.ResponseWriter, request *http.Request) {
+	query, err := s.galleryQuery(request)
+	if err != nil {
+		writeQueryError(response, err)
+		return
+	}
+	photos, err := s.photos.List(query)
+	if err != nil {
+		writeJSONError(response, http.StatusInternalServerError, "Unable to list photos")
+		return
+	}
+
+	keepWriting(response)
+	response.Header().Set("Content-Type", "application/zip")
+	response.Header().Set("Content-Disposition", `attachment; filename="wedding-photos.zip"`)
+	archive := zip.NewWriter(response)
+	names := make(map[string]bool)
+	started := time.Now()
+	for _, photo := range photos {
+		if err := s.addToArchive(request, archive, photo, archiveName(photo, names)); err != nil {
+			// The response has already started, so all that can be done is
+			// to cut the zip short
+			slog.Error("Unable to add photo to archive", "photo", photo.ID, "err", err)
+			return
+		}
+	}
+	if err := archive.Close(); err != nil {
+		slog.Error("Unable to finish archive", "err", err)
+		return
+	}
+	slog.Info("Sent archive", "photos", len(photos), "duration", time.Since(started))
+}
+
+// addToArchive copies the original of photo into the zip as name
+func (s *server) addToArchive(request *http.Request, archive *zip.Writer, photo *Photo, name string) error {
+	src, err := s.storage.Get(request.Context(), photo.originalName())
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	modified := photo.UploadedAt
+	if photo.TakenAt != nil {
+		modified = *photo.TakenAt
+	}
+	dst, err := archive.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Modified: modified})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	return err
+}
+
+// archiveName returns a name for photo in the zip that isn't in names yet,
+// using the name it had on the guest's device where there is one. Photos
+// are put in a folder for their part of the day.
+func archiveName(photo *Photo, names map[string]bool) string {
+	extension := path.Ext(photo.File)
+	base := photo.ID
+	if photo.OriginalFilename != "" {
+		base = strings.TrimSuffix(photo.OriginalFilename, path.Ext(photo.OriginalFilename))
+	}
+	folder := photo.Event
+	if folder == "" {
+		folder = "Other"
+	}
+
+	name := folder + "/" + base + extension
+	for i := 2; names[name]; i++ {
+		name = fmt.Sprintf("%s/%s-%d%s", folder, base, i, extension)
+	}
+	names[name] = true
+	return name
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Guest codes, album passphrases and two-factor codes are short enough that
+// a script trying them one after another would get there in the end. Each
+// client IP gets a few wrong guesses, after which it has to wait before the
+// next one, twice as long for each further miss. Only a right guess at the
+// same kind of secret clears the slate; requests that don't send one aren't
+// guesses at all.
+
+// Limits on wrong guesses
+const (
+	// freeAttempts is how many wrong guesses are allowed before any wait
+	freeAttempts = 5
+	// lockoutBase is the wait after the last of the free wrong guesses,
+	// doubling with each one after
+	lockoutBase = 30 * time.Second
+	// maxLockout is the longest a client is made to wait
+	maxLockout = time.Hour
+	// attemptsForgotten is how long after its last wrong guess a client's
+	// misses are forgotten
+	attemptsForgotten = 24 * time.Hour
+)
+
+// attempts is the wrong guesses of one client
+type attempts struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// attemptGuard keeps track of wrong guesses by each client IP, for each
+// kind of secret being guessed
+type attemptGuard struct {
+	mu      sync.Mutex
+	clients map[string]*attempts
+}
+
+// newAttemptGuard returns a guard with no wrong guesses recorded
+func newAttemptGuard() *attemptGuard {
+	guard := &attemptGuard{clients: make(map[string]*attempts)}
+	go guard.cleanup()
+	return guard
+}
+
+// lockout is how long a client has to wait after its nth wrong guess
+func lockout(failures int) time.Duration {
+	doublings := failures - freeAttempts
+	if doublings < 0 {
+		return 0
+	}
+	// Doubling is stopped well past maxLockout, before the wait overflows
+	wait := lockoutBase << min(doublings, 20)
+	return min(wait, maxLockout)
+}
+
+// attempt starts a guess by key at now, counting it as wrong until it is
+// found to be right, so guesses sent at once can't all get in before the
+// lockout. If key has to wait first, the guess isn't counted and the wait is
+// returned.
+func (guard *attemptGuard) attempt(key string, now time.Time) time.Duration {
+	guard.mu.Lock()
+	defer guard.mu.Unlock()
+
+	client, ok := guard.clients[key]
+	if !ok {
+		client = &attempts{}
+		guard.clients[key] = client
+	}
+	if now.Before(client.lockedUntil) {
+		return client.lockedUntil.Sub(now)
+	}
+	client.failures++
+	client.lastFailure = now
+	client.lockedUntil = now.Add(lockout(client.failures))
+	return 0
+}
+
+// succeed forgets the wrong guesses of key
+func (guard *attemptGuard) succeed(key string) {
+	guard.mu.Lock()
+	defer guard.mu.Unlock()
+
+	delete(guard.clients, key)
+}
+
+// cleanup forgets clients that stopped guessing long ago
+func (guard *attemptGuard) cleanup() {
+	for range time.Tick(clientIdle) {
+		guard.mu.Lock()
+		for key, client := range guard.clients {
+			if time.Since(client.lastFailure) > attemptsForgotten {
+				delete(guard.clients, key)
+			}
+		}
+		guard.mu.Unlock()
+	}
+}
+
+// Kinds of secret guesses are counted separately for
+const (
+	guessCodes  = "codes"
+	guessAlbums = "albums"
+	guessAdmin  = "admin"
+)
+
+// guess checks a guess at a secret of kind scope by the client that sent
+// request, with check reporting whether it is right. If the client has to
+// wait before guessing again, check isn't run and the wait is returned.
+func (guard *attemptGuard) guess(request *http.Request, scope string, check func() bool) (bool, time.Duration) {
+	key := scope + " " + clientIP(request)
+	if wait := guard.attempt(key, time.Now()); wait > 0 {
+		return false, wait
+	}
+	if !check() {
+		return false, 0
+	}
+	guard.succeed(key)
+	return true, 0
+}
+
+// writeLockedOut answers a request from a client that has to wait before
+// guessing again
+func writeLockedOut(response http.ResponseWriter, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	response.Header().Set("Retry-After", strconv.Itoa(seconds))
+	writeJSONError(response, http.StatusTooManyRequests, lockedOutMessage(wait))
+}
+
+// lockedOutMessage tells a guest how long to wait before guessing again
+func lockedOutMessage(wait time.Duration) string {
+	return fmt.Sprintf("Too many wrong tries, please wait %s and try again", formatWait(wait))
+}
+
+// formatWait describes a wait to a guest, rounded up to the second or minute
+func formatWait(wait time.Duration) string {
+	if wait <= time.Minute {
+		seconds := int(math.Ceil(wait.Seconds()))
+		if seconds == 1 {
+			return "a second"
+		}
+		return strconv.Itoa(seconds) + " seconds"
+	}
+	minutes := int(math.Ceil(wait.Minutes()))
+	return strconv.Itoa(minutes) + " minutes"
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLockout(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{failures: 1},
+		{failures: freeAttempts - 1},
+		{failures: freeAttempts, want: lockoutBase},
+		{failures: freeAttempts + 1, want: 2 * lockoutBase},
+		{failures: freeAttempts + 2, want: 4 * lockoutBase},
+		{failures: freeAttempts + 6, want: 64 * lockoutBase},
+		{failures: freeAttempts + 7, want: maxLockout},
+		{failures: 1000, want: maxLockout},
+	}
+	for _, test := range tests {
+		if wait := lockout(test.failures); wait != test.want {
+			t.Errorf("lockout(%d) = %v, want %v", test.failures, wait, test.want)
+		}
+	}
+}
+
+func TestAttemptGuard(t *testing.T) {
+	guard := &attemptGuard{clients: make(map[string]*attempts)}
+	now := time.Unix(1_800_000_000, 0)
+
+	// Guesses are counted as they start, so sending a burst at once doesn't
+	// get more than the free ones in
+	for i := range freeAttempts {
+		if wait := guard.attempt("codes 192.0.2.1", now); wait != 0 {
+			t.Fatalf("attempt %d waited %v, want none", i+1, wait)
+		}
+	}
+	if wait := guard.attempt("codes 192.0.2.1", now); wait != lockoutBase {
+		t.Fatalf("attempt past the free ones waited %v, want %v", wait, lockoutBase)
+	}
+	if wait := guard.attempt("codes 192.0.2.1", now.Add(lockoutBase-time.Second)); wait != time.Second {
+		t.Fatalf("attempt just before the wait is up waited %v, want a second", wait)
+	}
+	if wait := guard.attempt("codes 192.0.2.1", now.Add(lockoutBase)); wait != 0 {
+		t.Fatalf("attempt once the wait is up waited %v, want none", wait)
+	}
+	if wait := guard.attempt("codes 192.0.2.1", now.Add(lockoutBase)); wait != 2*lockoutBase {
+		t.Fatalf("next attempt waited %v, want %v", wait, 2*lockoutBase)
+	}
+
+	// Other clients, and other kinds of secret, are counted on their own
+	for _, key := range []string{"codes 192.0.2.2", "albums 192.0.2.1"} {
+		if wait := guard.attempt(key, now.Add(lockoutBase)); wait != 0 {
+			t.Errorf("attempt by %q waited %v, want none", key, wait)
+		}
+	}
+
+	guard.succeed("codes 192.0.2.1")
+	if wait := guard.attempt("codes 192.0.2.1", now.Add(lockoutBase)); wait != 0 {
+		t.Errorf("attempt after a right guess waited %v, want none", wait)
+	}
+}
+
+func TestGuess(t *testing.T) {
+	guard := &attemptGuard{clients: make(map[string]*attempts)}
+	request := httptest.NewRequest("POST", "/rsvp", nil)
+
+	checked := 0
+	wrong := func() bool { checked++; return false }
+	for range freeAttempts {
+		if ok, wait := guard.guess(request, guessCodes, wrong); ok || wait != 0 {
+			t.Fatalf("wrong guess = %v, %v, want false with no wait", ok, wait)
+		}
+	}
+	ok, wait := guard.guess(request, guessCodes, func() bool { checked++; return true })
+	if ok || wait <= 0 {
+		t.Fatalf("guess while locked out = %v, %v, want a wait", ok, wait)
+	}
+	if checked != freeAttempts {
+		t.Errorf("guesses checked = %d, want %d: a locked out client's guess was checked", checked, freeAttempts)
+	}
+
+	// A right guess at one kind of secret doesn't clear the misses at another
+	if ok, _ := guard.guess(request, guessAlbums, func() bool { return true }); !ok {
+		t.Error("right guess at an album passphrase turned away")
+	}
+	if _, wait := guard.guess(request, guessCodes, wrong); wait <= 0 {
+		t.Error("right album passphrase cleared the wrong guest codes")
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Everything done through the admin API that changes something, and every
+// file downloaded from it, such as an export or a photo's original, is
+// appended to an audit log in the upload directory: who did it, when, and to
+// what. Requests are marked for the log by authorizeAdmin itself, so nothing
+// it lets through is missed, and written once they are answered. Entries are
+// only ever added, so the log can be trusted to show what happened to a
+// deleted photo or a guest whose details were changed.
+
+// Limits on how much of the audit log is read back at once
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// AuditEntry is one admin action in the audit log
+type AuditEntry struct {
+	Time time.Time `json:"time"`
+	// Actor is the admin token or the session the action was done with, and
+	// who logged in to it with a login link
+	Actor string `json:"actor"`
+	IP    string `json:"ip"`
+	// Action is the route, like "DELETE /photos/{id}", and Resource the
+	// path it was done to
+	Action   string `json:"action"`
+	Resource string `json:"resource"`
+	Status   int    `json:"status"`
+}
+
+// auditLog appends admin actions to a JSON Lines file
+type auditLog struct {
+	mu   sync.Mutex
+	path string
+}
+
+// auditKey is the context key of the auditEntry of a request
+type auditKey struct{}
+
+// audited reports whether an admin request is recorded: anything but a
+// read, and reads that hand out a file rather than JSON
+func audited(request *http.Request, header http.Header) bool {
+	if request.Method != http.MethodGet && request.Method != http.MethodHead {
+		return true
+	}
+	if strings.HasPrefix(header.Get("Content-Disposition"), "attachment") {
+		return true
+	}
+	contentType := header.Get("Content-Type")
+	return contentType != "" && !strings.HasPrefix(contentType, "application/json")
+}
+
+// middleware gives every request to next an entry in the log, which
+// authorizeAdmin fills in if it lets the request through. Once the request
+// is answered, a filled in entry is appended if the request is audited.
+func (log *auditLog) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		entry := &AuditEntry{}
+		recorder := &statusRecorder{ResponseWriter: response, status: http.StatusOK}
+		next.ServeHTTP(recorder, request.WithContext(context.WithValue(request.Context(), auditKey{}, entry)))
+		if entry.Actor == "" || !audited(request, response.Header()) {
+			return
+		}
+
+		entry.Time, entry.Status = time.Now().UTC(), recorder.status
+		if err := log.append(*entry); err != nil {
+			slog.Error("Unable to write admin audit entry", "err", err)
+		}
+	})
+}
+
+// markAudited fills in the log entry of a request authorizeAdmin let through
+// with token
+func markAudited(request *http.Request, token string) {
+	entry, ok := request.Context().Value(auditKey{}).(*AuditEntry)
+	if !ok {
+		return
+	}
+	entry.Actor = adminActor(token, time.Now())
+	entry.IP = clientIP(request)
+	entry.Action, entry.Resource = request.Pattern, request.URL.Path
+}
+
+// append adds entry to the end of the log
+func (log *auditLog) append(entry AuditEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	log.mu.Lock()
+	defer log.mu.Unlock()
+
+	file, err := os.OpenFile(log.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(data, '\n'))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Entries returns up to limit entries that match, newest first
+func (log *auditLog) Entries(match func(AuditEntry) bool, limit int) ([]AuditEntry, error) {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+
+	entries := []AuditEntry{}
+	file, err := os.Open(log.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	lines := bufio.NewScanner(file)
+	for lines.Scan() {
+		var entry AuditEntry
+		if err := json.Unmarshal(lines.Bytes(), &entry); err != nil {
+			return nil, err
+		}
+		if match(entry) {
+			entries = append(entries, entry)
+		}
+	}
+	if err := lines.Err(); err != nil {
+		return nil, err
+	}
+	// The file is oldest first
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries[:min(limit, len(entries))], nil
+}
+
+// statusRecorder passes a response through while noting its status
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (recorder *statusRecorder) WriteHeader(status int) {
+	if !recorder.wroteHeader {
+		recorder.status = status
+		recorder.wroteHeader = true
+	}
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+func (recorder *statusRecorder) Write(p []byte) (int, error) {
+	if !recorder.wroteHeader {
+		recorder.WriteHeader(http.StatusOK)
+	}
+	return recorder.ResponseWriter.Write(p)
+}
+
+// Flush passes flushes through for the live streams
+func (recorder *statusRecorder) Flush() {
+	http.NewResponseController(recorder.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the response underneath
+func (recorder *statusRecorder) Unwrap() http.ResponseWriter {
+	return recorder.ResponseWriter
+}
+
+// auditHandler lists the audit log, newest first. ?since= only lists actions
+// from an RFC 3339 time on, ?action= those on a route like "DELETE
+// /photos/{id}", ?resource= those on paths starting with it, and ?limit=
+// how many are listed.
+func (s *server) auditHandler(response http.ResponseWriter, request *http.Request) {
+	query := request.URL.Query()
+	var since time.Time
+	if value := query.Get("since"); value != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, value); err != nil {
+			writeJSONError(response, http.StatusBadRequest, "since must be an RFC 3339 time like 2026-06-20T15:00:00Z")
+			return
+		}
+	}
+	limit := defaultAuditLimit
+	if value := query.Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 || limit > maxAuditLimit {
+			writeJSONError(response, http.StatusBadRequest, fmt.Sprintf("limit must be 1 to %d", maxAuditLimit))
+			return
+		}
+	}
+	action, resource := query.Get("action"), query.Get("resource")
+
+	entries, err := s.audit.Entries(func(entry AuditEntry) bool {
+		return !entry.Time.Before(since) &&
+			(action == "" || entry.Action == action) &&
+			strings.HasPrefix(entry.Resource, resource)
+	}, limit)
+	if err != nil {
+		slog.Error("Unable to read admin audit log", "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to read audit log")
+		return
+	}
+	writeJSON(response, http.StatusOK, entries)
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metadataFiles are the indexes kept in the uploads directory that are
+// backed up along with the photos. They change in place, so they are copied
+// on every run rather than only when they are new.
+var metadataFiles = []string{"photos.json", "guests.json", "quotas.json", "albums.json", "likes.json", "comments.json", "reports.json", "rsvps.json", "late-rsvps.json", "seating.json", "songs.json", "guestbook.json", "registry.json", "schedule.json", "travel.json", "shuttles.json", "faq.json", "party.json", "gifts.json", "checkins.json", "contest.json", "advice.json", "livestream.json", "addresses.json", "retention-audit.jsonl", "admin-audit.jsonl", "revoked-sessions.json"}
+
+// privateFiles are kept in the uploads directory but never copied out of it.
+// The two-factor secret would let anyone with a backup log in as the couple.
+var privateFiles = []string{"admin-2fa.json"}
+
+// isDataFile reports whether name is a file the server keeps in the uploads
+// directory rather than an upload, which local storage lists along with the
+// photos: the metadataFiles and privateFiles, the SQLite photo index and its
+// journals, which can't be copied safely while in use, and files part way
+// through being written
+func isDataFile(name string) bool {
+	if slices.Contains(metadataFiles, name) || slices.Contains(privateFiles, name) {
+		return true
+	}
+	for _, suffix := range []string{".db", ".db-wal", ".db-shm", ".db-journal", ".tmp"} {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// backupStatus is what the status endpoint reports about backups
+type backupStatus struct {
+	Enabled     bool       `json:"enabled"`
+	Running     bool       `json:"running"`
+	LastSuccess *time.Time `json:"lastSuccess,omitempty"`
+	LastAttempt *time.Time `json:"lastAttempt,omitempty"`
+	LastError   string     `json:"lastError,omitempty"`
+	// Copied is how many new files the last successful backup copied
+	Copied int `json:"copied"`
+}
+
+// backupJob mirrors everything stored, and the metadata kept alongside it,
+// to a second store every interval. Stored files are copied as they are, so
+// encrypted ones stay encrypted, while the metadata goes through metadata,
+// which encrypts it if a key is set.
+type backupJob struct {
+	source   Storage
+	target   Storage
+	metadata Storage
+	photos   PhotoStore
+
+	mu     sync.Mutex
+	status backupStatus
+}
+
+// snapshotter is implemented by photo stores that keep the index in a
+// database file, which can't be copied safely while it is in use
+type snapshotter interface {
+	// Snapshot writes a consistent copy of the database to path
+	Snapshot(path string) error
+}
+
+// newBackupJob starts mirroring source, and the photo index, to target in
+// the background
+func newBackupJob(source, target Storage, photos PhotoStore, interval time.Duration) (*backupJob, error) {
+	metadata, err := withEncryption(target)
+	if err != nil {
+		return nil, err
+	}
+	job := &backupJob{source: source, target: target, metadata: metadata, photos: photos, status: backupStatus{Enabled: true}}
+	go func() {
+		job.run(context.Background())
+		for range time.Tick(interval) {
+			job.run(context.Background())
+		}
+	}()
+	return job, nil
+}
+
+// newBackupStorage opens the backup store chosen in the config, or returns
+// nil if backups are off
+func newBackupStorage(ctx context.Context) (Storage, error) {
+	if *backupBackend == "" {
+		return nil, nil
+	}
+	if *backupBackend == *storageBackend && *backupBackend != "local" {
+		return nil, fmt.Errorf("backups can't go to the same %s storage the uploads are in", *backupBackend)
+	}
+	return openStorage(ctx, *backupBackend, *backupDir)
+}
+
+// run copies across every file the target doesn't have yet, then the
+// metadata
+func (job *backupJob) run(ctx context.Context) {
+	started := time.Now()
+	job.mu.Lock()
+	job.status.Running = true
+	job.status.LastAttempt = &started
+	job.mu.Unlock()
+
+	copied, err := job.mirror(ctx)
+
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	job.status.Running = false
+	if err != nil {
+		slog.Error("Backup failed", "err", err)
+		job.status.LastError = err.Error()
+		return
+	}
+	job.status.LastSuccess = &started
+	job.status.LastError = ""
+	job.status.Copied = copied
+	if copied > 0 {
+		slog.Info("Backed up", "files", copied, "duration", time.Since(started))
+	}
+}
+
+// mirror does the work of a backup run, returning how many files it copied
+func (job *backupJob) mirror(ctx context.Context) (int, error) {
+	sourceObjects, err := job.source.List(ctx, "")
+	if err != nil {
+		return 0, fmt.Errorf("listing uploads: %w", err)
+	}
+	targetObjects, err := job.target.List(ctx, "")
+	if err != nil {
+		return 0, fmt.Errorf("listing backup: %w", err)
+	}
+	backedUp := make(map[string]int64, len(targetObjects))
+	for _, object := range targetObjects {
+		backedUp[object.Name] = object.Size
+	}
+
+	// Stored files never change once written, so one the backup already has
+	// at the same size is up to date
+	copied := 0
+	for _, object := range sourceObjects {
+		if isDataFile(object.Name) {
+			continue
+		}
+		if size, ok := backedUp[object.Name]; ok && size == object.Size {
+			continue
+		}
+		if err := job.copy(ctx, object.Name); err != nil {
+			return copied, fmt.Errorf("copying %s: %w", object.Name, err)
+		}
+		copied++
+	}
+
+	for _, name := range metadataFiles {
+		file, err := os.Open(filepath.Join(*uploadDir, name))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return copied, err
+		}
+		err = putFile(ctx, job.metadata, name, file)
+		file.Close()
+		if err != nil {
+			return copied, fmt.Errorf("copying %s: %w", name, err)
+		}
+	}
+	if store, ok := job.photos.(snapshotter); ok {
+		if err := putSnapshot(ctx, job.metadata, store); err != nil {
+			return copied, fmt.Errorf("backing up photo index: %w", err)
+		}
+	}
+	return copied, nil
+}
+
+// putSnapshot copies a snapshot of the photo index database to target as
+// photos.db
+func putSnapshot(ctx context.Context, target Storage, store snapshotter) error {
+	path := filepath.Join(os.TempDir(), "photos-backup-"+randomHex(8)+".db")
+	if err := store.Snapshot(path); err != nil {
+		return err
+	}
+	defer os.Remove(path)
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return putFile(ctx, target, "photos.db", file)
+}
+
+// copy copies one stored file to the backup
+func (job *backupJob) copy(ctx context.Context, name string) error {
+	src, err := job.source.Get(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	return job.target.Put(ctx, name, src)
+}
+
+// Status returns how backups are doing
+func (job *backupJob) Status() backupStatus {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	return job.status
+}
+
+// backupStatusHandler reports when the last successful backup was
+func (s *server) backupStatusHandler(response http.ResponseWriter, request *http.Request) {
+	if s.backups == nil {
+		writeJSON(response, http.StatusOK, backupStatus{})
+		return
+	}
+	writeJSON(response, http.StatusOK, s.backups.Status())
+}
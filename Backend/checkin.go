@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// On the day, the planner scans the QR code on each household's invitation
+// as they arrive at the venue. Arrivals are counted for the planner and
+// announced over Server-Sent Events on /checkin/live, so the screen at the
+// reception can welcome guests by name.
+
+// CheckIn is a household that has arrived at the venue
+type CheckIn struct {
+	HouseholdID string `json:"householdId"`
+	Name        string `json:"name"`
+	// Arrived is how many people came with the household
+	Arrived   int       `json:"arrived"`
+	ArrivedAt time.Time `json:"arrivedAt"`
+}
+
+// checkInStore keeps the households that have arrived, in the order they
+// arrived
+type checkInStore struct {
+	mu       sync.Mutex
+	path     string
+	checkIns []*CheckIn
+	// watchers are the welcome screens told about each arrival
+	watchers map[chan CheckIn]struct{}
+}
+
+// openCheckInStore loads the arrivals saved at path, starting with none if
+// it doesn't exist
+func openCheckInStore(path string) (*checkInStore, error) {
+	store := &checkInStore{path: path, watchers: make(map[chan CheckIn]struct{})}
+
+	if err := loadJSONFile(path, &store.checkIns); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// All returns a copy of every arrival
+func (store *checkInStore) All() []CheckIn {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	checkIns := make([]CheckIn, 0, len(store.checkIns))
+	for _, checkIn := range store.checkIns {
+		checkIns = append(checkIns, *checkIn)
+	}
+	return checkIns
+}
+
+// CheckIn records a household's arrival, reporting whether it had already
+// arrived. Checking in again only changes how many came, and new arrivals
+// are announced to the welcome screens.
+func (store *checkInStore) CheckIn(checkIn CheckIn) (CheckIn, bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for _, existing := range store.checkIns {
+		if existing.HouseholdID != checkIn.HouseholdID {
+			continue
+		}
+		previous := *existing
+		existing.Arrived = checkIn.Arrived
+		if err := store.save(); err != nil {
+			*existing = previous
+			return CheckIn{}, true, err
+		}
+		return *existing, true, nil
+	}
+
+	store.checkIns = append(store.checkIns, &checkIn)
+	if err := store.save(); err != nil {
+		store.checkIns = store.checkIns[:len(store.checkIns)-1]
+		return CheckIn{}, false, err
+	}
+	for watcher := range store.watchers {
+		// Never hold up the door for a screen that isn't keeping up
+		select {
+		case watcher <- checkIn:
+		default:
+		}
+	}
+	return checkIn, false, nil
+}
+
+// Undo takes back a household's arrival, such as one scanned by mistake,
+// reporting whether it had arrived
+func (store *checkInStore) Undo(householdID string) (bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for i, checkIn := range store.checkIns {
+		if checkIn.HouseholdID != householdID {
+			continue
+		}
+		previous := store.checkIns
+		store.checkIns = slices.Concat(previous[:i], previous[i+1:])
+		if err := store.save(); err != nil {
+			store.checkIns = previous
+			return true, err
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+func (store *checkInStore) watch() chan CheckIn {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	watcher := make(chan CheckIn, feedBuffer)
+	store.watchers[watcher] = struct{}{}
+	return watcher
+}
+
+func (store *checkInStore) unwatch(watcher chan CheckIn) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	delete(store.watchers, watcher)
+}
+
+// save writes the arrivals to disk. The caller must hold store.mu.
+func (store *checkInStore) save() error {
+	return saveJSONFile(store.path, store.checkIns)
+}
+
+// checkInRequest is the body of a check-in. Code is the guest code, or the
+// whole link read from the invitation's QR code. Arrived defaults to the
+// party size on the household's RSVP.
+type checkInRequest struct {
+	Code    string `json:"code"`
+	Arrived *int   `json:"arrived"`
+}
+
+// scannedCode returns the guest code in what was read from an invitation:
+// the code itself, or a link with it in ?code=
+func scannedCode(scanned string) string {
+	scanned = strings.TrimSpace(scanned)
+	if link, err := url.Parse(scanned); err == nil && link.Scheme != "" {
+		return link.Query().Get("code")
+	}
+	return scanned
+}
+
+// checkInResult is a household's arrival, and whether it had already been
+// checked in
+type checkInResult struct {
+	CheckIn
+	AlreadyCheckedIn bool `json:"alreadyCheckedIn"`
+}
+
+// checkInHandler marks the household whose invitation was scanned as
+// arrived
+func (s *server) checkInHandler(response http.ResponseWriter, request *http.Request) {
+	var body checkInRequest
+	if !decodeJSON(response, request, &body) {
+		return
+	}
+	household, ok := s.guests.Lookup(scannedCode(body.Code))
+	if !ok {
+		writeJSONError(response, http.StatusNotFound, "That invitation isn't on the guest list")
+		return
+	}
+
+	arrived := 1
+	if body.Arrived != nil {
+		arrived = *body.Arrived
+	} else {
+		rsvp, _, err := s.rsvps.Get(household.Code)
+		if err != nil {
+			slog.Error("Unable to read RSVP", "code", household.Code, "err", err)
+		} else if rsvp != nil && rsvp.PartySize > 0 {
+			arrived = rsvp.PartySize
+		}
+	}
+	if most := partySize(household); arrived < 1 || arrived > most {
+		writeJSONError(response, http.StatusBadRequest, fmt.Sprintf("arrived must be 1 to %d", most))
+		return
+	}
+
+	checkIn, again, err := s.checkIns.CheckIn(CheckIn{
+		HouseholdID: household.ID,
+		Name:        household.Name,
+		Arrived:     arrived,
+		ArrivedAt:   time.Now().UTC(),
+	})
+	if err != nil {
+		slog.Error("Unable to save check-ins", "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to check in")
+		return
+	}
+	status := http.StatusCreated
+	if again {
+		status = http.StatusOK
+	}
+	writeJSON(response, status, checkInResult{CheckIn: checkIn, AlreadyCheckedIn: again})
+}
+
+// undoCheckInHandler takes back a household's arrival
+func (s *server) undoCheckInHandler(response http.ResponseWriter, request *http.Request) {
+	ok, err := s.checkIns.Undo(request.PathValue("id"))
+	if !ok {
+		writeJSONError(response, http.StatusNotFound, "That household hasn't checked in")
+		return
+	}
+	if err != nil {
+		slog.Error("Unable to save check-ins", "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to undo check-in")
+		return
+	}
+	response.WriteHeader(http.StatusNoContent)
+}
+
+// arrivals is how the day is going at the door, for the planner
+type arrivals struct {
+	// Households and Guests count who has arrived, and Expected is how many
+	// guests said they were coming on their RSVPs
+	Households int       `json:"households"`
+	Guests     int       `json:"guests"`
+	Expected   int       `json:"expected"`
+	CheckIns   []CheckIn `json:"checkIns"`
+}
+
+// arrivalsHandler counts who has arrived, with the most recent arrivals
+// first
+func (s *server) arrivalsHandler(response http.ResponseWriter, request *http.Request) {
+	rsvps, err := s.rsvps.All()
+	if err != nil {
+		slog.Error("Unable to read RSVPs", "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to read RSVPs")
+		return
+	}
+	counts := arrivals{CheckIns: s.checkIns.All()}
+	slices.Reverse(counts.CheckIns)
+	for _, checkIn := range counts.CheckIns {
+		counts.Households++
+		counts.Guests += checkIn.Arrived
+	}
+	for _, rsvp := range rsvps {
+		if rsvp.attending() {
+			counts.Expected += rsvp.PartySize
+		}
+	}
+	writeJSON(response, http.StatusOK, counts)
+}
+
+// welcome is an arrival as the welcome screen is told about it
+type welcome struct {
+	Name    string `json:"name"`
+	Arrived int    `json:"arrived"`
+}
+
+// liveArrivalsHandler streams an arrival event for every household that
+// checks in until the client goes away
+func (s *server) liveArrivalsHandler(response http.ResponseWriter, request *http.Request) {
+	flusher, ok := response.(http.Flusher)
+	if !ok {
+		http.Error(response, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	keepWriting(response)
+	response.Header().Set("Content-Type", "text/event-stream")
+	response.Header().Set("Cache-Control", "no-cache")
+	response.Header().Set("Connection", "keep-alive")
+
+	watcher := s.checkIns.watch()
+	defer s.checkIns.unwatch(watcher)
+
+	fmt.Fprint(response, ": connected\n\n")
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(feedKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case checkIn := <-watcher:
+			data, _ := json.Marshal(welcome{Name: checkIn.Name, Arrived: checkIn.Arrived})
+			fmt.Fprintf(response, "event: arrival\ndata: %s\n\n", data)
+		case <-keepAlive.C:
+			fmt.Fprint(response, ": keep-alive\n\n")
+		case <-request.Context().Done():
+			return
+		case <-s.shutdown.Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Comments are limited to maxCommentLength characters, and their authors'
+// names to maxAuthorLength
+const (
+	maxCommentLength = 1000
+	maxAuthorLength  = 60
+)
+
+// Comment is something a guest wrote about a photo
+type Comment struct {
+	ID        string    `json:"id"`
+	PhotoID   string    `json:"photoId"`
+	Author    string    `json:"author"`
+	Body      string    `json:"body"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// CommentFilter screens comments before they are posted, such as for
+// profanity
+type CommentFilter interface {
+	// Check returns why a comment should be turned away, or "" if it can be
+	// posted
+	Check(ctx context.Context, comment Comment) (string, error)
+}
+
+// newCommentFilter returns the filter set up in the config, or nil if
+// comments aren't screened
+func newCommentFilter() CommentFilter {
+	words := make(map[string]bool)
+	for _, word := range strings.Split(*commentBlocklist, ",") {
+		if word = strings.ToLower(strings.TrimSpace(word)); word != "" {
+			words[word] = true
+		}
+	}
+	if len(words) == 0 {
+		return nil
+	}
+	return &wordFilter{words: words}
+}
+
+// wordFilter turns away comments containing any of a list of words, whole
+// and ignoring case
+type wordFilter struct {
+	words map[string]bool
+}
+
+func (filter *wordFilter) Check(ctx context.Context, comment Comment) (string, error) {
+	notWord := func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}
+	for _, word := range strings.FieldsFunc(strings.ToLower(comment.Author+" "+comment.Body), notWord) {
+		if filter.words[word] {
+			return "Please keep comments friendly", nil
+		}
+	}
+	return "", nil
+}
+
+// commentRequest is the body of a request to comment on a photo. Guests who
+// send their guest code are named from the guest list instead.
+type commentRequest struct {
+	Author string `json:"author"`
+	Body   string `json:"body"`
+}
+
+// commentsHandler lists the comments on a photo, oldest first
+func (s *server) commentsHandler(response http.ResponseWriter, request *http.Request) {
+	photo, ok := s.servedPhoto(request)
+	if !ok {
+		writeJSONError(response, http.StatusNotFound, "Photo not found")
+		return
+	}
+	comments, err := s.photos.Comments(photo.ID)
+	if err != nil {
+		slog.Error("Unable to read comments", "photo", photo.ID, "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to read comments")
+		return
+	}
+	if comments == nil {
+		comments = []*Comment{}
+	}
+	writeJSON(response, http.StatusOK, comments)
+}
+
+// postCommentHandler adds a guest's comment to a photo
+func (s *server) postCommentHandler(response http.ResponseWriter, request *http.Request) {
+	photo, ok := s.servedPhoto(request)
+	if !ok {
+		writeJSONError(response, http.StatusNotFound, "Photo not found")
+		return
+	}
+	var body commentRequest
+	if !decodeJSON(response, request, &body) {
+		return
+	}
+
+	comment := Comment{
+		ID:        newUUID(),
+		PhotoID:   photo.ID,
+		Author:    strings.TrimSpace(body.Author),
+		Body:      strings.TrimSpace(body.Body),
+		CreatedAt: time.Now().UTC(),
+	}
+	if code := guestCode(request); code != "" {
+		household, ok, wait := s.lookupCode(request, code)
+		if wait > 0 {
+			writeLockedOut(response, wait)
+			return
+		}
+		if !ok {
+			writeJSONError(response, http.StatusUnauthorized, "unknown guest code")
+			return
+		}
+		comment.Author = household.Name
+	}
+	if comment.Author == "" || utf8.RuneCountInString(comment.Author) > maxAuthorLength {
+		writeJSONError(response, http.StatusBadRequest, fmt.Sprintf("author must be 1 to %d characters", maxAuthorLength))
+		return
+	}
+	if comment.Body == "" || utf8.RuneCountInString(comment.Body) > maxCommentLength {
+		writeJSONError(response, http.StatusBadRequest, fmt.Sprintf("body must be 1 to %d characters", maxCommentLength))
+		return
+	}
+
+	if s.comments != nil {
+		reason, err := s.comments.Check(request.Context(), comment)
+		if err != nil {
+			slog.Error("Unable to check comment", "photo", photo.ID, "err", err)
+			writeJSONError(response, http.StatusServiceUnavailable, "Unable to check comment, please try again")
+			return
+		}
+		if reason != "" {
+			writeJSONError(response, http.StatusUnprocessableEntity, reason)
+			return
+		}
+	}
+
+	if err := s.photos.AddComment(&comment); err != nil {
+		slog.Error("Unable to save comment", "photo", photo.ID, "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to save comment")
+		return
+	}
+	writeJSON(response, http.StatusCreated, comment)
+}
+
+// commentsPath is where a JSON index keeps its comments
+func (store *jsonPhotoStore) commentsPath() string {
+	return filepath.Join(filepath.Dir(store.path), "comments.json")
+}
+
+// loadComments reads the comments saved next to the index, if there are any
+func (store *jsonPhotoStore) loadComments() error {
+	return loadJSONFile(store.commentsPath(), &store.comments)
+}
+
+func (store *jsonPhotoStore) AddComment(comment *Comment) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if _, ok := store.photos[comment.PhotoID]; !ok {
+		return os.ErrNotExist
+	}
+	copied := *comment
+	store.comments[comment.PhotoID] = append(store.comments[comment.PhotoID], &copied)
+	if err := store.saveComments(); err != nil {
+		comments := store.comments[comment.PhotoID]
+		store.comments[comment.PhotoID] = comments[:len(comments)-1]
+		return err
+	}
+	return nil
+}
+
+func (store *jsonPhotoStore) Comments(photoID string) ([]*Comment, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	comments := make([]*Comment, 0, len(store.comments[photoID]))
+	for _, comment := range store.comments[photoID] {
+		copied := *comment
+		comments = append(comments, &copied)
+	}
+	return comments, nil
+}
+
+// saveComments writes the comments to disk. The caller must hold store.mu.
+func (store *jsonPhotoStore) saveComments() error {
+	return saveJSONFile(store.commentsPath(), store.comments)
+}
+
+func (store *sqlPhotoStore) AddComment(comment *Comment) error {
+	if _, ok := store.Get(comment.PhotoID); !ok {
+		return os.ErrNotExist
+	}
+	_, err := store.db.Exec(`INSERT INTO comments (id, photo_id, author, body, created_at) VALUES ($1, $2, $3, $4, $5)`,
+		comment.ID, comment.PhotoID, comment.Author, comment.Body, comment.CreatedAt.UTC())
+	return err
+}
+
+func (store *sqlPhotoStore) Comments(photoID string) ([]*Comment, error) {
+	rows, err := store.db.Query(`SELECT id, photo_id, author, body, created_at FROM comments
+		WHERE photo_id = $1 ORDER BY created_at, id`, photoID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var comments []*Comment
+	for rows.Next() {
+		var comment Comment
+		if err := rows.Scan(&comment.ID, &comment.PhotoID, &comment.Author, &comment.Body, &comment.CreatedAt); err != nil {
+			return nil, err
+		}
+		comments = append(comments, &comment)
+	}
+	return comments, rows.Err()
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Server settings. Each one can be set with a command line flag, and falls
+// back to an environment variable, then the config file, and then a default.
+var (
+	configFile       = flag.String("config", envString("CONFIG_FILE", ""), "YAML file of settings named like these flags, such as max-upload-size: 104857600; flags and environment variables take precedence over it (env CONFIG_FILE)")
+	listenAddress    = flag.String("listen", envString("LISTEN_ADDRESS", ":8085"), "address plain HTTP is served on when TLS is off (env LISTEN_ADDRESS)")
+	headerTimeout    = flag.Duration("read-header-timeout", envDuration("READ_HEADER_TIMEOUT", 10*time.Second), "longest a client can take to send a request's headers (env READ_HEADER_TIMEOUT)")
+	readTimeout      = flag.Duration("read-timeout", envDuration("READ_TIMEOUT", 15*time.Minute), "longest a client can take to send a whole request, so it has to allow for the biggest upload on a slow connection; 0 is no limit (env READ_TIMEOUT)")
+	writeTimeout     = flag.Duration("write-timeout", envDuration("WRITE_TIMEOUT", 10*time.Minute), "longest a response can take to send, other than live streams and gallery zips; 0 is no limit (env WRITE_TIMEOUT)")
+	idleTimeout      = flag.Duration("idle-timeout", envDuration("IDLE_TIMEOUT", 2*time.Minute), "how long an idle keep-alive connection is kept open (env IDLE_TIMEOUT)")
+	shutdownTimeout  = flag.Duration("shutdown-timeout", envDuration("SHUTDOWN_TIMEOUT", 30*time.Second), "how long requests in progress, such as uploads, are given to finish when the server is stopped (env SHUTDOWN_TIMEOUT)")
+	logFormat        = flag.String("log-format", envString("LOG_FORMAT", "text"), "how logs are written: text, or json for a log service (env LOG_FORMAT)")
+	logLevel         = flag.String("log-level", envString("LOG_LEVEL", "info"), "least important logs that are written: debug, info, warn or error (env LOG_LEVEL)")
+	uploadDir        = flag.String("upload-dir", envString("UPLOAD_DIR", "./uploads"), "directory the photo index and the rest of the site's data are kept in, along with uploads with local storage (env UPLOAD_DIR)")
+	maxUploadSize    = flag.Int64("max-upload-size", envInt64("MAX_UPLOAD_SIZE", 100<<20), "maximum photo upload size in bytes (env MAX_UPLOAD_SIZE)")
+	maxVideoSize     = flag.Int64("max-video-size", envInt64("MAX_VIDEO_SIZE", 500<<20), "maximum video upload size in bytes (env MAX_VIDEO_SIZE)")
+	maxVideoDuration = flag.Duration("max-video-duration", envDuration("MAX_VIDEO_DURATION", 3*time.Minute), "maximum length of an uploaded video clip (env MAX_VIDEO_DURATION)")
+	stripEXIF        = flag.Bool("strip-exif", envBool("STRIP_EXIF", true), "remove EXIF and other metadata, such as GPS location, from uploads (env STRIP_EXIF)")
+	workerCount      = flag.Int("workers", int(envInt64("WORKERS", int64(runtime.NumCPU()))), "number of background image processing workers (env WORKERS)")
+	queueSize        = flag.Int("queue-size", int(envInt64("QUEUE_SIZE", 100)), "number of photos that can wait for processing before uploads block (env QUEUE_SIZE)")
+	webpQuality      = flag.Int("webp-quality", int(envInt64("WEBP_QUALITY", 80)), "quality (0-100) of the WebP copy stored for each photo (env WEBP_QUALITY)")
+	jpegQuality      = flag.Int("jpeg-quality", int(envInt64("JPEG_QUALITY", 90)), "quality (1-100) of the JPEG copy stored for HEIC photos (env JPEG_QUALITY)")
+	maxDimension     = flag.Int("max-dimension", int(envInt64("MAX_DIMENSION", 4000)), "longest side in pixels of the full size copies of photos; 0 is no limit (env MAX_DIMENSION)")
+	watermarkText    = flag.String("watermark", envString("WATERMARK", ""), "text, such as the couple's names and the date, stamped on the gallery copies of photos; empty turns it off (env WATERMARK)")
+	keepOriginals    = flag.Bool("keep-originals", envBool("KEEP_ORIGINALS", true), "keep uploaded originals; when false they are replaced by their compressed full size copy (env KEEP_ORIGINALS)")
+	nearDupDistance  = flag.Int("near-duplicate-distance", int(envInt64("NEAR_DUPLICATE_DISTANCE", 10)), "largest perceptual hash distance (0-64) at which photos are grouped as near duplicates; -1 turns grouping off (env NEAR_DUPLICATE_DISTANCE)")
+	guestMaxBytes    = flag.Int64("guest-max-bytes", envInt64("GUEST_MAX_BYTES", 0), "most bytes one guest can upload in total; 0 is unlimited (env GUEST_MAX_BYTES)")
+	guestMaxPhotos   = flag.Int("guest-max-photos", int(envInt64("GUEST_MAX_PHOTOS", 0)), "most photos and clips one guest can upload; 0 is unlimited (env GUEST_MAX_PHOTOS)")
+	storageBackend   = flag.String("storage", envString("STORAGE_BACKEND", "local"), "where uploads are stored: local, s3 or gcs (env STORAGE_BACKEND)")
+	storageLayout    = flag.String("storage-layout", envString("STORAGE_LAYOUT", "date"), "how stored files are arranged: date for a directory per day, content to name files after their hash, or flat (env STORAGE_LAYOUT)")
+	backupBackend    = flag.String("backup", envString("BACKUP_STORAGE", ""), "second storage backend uploads are mirrored to: local, s3 or gcs; empty turns backups off (env BACKUP_STORAGE)")
+	backupDir        = flag.String("backup-dir", envString("BACKUP_DIR", "./backup"), "directory backups are kept in with local backup storage (env BACKUP_DIR)")
+	backupInterval   = flag.Duration("backup-interval", envDuration("BACKUP_INTERVAL", time.Hour), "how often uploads are mirrored to the backup storage (env BACKUP_INTERVAL)")
+	retentionFile    = flag.String("retention", envString("RETENTION_FILE", ""), "JSON file of lifecycle rules for stored photos; empty is retention.json in upload-dir (env RETENTION_FILE)")
+	retentionEvery   = flag.Duration("retention-interval", envDuration("RETENTION_INTERVAL", time.Hour), "how often the lifecycle rules are applied (env RETENTION_INTERVAL)")
+	retentionDryRun  = flag.Bool("retention-dry-run", envBool("RETENTION_DRY_RUN", false), "only log what the lifecycle rules would remove (env RETENTION_DRY_RUN)")
+	weddingDate      = flag.String("wedding-date", envString("WEDDING_DATE", ""), "date of the wedding, like 2026-06-20 (env WEDDING_DATE)")
+	adviceRelease    = flag.String("advice-release", envString("ADVICE_RELEASE", ""), "date guests' advice for the couple can be read, like 2027-06-20; empty is the first anniversary of the wedding date (env ADVICE_RELEASE)")
+	encryptKey       = flag.String("encryption-key", envString("ENCRYPTION_KEY", ""), "base64 encoded 32 byte key stored files are encrypted with; empty stores them as they are (env ENCRYPTION_KEY)")
+	encryptKeyFile   = flag.String("encryption-key-file", envString("ENCRYPTION_KEY_FILE", ""), "file holding the encryption key, instead of setting it directly (env ENCRYPTION_KEY_FILE)")
+	metadataBackend  = flag.String("metadata", envString("METADATA_BACKEND", "sqlite"), "where the photo index is kept: sqlite, postgres or json (env METADATA_BACKEND)")
+	sqlitePath       = flag.String("sqlite-path", envString("SQLITE_PATH", ""), "SQLite database of the photo index; empty is photos.db in upload-dir (env SQLITE_PATH)")
+	databaseURL      = flag.String("database-url", envString("DATABASE_URL", ""), "PostgreSQL connection URL for postgres metadata (env DATABASE_URL)")
+	resizeCacheDir   = flag.String("resize-cache", envString("RESIZE_CACHE_DIR", "./cache/resized"), "directory photos resized on request are cached in (env RESIZE_CACHE_DIR)")
+	s3Bucket         = flag.String("s3-bucket", envString("S3_BUCKET", ""), "bucket uploads are stored in with S3 storage (env S3_BUCKET)")
+	s3Prefix         = flag.String("s3-prefix", envString("S3_PREFIX", ""), "key prefix for uploads in the S3 bucket (env S3_PREFIX)")
+	s3Region         = flag.String("s3-region", envString("S3_REGION", ""), "region of the S3 bucket, if not set by AWS_REGION (env S3_REGION)")
+	s3Endpoint       = flag.String("s3-endpoint", envString("S3_ENDPOINT", ""), "URL of an S3-compatible service to use instead of AWS (env S3_ENDPOINT)")
+	s3PathStyle      = flag.Bool("s3-path-style", envBool("S3_PATH_STYLE", false), "address the S3 bucket in the path rather than the host name, as MinIO needs (env S3_PATH_STYLE)")
+	gcsBucket        = flag.String("gcs-bucket", envString("GCS_BUCKET", ""), "bucket uploads are stored in with GCS storage (env GCS_BUCKET)")
+	gcsPrefix        = flag.String("gcs-prefix", envString("GCS_PREFIX", ""), "object prefix for uploads in the GCS bucket (env GCS_PREFIX)")
+	storageLimit     = flag.Int64("storage-limit", envInt64("STORAGE_LIMIT", 0), "most bytes stored under the uploads directory before uploads are turned away; 0 is unlimited (env STORAGE_LIMIT)")
+	guestsFile       = flag.String("guests", envString("GUESTS_FILE", ""), "JSON file of the households on the guest list and their guest codes, kept up to date by the admin API; empty is guests.json in upload-dir (env GUESTS_FILE)")
+	collectAddresses = flag.Bool("collect-addresses", envBool("COLLECT_ADDRESSES", false), "let guests send their mailing addresses for the save-the-dates (env COLLECT_ADDRESSES)")
+	requireGuestCode = flag.Bool("require-guest-code", envBool("REQUIRE_GUEST_CODE", false), "only accept uploads carrying a code from the guest list (env REQUIRE_GUEST_CODE)")
+	signingKey       = flag.String("signing-key", envString("UPLOAD_SIGNING_KEY", ""), "secret for signing upload URLs; once set, uploads need a signed URL or a guest code (env UPLOAD_SIGNING_KEY)")
+	shareKey         = flag.String("share-key", envString("SHARE_LINK_KEY", ""), "secret for signing links that share a photo or album with someone outside the gallery; empty turns share links off (env SHARE_LINK_KEY)")
+	siteURL          = flag.String("site-url", envString("SITE_URL", ""), "public address of the wedding site that QR codes and emailed login links go to, like https://example.com; empty uses the address requests come in on, and turns logging in by email off (env SITE_URL)")
+	eventList        = flag.String("events", envString("EVENTS", "Ceremony,Cocktail hour,Reception,Brunch"), "comma separated parts of the day guests can tag uploads with (env EVENTS)")
+	rsvpDeadlineDate = flag.String("rsvp-deadline", envString("RSVP_DEADLINE", ""), "last day guests can RSVP, like 2026-05-01, or an RFC 3339 time; empty never closes RSVPs (env RSVP_DEADLINE)")
+	lateRSVPMode     = flag.String("late-rsvps", envString("LATE_RSVPS", lateReject), "what happens to RSVPs sent after the deadline: reject turns them away, review holds them for the couple to approve (env LATE_RSVPS)")
+	mealList         = flag.String("meals", envString("MEALS", ""), "comma separated meals guests choose from when they RSVP; empty lets them write in anything (env MEALS)")
+	uploadRate       = flag.Int("upload-rate", int(envInt64("UPLOAD_RATE", 30)), "uploads a minute allowed from each client IP (env UPLOAD_RATE)")
+	uploadBurst      = flag.Int("upload-burst", int(envInt64("UPLOAD_BURST", 20)), "uploads a client IP can make at once before being rate limited (env UPLOAD_BURST)")
+	clamdAddress     = flag.String("clamd", envString("CLAMD_ADDRESS", ""), "ClamAV daemon to scan uploads with, as host:port or unix:/path/to/socket; empty turns scanning off (env CLAMD_ADDRESS)")
+	adminToken       = flag.String("admin-token", envString("ADMIN_TOKEN", ""), "secret the couple sends as a bearer token to manage the site; empty turns the admin API off (env ADMIN_TOKEN)")
+	adminJWTKey      = flag.String("admin-jwt-key", envString("ADMIN_JWT_KEY", ""), "secret admin session tokens are signed with; empty signs them with the admin token (env ADMIN_JWT_KEY)")
+	adminSessionTTL  = flag.Duration("admin-session", envDuration("ADMIN_SESSION", 12*time.Hour), "how long an admin session token from /admin/login lasts (env ADMIN_SESSION)")
+	adminEmails      = flag.String("admin-emails", envString("ADMIN_EMAILS", ""), "comma separated email addresses the couple can be sent login links at; empty turns logging in by email off (env ADMIN_EMAILS)")
+	smtpAddress      = flag.String("smtp", envString("SMTP_ADDRESS", ""), "SMTP server email is sent through, as host:port; empty turns email off (env SMTP_ADDRESS)")
+	smtpUser         = flag.String("smtp-user", envString("SMTP_USER", ""), "username for the SMTP server; empty sends without logging in (env SMTP_USER)")
+	smtpPassword     = flag.String("smtp-password", envString("SMTP_PASSWORD", ""), "password for the SMTP server (env SMTP_PASSWORD)")
+	mailFrom         = flag.String("mail-from", envString("MAIL_FROM", ""), "address email from the site is sent from (env MAIL_FROM)")
+	commentBlocklist = flag.String("comment-blocklist", envString("COMMENT_BLOCKLIST", ""), "comma separated words that aren't allowed in comments on photos (env COMMENT_BLOCKLIST)")
+	reportHideAfter  = flag.Int("report-hide-after", int(envInt64("REPORT_HIDE_AFTER", 3)), "reports from different guests after which a photo is hidden until it is reviewed; 0 never hides reported photos (env REPORT_HIDE_AFTER)")
+	guestbookReview  = flag.Bool("guestbook-review", envBool("GUESTBOOK_REVIEW", false), "hold every guestbook message until the couple publishes it (env GUESTBOOK_REVIEW)")
+	formMinTime      = flag.Duration("form-min-time", envDuration("FORM_MIN_TIME", 3*time.Second), "quickest the guestbook and RSVP forms can be sent after they are shown, since only bots are faster; 0 turns the check off (env FORM_MIN_TIME)")
+	maxLinks         = flag.Int("max-links", int(envInt64("MAX_LINKS", 2)), "most links a guestbook message or RSVP note can have before it is held as spam; -1 is no limit (env MAX_LINKS)")
+	spamCheckURL     = flag.String("spam-check-url", envString("SPAM_CHECK_URL", ""), "spam check service guestbook messages and RSVP notes are posted to; empty turns it off (env SPAM_CHECK_URL)")
+	moderationURL    = flag.String("moderation-url", envString("MODERATION_URL", ""), "content moderation service each photo is posted to before it is published; empty turns screening off (env MODERATION_URL)")
+	spotifyClientID  = flag.String("spotify-client-id", envString("SPOTIFY_CLIENT_ID", ""), "client ID of a Spotify app used to look up the songs guests request; empty leaves requests as they are typed (env SPOTIFY_CLIENT_ID)")
+	spotifySecret    = flag.String("spotify-client-secret", envString("SPOTIFY_CLIENT_SECRET", ""), "client secret of the Spotify app (env SPOTIFY_CLIENT_SECRET)")
+	corsOrigins      = flag.String("cors-origins", envString("CORS_ORIGINS", "*"), "comma separated origins of the pages allowed to call the API, like https://example.com; * allows any origin, but only named ones can send cookies (env CORS_ORIGINS)")
+	contentPolicy    = flag.String("content-security-policy", envString("CONTENT_SECURITY_POLICY", "default-src 'none'; img-src 'self' data: blob:; media-src 'self' blob:; style-src 'unsafe-inline'; frame-ancestors 'none'; base-uri 'none'; form-action 'none'"), "Content-Security-Policy sent with every response; empty sends none (env CONTENT_SECURITY_POLICY)")
+	tlsDomains       = flag.String("tls-domains", envString("TLS_DOMAINS", ""), "comma separated domains to serve HTTPS for on :443 with Let's Encrypt certificates, redirecting HTTP on :80; empty serves plain HTTP on the listen address (env TLS_DOMAINS)")
+	tlsEmail         = flag.String("tls-email", envString("TLS_EMAIL", ""), "email Let's Encrypt can warn about certificate problems at (env TLS_EMAIL)")
+	tlsCacheDir      = flag.String("tls-cache", envString("TLS_CACHE_DIR", "./certs"), "directory Let's Encrypt certificates are kept in between restarts (env TLS_CACHE_DIR)")
+	trustProxy       = flag.Bool("trust-proxy", envBool("TRUST_PROXY", false), "use X-Forwarded-For for client IPs when running behind a reverse proxy (env TRUST_PROXY)")
+	proxyHops        = flag.Int("proxy-hops", int(envInt64("PROXY_HOPS", 1)), "how many trusted proxies in front of the server add to X-Forwarded-For, so the client IP is read that many entries from the end (env PROXY_HOPS)")
+)
+
+// commaList splits a comma separated setting into its items
+func commaList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// findItem returns the item of list matching name, ignoring case
+func findItem(list []string, name string) (string, bool) {
+	name = strings.TrimSpace(name)
+	for _, item := range list {
+		if strings.EqualFold(item, name) {
+			return item, true
+		}
+	}
+	return "", false
+}
+
+// events returns the configured list of events
+func events() []string {
+	return commaList(*eventList)
+}
+
+// findEvent returns the configured event matching name, ignoring case
+func findEvent(name string) (string, bool) {
+	return findItem(events(), name)
+}
+
+// findEvents returns the configured events matching names
+func findEvents(names []string) ([]string, error) {
+	found := make([]string, 0, len(names))
+	for _, name := range names {
+		event, ok := findEvent(name)
+		if !ok {
+			return nil, errors.New("events must be among " + strings.Join(events(), ", "))
+		}
+		found = append(found, event)
+	}
+	return found, nil
+}
+
+// meals returns the configured menu, which is empty if guests can ask for
+// any meal
+func meals() []string {
+	return commaList(*mealList)
+}
+
+// envErrors are the environment variables that were set to something that
+// couldn't be read, which validateConfig reports
+var envErrors []error
+
+// dataFile returns where a data file is kept: where its setting says, or
+// name in upload-dir if the setting is empty. A file left in the working
+// directory, where it used to be kept, is used until it is moved.
+func dataFile(setting, name string) string {
+	if setting != "" {
+		return setting
+	}
+	path := filepath.Join(*uploadDir, name)
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		if _, err := os.Stat(name); err == nil {
+			slog.Warn("Using a data file in the working directory, move it to upload-dir", "file", name, "uploadDir", *uploadDir)
+			return name
+		}
+	}
+	return path
+}
+
+// envString returns the value of the environment variable key, or def if it
+// is unset
+func envString(key, def string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	return def
+}
+
+// envInt64 returns the integer value of the environment variable key, or def
+// if it is unset or not a number
+func envInt64(key string, def int64) int64 {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return def
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		envErrors = append(envErrors, fmt.Errorf("%s must be a whole number", key))
+		return def
+	}
+	return n
+}
+
+// envBool returns the boolean value of the environment variable key, or def
+// if it is unset or not a boolean
+func envBool(key string, def bool) bool {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return def
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		envErrors = append(envErrors, fmt.Errorf("%s must be true or false", key))
+		return def
+	}
+	return b
+}
+
+// envDuration returns the duration value, such as "90s", of the environment
+// variable key, or def if it is unset or not a duration
+func envDuration(key string, def time.Duration) time.Duration {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		envErrors = append(envErrors, fmt.Errorf("%s must be a duration like 90s or 2h", key))
+		return def
+	}
+	return d
+}
+
+// envPattern finds the environment variable a flag's usage names
+var envPattern = regexp.MustCompile(`\(env ([A-Z0-9_]+)\)$`)
+
+// loadConfigFile fills in the settings from the config file, if there is
+// one, that weren't set with a flag or environment variable. The file is
+// YAML with a key for each setting, named like its flag. Lists, such as
+// events, can be written as YAML lists.
+func loadConfigFile() error {
+	if *configFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(*configFile)
+	if err != nil {
+		return err
+	}
+	var settings map[string]any
+	if err := yaml.Unmarshal(data, &settings); err != nil {
+		return fmt.Errorf("%s: %w", *configFile, err)
+	}
+
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	var problems []error
+	for _, name := range slices.Sorted(maps.Keys(settings)) {
+		value := settings[name]
+		f := flag.Lookup(name)
+		if f == nil || name == "config" {
+			problems = append(problems, fmt.Errorf("%s: unknown setting %q", *configFile, name))
+			continue
+		}
+		if set[name] {
+			continue
+		}
+		if env := envPattern.FindStringSubmatch(f.Usage); env != nil {
+			if _, ok := os.LookupEnv(env[1]); ok {
+				continue
+			}
+		}
+		text, err := settingText(value)
+		if err == nil {
+			err = f.Value.Set(text)
+		}
+		if err != nil {
+			problems = append(problems, fmt.Errorf("%s: %s: %w", *configFile, name, err))
+		}
+	}
+	return errors.Join(problems...)
+}
+
+// settingText returns a value from the config file as it would be written
+// on the command line
+func settingText(value any) (string, error) {
+	switch value := value.(type) {
+	case nil:
+		return "", nil
+	case []any:
+		items := make([]string, 0, len(value))
+		for _, item := range value {
+			text, err := settingText(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, text)
+		}
+		return strings.Join(items, ","), nil
+	case map[string]any:
+		return "", errors.New("must be a single value or a list, not a mapping")
+	}
+	return fmt.Sprint(value), nil
+}
+
+// validateConfig checks the settings make sense together, so a mistake is
+// found when the server starts rather than when a guest runs into it. Every
+// problem found is reported at once.
+func validateConfig() error {
+	problems := slices.Clone(envErrors)
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			problems = append(problems, fmt.Errorf(format, args...))
+		}
+	}
+	oneOf := func(name, value string, allowed ...string) {
+		check(slices.Contains(allowed, value), "%s must be one of %s, not %q", name, strings.Join(allowed, ", "), value)
+	}
+
+	check(*listenAddress != "", "listen can't be empty")
+	check(*uploadDir != "", "upload-dir can't be empty")
+	check(*maxUploadSize > 0, "max-upload-size must be more than 0")
+	check(*maxVideoSize > 0, "max-video-size must be more than 0")
+	check(*maxVideoDuration > 0, "max-video-duration must be more than 0")
+	check(*workerCount >= 1, "workers must be at least 1")
+	check(*queueSize >= 0, "queue-size can't be negative")
+	check(*webpQuality >= 0 && *webpQuality <= 100, "webp-quality must be 0 to 100")
+	check(*jpegQuality >= 1 && *jpegQuality <= 100, "jpeg-quality must be 1 to 100")
+	check(*maxDimension >= 0, "max-dimension can't be negative")
+	check(*nearDupDistance >= -1 && *nearDupDistance <= 64, "near-duplicate-distance must be -1 to 64")
+	check(*guestMaxBytes >= 0, "guest-max-bytes can't be negative")
+	check(*guestMaxPhotos >= 0, "guest-max-photos can't be negative")
+	check(*storageLimit >= 0, "storage-limit can't be negative")
+	oneOf("storage", *storageBackend, "local", "s3", "gcs")
+	oneOf("storage-layout", *storageLayout, "date", "content", "flat")
+	oneOf("backup", *backupBackend, "", "local", "s3", "gcs")
+	oneOf("metadata", *metadataBackend, "sqlite", "postgres", "json")
+	check(*storageBackend != "s3" && *backupBackend != "s3" || *s3Bucket != "", "s3-bucket is needed with S3 storage")
+	check(*storageBackend != "gcs" && *backupBackend != "gcs" || *gcsBucket != "", "gcs-bucket is needed with GCS storage")
+	check(*metadataBackend != "postgres" || *databaseURL != "", "database-url is needed with postgres metadata")
+	check(*backupInterval > 0, "backup-interval must be more than 0")
+	check(*retentionEvery > 0, "retention-interval must be more than 0")
+	oneOf("late-rsvps", *lateRSVPMode, lateReject, lateReview)
+	check(*uploadRate >= 1, "upload-rate must be at least 1")
+	check(*uploadBurst >= 1, "upload-burst must be at least 1")
+	check(*headerTimeout > 0, "read-header-timeout must be more than 0")
+	check(*readTimeout >= 0, "read-timeout can't be negative")
+	check(*writeTimeout >= 0, "write-timeout can't be negative")
+	check(*idleTimeout > 0, "idle-timeout must be more than 0")
+	check(*shutdownTimeout > 0, "shutdown-timeout must be more than 0")
+	check(*proxyHops >= 1, "proxy-hops must be at least 1")
+	check(*adminSessionTTL > 0, "admin-session must be more than 0")
+	check(*reportHideAfter >= 0, "report-hide-after can't be negative")
+	check(*formMinTime >= 0, "form-min-time can't be negative")
+	check(*maxLinks >= -1, "max-links must be -1 or more")
+	for _, date := range []struct{ name, value string }{{"wedding-date", *weddingDate}, {"advice-release", *adviceRelease}} {
+		if date.value != "" {
+			_, err := time.Parse("2006-01-02", date.value)
+			check(err == nil, "%s must be a date like 2026-06-20, not %q", date.name, date.value)
+		}
+	}
+	return errors.Join(problems...)
+}
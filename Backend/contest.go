@@ -0,0 +1,497 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Guests vote for their favorite photo in each of the contest's categories,
+// such as "best dance floor photo". Each invitation gets one vote per
+// category, which it can change until the couple reveals the winners at
+// the end of the night.
+
+// Limits on what a contest category can hold
+const (
+	maxCategoryName        = 100
+	maxCategoryDescription = 500
+)
+
+// ContestCategory is something guests vote for a photo in
+type ContestCategory struct {
+	// ID is made from the name when the category is added, and stays the
+	// same if it is renamed
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	// RevealedAt is when the couple revealed the winners, which closes the
+	// voting
+	RevealedAt *time.Time `json:"revealedAt,omitempty"`
+	// Position orders the categories, lowest first
+	Position int `json:"position"`
+}
+
+// contestData is what the contest store keeps on disk: the categories, and
+// for each one the photo each voter picked
+type contestData struct {
+	Categories []*ContestCategory           `json:"categories"`
+	Votes      map[string]map[string]string `json:"votes"`
+}
+
+// contestStore keeps the photo contest
+type contestStore struct {
+	mu   sync.Mutex
+	path string
+	data contestData
+}
+
+// errVotingClosed is returned for votes in a category whose winners have
+// been revealed
+var errVotingClosed = errors.New("voting in that category has closed")
+
+// openContestStore loads the contest saved at path, starting with no
+// categories if it doesn't exist
+func openContestStore(path string) (*contestStore, error) {
+	store := &contestStore{path: path}
+
+	if err := loadJSONFile(path, &store.data); err != nil {
+		return nil, err
+	}
+	if store.data.Votes == nil {
+		store.data.Votes = make(map[string]map[string]string)
+	}
+	return store, nil
+}
+
+// Categories returns a copy of every category, in the order they are listed
+func (store *contestStore) Categories() []ContestCategory {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	categories := make([]ContestCategory, 0, len(store.data.Categories))
+	for _, category := range store.data.Categories {
+		categories = append(categories, *category)
+	}
+	slices.SortStableFunc(categories, func(a, b ContestCategory) int {
+		return a.Position - b.Position
+	})
+	return categories
+}
+
+// Get returns the category with the given ID
+func (store *contestStore) Get(id string) (ContestCategory, bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	category := store.find(id)
+	if category == nil {
+		return ContestCategory{}, false
+	}
+	return *category, true
+}
+
+// find returns the category with the given ID. The caller must hold
+// store.mu.
+func (store *contestStore) find(id string) *ContestCategory {
+	for _, category := range store.data.Categories {
+		if category.ID == id {
+			return category
+		}
+	}
+	return nil
+}
+
+// Create adds a category, after the others unless it is given a position
+func (store *contestStore) Create(category ContestCategory, positioned bool) (ContestCategory, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	base := slug(category.Name, "category")
+	category.ID = base
+	for n := 2; store.find(category.ID) != nil; n++ {
+		category.ID = fmt.Sprintf("%s-%d", base, n)
+	}
+	if !positioned {
+		category.Position = 0
+		for _, other := range store.data.Categories {
+			category.Position = max(category.Position, other.Position+1)
+		}
+	}
+	store.data.Categories = append(store.data.Categories, &category)
+	if err := store.save(); err != nil {
+		store.data.Categories = store.data.Categories[:len(store.data.Categories)-1]
+		return ContestCategory{}, err
+	}
+	return category, nil
+}
+
+// Update changes the category with the given ID, reporting whether there is
+// one
+func (store *contestStore) Update(id string, change func(*ContestCategory)) (ContestCategory, bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	category := store.find(id)
+	if category == nil {
+		return ContestCategory{}, false, nil
+	}
+	previous := *category
+	change(category)
+	category.ID = previous.ID
+	if err := store.save(); err != nil {
+		*category = previous
+		return ContestCategory{}, true, err
+	}
+	return *category, true, nil
+}
+
+// Delete removes the category with the given ID and its votes, reporting
+// whether there was one
+func (store *contestStore) Delete(id string) (bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for i, category := range store.data.Categories {
+		if category.ID != id {
+			continue
+		}
+		previous, votes := store.data.Categories, store.data.Votes[id]
+		store.data.Categories = slices.Concat(previous[:i], previous[i+1:])
+		delete(store.data.Votes, id)
+		if err := store.save(); err != nil {
+			store.data.Categories = previous
+			if votes != nil {
+				store.data.Votes[id] = votes
+			}
+			return true, err
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// Vote records voter's pick of a photo in a category, replacing the one
+// they picked before. An empty photoID takes their vote back.
+func (store *contestStore) Vote(categoryID, voter, photoID string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	category := store.find(categoryID)
+	if category == nil {
+		return os.ErrNotExist
+	}
+	if category.RevealedAt != nil {
+		return errVotingClosed
+	}
+	votes := store.data.Votes[categoryID]
+	if votes == nil {
+		votes = make(map[string]string)
+		store.data.Votes[categoryID] = votes
+	}
+	previous, voted := votes[voter]
+	if photoID == "" {
+		delete(votes, voter)
+	} else {
+		votes[voter] = photoID
+	}
+	if err := store.save(); err != nil {
+		if voted {
+			votes[voter] = previous
+		} else {
+			delete(votes, voter)
+		}
+		return err
+	}
+	return nil
+}
+
+// VoteOf returns the photo voter picked in a category, or "" if they
+// haven't voted in it
+func (store *contestStore) VoteOf(categoryID, voter string) string {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	return store.data.Votes[categoryID][voter]
+}
+
+// Tally counts the votes for each photo in a category
+func (store *contestStore) Tally(categoryID string) map[string]int {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	tally := make(map[string]int)
+	for _, photoID := range store.data.Votes[categoryID] {
+		tally[photoID]++
+	}
+	return tally
+}
+
+// save writes the contest to disk. The caller must hold store.mu.
+func (store *contestStore) save() error {
+	return saveJSONFile(store.path, store.data)
+}
+
+// categoryRequest is the body of a request to add or change a contest
+// category. Fields left out of a change are kept as they are.
+type categoryRequest struct {
+	Name        *string `json:"name"`
+	Description *string `json:"description"`
+	Position    *int    `json:"position"`
+}
+
+// validate checks the fields that were given, tidying them up
+func (body *categoryRequest) validate() error {
+	if body.Name != nil {
+		name := strings.TrimSpace(*body.Name)
+		if name == "" || utf8.RuneCountInString(name) > maxCategoryName {
+			return fmt.Errorf("name must be 1 to %d characters", maxCategoryName)
+		}
+		body.Name = &name
+	}
+	if body.Description != nil {
+		description := strings.TrimSpace(*body.Description)
+		if utf8.RuneCountInString(description) > maxCategoryDescription {
+			return fmt.Errorf("description can be at most %d characters", maxCategoryDescription)
+		}
+		body.Description = &description
+	}
+	return nil
+}
+
+// apply makes the changes in the request to category
+func (body *categoryRequest) apply(category *ContestCategory) {
+	if body.Name != nil {
+		category.Name = *body.Name
+	}
+	if body.Description != nil {
+		category.Description = *body.Description
+	}
+	if body.Position != nil {
+		category.Position = *body.Position
+	}
+}
+
+// contestEntry is a photo's place in a category's results
+type contestEntry struct {
+	Photo photoSummary `json:"photo"`
+	Votes int          `json:"votes"`
+}
+
+// contestResults ranks the photos voted for in a category, the most votes
+// first. Photos that have since left the gallery are left out.
+func (s *server) contestResults(categoryID string) []contestEntry {
+	tally := s.contest.Tally(categoryID)
+	var photos []*Photo
+	for photoID := range tally {
+		if photo, ok := s.photos.Get(photoID); ok && photo.Status == photoReady {
+			photos = append(photos, photo)
+		}
+	}
+	entries := []contestEntry{}
+	for _, summary := range s.summarizePhotos(photos) {
+		entries = append(entries, contestEntry{Photo: summary, Votes: tally[summary.ID]})
+	}
+	slices.SortFunc(entries, func(a, b contestEntry) int {
+		if a.Votes != b.Votes {
+			return b.Votes - a.Votes
+		}
+		return strings.Compare(a.Photo.ID, b.Photo.ID)
+	})
+	return entries
+}
+
+// contestCategoryInfo is a contest category as guests are shown it: the
+// photo they voted for, if they sent their guest code, and once the winners
+// are revealed, the results
+type contestCategoryInfo struct {
+	ContestCategory
+	Vote    string         `json:"vote,omitempty"`
+	Results []contestEntry `json:"results,omitempty"`
+}
+
+// contestHandler lists the contest's categories
+func (s *server) contestHandler(response http.ResponseWriter, request *http.Request) {
+	voter := ""
+	if code := guestCode(request); code != "" {
+		if household, ok := s.guests.Lookup(code); ok {
+			voter = household.Code
+		}
+	}
+	categories := []contestCategoryInfo{}
+	for _, category := range s.contest.Categories() {
+		info := contestCategoryInfo{ContestCategory: category}
+		if voter != "" {
+			info.Vote = s.contest.VoteOf(category.ID, voter)
+		}
+		if category.RevealedAt != nil {
+			info.Results = s.contestResults(category.ID)
+		}
+		categories = append(categories, info)
+	}
+	response.Header().Set("Cache-Control", "no-store")
+	writeJSON(response, http.StatusOK, categories)
+}
+
+// voteRequest is the body of a guest's vote
+type voteRequest struct {
+	PhotoID string `json:"photoId"`
+}
+
+// voteHandler records a guest's vote for a photo in a category. Guests need
+// their guest code, so each invitation votes once.
+func (s *server) voteHandler(response http.ResponseWriter, request *http.Request) {
+	var body voteRequest
+	if !decodeJSON(response, request, &body) {
+		return
+	}
+	photo, ok := s.photos.Get(strings.TrimSpace(body.PhotoID))
+	if !ok || photo.Status != photoReady {
+		writeJSONError(response, http.StatusBadRequest, "photoId must be a photo in the gallery")
+		return
+	}
+	s.changeVote(response, request, photo.ID)
+}
+
+// unvoteHandler takes back a guest's vote in a category
+func (s *server) unvoteHandler(response http.ResponseWriter, request *http.Request) {
+	s.changeVote(response, request, "")
+}
+
+func (s *server) changeVote(response http.ResponseWriter, request *http.Request, photoID string) {
+	household, ok, wait := s.lookupCode(request, guestCode(request))
+	if wait > 0 {
+		writeLockedOut(response, wait)
+		return
+	}
+	if !ok {
+		writeJSONError(response, http.StatusUnauthorized, "Please enter the code from your invitation to vote")
+		return
+	}
+	err := s.contest.Vote(request.PathValue("id"), household.Code, photoID)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		writeJSONError(response, http.StatusNotFound, "Category not found")
+		return
+	case errors.Is(err, errVotingClosed):
+		writeJSONError(response, http.StatusConflict, "Voting in that category has closed")
+		return
+	case err != nil:
+		slog.Error("Unable to save contest votes", "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to save vote")
+		return
+	}
+	if photoID == "" {
+		response.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(response, http.StatusOK, voteRequest{PhotoID: photoID})
+}
+
+// createCategoryHandler adds a category to the contest
+func (s *server) createCategoryHandler(response http.ResponseWriter, request *http.Request) {
+	var body categoryRequest
+	if !decodeJSON(response, request, &body) {
+		return
+	}
+	if body.Name == nil {
+		writeJSONError(response, http.StatusBadRequest, "name is required")
+		return
+	}
+	if err := body.validate(); err != nil {
+		writeJSONError(response, http.StatusBadRequest, err.Error())
+		return
+	}
+	var category ContestCategory
+	body.apply(&category)
+	added, err := s.contest.Create(category, body.Position != nil)
+	if err != nil {
+		slog.Error("Unable to save contest", "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to add category")
+		return
+	}
+	writeJSON(response, http.StatusCreated, added)
+}
+
+// updateCategoryHandler changes a contest category
+func (s *server) updateCategoryHandler(response http.ResponseWriter, request *http.Request) {
+	var body categoryRequest
+	if !decodeJSON(response, request, &body) {
+		return
+	}
+	if err := body.validate(); err != nil {
+		writeJSONError(response, http.StatusBadRequest, err.Error())
+		return
+	}
+	category, ok, err := s.contest.Update(request.PathValue("id"), body.apply)
+	if !ok {
+		writeJSONError(response, http.StatusNotFound, "Category not found")
+		return
+	}
+	if err != nil {
+		slog.Error("Unable to save contest", "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to update category")
+		return
+	}
+	writeJSON(response, http.StatusOK, category)
+}
+
+// deleteCategoryHandler takes a category out of the contest, along with its
+// votes
+func (s *server) deleteCategoryHandler(response http.ResponseWriter, request *http.Request) {
+	ok, err := s.contest.Delete(request.PathValue("id"))
+	if !ok {
+		writeJSONError(response, http.StatusNotFound, "Category not found")
+		return
+	}
+	if err != nil {
+		slog.Error("Unable to save contest", "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to delete category")
+		return
+	}
+	response.WriteHeader(http.StatusNoContent)
+}
+
+// categoryTally is the votes in a category so far, for the couple
+type categoryTally struct {
+	ContestCategory
+	Results []contestEntry `json:"results"`
+}
+
+// tallyHandler counts the votes in a category so far, before or after the
+// winners are revealed
+func (s *server) tallyHandler(response http.ResponseWriter, request *http.Request) {
+	category, ok := s.contest.Get(request.PathValue("id"))
+	if !ok {
+		writeJSONError(response, http.StatusNotFound, "Category not found")
+		return
+	}
+	writeJSON(response, http.StatusOK, categoryTally{ContestCategory: category, Results: s.contestResults(category.ID)})
+}
+
+// revealHandler closes the voting in a category and shows guests its
+// results. Revealing it again keeps the time it was first revealed.
+func (s *server) revealHandler(response http.ResponseWriter, request *http.Request) {
+	now := time.Now().UTC()
+	category, ok, err := s.contest.Update(request.PathValue("id"), func(category *ContestCategory) {
+		if category.RevealedAt == nil {
+			category.RevealedAt = &now
+		}
+	})
+	if !ok {
+		writeJSONError(response, http.StatusNotFound, "Category not found")
+		return
+	}
+	if err != nil {
+		slog.Error("Unable to save contest", "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to reveal winners")
+		return
+	}
+	writeJSON(response, http.StatusOK, categoryTally{ContestCategory: category, Results: s.contestResults(category.ID)})
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// The wedding site's pages are served from a different origin than the API,
+// so browsers only let them call it if the API says the origin is allowed.
+// Which origins are allowed comes from the config; every route is covered by
+// the one middleware here rather than each handler setting its own headers.
+
+// corsMethods are the methods cross-origin requests can use
+const corsMethods = "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS"
+
+// corsHeaders are the request headers cross-origin requests can send
+const corsHeaders = "Authorization, Content-Type, Idempotency-Key, Tus-Resumable, Upload-Length, Upload-Metadata, Upload-Offset, X-Album-Token, X-Caption, X-Device-Token, X-Event, X-Filename, X-Guest-Code, X-Upload-Id, X-Uploader"
+
+// corsExposed are the response headers pages from another origin can read
+const corsExposed = "Content-Disposition, ETag, Idempotent-Replayed, Location, Retry-After, Tus-Resumable, Upload-Length, Upload-Offset, X-Photo-Duplicate, X-Photo-Id"
+
+// corsMaxAge is how many seconds browsers can cache a preflight response
+const corsMaxAge = "600"
+
+// corsPolicy is the origins allowed to call the API
+type corsPolicy struct {
+	// origins are the origins allowed by name. They can send credentials,
+	// such as cookies.
+	origins []string
+	// anyOrigin lets every other origin call the API too, without
+	// credentials
+	anyOrigin bool
+}
+
+// newCORSPolicy returns the policy for a comma separated list of origins,
+// like https://example.com, where * allows any origin
+func newCORSPolicy(list string) *corsPolicy {
+	policy := &corsPolicy{}
+	for _, origin := range commaList(list) {
+		if origin == "*" {
+			policy.anyOrigin = true
+			continue
+		}
+		policy.origins = append(policy.origins, strings.TrimSuffix(origin, "/"))
+	}
+	return policy
+}
+
+// middleware adds the CORS headers for allowed origins to every response,
+// and answers preflight requests itself. Responses to other origins carry
+// no CORS headers, so browsers keep the pages from reading them.
+func (policy *corsPolicy) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		response.Header().Add("Vary", "Origin")
+		origin := request.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(response, request)
+			return
+		}
+
+		named := slices.Contains(policy.origins, origin)
+		switch {
+		case named:
+			response.Header().Set("Access-Control-Allow-Origin", origin)
+			response.Header().Set("Access-Control-Allow-Credentials", "true")
+		case policy.anyOrigin:
+			response.Header().Set("Access-Control-Allow-Origin", "*")
+		}
+		allowed := named || policy.anyOrigin
+
+		if request.Method == http.MethodOptions && request.Header.Get("Access-Control-Request-Method") != "" {
+			if allowed {
+				response.Header().Set("Access-Control-Allow-Methods", corsMethods)
+				response.Header().Set("Access-Control-Allow-Headers", corsHeaders)
+				response.Header().Set("Access-Control-Max-Age", corsMaxAge)
+			}
+			response.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if allowed {
+			response.Header().Set("Access-Control-Expose-Headers", corsExposed)
+		}
+		next.ServeHTTP(response, request)
+	})
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// What happens to RSVPs sent after the deadline
+const (
+	// lateReject turns late RSVPs away
+	lateReject = "reject"
+	// lateReview holds late RSVPs for the couple to approve or decline
+	lateReview = "review"
+)
+
+// rsvpDeadline is when RSVPs close, and what happens to those sent after
+type rsvpDeadline struct {
+	// closes is the first moment RSVPs are late, and lastDay the day shown
+	// to guests as the last they could RSVP
+	closes  time.Time
+	lastDay time.Time
+	review  bool
+}
+
+// newRSVPDeadline reads the RSVP deadline settings. A deadline given as a
+// date lets guests RSVP through the end of that day. With no deadline it
+// returns nil, and RSVPs never close.
+func newRSVPDeadline(value, late string) (*rsvpDeadline, error) {
+	if late != lateReject && late != lateReview {
+		return nil, fmt.Errorf("late RSVPs must be %s or %s", lateReject, lateReview)
+	}
+	if value == "" {
+		return nil, nil
+	}
+	deadline := &rsvpDeadline{review: late == lateReview}
+	if day, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		deadline.lastDay = day
+		deadline.closes = day.AddDate(0, 0, 1)
+		return deadline, nil
+	}
+	closes, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, errors.New("RSVP deadline must be a date like 2006-01-02 or an RFC 3339 time")
+	}
+	deadline.closes, deadline.lastDay = closes, closes
+	return deadline, nil
+}
+
+// closed reports whether an RSVP sent at now is late
+func (deadline *rsvpDeadline) closed(now time.Time) bool {
+	return deadline != nil && !now.Before(deadline.closes)
+}
+
+// message explains to a guest that RSVPs have closed
+func (deadline *rsvpDeadline) message() string {
+	closed := "RSVPs closed on " + deadline.lastDay.Format("January 2, 2006")
+	if deadline.review {
+		return closed + ". We've passed your RSVP on to the couple, who will confirm it with you."
+	}
+	return closed + ". Please get in touch with the couple if your plans have changed."
+}
+
+// lateRSVP is the answer to an RSVP held for the couple to approve
+type lateRSVP struct {
+	RSVP    *RSVP  `json:"rsvp"`
+	Late    bool   `json:"late"`
+	Message string `json:"message"`
+}
+
+// holdLateRSVP keeps an RSVP sent after the deadline for the couple to
+// approve, rather than counting it
+func (s *server) holdLateRSVP(response http.ResponseWriter, rsvp *RSVP) {
+	if err := s.late.Save(rsvp); err != nil {
+		slog.Error("Unable to save late RSVP", "code", rsvp.Code, "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to save RSVP")
+		return
+	}
+	writeJSON(response, http.StatusAccepted, lateRSVP{RSVP: rsvp, Late: true, Message: s.deadline.message()})
+}
+
+// listLateRSVPsHandler lists the RSVPs sent after the deadline that are
+// waiting for the couple, the first sent first
+func (s *server) listLateRSVPsHandler(response http.ResponseWriter, request *http.Request) {
+	rsvps, err := s.late.All()
+	if err != nil {
+		slog.Error("Unable to read late RSVPs", "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to read late RSVPs")
+		return
+	}
+	writeJSON(response, http.StatusOK, rsvps)
+}
+
+// approveLateRSVPHandler counts a late RSVP as if it had come in on time,
+// replacing any the household sent before the deadline
+func (s *server) approveLateRSVPHandler(response http.ResponseWriter, request *http.Request) {
+	code := request.PathValue("code")
+	rsvp, ok, err := s.late.Get(code)
+	if err != nil {
+		slog.Error("Unable to read late RSVP", "code", code, "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to approve RSVP")
+		return
+	}
+	if !ok {
+		writeJSONError(response, http.StatusNotFound, "Late RSVP not found")
+		return
+	}
+	previous, _, err := s.rsvps.Get(code)
+	if err != nil {
+		slog.Error("Unable to read RSVP", "code", code, "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to approve RSVP")
+		return
+	}
+	if previous != nil {
+		rsvp.SubmittedAt = previous.SubmittedAt
+	}
+	rsvp.UpdatedAt = time.Now().UTC()
+	if err := s.rsvps.Save(rsvp); err != nil {
+		slog.Error("Unable to save RSVP", "code", code, "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to approve RSVP")
+		return
+	}
+	if err := s.late.Delete(code); err != nil {
+		slog.Error("Unable to save late RSVPs", "err", err)
+	}
+	writeJSON(response, http.StatusOK, rsvp)
+}
+
+// declineLateRSVPHandler turns away a late RSVP, leaving any the household
+// sent before the deadline as it was
+func (s *server) declineLateRSVPHandler(response http.ResponseWriter, request *http.Request) {
+	code := request.PathValue("code")
+	_, ok, err := s.late.Get(code)
+	if err == nil && ok {
+		err = s.late.Delete(code)
+	}
+	if err != nil {
+		slog.Error("Unable to decline late RSVP", "code", code, "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to decline RSVP")
+		return
+	}
+	if !ok {
+		writeJSONError(response, http.StatusNotFound, "Late RSVP not found")
+		return
+	}
+	response.WriteHeader(http.StatusNoContent)
+}
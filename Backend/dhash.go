@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"math/bits"
+	"strconv"
+
+	"golang.org/x/image/draw"
+)
+
+// Near duplicates, such as burst shots or a photo that was shared, compressed,
+// and uploaded again, don't hash the same byte for byte. They do look the
+// same, so photos are also given a difference hash (dHash) of what they look
+// like and grouped when those hashes are close.
+
+// differenceHash shrinks img to 9x8 shades of grey and sets one bit for each
+// pixel that is brighter than its neighbour to the right
+func differenceHash(img image.Image) uint64 {
+	small := image.NewGray(image.Rect(0, 0, 9, 8))
+	draw.CatmullRom.Scale(small, small.Bounds(), img, img.Bounds(), draw.Src, nil)
+
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if small.GrayAt(x, y).Y > small.GrayAt(x+1, y).Y {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// formatPerceptualHash and parsePerceptualHash convert a difference hash to
+// and from the hex string stored with a photo
+func formatPerceptualHash(hash uint64) string {
+	return fmt.Sprintf("%016x", hash)
+}
+
+func parsePerceptualHash(hash string) (uint64, bool) {
+	value, err := strconv.ParseUint(hash, 16, 64)
+	return value, err == nil && len(hash) == 16
+}
+
+// hashDistance is the number of bits that differ between two difference
+// hashes. Out of 64, up to about 10 is the same picture.
+func hashDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Encrypted files start with encryptionMagic and a random nonce prefix,
+// followed by the content sealed with AES-256-GCM in chunks of
+// encryptionChunkSize. Each chunk's nonce is the prefix, the chunk number
+// and a flag marking the last chunk, so chunks can't be reordered or cut
+// off the end without the file failing to decrypt. Files are written and
+// read a chunk at a time, so large videos never have to fit in memory.
+const (
+	encryptionMagic      = "WSE1"
+	encryptionChunkSize  = 64 << 10
+	encryptionPrefixSize = 7
+)
+
+var errDecryption = errors.New("unable to decrypt stored file")
+
+// encryptedStorage encrypts everything put in the store it wraps. Stat
+// reports the size of the decrypted content, while List reports the size of
+// the encrypted files, which is what they take up. Files stored before
+// encryption was turned on are read back as they are.
+type encryptedStorage struct {
+	Storage
+	aead cipher.AEAD
+}
+
+// withEncryption wraps storage so files are encrypted at rest, if a key is
+// set in the config
+func withEncryption(storage Storage) (Storage, error) {
+	key, err := encryptionKey()
+	if err != nil || key == nil {
+		return storage, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedStorage{Storage: storage, aead: aead}, nil
+}
+
+// encryptionKey returns the configured key, read from ENCRYPTION_KEY or
+// from the file at ENCRYPTION_KEY_FILE, such as one a secret manager
+// mounts. Keys are 32 bytes, base64 encoded.
+func encryptionKey() ([]byte, error) {
+	encoded := *encryptKey
+	if *encryptKeyFile != "" {
+		data, err := os.ReadFile(*encryptKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		encoded = string(data)
+	}
+	encoded = strings.TrimSpace(encoded)
+	if encoded == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("encryption key must be 32 bytes, base64 encoded")
+	}
+	return key, nil
+}
+
+// chunkNonce returns the nonce for chunk number counter of a file
+func chunkNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, 0, 12)
+	nonce = append(nonce, prefix...)
+	nonce = binary.BigEndian.AppendUint32(nonce, counter)
+	if last {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
+
+func (storage *encryptedStorage) Put(ctx context.Context, name string, content io.Reader) error {
+	prefix := make([]byte, encryptionPrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return err
+	}
+
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(storage.encrypt(writer, content, prefix))
+	}()
+	err := storage.Storage.Put(ctx, name, reader)
+	// Stop the encryption if the store gave up part way through
+	reader.CloseWithError(errors.New("storage closed"))
+	return err
+}
+
+// encrypt writes the encrypted form of content to dst
+func (storage *encryptedStorage) encrypt(dst io.Writer, content io.Reader, prefix []byte) error {
+	if _, err := io.WriteString(dst, encryptionMagic); err != nil {
+		return err
+	}
+	if _, err := dst.Write(prefix); err != nil {
+		return err
+	}
+
+	src := bufio.NewReaderSize(content, encryptionChunkSize)
+	plaintext := make([]byte, encryptionChunkSize)
+	sealed := make([]byte, 0, encryptionChunkSize+storage.aead.Overhead())
+	for counter := uint32(0); ; counter++ {
+		n, err := io.ReadFull(src, plaintext)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		last := n < len(plaintext)
+		if !last {
+			if _, peekErr := src.Peek(1); peekErr == io.EOF {
+				last = true
+			}
+		}
+		sealed = storage.aead.Seal(sealed[:0], chunkNonce(prefix, counter, last), plaintext[:n], nil)
+		if _, err := dst.Write(sealed); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+func (storage *encryptedStorage) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	src, err := storage.Storage.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, len(encryptionMagic)+encryptionPrefixSize)
+	n, err := io.ReadFull(src, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		src.Close()
+		return nil, err
+	}
+	if n < len(header) || string(header[:len(encryptionMagic)]) != encryptionMagic {
+		// Stored before encryption was turned on
+		return readCloser{io.MultiReader(bytes.NewReader(header[:n]), src), src}, nil
+	}
+	return storage.decrypting(src, header[len(encryptionMagic):], 0), nil
+}
+
+// GetRange decrypts part of a file, starting from the chunk offset is in so
+// the chunks before it are never read
+func (storage *encryptedStorage) GetRange(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	headerSize := int64(len(encryptionMagic) + encryptionPrefixSize)
+	src, err := getRange(ctx, storage.Storage, name, 0, headerSize)
+	if err != nil {
+		return nil, err
+	}
+	header, err := io.ReadAll(src)
+	src.Close()
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(header)) < headerSize || string(header[:len(encryptionMagic)]) != encryptionMagic {
+		// Stored before encryption was turned on
+		return getRange(ctx, storage.Storage, name, offset, length)
+	}
+
+	chunk := offset / encryptionChunkSize
+	sealedChunkSize := int64(encryptionChunkSize + storage.aead.Overhead())
+	src, err = getRange(ctx, storage.Storage, name, headerSize+chunk*sealedChunkSize, -1)
+	if err != nil {
+		return nil, err
+	}
+	reader := storage.decrypting(src, header[len(encryptionMagic):], uint32(chunk))
+	if _, err := io.CopyN(io.Discard, reader, offset-chunk*encryptionChunkSize); err != nil {
+		reader.Close()
+		return nil, err
+	}
+	if length < 0 {
+		return reader, nil
+	}
+	return readCloser{io.LimitReader(reader, length), reader}, nil
+}
+
+// decrypting returns a reader that decrypts src, which starts at chunk
+// number counter of a file encrypted with prefix
+func (storage *encryptedStorage) decrypting(src io.ReadCloser, prefix []byte, counter uint32) *decryptingReader {
+	return &decryptingReader{
+		src:     bufio.NewReaderSize(src, encryptionChunkSize+storage.aead.Overhead()),
+		closer:  src,
+		aead:    storage.aead,
+		prefix:  prefix,
+		counter: counter,
+		sealed:  make([]byte, encryptionChunkSize+storage.aead.Overhead()),
+	}
+}
+
+func (storage *encryptedStorage) Stat(ctx context.Context, name string) (ObjectInfo, error) {
+	info, err := storage.Storage.Stat(ctx, name)
+	if err != nil {
+		return info, err
+	}
+
+	// Only files that start with the header are encrypted
+	src, err := getRange(ctx, storage.Storage, name, 0, int64(len(encryptionMagic)))
+	if err != nil {
+		return info, err
+	}
+	header := make([]byte, len(encryptionMagic))
+	_, err = io.ReadFull(src, header)
+	src.Close()
+	if err != nil || string(header) != encryptionMagic {
+		return info, nil
+	}
+
+	sealed := info.Size - int64(len(encryptionMagic)+encryptionPrefixSize)
+	chunkSize := int64(encryptionChunkSize + storage.aead.Overhead())
+	chunks := (sealed + chunkSize - 1) / chunkSize
+	info.Size = sealed - chunks*int64(storage.aead.Overhead())
+	return info, nil
+}
+
+// readCloser pairs a reader with the closer of what it reads from
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// decryptingReader decrypts a file a chunk at a time as it is read
+type decryptingReader struct {
+	src     *bufio.Reader
+	closer  io.Closer
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	sealed  []byte
+	pending []byte
+	done    bool
+	err     error
+}
+
+func (reader *decryptingReader) Read(p []byte) (int, error) {
+	for len(reader.pending) == 0 {
+		if reader.err != nil {
+			return 0, reader.err
+		}
+		if reader.done {
+			return 0, io.EOF
+		}
+		reader.err = reader.next()
+	}
+	n := copy(p, reader.pending)
+	reader.pending = reader.pending[n:]
+	return n, nil
+}
+
+// next decrypts the next chunk into pending
+func (reader *decryptingReader) next() error {
+	n, err := io.ReadFull(reader.src, reader.sealed)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	last := n < len(reader.sealed)
+	if !last {
+		if _, peekErr := reader.src.Peek(1); peekErr == io.EOF {
+			last = true
+		}
+	}
+	plaintext, err := reader.aead.Open(reader.sealed[:0], chunkNonce(reader.prefix, reader.counter, last), reader.sealed[:n], nil)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errDecryption, err)
+	}
+	reader.counter++
+	reader.pending = plaintext
+	reader.done = last
+	return nil
+}
+
+func (reader *decryptingReader) Close() error {
+	return reader.closer.Close()
+}
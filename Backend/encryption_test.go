@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestEncryptedStorage returns an encrypted store in a temporary
+// directory, and the local store under it
+func newTestEncryptedStorage(t *testing.T) (*encryptedStorage, *localStorage) {
+	setFlag(t, encryptKey, base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32)))
+	setFlag(t, encryptKeyFile, "")
+	local := &localStorage{dir: t.TempDir()}
+	storage, err := withEncryption(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return storage.(*encryptedStorage), local
+}
+
+// testContent returns size bytes that differ from one offset to the next
+func testContent(size int) []byte {
+	content := make([]byte, size)
+	random := rand.New(rand.NewPCG(1, uint64(size)))
+	for i := range content {
+		content[i] = byte(random.Uint32())
+	}
+	return content
+}
+
+func TestEncryptedGetRange(t *testing.T) {
+	ctx := context.Background()
+	storage, _ := newTestEncryptedStorage(t)
+	const chunk = encryptionChunkSize
+
+	for _, size := range []int{0, 1, chunk - 1, chunk, chunk + 1, 2 * chunk, 2*chunk + 17} {
+		content := testContent(size)
+		name := fmt.Sprintf("file-%d", size)
+		if err := storage.Put(ctx, name, bytes.NewReader(content)); err != nil {
+			t.Fatalf("Put(%d bytes): %v", size, err)
+		}
+
+		info, err := storage.Stat(ctx, name)
+		if err != nil || info.Size != int64(size) {
+			t.Errorf("Stat(%d bytes) = %d, %v, want %d", size, info.Size, err, size)
+		}
+		whole, err := readStored(ctx, storage, name)
+		if err != nil || !bytes.Equal(whole, content) {
+			t.Errorf("Get(%d bytes) = %d bytes, %v, want the content put", size, len(whole), err)
+		}
+
+		ranges := []struct{ offset, length int64 }{
+			{0, -1},
+			{0, 1},
+			{chunk - 1, -1},
+			{chunk - 1, 2},
+			{chunk, -1},
+			{chunk, chunk},
+			{chunk + 1, 10},
+			{2*chunk - 1, 2},
+			{int64(size) - 1, -1},
+			{int64(size) - 1, 1},
+		}
+		for _, r := range ranges {
+			if r.offset < 0 || r.offset >= int64(size) {
+				continue
+			}
+			end := int64(size)
+			if r.length >= 0 {
+				end = min(end, r.offset+r.length)
+			}
+			got, err := readRange(storage.GetRange(ctx, name, r.offset, r.length))
+			if err != nil || !bytes.Equal(got, content[r.offset:end]) {
+				t.Errorf("GetRange(%d bytes, %d, %d) = %d bytes, %v, want bytes %d to %d", size, r.offset, r.length, len(got), err, r.offset, end)
+			}
+		}
+	}
+}
+
+func TestEncryptedTampering(t *testing.T) {
+	ctx := context.Background()
+	storage, local := newTestEncryptedStorage(t)
+	const chunk = encryptionChunkSize
+	headerSize := len(encryptionMagic) + encryptionPrefixSize
+	sealedChunk := chunk + storage.aead.Overhead()
+
+	content := testContent(3 * chunk)
+	if err := storage.Put(ctx, "file", bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := os.ReadFile(filepath.Join(local.dir, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chunkAt := func(i int) []byte {
+		return sealed[headerSize+i*sealedChunk : headerSize+(i+1)*sealedChunk]
+	}
+	flipped := bytes.Clone(sealed)
+	flipped[headerSize+sealedChunk+5] ^= 1
+	tests := []struct {
+		name   string
+		stored []byte
+	}{
+		{name: "flipped bit", stored: flipped},
+		{name: "last chunk cut off", stored: sealed[:headerSize+2*sealedChunk]},
+		{name: "part of last chunk cut off", stored: sealed[:len(sealed)-1]},
+		{name: "chunks swapped", stored: bytes.Join([][]byte{sealed[:headerSize], chunkAt(1), chunkAt(0), chunkAt(2)}, nil)},
+		{name: "chunk repeated", stored: bytes.Join([][]byte{sealed[:headerSize], chunkAt(0), chunkAt(0), chunkAt(2)}, nil)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := os.WriteFile(filepath.Join(local.dir, "tampered"), test.stored, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := readStored(ctx, storage, "tampered"); !errors.Is(err, errDecryption) {
+				t.Errorf("Get() error = %v, want errDecryption", err)
+			}
+			if _, err := readRange(storage.GetRange(ctx, "tampered", chunk+1, -1)); !errors.Is(err, errDecryption) {
+				t.Errorf("GetRange() error = %v, want errDecryption", err)
+			}
+		})
+	}
+}
+
+// readRange reads all of part of a file opened from storage
+func readRange(content io.ReadCloser, err error) ([]byte, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+	return io.ReadAll(content)
+}
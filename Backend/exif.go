@@ -0,0 +1,474 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"time"
+)
+
+// errMalformedImage is returned when an image's container can't be walked
+// well enough to find its metadata
+var errMalformedImage = errors.New("malformed image")
+
+// stripMetadata copies the image in src to dst with EXIF, XMP, and other
+// embedded metadata removed, so guests' GPS coordinates never reach the disk.
+// Pixel data is copied untouched. Formats without embedded metadata are
+// copied as is.
+func stripMetadata(dst io.Writer, src io.Reader, contentType string) error {
+	switch contentType {
+	case "image/jpeg":
+		return stripJPEG(dst, src)
+	case "image/png":
+		return stripPNG(dst, src)
+	case "image/webp":
+		return stripWebP(dst, src)
+	case "image/heic":
+		data, err := io.ReadAll(src)
+		if err != nil {
+			return err
+		}
+		if err := stripHEIF(data); err != nil {
+			return err
+		}
+		_, err = dst.Write(data)
+		return err
+	default:
+		_, err := io.Copy(dst, src)
+		return err
+	}
+}
+
+// stripJPEG removes the APP1 (EXIF and XMP) and APP13 (IPTC) segments from a
+// JPEG, leaving APP0 and the APP2 color profile in place
+func stripJPEG(dst io.Writer, src io.Reader) error {
+	reader := bufio.NewReader(src)
+
+	var soi [2]byte
+	if _, err := io.ReadFull(reader, soi[:]); err != nil || soi != [2]byte{0xFF, 0xD8} {
+		return errMalformedImage
+	}
+	if _, err := dst.Write(soi[:]); err != nil {
+		return err
+	}
+
+	for {
+		marker, err := readJPEGMarker(reader)
+		if err != nil {
+			return err
+		}
+
+		// Markers without a length field
+		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+			if _, err := dst.Write([]byte{0xFF, marker}); err != nil {
+				return err
+			}
+			continue
+		}
+		if marker == 0xD9 {
+			_, err := dst.Write([]byte{0xFF, marker})
+			return err
+		}
+
+		var length [2]byte
+		if _, err := io.ReadFull(reader, length[:]); err != nil {
+			return errMalformedImage
+		}
+		size := int64(binary.BigEndian.Uint16(length[:]))
+		if size < 2 {
+			return errMalformedImage
+		}
+
+		if marker == 0xE1 || marker == 0xED {
+			if _, err := io.CopyN(io.Discard, reader, size-2); err != nil {
+				return errMalformedImage
+			}
+			continue
+		}
+
+		if _, err := dst.Write([]byte{0xFF, marker, length[0], length[1]}); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(dst, reader, size-2); err != nil {
+			return errMalformedImage
+		}
+
+		// Everything after the start of scan is image data
+		if marker == 0xDA {
+			_, err := io.Copy(dst, reader)
+			return err
+		}
+	}
+}
+
+// readJPEGMarker reads the next marker byte, skipping any 0xFF fill bytes
+func readJPEGMarker(reader *bufio.Reader) (byte, error) {
+	b, err := reader.ReadByte()
+	if err != nil || b != 0xFF {
+		return 0, errMalformedImage
+	}
+	for b == 0xFF {
+		if b, err = reader.ReadByte(); err != nil {
+			return 0, errMalformedImage
+		}
+	}
+	return b, nil
+}
+
+// strippedPNGChunks are the PNG chunk types that can carry metadata
+var strippedPNGChunks = map[string]bool{
+	"eXIf": true,
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+}
+
+// stripPNG removes the EXIF and text chunks from a PNG
+func stripPNG(dst io.Writer, src io.Reader) error {
+	reader := bufio.NewReader(src)
+
+	signature := make([]byte, 8)
+	if _, err := io.ReadFull(reader, signature); err != nil || !bytes.Equal(signature, []byte("\x89PNG\r\n\x1a\n")) {
+		return errMalformedImage
+	}
+	if _, err := dst.Write(signature); err != nil {
+		return err
+	}
+
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(reader, header[:]); err != nil {
+			return errMalformedImage
+		}
+		length := int64(binary.BigEndian.Uint32(header[:4]))
+		chunkType := string(header[4:])
+
+		// Chunk data is followed by a 4 byte CRC
+		if strippedPNGChunks[chunkType] {
+			if _, err := io.CopyN(io.Discard, reader, length+4); err != nil {
+				return errMalformedImage
+			}
+			continue
+		}
+
+		if _, err := dst.Write(header[:]); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(dst, reader, length+4); err != nil {
+			return errMalformedImage
+		}
+		if chunkType == "IEND" {
+			return nil
+		}
+	}
+}
+
+// VP8X feature flags for embedded metadata
+const (
+	webpFlagEXIF = 0x08
+	webpFlagXMP  = 0x04
+)
+
+// stripWebP removes the EXIF and XMP chunks from a WebP, clearing their flags
+// in the VP8X header and fixing up the RIFF size to match
+func stripWebP(dst io.Writer, src io.Reader) error {
+	data, err := io.ReadAll(src)
+	if err != nil {
+		return err
+	}
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return errMalformedImage
+	}
+
+	var body bytes.Buffer
+	body.WriteString("WEBP")
+	for offset := 12; offset < len(data); {
+		if offset+8 > len(data) {
+			return errMalformedImage
+		}
+		fourCC := string(data[offset : offset+4])
+		size := int(binary.LittleEndian.Uint32(data[offset+4 : offset+8]))
+		end := offset + 8 + size + size%2
+		if end > len(data) {
+			return errMalformedImage
+		}
+		chunk := data[offset:end]
+		offset = end
+
+		switch fourCC {
+		case "EXIF", "XMP ":
+			continue
+		case "VP8X":
+			if size < 1 {
+				return errMalformedImage
+			}
+			chunk = bytes.Clone(chunk)
+			chunk[8] &^= webpFlagEXIF | webpFlagXMP
+		}
+		body.Write(chunk)
+	}
+
+	header := make([]byte, 8)
+	copy(header, "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], uint32(body.Len()))
+	if _, err := dst.Write(header); err != nil {
+		return err
+	}
+	_, err = body.WriteTo(dst)
+	return err
+}
+
+// exifInfo is the subset of EXIF data kept from an upload before the rest is
+// stripped
+type exifInfo struct {
+	TakenAt     time.Time
+	CameraMake  string
+	CameraModel string
+	// Orientation is the EXIF orientation, 1 to 8, or 0 if it isn't set
+	Orientation int
+}
+
+// EXIF tags read by readEXIF
+const (
+	tagMake               = 0x010F
+	tagModel              = 0x0110
+	tagOrientation        = 0x0112
+	tagExifIFD            = 0x8769
+	tagDateTimeOriginal   = 0x9003
+	tagOffsetTimeOriginal = 0x9011
+)
+
+// readEXIF extracts the capture time and camera from the image in file, which
+// is rewound afterwards. Images without EXIF data return an empty exifInfo.
+func readEXIF(file io.ReadSeeker, contentType string) (exifInfo, error) {
+	var info exifInfo
+
+	data, err := findEXIF(bufio.NewReader(file), contentType)
+	if _, seekErr := file.Seek(0, io.SeekStart); seekErr != nil {
+		return info, seekErr
+	}
+	if err != nil || data == nil {
+		return info, err
+	}
+
+	tiff, err := parseTIFF(data)
+	if err != nil {
+		return info, err
+	}
+
+	ifd0 := tiff.readIFD(tiff.firstIFD)
+	info.CameraMake = tiff.stringValue(ifd0[tagMake])
+	info.CameraModel = tiff.stringValue(ifd0[tagModel])
+	if entry, ok := ifd0[tagOrientation]; ok {
+		if orientation := tiff.uint32Value(entry); orientation >= 1 && orientation <= 8 {
+			info.Orientation = int(orientation)
+		}
+	}
+
+	if entry, ok := ifd0[tagExifIFD]; ok {
+		exifIFD := tiff.readIFD(tiff.uint32Value(entry))
+		taken := tiff.stringValue(exifIFD[tagDateTimeOriginal])
+		offset := tiff.stringValue(exifIFD[tagOffsetTimeOriginal])
+		if t, err := time.Parse("2006:01:02 15:04:05-07:00", taken+offset); err == nil && offset != "" {
+			info.TakenAt = t
+		} else if t, err := time.ParseInLocation("2006:01:02 15:04:05", taken, time.Local); err == nil {
+			info.TakenAt = t
+		}
+	}
+	return info, nil
+}
+
+// findEXIF returns the raw TIFF structured EXIF block embedded in an image,
+// or nil if there isn't one
+func findEXIF(reader *bufio.Reader, contentType string) ([]byte, error) {
+	switch contentType {
+	case "image/jpeg":
+		var soi [2]byte
+		if _, err := io.ReadFull(reader, soi[:]); err != nil || soi != [2]byte{0xFF, 0xD8} {
+			return nil, errMalformedImage
+		}
+		for {
+			marker, err := readJPEGMarker(reader)
+			if err != nil {
+				return nil, err
+			}
+			if marker == 0xDA || marker == 0xD9 {
+				return nil, nil
+			}
+			if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+				continue
+			}
+
+			var length [2]byte
+			if _, err := io.ReadFull(reader, length[:]); err != nil {
+				return nil, errMalformedImage
+			}
+			size := int(binary.BigEndian.Uint16(length[:]))
+			if size < 2 {
+				return nil, errMalformedImage
+			}
+			segment := make([]byte, size-2)
+			if _, err := io.ReadFull(reader, segment); err != nil {
+				return nil, errMalformedImage
+			}
+			if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+				return segment[6:], nil
+			}
+		}
+
+	case "image/png":
+		if _, err := reader.Discard(8); err != nil {
+			return nil, errMalformedImage
+		}
+		for {
+			var header [8]byte
+			if _, err := io.ReadFull(reader, header[:]); err != nil {
+				return nil, nil
+			}
+			length := int(binary.BigEndian.Uint32(header[:4]))
+			switch string(header[4:]) {
+			case "eXIf":
+				chunk := make([]byte, length)
+				if _, err := io.ReadFull(reader, chunk); err != nil {
+					return nil, errMalformedImage
+				}
+				return chunk, nil
+			case "IDAT", "IEND":
+				return nil, nil
+			}
+			if _, err := reader.Discard(length + 4); err != nil {
+				return nil, errMalformedImage
+			}
+		}
+
+	case "image/webp":
+		if _, err := reader.Discard(12); err != nil {
+			return nil, errMalformedImage
+		}
+		for {
+			var header [8]byte
+			if _, err := io.ReadFull(reader, header[:]); err != nil {
+				return nil, nil
+			}
+			size := int(binary.LittleEndian.Uint32(header[4:]))
+			if string(header[:4]) == "EXIF" {
+				chunk := make([]byte, size)
+				if _, err := io.ReadFull(reader, chunk); err != nil {
+					return nil, errMalformedImage
+				}
+				// Some encoders keep the JPEG style prefix
+				return bytes.TrimPrefix(chunk, []byte("Exif\x00\x00")), nil
+			}
+			if _, err := reader.Discard(size + size%2); err != nil {
+				return nil, nil
+			}
+		}
+
+	case "image/heic":
+		data, err := io.ReadAll(reader)
+		if err != nil {
+			return nil, err
+		}
+		return heifEXIF(data)
+	}
+	return nil, nil
+}
+
+// tiffData is an EXIF block along with its byte order
+type tiffData struct {
+	data     []byte
+	order    binary.ByteOrder
+	firstIFD uint32
+}
+
+// tiffEntry is a single tag from an IFD
+type tiffEntry struct {
+	kind  uint16
+	count uint32
+	value []byte
+}
+
+// parseTIFF reads the header of an EXIF block
+func parseTIFF(data []byte) (*tiffData, error) {
+	if len(data) < 8 {
+		return nil, errMalformedImage
+	}
+
+	tiff := &tiffData{data: data}
+	switch string(data[:2]) {
+	case "II":
+		tiff.order = binary.LittleEndian
+	case "MM":
+		tiff.order = binary.BigEndian
+	default:
+		return nil, errMalformedImage
+	}
+	if tiff.order.Uint16(data[2:4]) != 42 {
+		return nil, errMalformedImage
+	}
+	tiff.firstIFD = tiff.order.Uint32(data[4:8])
+	return tiff, nil
+}
+
+// tiffTypeSizes is the size in bytes of each TIFF field type
+var tiffTypeSizes = map[uint16]uint32{
+	1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8,
+}
+
+// readIFD returns the entries of the IFD at offset, keyed by tag. Entries
+// that point outside the block are skipped.
+func (tiff *tiffData) readIFD(offset uint32) map[uint16]tiffEntry {
+	entries := make(map[uint16]tiffEntry)
+	data := tiff.data
+	if uint64(offset)+2 > uint64(len(data)) {
+		return entries
+	}
+
+	count := int(tiff.order.Uint16(data[offset:]))
+	for i := 0; i < count; i++ {
+		start := uint64(offset) + 2 + uint64(i)*12
+		if start+12 > uint64(len(data)) {
+			break
+		}
+		raw := data[start : start+12]
+		tag := tiff.order.Uint16(raw[0:2])
+		kind := tiff.order.Uint16(raw[2:4])
+		n := tiff.order.Uint32(raw[4:8])
+
+		size := uint64(tiffTypeSizes[kind]) * uint64(n)
+		value := raw[8:12]
+		if size > 4 {
+			valueOffset := uint64(tiff.order.Uint32(raw[8:12]))
+			if valueOffset+size > uint64(len(data)) {
+				continue
+			}
+			value = data[valueOffset : valueOffset+size]
+		} else {
+			value = value[:size]
+		}
+		entries[tag] = tiffEntry{kind: kind, count: n, value: value}
+	}
+	return entries
+}
+
+// stringValue returns an ASCII entry without its trailing NULs
+func (tiff *tiffData) stringValue(entry tiffEntry) string {
+	if entry.kind != 2 {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(string(entry.value), "\x00"))
+}
+
+// uint32Value returns a SHORT or LONG entry as a number
+func (tiff *tiffData) uint32Value(entry tiffEntry) uint32 {
+	switch {
+	case entry.kind == 3 && len(entry.value) >= 2:
+		return uint32(tiff.order.Uint16(entry.value))
+	case entry.kind == 4 && len(entry.value) >= 4:
+		return tiff.order.Uint32(entry.value)
+	}
+	return 0
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The couple exports who is coming for the caterer and the planner as a
+// spreadsheet: a row for each attendee named on an RSVP, or for each RSVP
+// that only gave a party size.
+
+// exportColumns are the columns an export can have, in the order they are
+// listed when none are asked for
+var exportColumns = []string{"household", "name", "guests", "plusOne", "meal", "allergies", "events", "email", "notes", "code", "submittedAt", "updatedAt"}
+
+// defaultExportColumns are the columns of an export that doesn't choose
+var defaultExportColumns = []string{"household", "name", "guests", "meal", "allergies", "events", "notes"}
+
+// exportHeadings are the headings of the columns in the spreadsheet
+var exportHeadings = map[string]string{
+	"household":   "Household",
+	"name":        "Name",
+	"guests":      "Guests",
+	"plusOne":     "Plus-one",
+	"meal":        "Meal",
+	"allergies":   "Allergies and dietary notes",
+	"events":      "Events",
+	"email":       "Email",
+	"notes":       "RSVP notes",
+	"code":        "Guest code",
+	"submittedAt": "RSVP sent",
+	"updatedAt":   "RSVP updated",
+}
+
+// numericColumns are the columns holding numbers, which are written to a
+// workbook as numbers so they can be added up
+var numericColumns = map[string]bool{"guests": true}
+
+// formulaStarts are what a spreadsheet takes a cell starting with to be a
+// formula, or the start of one
+const formulaStarts = "=+-@\t\r"
+
+// csvCell returns value so that a spreadsheet opening the CSV shows it as
+// text rather than running it as a formula, by putting a ' before anything
+// that starts like one. Anything a guest typed can end up in an export.
+func csvCell(value string) string {
+	if value != "" && strings.ContainsRune(formulaStarts, rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+// csvRow returns cells as csvCell writes them
+func csvRow(cells ...string) []string {
+	row := make([]string, len(cells))
+	for i, cell := range cells {
+		row[i] = csvCell(cell)
+	}
+	return row
+}
+
+// exportRow is one row of an export, by column
+type exportRow map[string]string
+
+// exportRows returns a row for each attendee of the RSVPs that are coming,
+// or only coming to event if it is given
+func (s *server) exportRows(rsvps []*RSVP, event string) []exportRow {
+	emails := map[string]string{}
+	for _, household := range s.guests.All() {
+		for _, guest := range household.Guests {
+			emails[household.Code+"/"+guest.ID] = guest.Email
+		}
+	}
+
+	var rows []exportRow
+	for _, rsvp := range rsvps {
+		var coming []string
+		for _, name := range events() {
+			if rsvp.Events[name] && (event == "" || name == event) {
+				coming = append(coming, name)
+			}
+		}
+		if len(coming) == 0 {
+			continue
+		}
+		base := exportRow{
+			"household":   rsvp.Name,
+			"events":      strings.Join(coming, ", "),
+			"notes":       rsvp.Notes,
+			"code":        rsvp.Code,
+			"submittedAt": rsvp.SubmittedAt.Format(time.RFC3339),
+			"updatedAt":   rsvp.UpdatedAt.Format(time.RFC3339),
+		}
+		if len(rsvp.Attendees) == 0 {
+			row := base
+			row["guests"] = strconv.Itoa(rsvp.PartySize)
+			rows = append(rows, row)
+			continue
+		}
+		attendees := rsvp.Attendees
+		if event != "" {
+			attendees = rsvp.comingTo(event)
+		}
+		for _, attendee := range attendees {
+			row := exportRow{}
+			for column, value := range base {
+				row[column] = value
+			}
+			row["name"] = attendee.Name
+			row["guests"] = "1"
+			row["meal"] = attendee.Meal
+			row["allergies"] = attendee.Allergies
+			row["email"] = emails[rsvp.Code+"/"+attendee.ID]
+			if attendee.PlusOne {
+				row["plusOne"] = "yes"
+			}
+			if len(attendee.Events) > 0 && event == "" {
+				row["events"] = strings.Join(attendee.Events, ", ")
+			}
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
+
+// exportRSVPsHandler exports who is coming as a spreadsheet, in CSV or with
+// ?format=xlsx for Excel. ?columns= chooses the columns, comma separated,
+// and ?event= only includes the attendees of that event.
+func (s *server) exportRSVPsHandler(response http.ResponseWriter, request *http.Request) {
+	query := request.URL.Query()
+	format := query.Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "xlsx" {
+		writeJSONError(response, http.StatusBadRequest, "format must be csv or xlsx")
+		return
+	}
+	columns := defaultExportColumns
+	if value := query.Get("columns"); value != "" {
+		columns = nil
+		for _, column := range commaList(value) {
+			if !slices.Contains(exportColumns, column) {
+				writeJSONError(response, http.StatusBadRequest, "columns must be among "+strings.Join(exportColumns, ", "))
+				return
+			}
+			columns = append(columns, column)
+		}
+	}
+	event := ""
+	if name := query.Get("event"); name != "" {
+		var ok bool
+		if event, ok = findEvent(name); !ok {
+			writeJSONError(response, http.StatusBadRequest, "event must be one of "+strings.Join(events(), ", "))
+			return
+		}
+	}
+	rsvps, err := s.rsvps.All()
+	if err != nil {
+		slog.Error("Unable to read RSVPs", "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to read RSVPs")
+		return
+	}
+
+	table := [][]string{make([]string, len(columns))}
+	for i, column := range columns {
+		table[0][i] = exportHeadings[column]
+	}
+	for _, row := range s.exportRows(rsvps, event) {
+		cells := make([]string, len(columns))
+		for i, column := range columns {
+			cells[i] = row[column]
+		}
+		table = append(table, cells)
+	}
+
+	if format == "csv" {
+		response.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		response.Header().Set("Content-Disposition", `attachment; filename="rsvps.csv"`)
+		out := csv.NewWriter(response)
+		for _, row := range table {
+			out.Write(csvRow(row...))
+		}
+		out.Flush()
+		if err := out.Error(); err != nil {
+			slog.Error("Unable to write RSVP export", "err", err)
+		}
+		return
+	}
+	response.Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+	response.Header().Set("Content-Disposition", `attachment; filename="rsvps.xlsx"`)
+	numeric := make([]bool, len(columns))
+	for i, column := range columns {
+		numeric[i] = numericColumns[column]
+	}
+	if err := writeXLSX(response, "RSVPs", table, numeric); err != nil {
+		slog.Error("Unable to write RSVP export", "err", err)
+	}
+}
+
+// The parts of an Excel workbook with a single sheet, other than the sheet
+// itself
+var xlsxParts = []struct{ name, content string }{
+	{"[Content_Types].xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"><Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/><Default Extension="xml" ContentType="application/xml"/><Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/><Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/></Types>`},
+	{"_rels/.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/></Relationships>`},
+	{"xl/_rels/workbook.xml.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/></Relationships>`},
+}
+
+// writeXLSX writes table as an Excel workbook with one sheet called name.
+// Cells are written as text, except whole numbers in the columns numeric
+// marks, so they can be added up. The first row is the headings.
+func writeXLSX(w io.Writer, name string, table [][]string, numeric []bool) error {
+	archive := zip.NewWriter(w)
+	for _, part := range xlsxParts {
+		out, err := archive.Create(part.name)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(out, part.content); err != nil {
+			return err
+		}
+	}
+
+	out, err := archive.Create("xl/workbook.xml")
+	if err != nil {
+		return err
+	}
+	fmt.Fprint(out, `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>`+"\n")
+	fmt.Fprint(out, `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets><sheet name="`)
+	xml.EscapeText(out, []byte(name))
+	fmt.Fprint(out, `" sheetId="1" r:id="rId1"/></sheets></workbook>`)
+
+	out, err = archive.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return err
+	}
+	fmt.Fprint(out, `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>`+"\n")
+	fmt.Fprint(out, `<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	for r, row := range table {
+		fmt.Fprintf(out, `<row r="%d">`, r+1)
+		for c, cell := range row {
+			ref := xlsxColumn(c) + strconv.Itoa(r+1)
+			if _, err := strconv.Atoi(cell); err == nil && r > 0 && c < len(numeric) && numeric[c] {
+				fmt.Fprintf(out, `<c r="%s"><v>%s</v></c>`, ref, cell)
+				continue
+			}
+			fmt.Fprintf(out, `<c r="%s" t="inlineStr"><is><t xml:space="preserve">`, ref)
+			xml.EscapeText(out, []byte(cell))
+			fmt.Fprint(out, `</t></is></c>`)
+		}
+		fmt.Fprint(out, `</row>`)
+	}
+	fmt.Fprint(out, `</sheetData></worksheet>`)
+	return archive.Close()
+}
+
+// xlsxColumn returns the letters naming the column at index i, from A
+func xlsxColumn(i int) string {
+	name := ""
+	for i++; i > 0; i = (i - 1) / 26 {
+		name = string(rune('A'+(i-1)%26)) + name
+	}
+	return name
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Limits on what a question in the FAQ can hold
+const (
+	maxFAQKey      = 64
+	maxFAQQuestion = 300
+	maxFAQAnswer   = 5000
+)
+
+// FAQ is a question guests often ask, and the couple's answer
+type FAQ struct {
+	// Key names the question, like "dress-code", so the frontend can link to
+	// it. It is made from the question if it isn't given, and doesn't change.
+	Key      string `json:"key"`
+	Question string `json:"question"`
+	Answer   string `json:"answer"`
+	// Position orders the FAQ, lowest first
+	Position int `json:"position"`
+}
+
+// errFAQKeyTaken is returned when a question is added with the key of
+// another
+var errFAQKeyTaken = errors.New("that key is already used by another question")
+
+// faqStore keeps the FAQ
+type faqStore struct {
+	mu        sync.Mutex
+	path      string
+	questions []*FAQ
+}
+
+// openFAQStore loads the FAQ saved at path, starting empty if it doesn't
+// exist
+func openFAQStore(path string) (*faqStore, error) {
+	store := &faqStore{path: path}
+
+	if err := loadJSONFile(path, &store.questions); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// All returns a copy of every question, in the order of the FAQ
+func (store *faqStore) All() []FAQ {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	questions := make([]FAQ, 0, len(store.questions))
+	for _, question := range store.questions {
+		questions = append(questions, *question)
+	}
+	slices.SortStableFunc(questions, func(a, b FAQ) int {
+		return a.Position - b.Position
+	})
+	return questions
+}
+
+// find returns the question with the given key. The caller must hold
+// store.mu.
+func (store *faqStore) find(key string) *FAQ {
+	for _, question := range store.questions {
+		if question.Key == key {
+			return question
+		}
+	}
+	return nil
+}
+
+// Create adds a question to the FAQ, after the others unless it is given a
+// position. Without a key it is given one from the question.
+func (store *faqStore) Create(question FAQ, positioned bool) (FAQ, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if question.Key == "" {
+		base := slug(question.Question, "question")
+		if len(base) > maxFAQKey {
+			base = strings.TrimRight(base[:maxFAQKey], "-")
+		}
+		question.Key = base
+		for n := 2; store.find(question.Key) != nil; n++ {
+			question.Key = fmt.Sprintf("%s-%d", base, n)
+		}
+	} else if store.find(question.Key) != nil {
+		return FAQ{}, errFAQKeyTaken
+	}
+	if !positioned {
+		question.Position = 0
+		for _, other := range store.questions {
+			question.Position = max(question.Position, other.Position+1)
+		}
+	}
+	store.questions = append(store.questions, &question)
+	if err := store.save(); err != nil {
+		store.questions = store.questions[:len(store.questions)-1]
+		return FAQ{}, err
+	}
+	return question, nil
+}
+
+// Update changes the question with the given key, reporting whether there
+// is one
+func (store *faqStore) Update(key string, change func(*FAQ)) (FAQ, bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	question := store.find(key)
+	if question == nil {
+		return FAQ{}, false, nil
+	}
+	previous := *question
+	change(question)
+	question.Key = previous.Key
+	if err := store.save(); err != nil {
+		*question = previous
+		return FAQ{}, true, err
+	}
+	return *question, true, nil
+}
+
+// Delete removes the question with the given key, reporting whether there
+// was one
+func (store *faqStore) Delete(key string) (bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for i, question := range store.questions {
+		if question.Key != key {
+			continue
+		}
+		previous := store.questions
+		store.questions = slices.Concat(previous[:i], previous[i+1:])
+		if err := store.save(); err != nil {
+			store.questions = previous
+			return true, err
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// save writes the FAQ to disk. The caller must hold store.mu.
+func (store *faqStore) save() error {
+	return saveJSONFile(store.path, store.questions)
+}
+
+// faqRequest is the body of a request to add or change a question. Fields
+// left out of a change are kept as they are.
+type faqRequest struct {
+	Key      *string `json:"key"`
+	Question *string `json:"question"`
+	Answer   *string `json:"answer"`
+	Position *int    `json:"position"`
+}
+
+// validate checks the fields that were given, tidying them up
+func (body *faqRequest) validate() error {
+	if body.Key != nil {
+		key := strings.ToLower(strings.TrimSpace(*body.Key))
+		if key == "" || len(key) > maxFAQKey || strings.IndexFunc(key, func(r rune) bool {
+			return (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-'
+		}) >= 0 {
+			return fmt.Errorf("key must be 1 to %d letters, digits and dashes", maxFAQKey)
+		}
+		body.Key = &key
+	}
+	if body.Question != nil {
+		question := strings.TrimSpace(*body.Question)
+		if question == "" || utf8.RuneCountInString(question) > maxFAQQuestion {
+			return fmt.Errorf("question must be 1 to %d characters", maxFAQQuestion)
+		}
+		body.Question = &question
+	}
+	if body.Answer != nil {
+		answer := strings.TrimSpace(*body.Answer)
+		if answer == "" || utf8.RuneCountInString(answer) > maxFAQAnswer {
+			return fmt.Errorf("answer must be 1 to %d characters", maxFAQAnswer)
+		}
+		body.Answer = &answer
+	}
+	return nil
+}
+
+// apply makes the changes in the request to question, apart from its key
+func (body *faqRequest) apply(question *FAQ) {
+	if body.Question != nil {
+		question.Question = *body.Question
+	}
+	if body.Answer != nil {
+		question.Answer = *body.Answer
+	}
+	if body.Position != nil {
+		question.Position = *body.Position
+	}
+}
+
+// faqHandler lists the FAQ
+func (s *server) faqHandler(response http.ResponseWriter, request *http.Request) {
+	writeJSON(response, http.StatusOK, s.faq.All())
+}
+
+// createFAQHandler adds a question to the FAQ
+func (s *server) createFAQHandler(response http.ResponseWriter, request *http.Request) {
+	var body faqRequest
+	if !decodeJSON(response, request, &body) {
+		return
+	}
+	if body.Question == nil || body.Answer == nil {
+		writeJSONError(response, http.StatusBadRequest, "question and answer are required")
+		return
+	}
+	if err := body.validate(); err != nil {
+		writeJSONError(response, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var question FAQ
+	if body.Key != nil {
+		question.Key = *body.Key
+	}
+	body.apply(&question)
+	added, err := s.faq.Create(question, body.Position != nil)
+	if errors.Is(err, errFAQKeyTaken) {
+		writeJSONError(response, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		slog.Error("Unable to save FAQ", "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to add question")
+		return
+	}
+	writeJSON(response, http.StatusCreated, added)
+}
+
+// updateFAQHandler changes a question, its answer, or where it is in the FAQ
+func (s *server) updateFAQHandler(response http.ResponseWriter, request *http.Request) {
+	var body faqRequest
+	if !decodeJSON(response, request, &body) {
+		return
+	}
+	if body.Key != nil {
+		writeJSONError(response, http.StatusBadRequest, "a question's key can't be changed")
+		return
+	}
+	if err := body.validate(); err != nil {
+		writeJSONError(response, http.StatusBadRequest, err.Error())
+		return
+	}
+	question, ok, err := s.faq.Update(request.PathValue("key"), body.apply)
+	if !ok {
+		writeJSONError(response, http.StatusNotFound, "Question not found")
+		return
+	}
+	if err != nil {
+		slog.Error("Unable to save FAQ", "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to update question")
+		return
+	}
+	writeJSON(response, http.StatusOK, question)
+}
+
+// deleteFAQHandler takes a question off the FAQ
+func (s *server) deleteFAQHandler(response http.ResponseWriter, request *http.Request) {
+	ok, err := s.faq.Delete(request.PathValue("key"))
+	if !ok {
+		writeJSONError(response, http.StatusNotFound, "Question not found")
+		return
+	}
+	if err != nil {
+		slog.Error("Unable to save FAQ", "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to delete question")
+		return
+	}
+	response.WriteHeader(http.StatusNoContent)
+}
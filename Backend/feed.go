@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// New photos are announced over Server-Sent Events on /photos/live, so the
+// projector at the reception and guests' phones can add them to the gallery
+// as they arrive instead of polling for them.
+
+// feedKeepAlive is how often an idle stream sends a comment, so proxies and
+// phones don't give up on a quiet connection
+const feedKeepAlive = 30 * time.Second
+
+// feedBuffer is how many photos a slow client can fall behind by before it
+// starts missing them
+const feedBuffer = 16
+
+// photoFeed fans out photos to the clients watching the live stream as they
+// become ready
+type photoFeed struct {
+	mu          sync.Mutex
+	subscribers map[chan photoSummary]struct{}
+}
+
+func newPhotoFeed() *photoFeed {
+	return &photoFeed{subscribers: make(map[chan photoSummary]struct{})}
+}
+
+// publish announces photo to every subscriber. Photos that aren't ready to
+// be shown are left out.
+func (feed *photoFeed) publish(photo *Photo) {
+	if photo.Status != photoReady {
+		return
+	}
+	summary := summarizePhoto(photo)
+
+	feed.mu.Lock()
+	defer feed.mu.Unlock()
+	for subscriber := range feed.subscribers {
+		// Never hold up processing for a client that isn't keeping up
+		select {
+		case subscriber <- summary:
+		default:
+		}
+	}
+}
+
+func (feed *photoFeed) subscribe() chan photoSummary {
+	feed.mu.Lock()
+	defer feed.mu.Unlock()
+
+	subscriber := make(chan photoSummary, feedBuffer)
+	feed.subscribers[subscriber] = struct{}{}
+	return subscriber
+}
+
+func (feed *photoFeed) unsubscribe(subscriber chan photoSummary) {
+	feed.mu.Lock()
+	defer feed.mu.Unlock()
+
+	delete(feed.subscribers, subscriber)
+}
+
+// liveFeedHandler streams a photo event for every new photo in the gallery
+// until the client goes away
+func (s *server) liveFeedHandler(response http.ResponseWriter, request *http.Request) {
+	flusher, ok := response.(http.Flusher)
+	if !ok {
+		http.Error(response, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	keepWriting(response)
+	response.Header().Set("Content-Type", "text/event-stream")
+	response.Header().Set("Cache-Control", "no-cache")
+	response.Header().Set("Connection", "keep-alive")
+
+	subscriber := s.feed.subscribe()
+	defer s.feed.unsubscribe(subscriber)
+
+	// Let the client know it is connected before the first photo arrives
+	fmt.Fprint(response, ": connected\n\n")
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(feedKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case summary := <-subscriber:
+			data, _ := json.Marshal(summary)
+			fmt.Fprintf(response, "id: %s\nevent: photo\ndata: %s\n\n", summary.ID, data)
+		case <-keepAlive.C:
+			fmt.Fprint(response, ": keep-alive\n\n")
+		case <-request.Context().Done():
+			return
+		case <-s.shutdown.Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
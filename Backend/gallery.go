@@ -0,0 +1,342 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Gallery pages are newest first and limited to pageLimit photos unless the
+// client asks for fewer, or more up to maxPageLimit
+const (
+	pageLimit    = 50
+	maxPageLimit = 200
+)
+
+// photoSummary is how a photo is listed in the gallery
+type photoSummary struct {
+	ID           string     `json:"id"`
+	Kind         string     `json:"kind"`
+	URL          string     `json:"url"`
+	ThumbnailURL string     `json:"thumbnailUrl,omitempty"`
+	Uploader     string     `json:"uploader,omitempty"`
+	Caption      string     `json:"caption,omitempty"`
+	Event        string     `json:"event,omitempty"`
+	Album        string     `json:"album,omitempty"`
+	Group        string     `json:"group,omitempty"`
+	TakenAt      *time.Time `json:"takenAt,omitempty"`
+	UploadedAt   time.Time  `json:"uploadedAt"`
+	Likes        int        `json:"likes"`
+}
+
+// photoPage is a page of the gallery. NextCursor is passed back as cursor to
+// get the next page, and is left out on the last page.
+type photoPage struct {
+	Photos     []photoSummary `json:"photos"`
+	NextCursor string         `json:"nextCursor,omitempty"`
+}
+
+// summarizePhoto returns how photo is listed
+func summarizePhoto(photo *Photo) photoSummary {
+	summary := photoSummary{
+		ID:         photo.ID,
+		Kind:       photo.Kind,
+		URL:        "/photos/" + photo.ID,
+		Uploader:   photo.Uploader,
+		Caption:    photo.Caption,
+		Event:      photo.Event,
+		Album:      photo.Album,
+		Group:      photo.Group,
+		TakenAt:    photo.TakenAt,
+		UploadedAt: photo.UploadedAt,
+	}
+	if _, ok := photo.Variants["medium"]; ok {
+		summary.ThumbnailURL = "/photos/" + photo.ID + "/thumb/medium"
+	}
+	return summary
+}
+
+// sortShuffle lists photos in a random order. The order comes from a seed,
+// which is kept in the cursor so every page follows the same order.
+const sortShuffle = "shuffle"
+
+// encodeCursor returns the cursor for the page after photo
+func encodeCursor(query photoQuery, photo *Photo) string {
+	value := query.sortTime(photo).UTC().Format(time.RFC3339Nano) + " " + photo.ID
+	return base64.RawURLEncoding.EncodeToString([]byte(value))
+}
+
+// decodeCursor reads a cursor made by encodeCursor
+func decodeCursor(cursor string) (*photoCursor, bool) {
+	value, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, false
+	}
+	last, id, ok := strings.Cut(string(value), " ")
+	if !ok {
+		return nil, false
+	}
+	lastTime, err := time.Parse(time.RFC3339Nano, last)
+	if err != nil {
+		return nil, false
+	}
+	return &photoCursor{Time: lastTime, ID: id}, true
+}
+
+// encodeShuffleCursor returns the cursor for the shuffled page starting at
+// offset
+func encodeShuffleCursor(seed string, offset int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(sortShuffle + " " + seed + " " + strconv.Itoa(offset)))
+}
+
+// decodeShuffleCursor reads a cursor made by encodeShuffleCursor
+func decodeShuffleCursor(cursor string) (seed string, offset int, ok bool) {
+	value, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", 0, false
+	}
+	fields := strings.Fields(string(value))
+	if len(fields) != 3 || fields[0] != sortShuffle {
+		return "", 0, false
+	}
+	offset, err = strconv.Atoi(fields[2])
+	if err != nil || offset < 0 {
+		return "", 0, false
+	}
+	return fields[1], offset, true
+}
+
+// shufflePhotos puts photos in the random order given by seed
+func shufflePhotos(photos []*Photo, seed string) {
+	rank := func(photo *Photo) string {
+		sum := sha256.Sum256([]byte(seed + " " + photo.ID))
+		return string(sum[:])
+	}
+	slices.SortFunc(photos, func(a, b *Photo) int {
+		return strings.Compare(rank(a), rank(b))
+	})
+}
+
+// listedStatuses are the processing states the gallery can be filtered by.
+// Photos that failed or are held for review are never shown to guests.
+var listedStatuses = []string{photoReady, photoProcessing}
+
+// errAlbumLocked is returned for a private album asked for without a token
+// unlocking it
+var errAlbumLocked = errors.New("this album is private, unlock it with its passphrase")
+
+// writeQueryError answers a request whose filters galleryQuery turned away
+func writeQueryError(response http.ResponseWriter, err error) {
+	status := http.StatusBadRequest
+	if errors.Is(err, errAlbumLocked) {
+		status = http.StatusUnauthorized
+	}
+	writeJSONError(response, status, err.Error())
+}
+
+// galleryQuery reads the filters of a gallery request: ?q= to search for,
+// ?uploader=, ?event=, ?album=, ?status=, and ?from= and ?to= as dates like
+// 2026-06-20 or RFC 3339 times. A to date includes the whole of that day. Only processed
+// photos are included unless another status is asked for, and private albums
+// only with a token unlocking them.
+func (s *server) galleryQuery(request *http.Request) (photoQuery, error) {
+	values := request.URL.Query()
+	query := photoQuery{Status: photoReady, Uploader: strings.TrimSpace(values.Get("uploader"))}
+
+	query.Text = strings.TrimSpace(values.Get("q"))
+	if len(query.Text) > maxSearchLength {
+		return query, fmt.Errorf("q can be at most %d characters", maxSearchLength)
+	}
+	if status := values.Get("status"); status != "" {
+		if !slices.Contains(listedStatuses, status) {
+			return query, fmt.Errorf("status must be one of %s", strings.Join(listedStatuses, ", "))
+		}
+		query.Status = status
+	}
+	if event := values.Get("event"); event != "" {
+		found, ok := findEvent(event)
+		if !ok {
+			return query, errors.New("unknown event")
+		}
+		query.Event = found
+	}
+	if album := values.Get("album"); album != "" {
+		if _, ok := s.albums.Get(album); !ok {
+			return query, errors.New("unknown album")
+		}
+		if !s.canSeeAlbum(request, album) {
+			return query, errAlbumLocked
+		}
+		query.Album = album
+	}
+	query.HiddenAlbums = s.hiddenAlbums(request)
+
+	var err error
+	if query.From, err = parseDateParam(values.Get("from"), false); err != nil {
+		return query, errors.New("from must be a date like 2006-01-02 or an RFC 3339 time")
+	}
+	if query.To, err = parseDateParam(values.Get("to"), true); err != nil {
+		return query, errors.New("to must be a date like 2006-01-02 or an RFC 3339 time")
+	}
+	if !query.From.IsZero() && !query.To.IsZero() && !query.From.Before(query.To) {
+		return query, errors.New("from must be before to")
+	}
+	return query, nil
+}
+
+// parseDateParam parses a date or time from a query string. Dates are the
+// start of the day in UTC, or the start of the next day for endOfDay, so a
+// range ending on a date includes it.
+func parseDateParam(value string, endOfDay bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if date, err := time.Parse(time.DateOnly, value); err == nil {
+		if endOfDay {
+			date = date.AddDate(0, 0, 1)
+		}
+		return date, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// listPhotosHandler lists the photos in the gallery a page at a time,
+// filtered as galleryQuery describes. ?sort= is uploaded for the newest
+// uploads first, taken for the order they were taken in, or shuffle.
+func (s *server) listPhotosHandler(response http.ResponseWriter, request *http.Request) {
+	query, err := s.galleryQuery(request)
+	if err != nil {
+		writeQueryError(response, err)
+		return
+	}
+	query.Limit = pageLimit
+	switch sort := request.URL.Query().Get("sort"); sort {
+	case "", sortUploaded, sortTaken:
+		query.Sort = sort
+	case sortShuffle:
+	default:
+		writeJSONError(response, http.StatusBadRequest, "sort must be uploaded, taken or shuffle")
+		return
+	}
+
+	if limit := request.URL.Query().Get("limit"); limit != "" {
+		parsed, err := strconv.Atoi(limit)
+		if err != nil || parsed < 1 || parsed > maxPageLimit {
+			writeJSONError(response, http.StatusBadRequest, "limit must be a number from 1 to "+strconv.Itoa(maxPageLimit))
+			return
+		}
+		query.Limit = parsed
+	}
+	if request.URL.Query().Get("sort") == sortShuffle {
+		s.listShuffled(response, request, query)
+		return
+	}
+	if cursor := request.URL.Query().Get("cursor"); cursor != "" {
+		after, ok := decodeCursor(cursor)
+		if !ok {
+			writeJSONError(response, http.StatusBadRequest, "invalid cursor")
+			return
+		}
+		query.After = after
+	}
+
+	// Ask for one more than fits on the page to find out if there is a next
+	// page
+	limit := query.Limit
+	query.Limit++
+	photos, err := s.photos.List(query)
+	if err != nil {
+		writeJSONError(response, http.StatusInternalServerError, "Unable to list photos")
+		return
+	}
+
+	var page photoPage
+	if len(photos) > limit {
+		photos = photos[:limit]
+		page.NextCursor = encodeCursor(query, photos[limit-1])
+	}
+	page.Photos = s.summarizePhotos(photos)
+	writeJSON(response, http.StatusOK, page)
+}
+
+// listShuffled lists a page of the photos matching query in a random order.
+// The whole gallery is shuffled each time, which is fine for the few
+// thousand photos of a wedding.
+func (s *server) listShuffled(response http.ResponseWriter, request *http.Request, query photoQuery) {
+	seed, offset := request.URL.Query().Get("seed"), 0
+	if cursor := request.URL.Query().Get("cursor"); cursor != "" {
+		var ok bool
+		if seed, offset, ok = decodeShuffleCursor(cursor); !ok {
+			writeJSONError(response, http.StatusBadRequest, "invalid cursor")
+			return
+		}
+	}
+	if strings.ContainsFunc(seed, unicode.IsSpace) || len(seed) > 64 {
+		writeJSONError(response, http.StatusBadRequest, "seed must be up to 64 characters with no spaces")
+		return
+	}
+	if seed == "" {
+		seed = randomHex(8)
+	}
+
+	limit := query.Limit
+	query.Limit = 0
+	photos, err := s.photos.List(query)
+	if err != nil {
+		writeJSONError(response, http.StatusInternalServerError, "Unable to list photos")
+		return
+	}
+	shufflePhotos(photos, seed)
+
+	var page photoPage
+	photos = photos[min(offset, len(photos)):]
+	if len(photos) > limit {
+		photos = photos[:limit]
+		page.NextCursor = encodeShuffleCursor(seed, offset+limit)
+	}
+	page.Photos = s.summarizePhotos(photos)
+	writeJSON(response, http.StatusOK, page)
+}
+
+// photoMeta is the part of a photo's EXIF details that is safe to show
+// guests. Where it was taken is never included.
+type photoMeta struct {
+	ID              string     `json:"id"`
+	Kind            string     `json:"kind"`
+	TakenAt         *time.Time `json:"takenAt,omitempty"`
+	CameraMake      string     `json:"cameraMake,omitempty"`
+	CameraModel     string     `json:"cameraModel,omitempty"`
+	Width           int        `json:"width,omitempty"`
+	Height          int        `json:"height,omitempty"`
+	DurationSeconds float64    `json:"durationSeconds,omitempty"`
+}
+
+// photoMetaHandler returns when and on what a photo was taken and its size,
+// for the details shown under it in the gallery
+func (s *server) photoMetaHandler(response http.ResponseWriter, request *http.Request) {
+	photo, ok := s.servedPhoto(request)
+	if !ok {
+		writeJSONError(response, http.StatusNotFound, "Photo not found")
+		return
+	}
+	meta := photoMeta{
+		ID:          photo.ID,
+		Kind:        photo.Kind,
+		TakenAt:     photo.TakenAt,
+		CameraMake:  photo.CameraMake,
+		CameraModel: photo.CameraModel,
+		Width:       photo.Width,
+		Height:      photo.Height,
+	}
+	if photo.Video != nil {
+		meta.DurationSeconds = photo.Video.DurationSeconds
+	}
+	writeJSON(response, http.StatusOK, meta)
+}
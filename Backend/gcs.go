@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// gcsChunkSize is how much of a file is sent to GCS per request. Writes are
+// resumable, so a dropped connection part way through a large video only
+// resends the chunk it was on.
+const gcsChunkSize = 8 << 20
+
+// gcsStorage keeps files in a Google Cloud Storage bucket, under an optional
+// object prefix. Credentials come from Application Default Credentials, so
+// GOOGLE_APPLICATION_CREDENTIALS or the VM's service account.
+type gcsStorage struct {
+	bucket *storage.BucketHandle
+	prefix string
+}
+
+// newGCSStorage connects to the bucket set up in the config
+func newGCSStorage(ctx context.Context) (*gcsStorage, error) {
+	if *gcsBucket == "" {
+		return nil, errors.New("GCS_BUCKET must be set to use GCS storage")
+	}
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("creating GCS client: %w", err)
+	}
+
+	prefix := strings.Trim(*gcsPrefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return &gcsStorage{bucket: client.Bucket(*gcsBucket), prefix: prefix}, nil
+}
+
+// object returns the handle for the object name is stored as
+func (store *gcsStorage) object(name string) (*storage.ObjectHandle, error) {
+	cleaned, err := cleanStorageName(name)
+	if err != nil {
+		return nil, err
+	}
+	return store.bucket.Object(store.prefix + cleaned), nil
+}
+
+// gcsError turns GCS's not found error into fs.ErrNotExist
+func gcsError(name string, err error) error {
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+	}
+	return err
+}
+
+func (store *gcsStorage) Put(ctx context.Context, name string, content io.Reader) error {
+	object, err := store.object(name)
+	if err != nil {
+		return err
+	}
+
+	// Cancelling the context is the only way to abandon a GCS write, so a
+	// failed copy doesn't leave half a file behind
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	writer := object.NewWriter(ctx)
+	writer.ChunkSize = gcsChunkSize
+	writer.ContentType = storageContentType(name)
+	if _, err := io.Copy(writer, content); err != nil {
+		cancel()
+		writer.Close()
+		return err
+	}
+	return writer.Close()
+}
+
+func (store *gcsStorage) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	object, err := store.object(name)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := object.NewReader(ctx)
+	if err != nil {
+		return nil, gcsError(name, err)
+	}
+	return reader, nil
+}
+
+func (store *gcsStorage) GetRange(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	object, err := store.object(name)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := object.NewRangeReader(ctx, offset, length)
+	if err != nil {
+		return nil, gcsError(name, err)
+	}
+	return reader, nil
+}
+
+func (store *gcsStorage) Stat(ctx context.Context, name string) (ObjectInfo, error) {
+	object, err := store.object(name)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	attrs, err := object.Attrs(ctx)
+	if err != nil {
+		return ObjectInfo{}, gcsError(name, err)
+	}
+	return ObjectInfo{Name: name, Size: attrs.Size, ModTime: attrs.Updated}, nil
+}
+
+func (store *gcsStorage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	it := store.bucket.Objects(ctx, &storage.Query{Prefix: store.prefix + prefix})
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			return objects, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, ObjectInfo{
+			Name:    strings.TrimPrefix(attrs.Name, store.prefix),
+			Size:    attrs.Size,
+			ModTime: attrs.Updated,
+		})
+	}
+}
+
+func (store *gcsStorage) Delete(ctx context.Context, name string) error {
+	object, err := store.object(name)
+	if err != nil {
+		return err
+	}
+	if err := object.Delete(ctx); err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+		return err
+	}
+	return nil
+}
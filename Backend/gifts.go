@@ -0,0 +1,347 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Limits on what a gift's record can hold
+const (
+	maxGiftText  = 300
+	maxGiftNotes = 2000
+)
+
+// Where a gift's thank-you note is
+const (
+	// giftReceived gifts haven't been thanked for yet
+	giftReceived = "received"
+	// giftNoted gifts have a thank-you note written, waiting to be sent
+	giftNoted = "noted"
+	// giftSent gifts have had their thank-you note sent
+	giftSent = "sent"
+)
+
+// Gift is a gift the couple received, and where its thank-you note is
+type Gift struct {
+	ID string `json:"id"`
+	// HouseholdID is the household on the guest list it came from, if
+	// it came from guests, and From who to thank, which defaults to the
+	// household's name
+	HouseholdID string `json:"householdId,omitempty"`
+	From        string `json:"from"`
+	Description string `json:"description"`
+	// AmountCents is how much a gift of money was, in cents
+	AmountCents int64  `json:"amountCents,omitempty"`
+	Notes       string `json:"notes,omitempty"`
+	Status      string `json:"status"`
+	// ReceivedAt is when the gift came, NotedAt when its thank-you was
+	// written, and SentAt when it was sent
+	ReceivedAt time.Time  `json:"receivedAt"`
+	NotedAt    *time.Time `json:"notedAt,omitempty"`
+	SentAt     *time.Time `json:"sentAt,omitempty"`
+}
+
+// giftStore keeps the gifts, in the order they were recorded
+type giftStore struct {
+	mu    sync.Mutex
+	path  string
+	gifts []*Gift
+}
+
+// openGiftStore loads the gifts saved at path, starting with none if it
+// doesn't exist
+func openGiftStore(path string) (*giftStore, error) {
+	store := &giftStore{path: path}
+
+	if err := loadJSONFile(path, &store.gifts); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// All returns a copy of every gift
+func (store *giftStore) All() []Gift {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	gifts := make([]Gift, 0, len(store.gifts))
+	for _, gift := range store.gifts {
+		gifts = append(gifts, *gift)
+	}
+	return gifts
+}
+
+// Create records a gift
+func (store *giftStore) Create(gift Gift) (Gift, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	gift.ID = newUUID()
+	store.gifts = append(store.gifts, &gift)
+	if err := store.save(); err != nil {
+		store.gifts = store.gifts[:len(store.gifts)-1]
+		return Gift{}, err
+	}
+	return gift, nil
+}
+
+// Update changes the gift with the given ID, reporting whether there is one
+func (store *giftStore) Update(id string, change func(*Gift)) (Gift, bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for _, gift := range store.gifts {
+		if gift.ID != id {
+			continue
+		}
+		previous := *gift
+		change(gift)
+		gift.ID = previous.ID
+		if err := store.save(); err != nil {
+			*gift = previous
+			return Gift{}, true, err
+		}
+		return *gift, true, nil
+	}
+	return Gift{}, false, nil
+}
+
+// Delete removes the gift with the given ID, reporting whether there was one
+func (store *giftStore) Delete(id string) (bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for i, gift := range store.gifts {
+		if gift.ID != id {
+			continue
+		}
+		previous := store.gifts
+		store.gifts = slices.Concat(previous[:i], previous[i+1:])
+		if err := store.save(); err != nil {
+			store.gifts = previous
+			return true, err
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// save writes the gifts to disk. The caller must hold store.mu.
+func (store *giftStore) save() error {
+	return saveJSONFile(store.path, store.gifts)
+}
+
+// giftRequest is the body of a request to record or change a gift. Fields
+// left out of a change are kept as they are.
+type giftRequest struct {
+	HouseholdID *string    `json:"householdId"`
+	From        *string    `json:"from"`
+	Description *string    `json:"description"`
+	AmountCents *int64     `json:"amountCents"`
+	Notes       *string    `json:"notes"`
+	Status      *string    `json:"status"`
+	ReceivedAt  *time.Time `json:"receivedAt"`
+}
+
+// validate checks the fields that were given, tidying them up. A household
+// has to be on the guest list.
+func (body *giftRequest) validate(guests *guestStore) error {
+	text := func(field **string, name string, limit int) error {
+		if *field == nil {
+			return nil
+		}
+		trimmed := strings.TrimSpace(**field)
+		if utf8.RuneCountInString(trimmed) > limit {
+			return fmt.Errorf("%s can be at most %d characters", name, limit)
+		}
+		*field = &trimmed
+		return nil
+	}
+	for _, err := range []error{
+		text(&body.HouseholdID, "householdId", maxGiftText),
+		text(&body.From, "from", maxGiftText),
+		text(&body.Description, "description", maxGiftText),
+		text(&body.Notes, "notes", maxGiftNotes),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	if body.HouseholdID != nil && *body.HouseholdID != "" {
+		if _, ok := guests.Get(*body.HouseholdID); !ok {
+			return errors.New("householdId must be a household on the guest list")
+		}
+	}
+	if body.AmountCents != nil && *body.AmountCents < 0 {
+		return errors.New("amountCents can't be negative")
+	}
+	if body.Status != nil {
+		switch *body.Status {
+		case giftReceived, giftNoted, giftSent:
+		default:
+			return errors.New("status must be received, noted or sent")
+		}
+	}
+	return nil
+}
+
+// apply makes the changes in the request to gift. Moving it along to noted
+// or sent records when, and moving it back clears the times it is past.
+func (body *giftRequest) apply(gift *Gift, household *Household, now time.Time) {
+	if body.HouseholdID != nil {
+		gift.HouseholdID = *body.HouseholdID
+	}
+	if body.From != nil {
+		gift.From = *body.From
+	}
+	if gift.From == "" && household != nil {
+		gift.From = household.Name
+	}
+	if body.Description != nil {
+		gift.Description = *body.Description
+	}
+	if body.AmountCents != nil {
+		gift.AmountCents = *body.AmountCents
+	}
+	if body.Notes != nil {
+		gift.Notes = *body.Notes
+	}
+	if body.ReceivedAt != nil {
+		gift.ReceivedAt = body.ReceivedAt.UTC()
+	}
+	if body.Status != nil && *body.Status != gift.Status {
+		gift.Status = *body.Status
+		switch gift.Status {
+		case giftReceived:
+			gift.NotedAt, gift.SentAt = nil, nil
+		case giftNoted:
+			gift.NotedAt, gift.SentAt = &now, nil
+		case giftSent:
+			if gift.NotedAt == nil {
+				gift.NotedAt = &now
+			}
+			gift.SentAt = &now
+		}
+	}
+}
+
+// giftList is the gifts for the couple, with how many are at each step of
+// their thank-you notes
+type giftList struct {
+	Gifts  []Gift         `json:"gifts"`
+	Counts map[string]int `json:"counts"`
+}
+
+// listGiftsHandler lists the gifts, the oldest first, or with ?status= only
+// those at one step of their thank-you notes, such as "received" for the
+// ones still to write
+func (s *server) listGiftsHandler(response http.ResponseWriter, request *http.Request) {
+	status := request.URL.Query().Get("status")
+	switch status {
+	case "", giftReceived, giftNoted, giftSent:
+	default:
+		writeJSONError(response, http.StatusBadRequest, "status must be received, noted or sent")
+		return
+	}
+
+	list := giftList{Gifts: []Gift{}, Counts: map[string]int{giftReceived: 0, giftNoted: 0, giftSent: 0}}
+	gifts := s.gifts.All()
+	slices.SortStableFunc(gifts, func(a, b Gift) int {
+		return a.ReceivedAt.Compare(b.ReceivedAt)
+	})
+	for _, gift := range gifts {
+		list.Counts[gift.Status]++
+		if status == "" || gift.Status == status {
+			list.Gifts = append(list.Gifts, gift)
+		}
+	}
+	writeJSON(response, http.StatusOK, list)
+}
+
+// giftHousehold returns the household a gift request links to, if it does
+func (s *server) giftHousehold(body giftRequest) *Household {
+	if body.HouseholdID == nil || *body.HouseholdID == "" {
+		return nil
+	}
+	household, _ := s.guests.Get(*body.HouseholdID)
+	return household
+}
+
+// createGiftHandler records a gift the couple received
+func (s *server) createGiftHandler(response http.ResponseWriter, request *http.Request) {
+	var body giftRequest
+	if !decodeJSON(response, request, &body) {
+		return
+	}
+	if err := body.validate(s.guests); err != nil {
+		writeJSONError(response, http.StatusBadRequest, err.Error())
+		return
+	}
+	if body.Description == nil || *body.Description == "" {
+		writeJSONError(response, http.StatusBadRequest, "description is required")
+		return
+	}
+
+	now := time.Now().UTC()
+	gift := Gift{Status: giftReceived, ReceivedAt: now}
+	body.apply(&gift, s.giftHousehold(body), now)
+	if gift.From == "" {
+		writeJSONError(response, http.StatusBadRequest, "from or householdId is required")
+		return
+	}
+	added, err := s.gifts.Create(gift)
+	if err != nil {
+		slog.Error("Unable to save gifts", "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to record gift")
+		return
+	}
+	writeJSON(response, http.StatusCreated, added)
+}
+
+// updateGiftHandler changes a gift, such as to mark its thank-you note sent
+func (s *server) updateGiftHandler(response http.ResponseWriter, request *http.Request) {
+	var body giftRequest
+	if !decodeJSON(response, request, &body) {
+		return
+	}
+	if err := body.validate(s.guests); err != nil {
+		writeJSONError(response, http.StatusBadRequest, err.Error())
+		return
+	}
+	household := s.giftHousehold(body)
+	gift, ok, err := s.gifts.Update(request.PathValue("id"), func(gift *Gift) {
+		body.apply(gift, household, time.Now().UTC())
+	})
+	if !ok {
+		writeJSONError(response, http.StatusNotFound, "Gift not found")
+		return
+	}
+	if err != nil {
+		slog.Error("Unable to save gifts", "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to update gift")
+		return
+	}
+	writeJSON(response, http.StatusOK, gift)
+}
+
+// deleteGiftHandler removes a gift recorded by mistake
+func (s *server) deleteGiftHandler(response http.ResponseWriter, request *http.Request) {
+	ok, err := s.gifts.Delete(request.PathValue("id"))
+	if !ok {
+		writeJSONError(response, http.StatusNotFound, "Gift not found")
+		return
+	}
+	if err != nil {
+		slog.Error("Unable to save gifts", "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to delete gift")
+		return
+	}
+	response.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// maxGuestbookMessage is the longest message a guest can leave
+const maxGuestbookMessage = 2000
+
+// Statuses of a guestbook message
+const (
+	// guestbookPublished messages are shown in the guestbook
+	guestbookPublished = "published"
+	// guestbookNeedsReview messages were caught by the comment filter, or are
+	// waiting for the couple when every message is reviewed, and aren't
+	// shown until they are published
+	guestbookNeedsReview = "needs_review"
+	// guestbookHidden messages were taken down by the couple
+	guestbookHidden = "hidden"
+)
+
+// GuestbookEntry is a message a guest left for the couple in the guestbook,
+// with one of their photos if they want
+type GuestbookEntry struct {
+	ID           string    `json:"id"`
+	Author       string    `json:"author"`
+	Message      string    `json:"message"`
+	PhotoID      string    `json:"photoId,omitempty"`
+	Status       string    `json:"status"`
+	ReviewReason string    `json:"reviewReason,omitempty"`
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+// guestbookStore keeps the guestbook, oldest message first
+type guestbookStore struct {
+	mu      sync.Mutex
+	path    string
+	entries []*GuestbookEntry
+}
+
+// openGuestbookStore loads the guestbook saved at path, starting empty if it
+// doesn't exist
+func openGuestbookStore(path string) (*guestbookStore, error) {
+	store := &guestbookStore{path: path}
+
+	if err := loadJSONFile(path, &store.entries); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// List returns a copy of up to limit messages with one of the statuses,
+// newest first, starting after the message a cursor points at
+func (store *guestbookStore) List(statuses []string, after *photoCursor, limit int) []GuestbookEntry {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var entries []GuestbookEntry
+	for i := len(store.entries) - 1; i >= 0 && len(entries) < limit; i-- {
+		entry := store.entries[i]
+		if !slices.Contains(statuses, entry.Status) {
+			continue
+		}
+		if after != nil && !entry.CreatedAt.Before(after.Time) && (!entry.CreatedAt.Equal(after.Time) || entry.ID >= after.ID) {
+			continue
+		}
+		entries = append(entries, *entry)
+	}
+	return entries
+}
+
+// Add adds a message to the guestbook
+func (store *guestbookStore) Add(entry GuestbookEntry) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.entries = append(store.entries, &entry)
+	if err := store.save(); err != nil {
+		store.entries = store.entries[:len(store.entries)-1]
+		return err
+	}
+	return nil
+}
+
+// SetStatus changes the status of the message with the given ID, reporting
+// whether there is one
+func (store *guestbookStore) SetStatus(id, status string) (GuestbookEntry, bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for _, entry := range store.entries {
+		if entry.ID != id {
+			continue
+		}
+		previous := *entry
+		entry.Status = status
+		if status == guestbookPublished {
+			entry.ReviewReason = ""
+		}
+		if err := store.save(); err != nil {
+			*entry = previous
+			return GuestbookEntry{}, true, err
+		}
+		return *entry, true, nil
+	}
+	return GuestbookEntry{}, false, nil
+}
+
+// Delete removes the message with the given ID, reporting whether there was
+// one
+func (store *guestbookStore) Delete(id string) (bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for i, entry := range store.entries {
+		if entry.ID != id {
+			continue
+		}
+		previous := store.entries
+		store.entries = slices.Concat(previous[:i], previous[i+1:])
+		if err := store.save(); err != nil {
+			store.entries = previous
+			return true, err
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// save writes the guestbook to disk. The caller must hold store.mu.
+func (store *guestbookStore) save() error {
+	return saveJSONFile(store.path, store.entries)
+}
+
+// guestbookRequest is the body of a message for the guestbook. Guests who
+// send their guest code are named from the guest list instead.
+type guestbookRequest struct {
+	Author  string `json:"author"`
+	Message string `json:"message"`
+	PhotoID string `json:"photoId"`
+	spamFields
+}
+
+// guestbookMessage is a message as the guestbook lists it, with a summary
+// of its photo
+type guestbookMessage struct {
+	GuestbookEntry
+	Photo *photoSummary `json:"photo,omitempty"`
+}
+
+// guestbookPage is a page of the guestbook. NextCursor is passed back as
+// cursor to get the next page, and is left out on the last page.
+type guestbookPage struct {
+	Messages   []guestbookMessage `json:"messages"`
+	NextCursor string             `json:"nextCursor,omitempty"`
+}
+
+// guestbookHandler lists the published messages in the guestbook, newest
+// first, a page at a time. With the admin token, ?status= lists the
+// messages waiting for review, hidden ones, or all of them.
+func (s *server) guestbookHandler(response http.ResponseWriter, request *http.Request) {
+	query := request.URL.Query()
+	statuses := []string{guestbookPublished}
+	switch status := query.Get("status"); status {
+	case "", guestbookPublished:
+	case guestbookNeedsReview, guestbookHidden, "all":
+		if !s.authorizeAdmin(response, request) {
+			return
+		}
+		statuses = []string{status}
+		if status == "all" {
+			statuses = []string{guestbookPublished, guestbookNeedsReview, guestbookHidden}
+		}
+	default:
+		writeJSONError(response, http.StatusBadRequest, "status must be published, needs_review, hidden or all")
+		return
+	}
+
+	limit := pageLimit
+	if value := query.Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > maxPageLimit {
+			writeJSONError(response, http.StatusBadRequest, "limit must be a number from 1 to "+strconv.Itoa(maxPageLimit))
+			return
+		}
+		limit = parsed
+	}
+	var after *photoCursor
+	if cursor := query.Get("cursor"); cursor != "" {
+		var ok bool
+		if after, ok = decodeCursor(cursor); !ok {
+			writeJSONError(response, http.StatusBadRequest, "invalid cursor")
+			return
+		}
+	}
+
+	// Ask for one more than fits on the page to find out if there is a next
+	// page
+	entries := s.guestbook.List(statuses, after, limit+1)
+	page := guestbookPage{Messages: []guestbookMessage{}}
+	if len(entries) > limit {
+		entries = entries[:limit]
+		last := entries[limit-1]
+		page.NextCursor = base64.RawURLEncoding.EncodeToString([]byte(last.CreatedAt.UTC().Format(time.RFC3339Nano) + " " + last.ID))
+	}
+	for _, entry := range entries {
+		message := guestbookMessage{GuestbookEntry: entry}
+		if entry.PhotoID != "" {
+			if photo, ok := s.photos.Get(entry.PhotoID); ok && photo.Status == photoReady {
+				summary := summarizePhoto(photo)
+				message.Photo = &summary
+			}
+		}
+		page.Messages = append(page.Messages, message)
+	}
+	writeJSON(response, http.StatusOK, page)
+}
+
+// signGuestbookHandler adds a guest's message to the guestbook. It goes
+// through the same filter as comments on photos; messages it catches, and
+// every message when they are all reviewed, wait for the couple before they
+// are shown.
+func (s *server) signGuestbookHandler(response http.ResponseWriter, request *http.Request) {
+	var body guestbookRequest
+	if !decodeJSON(response, request, &body) {
+		return
+	}
+
+	entry := GuestbookEntry{
+		ID:        newUUID(),
+		Author:    strings.TrimSpace(body.Author),
+		Message:   strings.TrimSpace(body.Message),
+		PhotoID:   strings.TrimSpace(body.PhotoID),
+		Status:    guestbookPublished,
+		CreatedAt: time.Now().UTC(),
+	}
+	if code := guestCode(request); code != "" {
+		household, ok, wait := s.lookupCode(request, code)
+		if wait > 0 {
+			writeLockedOut(response, wait)
+			return
+		}
+		if !ok {
+			writeJSONError(response, http.StatusUnauthorized, "unknown guest code")
+			return
+		}
+		entry.Author = household.Name
+	}
+	if entry.Author == "" || utf8.RuneCountInString(entry.Author) > maxAuthorLength {
+		writeJSONError(response, http.StatusBadRequest, fmt.Sprintf("author must be 1 to %d characters", maxAuthorLength))
+		return
+	}
+	if entry.Message == "" || utf8.RuneCountInString(entry.Message) > maxGuestbookMessage {
+		writeJSONError(response, http.StatusBadRequest, fmt.Sprintf("message must be 1 to %d characters", maxGuestbookMessage))
+		return
+	}
+	if entry.PhotoID != "" {
+		if photo, ok := s.photos.Get(entry.PhotoID); !ok || photo.Status != photoReady {
+			writeJSONError(response, http.StatusBadRequest, "photoId must be a photo in the gallery")
+			return
+		}
+	}
+
+	verdict := s.spam.check(request, "guestbook", body.spamFields, entry.Author, entry.Message)
+	if verdict.Kind == spamBot {
+		// Bots are told their message was saved, so they don't look for
+		// another way in
+		slog.Warn("Dropped guestbook message", "ip", clientIP(request), "reason", verdict.Reason)
+		writeJSON(response, http.StatusCreated, entry)
+		return
+	}
+
+	if *guestbookReview {
+		entry.Status, entry.ReviewReason = guestbookNeedsReview, "every message is reviewed"
+	}
+	if verdict.Kind == spamSuspect {
+		entry.Status, entry.ReviewReason = guestbookNeedsReview, verdict.Reason
+	}
+	if s.comments != nil {
+		reason, err := s.comments.Check(request.Context(), Comment{Author: entry.Author, Body: entry.Message})
+		if err != nil {
+			slog.Error("Unable to check guestbook message", "err", err)
+			writeJSONError(response, http.StatusServiceUnavailable, "Unable to check message, please try again")
+			return
+		}
+		if reason != "" {
+			entry.Status, entry.ReviewReason = guestbookNeedsReview, reason
+		}
+	}
+
+	if err := s.guestbook.Add(entry); err != nil {
+		slog.Error("Unable to save guestbook", "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to save message")
+		return
+	}
+	writeJSON(response, http.StatusCreated, entry)
+}
+
+// guestbookStatusRequest is the body of a request to publish or hide a
+// guestbook message
+type guestbookStatusRequest struct {
+	Status string `json:"status"`
+}
+
+// moderateGuestbookHandler publishes a guestbook message held for review,
+// or hides one
+func (s *server) moderateGuestbookHandler(response http.ResponseWriter, request *http.Request) {
+	var body guestbookStatusRequest
+	if !decodeJSON(response, request, &body) {
+		return
+	}
+	if body.Status != guestbookPublished && body.Status != guestbookHidden {
+		writeJSONError(response, http.StatusBadRequest, "status must be published or hidden")
+		return
+	}
+	entry, ok, err := s.guestbook.SetStatus(request.PathValue("id"), body.Status)
+	if !ok {
+		writeJSONError(response, http.StatusNotFound, "Message not found")
+		return
+	}
+	if err != nil {
+		slog.Error("Unable to save guestbook", "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to update message")
+		return
+	}
+	writeJSON(response, http.StatusOK, entry)
+}
+
+// deleteGuestbookHandler removes a message from the guestbook
+func (s *server) deleteGuestbookHandler(response http.ResponseWriter, request *http.Request) {
+	ok, err := s.guestbook.Delete(request.PathValue("id"))
+	if !ok {
+		writeJSONError(response, http.StatusNotFound, "Message not found")
+		return
+	}
+	if err != nil {
+		slog.Error("Unable to save guestbook", "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to delete message")
+		return
+	}
+	response.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Household is one invitation: the guests invited together, such as a
+// couple or a family, and the short code printed on it that lets them RSVP
+// and share photos
+type Household struct {
+	// ID is made from the name when the household is added, and stays the
+	// same if it is renamed or given a new code
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Code string `json:"code"`
+	// PartySize is the most people the invitation is for. Without one, it is
+	// for the household's guests and plus-ones, or up to maxPartySize if it
+	// doesn't list its guests.
+	PartySize int `json:"partySize,omitempty"`
+	// PlusOnes is how many people the household can bring who aren't on the
+	// guest list
+	PlusOnes int `json:"plusOnes,omitempty"`
+	// Events are the events the household is invited to, or every event if
+	// there are none
+	Events []string `json:"events,omitempty"`
+	Guests []*Guest `json:"guests,omitempty"`
+}
+
+// Guest is someone invited to the wedding, as part of a household
+type Guest struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Email string `json:"email,omitempty"`
+	// Events are the events the guest is invited to, such as only the
+	// wedding party to the rehearsal dinner, or every event the household
+	// is invited to if there are none
+	Events []string `json:"events,omitempty"`
+}
+
+// clone returns a copy of household that can be changed without affecting
+// the one held by the store
+func (household *Household) clone() *Household {
+	copied := *household
+	copied.Events = slices.Clone(household.Events)
+	copied.Guests = make([]*Guest, len(household.Guests))
+	for i, guest := range household.Guests {
+		guestCopy := *guest
+		guestCopy.Events = slices.Clone(guest.Events)
+		copied.Guests[i] = &guestCopy
+	}
+	return &copied
+}
+
+// invitedEvents returns the configured events the household is invited to
+func (household *Household) invitedEvents() []string {
+	if len(household.Events) == 0 {
+		return events()
+	}
+	var invited []string
+	for _, event := range events() {
+		if slices.Contains(household.Events, event) {
+			invited = append(invited, event)
+		}
+	}
+	return invited
+}
+
+// guestEvents returns the configured events one of the household's guests
+// is invited to
+func (household *Household) guestEvents(guest *Guest) []string {
+	invited := household.invitedEvents()
+	if len(guest.Events) == 0 {
+		return invited
+	}
+	return slices.DeleteFunc(invited, func(event string) bool {
+		return !slices.Contains(guest.Events, event)
+	})
+}
+
+// guest returns the guest in the household with the given ID
+func (household *Household) guest(id string) *Guest {
+	for _, guest := range household.Guests {
+		if guest.ID == id {
+			return guest
+		}
+	}
+	return nil
+}
+
+// errCodeTaken is returned when a household is given another's guest code
+var errCodeTaken = errors.New("that code is already used by another household")
+
+// guestStore is the guest list, kept in a JSON file of households in the
+// order they were added
+type guestStore struct {
+	mu         sync.Mutex
+	path       string
+	households []*Household
+}
+
+// openGuestStore loads the guest list at path, starting empty if it doesn't
+// exist. Lists written before households had IDs are given them from their
+// codes.
+func openGuestStore(path string) (*guestStore, error) {
+	store := &guestStore{path: path}
+
+	var households []*Household
+	if err := loadJSONFile(path, &households); err != nil {
+		return nil, err
+	}
+	for _, household := range households {
+		household.Code = normalizeGuestCode(household.Code)
+		if household.Code == "" {
+			continue
+		}
+		if household.ID == "" {
+			household.ID = strings.ToLower(household.Code)
+		}
+		store.households = append(store.households, household)
+	}
+	return store, nil
+}
+
+// normalizeGuestCode makes codes match however the guest typed them
+func normalizeGuestCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// Lookup returns a copy of the household with the given code
+func (store *guestStore) Lookup(code string) (*Household, bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	code = normalizeGuestCode(code)
+	for _, household := range store.households {
+		if household.Code == code {
+			return household.clone(), true
+		}
+	}
+	return nil, false
+}
+
+// FindByName returns a copy of the household with the given name, or with a
+// guest of that name, ignoring case and spacing, if exactly one has it
+func (store *guestStore) FindByName(name string) (*Household, bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	name = strings.Join(strings.Fields(name), " ")
+	named := func(other string) bool {
+		return strings.EqualFold(strings.Join(strings.Fields(other), " "), name)
+	}
+	var found *Household
+	for _, household := range store.households {
+		matches := named(household.Name)
+		for _, guest := range household.Guests {
+			matches = matches || named(guest.Name)
+		}
+		if !matches {
+			continue
+		}
+		if found != nil {
+			return nil, false
+		}
+		found = household
+	}
+	if found == nil {
+		return nil, false
+	}
+	return found.clone(), true
+}
+
+// All returns a copy of every household
+func (store *guestStore) All() []*Household {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	households := make([]*Household, 0, len(store.households))
+	for _, household := range store.households {
+		households = append(households, household.clone())
+	}
+	return households
+}
+
+// Get returns a copy of the household with the given ID
+func (store *guestStore) Get(id string) (*Household, bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if household := store.find(id); household != nil {
+		return household.clone(), true
+	}
+	return nil, false
+}
+
+// find returns the household with the given ID. The caller must hold
+// store.mu.
+func (store *guestStore) find(id string) *Household {
+	for _, household := range store.households {
+		if household.ID == id {
+			return household
+		}
+	}
+	return nil
+}
+
+// codeTaken reports whether a household other than the one with the given
+// ID has code. The caller must hold store.mu.
+func (store *guestStore) codeTaken(code, id string) bool {
+	for _, household := range store.households {
+		if household.Code == code && household.ID != id {
+			return true
+		}
+	}
+	return false
+}
+
+// Create adds a household, giving it an ID and, if it has none, a code
+func (store *guestStore) Create(household *Household) (*Household, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	added := household.clone()
+	base := slug(added.Name, "household")
+	added.ID = base
+	for n := 2; store.find(added.ID) != nil; n++ {
+		added.ID = fmt.Sprintf("%s-%d", base, n)
+	}
+	added.Code = normalizeGuestCode(added.Code)
+	if added.Code == "" {
+		for added.Code == "" || store.codeTaken(added.Code, "") {
+			added.Code = newGuestCode()
+		}
+	} else if store.codeTaken(added.Code, "") {
+		return nil, errCodeTaken
+	}
+
+	store.households = append(store.households, added)
+	if err := store.save(); err != nil {
+		store.households = store.households[:len(store.households)-1]
+		return nil, err
+	}
+	return added.clone(), nil
+}
+
+// Update changes the household with the given ID, reporting whether there is
+// one. Changes that change returns an error for are thrown away.
+func (store *guestStore) Update(id string, change func(*Household) error) (*Household, bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	household := store.find(id)
+	if household == nil {
+		return nil, false, nil
+	}
+	changed := household.clone()
+	if err := change(changed); err != nil {
+		return nil, true, err
+	}
+	changed.ID = household.ID
+	changed.Code = normalizeGuestCode(changed.Code)
+	if changed.Code == "" {
+		changed.Code = household.Code
+	}
+	if store.codeTaken(changed.Code, id) {
+		return nil, true, errCodeTaken
+	}
+
+	previous := *household
+	*household = *changed
+	if err := store.save(); err != nil {
+		*household = previous
+		return nil, true, err
+	}
+	return household.clone(), true, nil
+}
+
+// Delete removes the household with the given ID, reporting whether there
+// was one
+func (store *guestStore) Delete(id string) (bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for i, household := range store.households {
+		if household.ID != id {
+			continue
+		}
+		previous := store.households
+		store.households = slices.Concat(previous[:i], previous[i+1:])
+		if err := store.save(); err != nil {
+			store.households = previous
+			return true, err
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// save writes the guest list to disk. The caller must hold store.mu.
+func (store *guestStore) save() error {
+	return saveJSONFile(store.path, store.households)
+}
+
+// guestCodeLetters are what generated codes are made of, leaving out ones
+// that are easy to mix up on a printed card, like 0 and O
+const guestCodeLetters = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// newGuestCode returns a random six character guest code
+func newGuestCode() string {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	for i := range b {
+		b[i] = guestCodeLetters[int(b[i])%len(guestCodeLetters)]
+	}
+	return string(b)
+}
+
+// guestCode returns the guest code sent with a request as an X-Guest-Code
+// header, if there is one. Upload forms can send it as a "code" field instead.
+func guestCode(request *http.Request) string {
+	return request.Header.Get("X-Guest-Code")
+}
+
+// findHousehold finds an invitation for the client that sent request with
+// find, counting it as a guess at a guest code. If the client has to wait
+// before guessing again, find isn't run and the wait is returned.
+func (s *server) findHousehold(request *http.Request, find func() (*Household, bool)) (*Household, bool, time.Duration) {
+	var household *Household
+	ok, wait := s.guesses.guess(request, guessCodes, func() bool {
+		var found bool
+		household, found = find()
+		return found
+	})
+	return household, ok, wait
+}
+
+// lookupCode finds the invitation with code, counting it as a guess at a
+// guest code by the client that sent request
+func (s *server) lookupCode(request *http.Request, code string) (*Household, bool, time.Duration) {
+	return s.findHousehold(request, func() (*Household, bool) {
+		return s.guests.Lookup(code)
+	})
+}
+
+// authorizeGuest checks the guest code sent with an upload. Unknown codes are
+// always turned away, and missing ones are too when codes are required,
+// unless the upload came through a signed URL. With no code and none
+// required, the returned household is nil.
+func (s *server) authorizeGuest(request *http.Request, code string) (*Household, error) {
+	if strings.TrimSpace(code) == "" {
+		if (*requireGuestCode || s.signer != nil) && !isSignedRequest(request.Context()) {
+			return nil, &uploadError{http.StatusUnauthorized, "Please enter the guest code from your invitation to share photos"}
+		}
+		return nil, nil
+	}
+	household, ok, wait := s.lookupCode(request, code)
+	if wait > 0 {
+		return nil, &uploadError{http.StatusTooManyRequests, lockedOutMessage(wait)}
+	}
+	if !ok {
+		return nil, &uploadError{http.StatusUnauthorized, "That guest code isn't one we know. Please check your invitation and try again"}
+	}
+	return household, nil
+}
@@ -0,0 +1,27 @@
+package main
+
+import "net/http"
+
+// Guests upload the photos and clips the site serves back, so every response
+// carries headers telling browsers not to second-guess its content type, not
+// to let other sites frame it, and what the page may load. An upload that
+// slips through as something other than a photo can't then run as a page on
+// the site's origin.
+
+// securityHeaders adds the security headers to every response
+func securityHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		header := response.Header()
+		header.Set("X-Content-Type-Options", "nosniff")
+		header.Set("X-Frame-Options", "DENY")
+		header.Set("Referrer-Policy", "strict-origin-when-cross-origin")
+		if *contentPolicy != "" {
+			header.Set("Content-Security-Policy", *contentPolicy)
+		}
+		// Browsers only take HSTS over HTTPS, so it is only sent there
+		if request.TLS != nil {
+			header.Set("Strict-Transport-Security", "max-age=31536000")
+		}
+		next.ServeHTTP(response, request)
+	})
+}
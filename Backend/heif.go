@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// HEIC files are ISO base media files (the same box structure as MP4). Their
+// EXIF and XMP metadata live in items listed in the meta box: iinf says what
+// each item is and iloc says where its bytes are in the file.
+
+// heicBrands are the ftyp major brands of HEIC photos from phones
+var heicBrands = map[string]bool{
+	"heic": true,
+	"heix": true,
+	"hevc": true,
+	"hevx": true,
+	"msf1": true,
+}
+
+// isHEIC reports whether the start of a file is a HEIC ftyp box
+func isHEIC(header []byte) bool {
+	return len(header) >= 12 && string(header[4:8]) == "ftyp" && heicBrands[string(header[8:12])]
+}
+
+// isoBox is a box found while walking an ISO base media file
+type isoBox struct {
+	kind string
+	// body is the box content after its header
+	body []byte
+}
+
+// readBoxes splits data into the boxes it contains
+func readBoxes(data []byte) ([]isoBox, error) {
+	var boxes []isoBox
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return nil, errMalformedImage
+		}
+		size := uint64(binary.BigEndian.Uint32(data[:4]))
+		kind := string(data[4:8])
+		headerSize := uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return nil, errMalformedImage
+			}
+			size = binary.BigEndian.Uint64(data[8:16])
+			headerSize = 16
+		}
+		if size < headerSize || size > uint64(len(data)) {
+			return nil, errMalformedImage
+		}
+		boxes = append(boxes, isoBox{kind: kind, body: data[headerSize:size]})
+		data = data[size:]
+	}
+	return boxes, nil
+}
+
+// findBox returns the first box of the given kind
+func findBox(boxes []isoBox, kind string) (isoBox, bool) {
+	for _, box := range boxes {
+		if box.kind == kind {
+			return box, true
+		}
+	}
+	return isoBox{}, false
+}
+
+// fileExtent is a range of bytes in a file
+type fileExtent struct {
+	offset uint64
+	length uint64
+}
+
+// heifMetadata returns where the EXIF and XMP items of a HEIC file are
+func heifMetadata(data []byte) (exif []fileExtent, xmp []fileExtent, err error) {
+	top, err := readBoxes(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	meta, ok := findBox(top, "meta")
+	if !ok || len(meta.body) < 4 {
+		return nil, nil, nil
+	}
+	// meta is a full box, so skip its version and flags
+	children, err := readBoxes(meta.body[4:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	iinf, ok := findBox(children, "iinf")
+	if !ok {
+		return nil, nil, nil
+	}
+	exifItems, xmpItems, err := parseIINF(iinf.body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(exifItems) == 0 && len(xmpItems) == 0 {
+		return nil, nil, nil
+	}
+
+	iloc, ok := findBox(children, "iloc")
+	if !ok {
+		return nil, nil, errMalformedImage
+	}
+	locations, err := parseILOC(iloc.body)
+	if err != nil {
+		return nil, nil, err
+	}
+	for id := range exifItems {
+		exif = append(exif, locations[id]...)
+	}
+	for id := range xmpItems {
+		xmp = append(xmp, locations[id]...)
+	}
+	return exif, xmp, nil
+}
+
+// parseIINF finds the IDs of the EXIF and XMP items in an iinf box
+func parseIINF(body []byte) (exif, xmp map[uint32]bool, err error) {
+	exif, xmp = make(map[uint32]bool), make(map[uint32]bool)
+	if len(body) < 6 {
+		return nil, nil, errMalformedImage
+	}
+	entries := body[6:]
+	if body[0] != 0 {
+		if len(body) < 8 {
+			return nil, nil, errMalformedImage
+		}
+		entries = body[8:]
+	}
+
+	boxes, err := readBoxes(entries)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, box := range boxes {
+		if box.kind != "infe" || len(box.body) < 4 {
+			continue
+		}
+		version := box.body[0]
+		rest := box.body[4:]
+
+		// Only version 2 and 3 entries carry an item type, which is what
+		// HEIC encoders write
+		var id uint32
+		switch version {
+		case 2:
+			if len(rest) < 8 {
+				continue
+			}
+			id = uint32(binary.BigEndian.Uint16(rest))
+			rest = rest[4:]
+		case 3:
+			if len(rest) < 10 {
+				continue
+			}
+			id = binary.BigEndian.Uint32(rest)
+			rest = rest[6:]
+		default:
+			continue
+		}
+
+		itemType := string(rest[:4])
+		switch itemType {
+		case "Exif":
+			exif[id] = true
+		case "mime":
+			// The name is followed by the content type
+			_, after, _ := bytes.Cut(rest[4:], []byte{0})
+			contentType, _, _ := bytes.Cut(after, []byte{0})
+			if string(contentType) == "application/rdf+xml" {
+				xmp[id] = true
+			}
+		}
+	}
+	return exif, xmp, nil
+}
+
+// parseILOC returns the file extents of every item in an iloc box. Items
+// stored anywhere other than directly in the file are skipped.
+func parseILOC(body []byte) (map[uint32][]fileExtent, error) {
+	locations := make(map[uint32][]fileExtent)
+	reader := &byteReader{data: body}
+
+	version := reader.uint(1)
+	reader.skip(3)
+	sizes := reader.uint(1)
+	offsetSize, lengthSize := int(sizes>>4), int(sizes&0x0F)
+	sizes = reader.uint(1)
+	baseOffsetSize, indexSize := int(sizes>>4), int(sizes&0x0F)
+	if version == 0 {
+		indexSize = 0
+	}
+
+	count := reader.uint(2)
+	if version == 2 {
+		count = reader.uint(4)
+	}
+	for i := uint64(0); i < count && reader.err == nil; i++ {
+		var id uint64
+		if version < 2 {
+			id = reader.uint(2)
+		} else {
+			id = reader.uint(4)
+		}
+		method := uint64(0)
+		if version > 0 {
+			method = reader.uint(2) & 0x0F
+		}
+		reader.skip(2) // data reference index
+		base := reader.uint(baseOffsetSize)
+
+		extents := reader.uint(2)
+		for j := uint64(0); j < extents && reader.err == nil; j++ {
+			reader.uint(indexSize)
+			offset := reader.uint(offsetSize)
+			length := reader.uint(lengthSize)
+			if method == 0 {
+				locations[uint32(id)] = append(locations[uint32(id)], fileExtent{offset: base + offset, length: length})
+			}
+		}
+	}
+	if reader.err != nil {
+		return nil, reader.err
+	}
+	return locations, nil
+}
+
+// byteReader reads big endian numbers of varying width, remembering the first
+// time it runs out of data
+type byteReader struct {
+	data []byte
+	err  error
+}
+
+func (reader *byteReader) uint(size int) uint64 {
+	if reader.err != nil || size == 0 {
+		return 0
+	}
+	if len(reader.data) < size {
+		reader.err = errMalformedImage
+		return 0
+	}
+	var value uint64
+	for _, b := range reader.data[:size] {
+		value = value<<8 | uint64(b)
+	}
+	reader.data = reader.data[size:]
+	return value
+}
+
+func (reader *byteReader) skip(size int) {
+	reader.uint(size)
+}
+
+// heifEXIF returns the TIFF structured EXIF block of a HEIC file, or nil if
+// there isn't one
+func heifEXIF(data []byte) ([]byte, error) {
+	extents, _, err := heifMetadata(data)
+	if err != nil || len(extents) == 0 {
+		return nil, err
+	}
+
+	var item []byte
+	for _, extent := range extents {
+		if extent.offset+extent.length > uint64(len(data)) {
+			return nil, errMalformedImage
+		}
+		item = append(item, data[extent.offset:extent.offset+extent.length]...)
+	}
+
+	// The item starts with the offset of the TIFF header within it
+	if len(item) < 4 {
+		return nil, errMalformedImage
+	}
+	start := uint64(binary.BigEndian.Uint32(item)) + 4
+	if start > uint64(len(item)) {
+		return nil, errMalformedImage
+	}
+	return item[start:], nil
+}
+
+// stripHEIF blanks out the EXIF and XMP items of a HEIC file in place. The
+// items are zeroed rather than removed so none of the offsets in the file
+// need rewriting.
+func stripHEIF(data []byte) error {
+	exif, xmp, err := heifMetadata(data)
+	if err != nil {
+		return err
+	}
+	for _, extent := range append(exif, xmp...) {
+		if extent.offset+extent.length > uint64(len(data)) {
+			return errMalformedImage
+		}
+		clear(data[extent.offset : extent.offset+extent.length])
+	}
+	return nil
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"strings"
+	"unicode"
+)
+
+// Limits on what the guest list can hold
+const (
+	maxGuestName  = 100
+	maxGuestEmail = 254
+	minCodeLength = 4
+	maxCodeLength = 32
+)
+
+// householdRequest is the body of a request to add or change a household.
+// Fields left out of a change are kept as they are.
+type householdRequest struct {
+	Name      *string   `json:"name"`
+	Code      *string   `json:"code"`
+	PartySize *int      `json:"partySize"`
+	PlusOnes  *int      `json:"plusOnes"`
+	Events    *[]string `json:"events"`
+}
+
+// validate checks the fields that were given, tidying them up
+func (body *householdRequest) validate() error {
+	if body.Name != nil {
+		name := strings.TrimSpace(*body.Name)
+		if name == "" || len(name) > maxGuestName {
+			return fmt.Errorf("name must be 1 to %d characters", maxGuestName)
+		}
+		body.Name = &name
+	}
+	if body.Code != nil {
+		code := normalizeGuestCode(*body.Code)
+		if len(code) < minCodeLength || len(code) > maxCodeLength || strings.IndexFunc(code, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		}) >= 0 {
+			return fmt.Errorf("code must be %d to %d letters and digits", minCodeLength, maxCodeLength)
+		}
+		body.Code = &code
+	}
+	if body.PartySize != nil && (*body.PartySize < 0 || *body.PartySize > maxPartySize) {
+		return fmt.Errorf("partySize must be 0 to %d", maxPartySize)
+	}
+	if body.PlusOnes != nil && (*body.PlusOnes < 0 || *body.PlusOnes > maxPartySize) {
+		return fmt.Errorf("plusOnes must be 0 to %d", maxPartySize)
+	}
+	if body.Events != nil {
+		invited, err := findEvents(*body.Events)
+		if err != nil {
+			return err
+		}
+		body.Events = &invited
+	}
+	return nil
+}
+
+// apply makes the changes in the request to household
+func (body *householdRequest) apply(household *Household) {
+	if body.Name != nil {
+		household.Name = *body.Name
+	}
+	if body.Code != nil {
+		household.Code = *body.Code
+	}
+	if body.PartySize != nil {
+		household.PartySize = *body.PartySize
+	}
+	if body.PlusOnes != nil {
+		household.PlusOnes = *body.PlusOnes
+	}
+	if body.Events != nil {
+		household.Events = *body.Events
+	}
+}
+
+// createHouseholdRequest is the body of a request to add a household, which
+// can come with its guests
+type createHouseholdRequest struct {
+	householdRequest
+	Guests []guestRequest `json:"guests"`
+}
+
+// guestRequest is the body of a request to add or change a guest. Fields
+// left out of a change are kept as they are, and an empty list of events
+// invites the guest to all of the household's.
+type guestRequest struct {
+	Name   *string   `json:"name"`
+	Email  *string   `json:"email"`
+	Events *[]string `json:"events"`
+}
+
+// validate checks the fields that were given, tidying them up
+func (body *guestRequest) validate() error {
+	if body.Name != nil {
+		name := strings.TrimSpace(*body.Name)
+		if name == "" || len(name) > maxGuestName {
+			return fmt.Errorf("guest names must be 1 to %d characters", maxGuestName)
+		}
+		body.Name = &name
+	}
+	if body.Email != nil {
+		email := strings.TrimSpace(*body.Email)
+		if email != "" {
+			address, err := mail.ParseAddress(email)
+			if err != nil || address.Address != email || len(email) > maxGuestEmail {
+				return errors.New("email must be an email address like name@example.com")
+			}
+		}
+		body.Email = &email
+	}
+	if body.Events != nil {
+		invited, err := findEvents(*body.Events)
+		if err != nil {
+			return err
+		}
+		body.Events = &invited
+	}
+	return nil
+}
+
+// apply makes the changes in the request to guest
+func (body *guestRequest) apply(guest *Guest) {
+	if body.Name != nil {
+		guest.Name = *body.Name
+	}
+	if body.Email != nil {
+		guest.Email = *body.Email
+	}
+	if body.Events != nil {
+		guest.Events = *body.Events
+	}
+}
+
+// newGuest returns a guest for a household, with an ID none of its other
+// guests have
+func newGuest(household *Household, body guestRequest) *Guest {
+	guest := &Guest{ID: randomHex(4)}
+	for household.guest(guest.ID) != nil {
+		guest.ID = randomHex(4)
+	}
+	body.apply(guest)
+	return guest
+}
+
+// writeGuestListError answers a request to change the guest list that
+// couldn't be saved
+func writeGuestListError(response http.ResponseWriter, err error, message string) {
+	if errors.Is(err, errCodeTaken) {
+		writeJSONError(response, http.StatusConflict, err.Error())
+		return
+	}
+	slog.Error("Unable to save guest list", "err", err)
+	writeJSONError(response, http.StatusInternalServerError, message)
+}
+
+// listHouseholdsHandler lists the guest list, in the order households were
+// added
+func (s *server) listHouseholdsHandler(response http.ResponseWriter, request *http.Request) {
+	writeJSON(response, http.StatusOK, s.guests.All())
+}
+
+// householdHandler describes one household and its guests
+func (s *server) householdHandler(response http.ResponseWriter, request *http.Request) {
+	household, ok := s.guests.Get(request.PathValue("id"))
+	if !ok {
+		writeJSONError(response, http.StatusNotFound, "Household not found")
+		return
+	}
+	writeJSON(response, http.StatusOK, household)
+}
+
+// createHouseholdHandler adds a household to the guest list, making up a
+// guest code for it if it isn't given one
+func (s *server) createHouseholdHandler(response http.ResponseWriter, request *http.Request) {
+	var body createHouseholdRequest
+	if !decodeJSON(response, request, &body) {
+		return
+	}
+	if body.Name == nil {
+		writeJSONError(response, http.StatusBadRequest, "name is required")
+		return
+	}
+	if err := body.validate(); err != nil {
+		writeJSONError(response, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	household := &Household{}
+	body.apply(household)
+	for _, guestBody := range body.Guests {
+		if guestBody.Name == nil {
+			writeJSONError(response, http.StatusBadRequest, "every guest needs a name")
+			return
+		}
+		if err := guestBody.validate(); err != nil {
+			writeJSONError(response, http.StatusBadRequest, err.Error())
+			return
+		}
+		household.Guests = append(household.Guests, newGuest(household, guestBody))
+	}
+
+	added, err := s.guests.Create(household)
+	if err != nil {
+		writeGuestListError(response, err, "Unable to add household")
+		return
+	}
+	writeJSON(response, http.StatusCreated, added)
+}
+
+// updateHouseholdHandler changes a household's name, code, party size,
+// plus-ones, or the events it is invited to. An RSVP already sent moves to
+// the new code.
+func (s *server) updateHouseholdHandler(response http.ResponseWriter, request *http.Request) {
+	var body householdRequest
+	if !decodeJSON(response, request, &body) {
+		return
+	}
+	if err := body.validate(); err != nil {
+		writeJSONError(response, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var previousCode string
+	household, ok, err := s.guests.Update(request.PathValue("id"), func(household *Household) error {
+		previousCode = household.Code
+		body.apply(household)
+		return nil
+	})
+	if !ok {
+		writeJSONError(response, http.StatusNotFound, "Household not found")
+		return
+	}
+	if err != nil {
+		writeGuestListError(response, err, "Unable to update household")
+		return
+	}
+	if household.Code != previousCode {
+		if err := s.moveRSVP(previousCode, household.Code); err != nil {
+			slog.Error("Unable to move RSVP", "from", previousCode, "to", household.Code, "err", err)
+		}
+	}
+	writeJSON(response, http.StatusOK, household)
+}
+
+// moveRSVP gives the RSVP sent with one guest code to another
+func (s *server) moveRSVP(from, to string) error {
+	rsvp, ok, err := s.rsvps.Get(from)
+	if err != nil || !ok {
+		return err
+	}
+	rsvp.Code = to
+	if err := s.rsvps.Save(rsvp); err != nil {
+		return err
+	}
+	return s.rsvps.Delete(from)
+}
+
+// deleteHouseholdHandler takes a household off the guest list. Any RSVP it
+// sent is kept for the couple's records.
+func (s *server) deleteHouseholdHandler(response http.ResponseWriter, request *http.Request) {
+	ok, err := s.guests.Delete(request.PathValue("id"))
+	if !ok {
+		writeJSONError(response, http.StatusNotFound, "Household not found")
+		return
+	}
+	if err != nil {
+		writeGuestListError(response, err, "Unable to delete household")
+		return
+	}
+	response.WriteHeader(http.StatusNoContent)
+}
+
+// addGuestHandler adds a guest to a household
+func (s *server) addGuestHandler(response http.ResponseWriter, request *http.Request) {
+	var body guestRequest
+	if !decodeJSON(response, request, &body) {
+		return
+	}
+	if body.Name == nil {
+		writeJSONError(response, http.StatusBadRequest, "name is required")
+		return
+	}
+	if err := body.validate(); err != nil {
+		writeJSONError(response, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var added *Guest
+	_, ok, err := s.guests.Update(request.PathValue("id"), func(household *Household) error {
+		added = newGuest(household, body)
+		household.Guests = append(household.Guests, added)
+		return nil
+	})
+	if !ok {
+		writeJSONError(response, http.StatusNotFound, "Household not found")
+		return
+	}
+	if err != nil {
+		writeGuestListError(response, err, "Unable to add guest")
+		return
+	}
+	writeJSON(response, http.StatusCreated, added)
+}
+
+// errGuestNotFound is returned when a change is for a guest the household
+// doesn't have
+var errGuestNotFound = errors.New("guest not found")
+
+// updateGuestHandler changes a guest's name, email, or the events they are
+// invited to
+func (s *server) updateGuestHandler(response http.ResponseWriter, request *http.Request) {
+	var body guestRequest
+	if !decodeJSON(response, request, &body) {
+		return
+	}
+	if err := body.validate(); err != nil {
+		writeJSONError(response, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var updated Guest
+	_, ok, err := s.guests.Update(request.PathValue("id"), func(household *Household) error {
+		guest := household.guest(request.PathValue("guestID"))
+		if guest == nil {
+			return errGuestNotFound
+		}
+		body.apply(guest)
+		updated = *guest
+		return nil
+	})
+	if !ok || errors.Is(err, errGuestNotFound) {
+		writeJSONError(response, http.StatusNotFound, "Guest not found")
+		return
+	}
+	if err != nil {
+		writeGuestListError(response, err, "Unable to update guest")
+		return
+	}
+	writeJSON(response, http.StatusOK, updated)
+}
+
+// deleteGuestHandler takes a guest out of a household
+func (s *server) deleteGuestHandler(response http.ResponseWriter, request *http.Request) {
+	_, ok, err := s.guests.Update(request.PathValue("id"), func(household *Household) error {
+		for i, guest := range household.Guests {
+			if guest.ID == request.PathValue("guestID") {
+				household.Guests = append(household.Guests[:i], household.Guests[i+1:]...)
+				return nil
+			}
+		}
+		return errGuestNotFound
+	})
+	if !ok || errors.Is(err, errGuestNotFound) {
+		writeJSONError(response, http.StatusNotFound, "Guest not found")
+		return
+	}
+	if err != nil {
+		writeGuestListError(response, err, "Unable to delete guest")
+		return
+	}
+	response.WriteHeader(http.StatusNoContent)
+}
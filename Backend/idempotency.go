@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// idempotencyTTL is how long the result of an upload is remembered for
+// clients retrying it
+const idempotencyTTL = 24 * time.Hour
+
+// maxIdempotencyKey is the longest Idempotency-Key accepted
+const maxIdempotencyKey = 255
+
+// idempotentResponse is a response remembered for replaying. While the first
+// request with a key is still running, done is open and there is no response
+// yet.
+type idempotentResponse struct {
+	done    chan struct{}
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+// idempotencyStore remembers the responses to uploads sent with an
+// Idempotency-Key header. Phones on flaky connections often send an upload
+// again when they miss the response, and this way the retry gets the
+// original result instead of storing the photo a second time.
+type idempotencyStore struct {
+	mu        sync.Mutex
+	responses map[string]*idempotentResponse
+}
+
+func newIdempotencyStore() *idempotencyStore {
+	store := &idempotencyStore{responses: make(map[string]*idempotentResponse)}
+	go store.cleanup()
+	return store
+}
+
+// cleanup forgets responses once they have expired
+func (store *idempotencyStore) cleanup() {
+	for range time.Tick(time.Hour) {
+		store.mu.Lock()
+		for key, remembered := range store.responses {
+			if !remembered.expires.IsZero() && time.Now().After(remembered.expires) {
+				delete(store.responses, key)
+			}
+		}
+		store.mu.Unlock()
+	}
+}
+
+// begin claims key for a new request. If the key has been used before, the
+// earlier response is returned instead.
+func (store *idempotencyStore) begin(key string) (*idempotentResponse, bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if remembered, ok := store.responses[key]; ok && (remembered.expires.IsZero() || time.Now().Before(remembered.expires)) {
+		return remembered, false
+	}
+	remembered := &idempotentResponse{done: make(chan struct{})}
+	store.responses[key] = remembered
+	return remembered, true
+}
+
+// finish records the response to a claimed key. Only successful responses
+// are kept, so a failed upload can be tried again with the same key.
+func (store *idempotencyStore) finish(key string, remembered *idempotentResponse, recorder *responseRecorder) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if recorder.status >= 200 && recorder.status < 300 {
+		remembered.status = recorder.status
+		remembered.header = recorder.snapshot
+		remembered.body = recorder.body.Bytes()
+		remembered.expires = time.Now().Add(idempotencyTTL)
+	} else {
+		delete(store.responses, key)
+	}
+	close(remembered.done)
+}
+
+// middleware replays the response to requests whose Idempotency-Key has been
+// seen before. Requests without a key are handled as usual.
+func (store *idempotencyStore) middleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(response http.ResponseWriter, request *http.Request) {
+		key := request.Header.Get("Idempotency-Key")
+		if key == "" || (request.Method != http.MethodPost && request.Method != http.MethodPut) {
+			next(response, request)
+			return
+		}
+		if len(key) > maxIdempotencyKey {
+			http.Error(response, "Idempotency-Key is too long", http.StatusBadRequest)
+			return
+		}
+
+		key = idempotencyScope(request) + key
+		remembered, first := store.begin(key)
+		if !first {
+			select {
+			case <-remembered.done:
+			default:
+				http.Error(response, "An upload with this Idempotency-Key is still in progress", http.StatusConflict)
+				return
+			}
+			if remembered.status == 0 {
+				// The first attempt failed after this one found it
+				http.Error(response, "The upload with this Idempotency-Key failed, please try again", http.StatusConflict)
+				return
+			}
+			for name, values := range remembered.header {
+				response.Header()[name] = values
+			}
+			response.Header().Set("Idempotent-Replayed", "true")
+			response.WriteHeader(remembered.status)
+			response.Write(remembered.body)
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: response, status: http.StatusOK}
+		defer store.finish(key, remembered, recorder)
+		next(recorder, request)
+	}
+}
+
+// idempotencyScope is what an Idempotency-Key is remembered under along with
+// the key itself: the endpoint, and who sent it by their guest code or else
+// their IP address. That way a key can only replay a response to the client
+// it was sent by, for the request it was sent with.
+func idempotencyScope(request *http.Request) string {
+	sender := normalizeGuestCode(guestCode(request))
+	if sender == "" {
+		sender = clientIP(request)
+	}
+	return request.Method + " " + request.URL.Path + " " + sender + " "
+}
+
+// responseRecorder passes a response through while keeping a copy of it
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	snapshot    http.Header
+	body        bytes.Buffer
+}
+
+func (recorder *responseRecorder) WriteHeader(status int) {
+	if !recorder.wroteHeader {
+		recorder.status = status
+		recorder.wroteHeader = true
+		recorder.snapshot = recorder.Header().Clone()
+	}
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+func (recorder *responseRecorder) Write(p []byte) (int, error) {
+	if !recorder.wroteHeader {
+		recorder.WriteHeader(http.StatusOK)
+	}
+	recorder.body.Write(p)
+	return recorder.ResponseWriter.Write(p)
+}
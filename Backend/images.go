@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"image"
+	"image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"net/http"
+
+	_ "github.com/gen2brain/heic"
+	_ "golang.org/x/image/webp"
+)
+
+// errUnsupportedType is returned when an upload is not one of the accepted
+// image formats
+var errUnsupportedType = errors.New("unsupported file type")
+
+// allowedImageTypes maps the sniffed content types we accept to the format
+// name the image package reports when decoding them
+var allowedImageTypes = map[string]string{
+	"image/gif":  "gif",
+	"image/heic": "heic",
+	"image/jpeg": "jpeg",
+	"image/png":  "png",
+	"image/webp": "webp",
+}
+
+// imageExtensions are the file extensions used to store each image type
+var imageExtensions = map[string]string{
+	"image/gif":  ".gif",
+	"image/heic": ".heic",
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/webp": ".webp",
+}
+
+// detectImageType checks the content of file rather than trusting the client
+// supplied Content-Type. The first 512 bytes are sniffed and the image header
+// is then decoded to make sure it really is the format it claims to be. The
+// file is rewound to the start before returning.
+func detectImageType(file io.ReadSeeker) (string, error) {
+	defer file.Seek(0, io.SeekStart)
+
+	buffer := make([]byte, 512)
+	n, err := io.ReadFull(file, buffer)
+	if err == io.EOF {
+		return "", errUnsupportedType
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+
+	contentType := http.DetectContentType(buffer[:n])
+	if isHEIC(buffer[:n]) {
+		// iPhone photos, which the standard sniffer doesn't know about
+		contentType = "image/heic"
+	}
+	format, ok := allowedImageTypes[contentType]
+	if !ok {
+		return "", errUnsupportedType
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	_, decodedFormat, err := image.DecodeConfig(file)
+	if err != nil || decodedFormat != format {
+		return "", errUnsupportedType
+	}
+	return contentType, nil
+}
+
+// maxImagePixels is the most pixels an upload can have. Decoding allocates
+// memory for every pixel, so a small file claiming to be enormous is turned
+// away before it is decoded.
+const maxImagePixels = 150_000_000
+
+// Errors from verifyImage
+var (
+	errCorruptImage  = errors.New("image is damaged or incomplete")
+	errImageTooLarge = errors.New("image has too many pixels")
+)
+
+// verifyImage decodes the whole of file, which catches uploads that were cut
+// off or damaged on the way, and rewinds it. GIFs have every frame decoded.
+func verifyImage(file io.ReadSeeker, contentType string) error {
+	defer file.Seek(0, io.SeekStart)
+
+	config, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return errCorruptImage
+	}
+	if int64(config.Width)*int64(config.Height) > maxImagePixels {
+		return errImageTooLarge
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	if contentType == "image/gif" {
+		_, err = gif.DecodeAll(file)
+	} else {
+		_, _, err = image.Decode(file)
+	}
+	if err != nil {
+		return errCorruptImage
+	}
+	return nil
+}
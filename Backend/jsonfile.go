@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// The smaller stores each keep what they hold in a JSON file of their own in
+// the upload directory, whichever backend the photo index is in. The file is
+// read once when the store opens and written whole after every change.
+
+// loadJSONFile reads the JSON file at path into value. If there is no file
+// yet, value is left as it is.
+func loadJSONFile[T any](path string, value *T) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, value)
+}
+
+// saveJSONFile writes value to the file at path as indented JSON
+func saveJSONFile[T any](path string, value T) error {
+	return writeJSONFile(path, value, 0o644)
+}
+
+// savePrivateJSONFile is saveJSONFile for files only the server should be
+// able to read
+func savePrivateJSONFile[T any](path string, value T) error {
+	return writeJSONFile(path, value, 0o600)
+}
+
+// writeJSONFile writes value to the file at path with perm. It is written to
+// a temporary file first and moved into place, so a crash never leaves half
+// a file.
+func writeJSONFile(path string, value any, perm os.FileMode) error {
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// Uploads are stored in a directory for the day they arrived, such as
+// 2026/06/20/, so no single directory ends up with thousands of files in it.
+// Photos from before the layout was sharded are moved in by
+// migrateFlatLayout when the server starts.
+//
+// With the content layout every file is instead named after the SHA-256 of
+// its content, under blobs/ab/cd/ for a hash starting abcd. Identical files
+// are only stored once, and files never change once they are written, which
+// suits tools that sync files by name. The photo index maps each photo to
+// the files it is made of.
+
+// blobDirectory is where files are stored with the content layout
+const blobDirectory = "blobs"
+
+// shardDirectory returns the directory for files uploaded at uploaded, or ""
+// if the layout doesn't shard by date
+func shardDirectory(uploaded time.Time) string {
+	if *storageLayout != "date" {
+		return ""
+	}
+	return uploaded.UTC().Format("2006/01/02")
+}
+
+// contentDirectory returns the directory a file with the given hex SHA-256
+// is stored in with the content layout
+func contentDirectory(hash string) string {
+	return path.Join(blobDirectory, hash[:2], hash[2:4])
+}
+
+// storeOriginal stores the staged original of photo. With the content
+// layout the photo's file is named after the hash of what is stored.
+func storeOriginal(ctx context.Context, storage Storage, photo *Photo, staged *os.File) error {
+	if *storageLayout != "content" {
+		return putFile(ctx, storage, photo.originalName(), staged)
+	}
+	if _, err := staged.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	hash, err := hashFile(staged)
+	if err != nil {
+		return err
+	}
+	photo.Directory = contentDirectory(hash)
+	photo.File = hash + path.Ext(photo.File)
+	return putContent(ctx, storage, photo.originalName(), staged)
+}
+
+// putVariant stores one of photo's variants, which would be called name,
+// and returns the name it was stored under
+func putVariant(ctx context.Context, storage Storage, photo *Photo, name string, content io.ReadSeeker) (string, error) {
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	if *storageLayout != "content" {
+		name = photo.storageName(name)
+		return name, storage.Put(ctx, name, content)
+	}
+	hash, err := hashFile(content)
+	if err != nil {
+		return "", err
+	}
+	// Videos are kept in their own directory however they are laid out, so
+	// a clip shared as a video and as part of a Live Photo is stored once
+	name = path.Join(contentDirectory(hash), path.Dir(name), hash+path.Ext(name))
+	return name, putContent(ctx, storage, name, content)
+}
+
+// putContent stores content under a name that comes from its hash, unless
+// a file is already stored there, in which case it is the same content
+func putContent(ctx context.Context, storage Storage, name string, content io.Reader) error {
+	if _, err := storage.Stat(ctx, name); err == nil {
+		return nil
+	}
+	return storage.Put(ctx, name, content)
+}
+
+// renamer is implemented by stores that can move a file without copying it
+type renamer interface {
+	Rename(ctx context.Context, from, to string) error
+}
+
+// Rename moves a file on disk, creating the directory it is moved into
+func (storage *localStorage) Rename(ctx context.Context, from, to string) error {
+	fromPath, err := storage.path(from)
+	if err != nil {
+		return err
+	}
+	toPath, err := storage.path(to)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(toPath), os.ModePerm); err != nil {
+		return err
+	}
+	return os.Rename(fromPath, toPath)
+}
+
+// moveStored moves a stored file from one name to another. A file that is
+// already at its new name, from a migration that was interrupted, counts as
+// moved.
+func moveStored(ctx context.Context, storage Storage, from, to string) error {
+	if _, err := storage.Stat(ctx, from); errors.Is(err, fs.ErrNotExist) {
+		if _, err := storage.Stat(ctx, to); err == nil {
+			return nil
+		}
+	}
+
+	if store, ok := storage.(renamer); ok {
+		return store.Rename(ctx, from, to)
+	}
+	src, err := storage.Get(ctx, from)
+	if err != nil {
+		return err
+	}
+	err = storage.Put(ctx, to, src)
+	src.Close()
+	if err != nil {
+		return err
+	}
+	return storage.Delete(ctx, from)
+}
+
+// migrateFlatLayout moves the files of photos stored before the layout was
+// sharded into the directory for the day they were uploaded
+func migrateFlatLayout(ctx context.Context, storage Storage, photos PhotoStore) error {
+	switch *storageLayout {
+	case "flat", "content":
+		return nil
+	case "date":
+	default:
+		return fmt.Errorf("unknown storage layout %q", *storageLayout)
+	}
+
+	moved := 0
+	for _, photo := range photos.All() {
+		if photo.Directory != "" {
+			continue
+		}
+		directory := shardDirectory(photo.UploadedAt)
+
+		migrated := photo.clone()
+		migrated.Directory = directory
+		if err := moveStored(ctx, storage, photo.originalName(), migrated.originalName()); err != nil {
+			return fmt.Errorf("moving %s: %w", photo.originalName(), err)
+		}
+		for variant, name := range photo.Variants {
+			newName := path.Join(directory, name)
+			if err := moveStored(ctx, storage, name, newName); err != nil {
+				return fmt.Errorf("moving %s: %w", name, err)
+			}
+			migrated.Variants[variant] = newName
+		}
+
+		if err := photos.Update(migrated); err != nil {
+			return err
+		}
+		moved++
+	}
+	if moved > 0 {
+		slog.Info("Moved photos into the date sharded layout", "photos", moved)
+	}
+	return nil
+}
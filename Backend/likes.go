@@ -0,0 +1,243 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Guests like photos so the couple can see which ones everyone loved. Each
+// guest counts once per photo: guests with a code are told apart by it, and
+// everyone else by a random device token their browser keeps and sends as an
+// X-Device-Token header. Reports are counted the same way.
+
+// Device tokens must be at least minDeviceToken and at most maxDeviceToken
+// characters, so they are hard to guess and cheap to keep
+const (
+	minDeviceToken = 16
+	maxDeviceToken = 128
+)
+
+// guestKey returns who a request is from, so guests can be counted once
+// each, or "" if it carries neither a known guest code nor a valid device
+// token
+func (s *server) guestKey(request *http.Request) string {
+	if code := guestCode(request); code != "" {
+		if household, ok, _ := s.lookupCode(request, code); ok {
+			return "guest:" + household.Code
+		}
+		return ""
+	}
+	return deviceKey(request)
+}
+
+// deviceKey returns who a request is from by its X-Device-Token header, or ""
+// if it doesn't carry a valid one
+func deviceKey(request *http.Request) string {
+	token := request.Header.Get("X-Device-Token")
+	if len(token) < minDeviceToken || len(token) > maxDeviceToken {
+		return ""
+	}
+	// Only a hash of the token is kept, so the index can't be used to like
+	// photos as someone else
+	sum := sha256.Sum256([]byte(token))
+	return "device:" + hex.EncodeToString(sum[:16])
+}
+
+// likeResponse is the result of liking or unliking a photo
+type likeResponse struct {
+	Likes int  `json:"likes"`
+	Liked bool `json:"liked"`
+}
+
+// likeHandler likes a photo on behalf of a guest. Liking it again changes
+// nothing.
+func (s *server) likeHandler(response http.ResponseWriter, request *http.Request) {
+	s.changeLike(response, request, true)
+}
+
+// unlikeHandler takes back a guest's like of a photo
+func (s *server) unlikeHandler(response http.ResponseWriter, request *http.Request) {
+	s.changeLike(response, request, false)
+}
+
+func (s *server) changeLike(response http.ResponseWriter, request *http.Request, like bool) {
+	photo, ok := s.servedPhoto(request)
+	if !ok {
+		writeJSONError(response, http.StatusNotFound, "Photo not found")
+		return
+	}
+	liker := s.guestKey(request)
+	if liker == "" {
+		writeJSONError(response, http.StatusBadRequest, "a guest code or X-Device-Token header is needed to like photos")
+		return
+	}
+
+	var err error
+	if like {
+		_, err = s.photos.Like(photo.ID, liker)
+	} else {
+		_, err = s.photos.Unlike(photo.ID, liker)
+	}
+	if err != nil {
+		slog.Error("Unable to save like", "photo", photo.ID, "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to save like")
+		return
+	}
+	counts, err := s.photos.LikeCounts([]string{photo.ID})
+	if err != nil {
+		writeJSONError(response, http.StatusInternalServerError, "Unable to count likes")
+		return
+	}
+	writeJSON(response, http.StatusOK, likeResponse{Likes: counts[photo.ID], Liked: like})
+}
+
+// summarizePhotos returns how photos are listed, with their like counts
+func (s *server) summarizePhotos(photos []*Photo) []photoSummary {
+	ids := make([]string, len(photos))
+	for i, photo := range photos {
+		ids[i] = photo.ID
+	}
+	counts, err := s.photos.LikeCounts(ids)
+	if err != nil {
+		// The photos matter more than the counts, so list them anyway
+		slog.Error("Unable to count likes", "err", err)
+	}
+
+	summaries := make([]photoSummary, 0, len(photos))
+	for _, photo := range photos {
+		summary := summarizePhoto(photo)
+		summary.Likes = counts[photo.ID]
+		summaries = append(summaries, summary)
+	}
+	return summaries
+}
+
+// likesPath is where a JSON index keeps its likes
+func (store *jsonPhotoStore) likesPath() string {
+	return filepath.Join(filepath.Dir(store.path), "likes.json")
+}
+
+// loadLikes reads the likes saved next to the index, if there are any
+func (store *jsonPhotoStore) loadLikes() error {
+	return loadJSONFile(store.likesPath(), &store.likes)
+}
+
+func (store *jsonPhotoStore) Like(photoID, liker string) (bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if _, ok := store.photos[photoID]; !ok {
+		return false, os.ErrNotExist
+	}
+	likers, ok := store.likes[photoID]
+	if !ok {
+		likers = make(map[string]time.Time)
+		store.likes[photoID] = likers
+	}
+	if _, ok := likers[liker]; ok {
+		return false, nil
+	}
+	likers[liker] = time.Now().UTC()
+	if err := store.saveLikes(); err != nil {
+		delete(likers, liker)
+		return false, err
+	}
+	return true, nil
+}
+
+func (store *jsonPhotoStore) Unlike(photoID, liker string) (bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	likers := store.likes[photoID]
+	liked, ok := likers[liker]
+	if !ok {
+		return false, nil
+	}
+	delete(likers, liker)
+	if len(likers) == 0 {
+		delete(store.likes, photoID)
+	}
+	if err := store.saveLikes(); err != nil {
+		likers[liker] = liked
+		store.likes[photoID] = likers
+		return false, err
+	}
+	return true, nil
+}
+
+func (store *jsonPhotoStore) LikeCounts(photoIDs []string) (map[string]int, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	counts := make(map[string]int)
+	for _, id := range photoIDs {
+		if likers := store.likes[id]; len(likers) > 0 {
+			counts[id] = len(likers)
+		}
+	}
+	return counts, nil
+}
+
+// saveLikes writes the likes to disk. The caller must hold store.mu.
+func (store *jsonPhotoStore) saveLikes() error {
+	return saveJSONFile(store.likesPath(), store.likes)
+}
+
+func (store *sqlPhotoStore) Like(photoID, liker string) (bool, error) {
+	if _, ok := store.Get(photoID); !ok {
+		return false, os.ErrNotExist
+	}
+	result, err := store.db.Exec(`INSERT INTO likes (photo_id, liker, liked_at) VALUES ($1, $2, $3)
+		ON CONFLICT (photo_id, liker) DO NOTHING`, photoID, liker, time.Now().UTC())
+	if err != nil {
+		return false, err
+	}
+	added, err := result.RowsAffected()
+	return added > 0, err
+}
+
+func (store *sqlPhotoStore) Unlike(photoID, liker string) (bool, error) {
+	result, err := store.db.Exec(`DELETE FROM likes WHERE photo_id = $1 AND liker = $2`, photoID, liker)
+	if err != nil {
+		return false, err
+	}
+	removed, err := result.RowsAffected()
+	return removed > 0, err
+}
+
+func (store *sqlPhotoStore) LikeCounts(photoIDs []string) (map[string]int, error) {
+	counts := make(map[string]int)
+	if len(photoIDs) == 0 {
+		return counts, nil
+	}
+	placeholders := make([]string, len(photoIDs))
+	args := make([]any, len(photoIDs))
+	for i, id := range photoIDs {
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+		args[i] = id
+	}
+
+	rows, err := store.db.Query(`SELECT photo_id, COUNT(*) FROM likes WHERE photo_id IN (`+
+		strings.Join(placeholders, ", ")+`) GROUP BY photo_id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		var count int
+		if err := rows.Scan(&id, &count); err != nil {
+			return nil, err
+		}
+		counts[id] = count
+	}
+	return counts, rows.Err()
+}
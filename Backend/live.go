@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A Live Photo is a still, usually HEIC, and a few seconds of video taken
+// around it. Phones share them as two files with the same name, such as
+// IMG_0042.HEIC and IMG_0042.MOV. They are kept under one photo record: the
+// still is the photo, and the clip is stored alongside it as its "live"
+// variant so the gallery can offer the animated version.
+
+// liveStillExtensions and liveVideoExtensions are the file name extensions of
+// the two halves of a Live Photo
+var (
+	liveStillExtensions = map[string]bool{".heic": true, ".jpg": true, ".jpeg": true}
+	liveVideoExtensions = map[string]bool{".mov": true, ".mp4": true}
+)
+
+// pairLivePhotos attaches each clip in files to the still with the same name,
+// returning the files that are left to save on their own
+func pairLivePhotos(files []receivedFile) []receivedFile {
+	stills := make(map[string]int)
+	for i, file := range files {
+		base, extension := splitExtension(file.filename)
+		if liveStillExtensions[extension] {
+			stills[base] = i
+		}
+	}
+
+	paired := make(map[int]bool)
+	for i, file := range files {
+		base, extension := splitExtension(file.filename)
+		if still, ok := stills[base]; ok && liveVideoExtensions[extension] && files[still].live == nil {
+			files[still].live = &files[i]
+			paired[i] = true
+		}
+	}
+
+	remaining := make([]receivedFile, 0, len(files)-len(paired))
+	for i, file := range files {
+		if !paired[i] {
+			remaining = append(remaining, file)
+		}
+	}
+	return remaining
+}
+
+// splitExtension splits a client file name into its lower cased name and
+// extension
+func splitExtension(filename string) (string, string) {
+	filename = strings.ToLower(cleanFilename(filename))
+	extension := filepath.Ext(filename)
+	return strings.TrimSuffix(filename, extension), extension
+}
+
+// storeLiveVideo checks the clip of a Live Photo and stores it as the live
+// variant of photo
+func storeLiveVideo(ctx context.Context, storage Storage, photo *Photo, clip io.ReadSeeker, size int64) error {
+	contentType, err := detectVideoType(clip)
+	if err != nil {
+		return &uploadError{http.StatusUnsupportedMediaType, "invalid Live Photo video"}
+	}
+	if size > *maxVideoSize {
+		return &uploadError{http.StatusRequestEntityTooLarge, "Live Photo video is too large"}
+	}
+	info, _, err := readVideoInfo(clip)
+	if err != nil {
+		return &uploadError{http.StatusBadRequest, "invalid Live Photo video"}
+	}
+	if time.Duration(info.DurationSeconds*float64(time.Second)) > *maxVideoDuration {
+		return &uploadError{http.StatusRequestEntityTooLarge, fmt.Sprintf("Live Photo video is longer than %v", *maxVideoDuration)}
+	}
+
+	// The metadata is stripped in place, so work on a copy
+	staged, err := createIncomingFile()
+	if err != nil {
+		return err
+	}
+	defer os.Remove(staged.Name())
+	defer staged.Close()
+	_, err = io.Copy(staged, clip)
+	if err == nil && *stripEXIF {
+		err = stripVideoMetadata(staged)
+	}
+	if err != nil {
+		return err
+	}
+
+	name, err := putVariant(ctx, storage, photo, videoDirectory+"/"+photo.ID+"_live"+videoTypes[contentType], staged)
+	if err != nil {
+		return err
+	}
+	photo.Variants["live"] = name
+	return nil
+}
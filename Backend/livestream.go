@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Relatives who can't make it watch the ceremony on a livestream. The couple
+// sets its link and flips it live when it starts; guests waiting on the page
+// are told over Server-Sent Events on /livestream/live rather than having to
+// refresh it.
+
+// States of the livestream
+const (
+	streamNotStarted = "not_started"
+	streamLive       = "live"
+	streamEnded      = "ended"
+)
+
+// Livestream is the link to the livestream and whether it is on
+type Livestream struct {
+	URL    string `json:"url,omitempty"`
+	Status string `json:"status"`
+	// StartedAt is when it last went live, and EndedAt when it ended
+	StartedAt *time.Time `json:"startedAt,omitempty"`
+	EndedAt   *time.Time `json:"endedAt,omitempty"`
+}
+
+// livestreamStore keeps the livestream
+type livestreamStore struct {
+	mu     sync.Mutex
+	path   string
+	stream Livestream
+	// watchers are the pages told when the livestream changes
+	watchers map[chan Livestream]struct{}
+}
+
+// openLivestreamStore loads the livestream saved at path, starting with none
+// if it doesn't exist
+func openLivestreamStore(path string) (*livestreamStore, error) {
+	store := &livestreamStore{path: path, stream: Livestream{Status: streamNotStarted}, watchers: make(map[chan Livestream]struct{})}
+
+	if err := loadJSONFile(path, &store.stream); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Get returns the livestream as it is now
+func (store *livestreamStore) Get() Livestream {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	return store.stream
+}
+
+// Update changes the livestream, telling the pages watching it if its link
+// or status changed. Changes that change returns an error for are thrown
+// away.
+func (store *livestreamStore) Update(change func(*Livestream) error) (Livestream, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	previous := store.stream
+	if err := change(&store.stream); err != nil {
+		store.stream = previous
+		return Livestream{}, err
+	}
+	if err := store.save(); err != nil {
+		store.stream = previous
+		return Livestream{}, err
+	}
+	if store.stream.URL != previous.URL || store.stream.Status != previous.Status {
+		for watcher := range store.watchers {
+			select {
+			case watcher <- store.stream:
+			default:
+			}
+		}
+	}
+	return store.stream, nil
+}
+
+func (store *livestreamStore) watch() chan Livestream {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	watcher := make(chan Livestream, feedBuffer)
+	store.watchers[watcher] = struct{}{}
+	return watcher
+}
+
+func (store *livestreamStore) unwatch(watcher chan Livestream) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	delete(store.watchers, watcher)
+}
+
+// save writes the livestream to disk. The caller must hold store.mu.
+func (store *livestreamStore) save() error {
+	return saveJSONFile(store.path, store.stream)
+}
+
+// errNoStreamURL is returned when the livestream is flipped live without a
+// link
+var errNoStreamURL = errors.New("the livestream needs a url to go live")
+
+// livestreamRequest is the body of a request to set the livestream's link or
+// flip it live. Fields left out are kept as they are.
+type livestreamRequest struct {
+	URL    *string `json:"url"`
+	Status *string `json:"status"`
+}
+
+// forGuests returns the livestream as guests are shown it. The link is only
+// given out while it is live, so nobody sits on a dead page before it
+// starts.
+func (stream Livestream) forGuests() Livestream {
+	if stream.Status != streamLive {
+		stream.URL = ""
+	}
+	return stream
+}
+
+// livestreamHandler tells guests whether the livestream has started, with
+// its link while it is live
+func (s *server) livestreamHandler(response http.ResponseWriter, request *http.Request) {
+	response.Header().Set("Cache-Control", "no-store")
+	writeJSON(response, http.StatusOK, s.streaming.Get().forGuests())
+}
+
+// updateLivestreamHandler sets the livestream's link, or flips it live or
+// ended
+func (s *server) updateLivestreamHandler(response http.ResponseWriter, request *http.Request) {
+	var body livestreamRequest
+	if !decodeJSON(response, request, &body) {
+		return
+	}
+	if body.URL != nil {
+		link := strings.TrimSpace(*body.URL)
+		if link != "" && !webURL(link) {
+			writeJSONError(response, http.StatusBadRequest, "url must be a web address starting with http:// or https://")
+			return
+		}
+		body.URL = &link
+	}
+	if body.Status != nil {
+		switch *body.Status {
+		case streamNotStarted, streamLive, streamEnded:
+		default:
+			writeJSONError(response, http.StatusBadRequest, "status must be not_started, live or ended")
+			return
+		}
+	}
+
+	now := time.Now().UTC()
+	stream, err := s.streaming.Update(func(stream *Livestream) error {
+		if body.URL != nil {
+			stream.URL = *body.URL
+		}
+		if body.Status != nil && *body.Status != stream.Status {
+			stream.Status = *body.Status
+			switch stream.Status {
+			case streamNotStarted:
+				stream.StartedAt, stream.EndedAt = nil, nil
+			case streamLive:
+				stream.StartedAt, stream.EndedAt = &now, nil
+			case streamEnded:
+				stream.EndedAt = &now
+			}
+		}
+		// A livestream can't go live without a link to watch it at
+		if stream.Status == streamLive && stream.URL == "" {
+			return errNoStreamURL
+		}
+		return nil
+	})
+	if errors.Is(err, errNoStreamURL) {
+		writeJSONError(response, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		slog.Error("Unable to save livestream", "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to update livestream")
+		return
+	}
+	writeJSON(response, http.StatusOK, stream)
+}
+
+// liveStreamEventsHandler streams a status event whenever the livestream
+// goes live, ends, or changes its link, until the client goes away. The
+// first event is the livestream as it is now.
+func (s *server) liveStreamEventsHandler(response http.ResponseWriter, request *http.Request) {
+	flusher, ok := response.(http.Flusher)
+	if !ok {
+		http.Error(response, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	keepWriting(response)
+	response.Header().Set("Content-Type", "text/event-stream")
+	response.Header().Set("Cache-Control", "no-cache")
+	response.Header().Set("Connection", "keep-alive")
+
+	watcher := s.streaming.watch()
+	defer s.streaming.unwatch(watcher)
+
+	send := func(stream Livestream) {
+		data, _ := json.Marshal(stream.forGuests())
+		fmt.Fprintf(response, "event: status\ndata: %s\n\n", data)
+	}
+	send(s.streaming.Get())
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(feedKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case stream := <-watcher:
+			send(stream)
+		case <-keepAlive.C:
+			fmt.Fprint(response, ": keep-alive\n\n")
+		case <-request.Context().Done():
+			return
+		case <-s.shutdown.Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// The server logs with log/slog, as text for reading in a terminal or as
+// JSON for a log service to search. Every request is logged once it is
+// answered, with how long it took and how much was sent each way, so a
+// problem at the venue can be traced back to the requests around it.
+
+// setupLogging makes the default logger the one set up in the config
+func setupLogging() error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		return fmt.Errorf("log-level must be debug, info, warn or error, not %q", *logLevel)
+	}
+	options := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	switch strings.ToLower(*logFormat) {
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, options)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	default:
+		return fmt.Errorf("log-format must be text or json, not %q", *logFormat)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// countingBody counts the bytes read from a request body
+type countingBody struct {
+	io.ReadCloser
+	read int64
+}
+
+func (body *countingBody) Read(p []byte) (int, error) {
+	n, err := body.ReadCloser.Read(p)
+	body.read += int64(n)
+	return n, err
+}
+
+// loggedResponse counts the bytes written in a response as it passes them
+// through
+type loggedResponse struct {
+	statusRecorder
+	written int64
+}
+
+func (response *loggedResponse) Write(p []byte) (int, error) {
+	n, err := response.statusRecorder.Write(p)
+	response.written += int64(n)
+	return n, err
+}
+
+// logRequests logs every request to next once it is answered. Server errors
+// are logged as errors, and everything else at info, or at debug for HEAD and
+// OPTIONS requests, such as CORS preflights and resumable upload checks, which
+// would drown the rest out.
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		started := time.Now()
+		body := &countingBody{ReadCloser: request.Body}
+		request.Body = body
+		logged := &loggedResponse{statusRecorder: statusRecorder{ResponseWriter: response, status: http.StatusOK}}
+
+		next.ServeHTTP(logged, request)
+
+		level := slog.LevelInfo
+		switch {
+		case logged.status >= http.StatusInternalServerError:
+			level = slog.LevelError
+		case request.Method == http.MethodHead || request.Method == http.MethodOptions:
+			level = slog.LevelDebug
+		}
+		slog.Log(request.Context(), level, "Request",
+			"method", request.Method,
+			"path", request.URL.Path,
+			"status", logged.status,
+			"durationMs", float64(time.Since(started).Microseconds())/1000,
+			"bytesIn", body.read,
+			"bytesOut", logged.written,
+			"ip", clientIP(request),
+		)
+	})
+}
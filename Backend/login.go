@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rather than keep a password, the couple logs in to the admin area with a
+// link emailed to one of the addresses in the config. The link works once,
+// for a few minutes, and swaps itself for a session cookie holding the same
+// kind of session token /admin/login hands out. With two-factor
+// authentication on, the cookie only holds a pending session until a code
+// is sent to /admin/login/verify.
+
+// magicLinkLifetime is how long an emailed login link works for
+const magicLinkLifetime = 15 * time.Minute
+
+// Limits on sending login links, so asking for them over and over can't
+// flood the couple's inbox
+const (
+	// loginEmailRate and loginEmailBurst are how many links a minute each
+	// client IP can ask for, and how many at once
+	loginEmailRate  = 2
+	loginEmailBurst = 3
+	// magicLinkResend is how long after a link is sent to an address before
+	// another one is
+	magicLinkResend = time.Minute
+)
+
+// sessionCookie is the cookie an admin session from a login link is kept in
+const sessionCookie = "admin_session"
+
+// pendingLogin is a login link that has been sent and not yet used
+type pendingLogin struct {
+	email   string
+	expires time.Time
+}
+
+// magicLinkStore keeps the login links that have been sent, in memory, so a
+// restart only means asking for a new one. Links are kept by the hash of
+// their token, so the tokens themselves are only ever in the emails.
+type magicLinkStore struct {
+	mu      sync.Mutex
+	pending map[string]pendingLogin
+}
+
+func newMagicLinkStore() *magicLinkStore {
+	return &magicLinkStore{pending: make(map[string]pendingLogin)}
+}
+
+// hashLoginToken returns what a login link's token is kept as
+func hashLoginToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Issue returns the token of a new login link for email, lasting
+// magicLinkLifetime from now. It reports false, without a link, if one was
+// sent to email less than magicLinkResend ago.
+func (store *magicLinkStore) Issue(email string, now time.Time) (string, bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for hash, login := range store.pending {
+		switch {
+		case !now.Before(login.expires):
+			delete(store.pending, hash)
+		case login.email == email && now.Before(login.expires.Add(magicLinkResend-magicLinkLifetime)):
+			return "", false
+		}
+	}
+	token := randomHex(32)
+	store.pending[hashLoginToken(token)] = pendingLogin{email: email, expires: now.Add(magicLinkLifetime)}
+	return token, true
+}
+
+// Redeem uses up the login link with token, returning the email it was sent
+// to if it hadn't expired at now
+func (store *magicLinkStore) Redeem(token string, now time.Time) (string, bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	hash := hashLoginToken(token)
+	login, ok := store.pending[hash]
+	if !ok {
+		return "", false
+	}
+	delete(store.pending, hash)
+	return login.email, now.Before(login.expires)
+}
+
+// adminEmail returns the admin address matching email, ignoring case, if
+// it is one that can log in
+func adminEmail(email string) (string, bool) {
+	email = strings.TrimSpace(email)
+	for _, admin := range commaList(*adminEmails) {
+		if strings.EqualFold(admin, email) {
+			return admin, true
+		}
+	}
+	return "", false
+}
+
+// apiAddress returns the address request came in on, which links back to
+// the API are made with
+func apiAddress(request *http.Request) string {
+	scheme := "http"
+	if request.TLS != nil || (*trustProxy && request.Header.Get("X-Forwarded-Proto") == "https") {
+		scheme = "https"
+	}
+	return scheme + "://" + request.Host
+}
+
+// emailLoginRequest is the body of a request for a login link
+type emailLoginRequest struct {
+	Email string `json:"email"`
+}
+
+// emailLoginHandler emails a login link to the address given, if it is one
+// of the admin addresses. The answer is the same either way, so it can't be
+// used to find out which addresses can log in. The link is only ever made
+// with the site address from the config, never the one the request came in
+// on, so a forged Host header can't send the token somewhere else.
+func (s *server) emailLoginHandler(response http.ResponseWriter, request *http.Request) {
+	if *adminToken == "" || s.mailer == nil || *adminEmails == "" || *siteURL == "" {
+		writeJSONError(response, http.StatusNotFound, "logging in by email isn't set up")
+		return
+	}
+	var body emailLoginRequest
+	if !decodeJSON(response, request, &body) {
+		return
+	}
+
+	email, ok := adminEmail(body.Email)
+	var token string
+	if ok {
+		token, ok = s.logins.Issue(email, time.Now())
+	}
+	if ok {
+		link := strings.TrimRight(*siteURL, "/") + "/admin/login/link?token=" + url.QueryEscape(token)
+		message := fmt.Sprintf("Here is your link to log in to the wedding site:\n\n%s\n\nIt works once, for the next %d minutes. If you didn't ask for it, you can ignore this email.\n", link, int(magicLinkLifetime.Minutes()))
+		// The link is sent in the background, so the answer doesn't take
+		// longer for an admin address than for any other
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			if err := s.mailer.Send(ctx, email, "Your wedding site login link", message); err != nil {
+				slog.Error("Unable to send login link", "err", err)
+			}
+		}()
+	}
+	writeJSON(response, http.StatusAccepted, map[string]string{"message": "If that address can log in, a link is on its way"})
+}
+
+// loginLinkHandler uses up a login link, starting an admin session in a
+// cookie and sending the browser on to the site
+func (s *server) loginLinkHandler(response http.ResponseWriter, request *http.Request) {
+	if *adminToken == "" {
+		writeJSONError(response, http.StatusForbidden, "the admin API is turned off")
+		return
+	}
+	email, ok := s.logins.Redeem(request.URL.Query().Get("token"), time.Now())
+	if !ok {
+		writeJSONError(response, http.StatusUnauthorized, "This login link has expired or was already used")
+		return
+	}
+	options := sessionOptions{Email: email}
+	next := siteAddress(request) + "/"
+	if s.twoFactor.Enabled() {
+		// The site asks for the code when it is sent back with twoFactor
+		options.Pending = true
+		next += "?twoFactor=1"
+	}
+	session, expires := issueSessionToken(time.Now(), *adminSessionTTL, options)
+	setSessionCookie(response, request, session, expires)
+	response.Header().Set("Cache-Control", "no-store")
+	http.Redirect(response, request, next, http.StatusSeeOther)
+}
+
+// setSessionCookie keeps an admin session token in the browser
+func setSessionCookie(response http.ResponseWriter, request *http.Request, session string, expires time.Time) {
+	http.SetCookie(response, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    session,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(apiAddress(request), "https:"),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// logoutHandler ends the admin session a request was sent with, so its token
+// stops working even if it was copied, and clears the session cookie
+func (s *server) logoutHandler(response http.ResponseWriter, request *http.Request) {
+	if token, ok := adminCredential(request); ok {
+		if claims, ok := verifySessionToken(token, time.Now()); ok {
+			if err := s.revoked.Revoke(claims, time.Now()); err != nil {
+				slog.Error("Unable to end admin session", "err", err)
+				writeJSONError(response, http.StatusInternalServerError, "Unable to log out")
+				return
+			}
+		}
+	}
+	http.SetCookie(response, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(apiAddress(request), "https:"),
+		SameSite: http.SameSiteLaxMode,
+	})
+	response.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Guests who lost their code can find their invitation by name. Names match
+// however they are typed: ignoring case and accents, with common nicknames
+// standing in for the names they are short for, and allowing a letter's
+// typo in longer names. The last name has to match, and at least a first
+// name too, so one surname isn't enough to find someone's invitation.
+
+// nicknameGroups are the first names that are taken to be the same person
+var nicknameGroups = [][]string{
+	{"abigail", "abby", "abbie", "gail"},
+	{"alexander", "alex", "al", "xander", "sandy"},
+	{"alexandra", "alex", "alexa", "lexi", "sandra", "sandy"},
+	{"andrew", "andy", "drew"},
+	{"anthony", "tony"},
+	{"benjamin", "ben", "benny"},
+	{"catherine", "katherine", "kathryn", "cathy", "kathy", "kate", "katie", "kat"},
+	{"charles", "charlie", "chuck", "chas"},
+	{"christine", "christina", "chris", "chrissy", "tina"},
+	{"christopher", "chris", "kit"},
+	{"daniel", "dan", "danny"},
+	{"david", "dave", "davey"},
+	{"deborah", "debra", "deb", "debbie"},
+	{"donald", "don", "donnie"},
+	{"edward", "ed", "eddie", "ned", "ted"},
+	{"elizabeth", "eliza", "liz", "lizzie", "beth", "betty", "libby"},
+	{"frederick", "fred", "freddie"},
+	{"gregory", "greg"},
+	{"henry", "harry", "hank"},
+	{"james", "jim", "jimmy", "jamie"},
+	{"jennifer", "jen", "jenny"},
+	{"jessica", "jess", "jessie"},
+	{"john", "jack", "johnny"},
+	{"jonathan", "jon", "jonny"},
+	{"joseph", "joe", "joey"},
+	{"kenneth", "ken", "kenny"},
+	{"lawrence", "laurence", "larry"},
+	{"margaret", "maggie", "meg", "peggy", "marge"},
+	{"matthew", "matt"},
+	{"michael", "mike", "mikey", "mick"},
+	{"nicholas", "nick", "nicky"},
+	{"patricia", "pat", "patty", "trish"},
+	{"patrick", "pat", "paddy"},
+	{"peter", "pete"},
+	{"philip", "phillip", "phil"},
+	{"rebecca", "becca", "becky"},
+	{"richard", "rich", "rick", "ricky", "dick"},
+	{"robert", "rob", "robbie", "bob", "bobby"},
+	{"ronald", "ron", "ronnie"},
+	{"samantha", "sam", "sammy"},
+	{"samuel", "sam", "sammy"},
+	{"stephen", "steven", "steve"},
+	{"susan", "sue", "suzy"},
+	{"theodore", "theo", "ted", "teddy"},
+	{"thomas", "tom", "tommy"},
+	{"timothy", "tim", "timmy"},
+	{"victoria", "vicky", "tori"},
+	{"william", "will", "bill", "billy", "liam"},
+	{"zachary", "zach", "zack"},
+}
+
+// nicknames maps each name in nicknameGroups to the groups it is in
+var nicknames = func() map[string][]int {
+	groups := make(map[string][]int)
+	for i, group := range nicknameGroups {
+		for _, name := range group {
+			groups[name] = append(groups[name], i)
+		}
+	}
+	return groups
+}()
+
+// foldedLetters are letters that don't come apart into a plain letter and
+// an accent
+var foldedLetters = strings.NewReplacer("ß", "ss", "æ", "ae", "ø", "o", "œ", "oe", "ł", "l", "đ", "d", "ı", "i")
+
+// nameWords splits a name into lower case words without accents, such as
+// "jose", "garcia" for "José García"
+func nameWords(name string) []string {
+	unaccented, _, err := transform.String(transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC), name)
+	if err != nil {
+		unaccented = name
+	}
+	unaccented = foldedLetters.Replace(strings.ToLower(unaccented))
+	return strings.FieldsFunc(unaccented, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '\''
+	})
+}
+
+// sameName reports whether two words of names could be the same name
+func sameName(a, b string) bool {
+	if a == b {
+		return true
+	}
+	for _, i := range nicknames[a] {
+		for _, j := range nicknames[b] {
+			if i == j {
+				return true
+			}
+		}
+	}
+	return len(a) >= 4 && len(b) >= 4 && withinOneEdit(a, b)
+}
+
+// withinOneEdit reports whether a can be made into b by adding, removing,
+// or changing at most one letter
+func withinOneEdit(a, b string) bool {
+	x, y := []rune(a), []rune(b)
+	if len(x) > len(y) {
+		x, y = y, x
+	}
+	if len(y)-len(x) > 1 {
+		return false
+	}
+	i := 0
+	for i < len(x) && x[i] == y[i] {
+		i++
+	}
+	if i == len(x) {
+		return true
+	}
+	if len(x) == len(y) {
+		return string(x[i+1:]) == string(y[i+1:])
+	}
+	return string(x[i:]) == string(y[i+1:])
+}
+
+// namesMatch reports whether what a guest typed could be name. The last
+// words have to match, and every other word typed has to match another word
+// of name.
+func namesMatch(typed, name []string) bool {
+	if len(typed) < 2 || len(name) < 2 || !sameName(typed[len(typed)-1], name[len(name)-1]) {
+		return false
+	}
+	used := make([]bool, len(name)-1)
+	for _, word := range typed[:len(typed)-1] {
+		found := false
+		for i, other := range name[:len(name)-1] {
+			if !used[i] && sameName(word, other) {
+				used[i], found = true, true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Match returns copies of the households with a guest, or a name, matching
+// what a guest typed
+func (store *guestStore) Match(typed string) []*Household {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	words := nameWords(typed)
+	var matches []*Household
+	for _, household := range store.households {
+		matched := namesMatch(words, nameWords(household.Name))
+		for _, guest := range household.Guests {
+			matched = matched || namesMatch(words, nameWords(guest.Name))
+		}
+		if matched {
+			matches = append(matches, household.clone())
+		}
+	}
+	return matches
+}
+
+// matchName finds the invitations matching a typed name, counting it as a
+// guess at a guest's name by the client that sent request. Only a name
+// matching one invitation is a right guess. If the client has to wait before
+// guessing again, nothing is looked up and the wait is returned.
+func (s *server) matchName(request *http.Request, name string) ([]*Household, time.Duration) {
+	var matches []*Household
+	_, wait := s.guesses.guess(request, guessCodes, func() bool {
+		matches = s.guests.Match(name)
+		return len(matches) == 1
+	})
+	return matches, wait
+}
+
+// lookupInvitationHandler finds the invitation of a guest who lost their
+// code by ?name=, the way their name is on the guest list or close to it
+func (s *server) lookupInvitationHandler(response http.ResponseWriter, request *http.Request) {
+	name := request.URL.Query().Get("name")
+	if len(nameWords(name)) < 2 {
+		writeJSONError(response, http.StatusBadRequest, "Please enter your first and last name")
+		return
+	}
+	matches, wait := s.matchName(request, name)
+	if wait > 0 {
+		writeLockedOut(response, wait)
+		return
+	}
+	switch len(matches) {
+	case 0:
+		writeJSONError(response, http.StatusNotFound, "We couldn't find that invitation")
+	case 1:
+		s.writeInvitation(response, matches[0])
+	default:
+		writeJSONError(response, http.StatusConflict, "More than one invitation matches that name. Please enter your full name as it is on your invitation")
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Mailer sends email from the site, such as login links for the couple
+type Mailer interface {
+	// Send emails a plain text message to one address
+	Send(ctx context.Context, to, subject, body string) error
+}
+
+// newMailer returns the mailer set up in the config, or nil if the site
+// doesn't send email
+func newMailer() Mailer {
+	if *smtpAddress == "" {
+		return nil
+	}
+	return &smtpMailer{address: *smtpAddress, username: *smtpUser, password: *smtpPassword, from: *mailFrom}
+}
+
+// smtpMailer sends email through an SMTP server, logging in if it is given
+// a username. The connection is upgraded with STARTTLS when the server
+// offers it.
+type smtpMailer struct {
+	address  string
+	username string
+	password string
+	from     string
+}
+
+func (mailer *smtpMailer) Send(ctx context.Context, to, subject, body string) error {
+	// Addresses are checked before they get here, but a line break in a
+	// header would let one add headers of its own
+	if strings.ContainsAny(to+subject, "\r\n") {
+		return fmt.Errorf("email header contains a line break")
+	}
+	var auth smtp.Auth
+	if mailer.username != "" {
+		host, _, _ := net.SplitHostPort(mailer.address)
+		auth = smtp.PlainAuth("", mailer.username, mailer.password, host)
+	}
+
+	var message strings.Builder
+	fmt.Fprintf(&message, "From: %s\r\n", mailer.from)
+	fmt.Fprintf(&message, "To: %s\r\n", to)
+	fmt.Fprintf(&message, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&message, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	message.WriteString("MIME-Version: 1.0\r\n")
+	message.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	message.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(mailer.address, auth, mailer.from, []string{to}, []byte(message.String()))
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
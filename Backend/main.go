@@ -1,115 +1,526 @@
 package main
 
 import (
-	"fmt"
-    "io"
+	"context"
+	"flag"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
-    "time"
+	"syscall"
 )
 
-const uploadPath = "./uploads"
-
-// uploadHandler handles the file upload
-func uploadHandler(response http.ResponseWriter, request *http.Request) {
-    start := time.Now()
-    var checkpoint time.Time
-
-    // Set CORS headers
-    response.Header().Set("Access-Control-Allow-Origin", "*")  // Allow all origins; for production, specify the allowed domain
-    response.Header().Set("Access-Control-Allow-Methods", "POST")
-    response.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-
-    if request.Method == http.MethodOptions {
-        response.WriteHeader(http.StatusOK)  // Handle preflight requests
-        return
-    }
-
-    // Parse the multipart form
-    err := request.ParseMultipartForm(32 << 20)
-    if err != nil {
-        http.Error(response, "Could not parse form", http.StatusBadRequest)
-        return
-    }
-
-    if request.Method == http.MethodPost {
-        file, header, err := request.FormFile("image")
-            if err != nil {
-            http.Error(response, "Error retrieving the file", http.StatusBadRequest)
-            return
-        }
-		defer file.Close()
-
-        // Limit file size to 100MB
-        if header.Size > 100*1024*1024 {
-            http.Error(response, "file is too large", http.StatusBadRequest)
-            return
-        }
-
-        // Restrict file types to images only
-        allowedTypes := map[string]bool{
-            "image/gif": true,
-            "image/heif": true,
-            "image/jpeg": true,
-            "image/raw": true,
-            "image/png":  true,
-            "image/webp": true,
-        }
-
-        fileType := header.Header.Get("Content-Type")
-        if !allowedTypes[fileType] {
-            http.Error(response, "invalid file type", http.StatusBadRequest)
-            return
-        }
-            
-		// Create the uploads directory if it doesn't exist
-		if _, err := os.Stat(uploadPath); os.IsNotExist(err) {
-			err := os.Mkdir(uploadPath, os.ModePerm)
-			if err != nil {
-				http.Error(response, "Unable to create upload directory\n", http.StatusInternalServerError)
-				return
-			}
+// server holds the state shared between request handlers
+type server struct {
+	photos   PhotoStore
+	workers  *workerPool
+	tus      *tusStore
+	progress *progressHub
+	quotas   *quotaStore
+	guests   *guestStore
+	albums   *albumStore
+	rsvps    RSVPStore
+	// late is the RSVPs sent after the deadline, waiting for the couple
+	late *jsonRSVPStore
+	// deadline is when RSVPs close, if they do
+	deadline *rsvpDeadline
+	seating  *seatingStore
+	songs    *songStore
+	// guestbook is the messages guests have left for the couple
+	guestbook *guestbookStore
+	registry  *registryStore
+	schedule  *scheduleStore
+	travel    *travelStore
+	shuttles  *shuttleStore
+	faq       *faqStore
+	party     *partyStore
+	gifts     *giftStore
+	checkIns  *checkInStore
+	contest   *contestStore
+	advice    *adviceStore
+	streaming *livestreamStore
+	addresses *addressStore
+	storage   Storage
+	capacity  *storageQuota
+	// scanner checks uploads for malware, if it is set
+	scanner Scanner
+	// comments screens comments on photos before they are posted, if it is
+	// set
+	comments CommentFilter
+	// signer makes and checks signed upload URLs, if a signing key is set
+	signer *urlSigner
+	// shares makes and checks share links to photos and albums, if a share
+	// link key is set
+	shares *urlSigner
+	// resized caches photos scaled to the sizes the gallery asks for
+	resized Storage
+	// backups mirrors uploads to a second store, if one is set
+	backups *backupJob
+	// audit records what is done through the admin API
+	audit *auditLog
+	// mailer sends email, if an SMTP server is set
+	mailer Mailer
+	// logins is the login links emailed to the couple
+	logins *magicLinkStore
+	// spam screens what guests send through the forms
+	spam *spamGuard
+	// twoFactor is the couple's two-factor authentication settings
+	twoFactor *twoFactorStore
+	// revoked is the admin sessions that were logged out
+	revoked *revokedSessions
+	// guesses slows down scripts trying guest codes, album passphrases or
+	// two-factor codes
+	guesses *attemptGuard
+	// shutdown is done once the server is asked to stop, which ends live
+	// streams so they don't hold up the requests that can finish
+	shutdown context.Context
+	// feed announces new photos to the live gallery
+	feed *photoFeed
+	// spotify looks up the songs guests request, if a Spotify app is set
+	spotify *spotifyClient
+}
+
+func main() {
+	flag.Parse()
+	if err := loadConfigFile(); err != nil {
+		slog.Error("Unable to load config file", "err", err)
+		os.Exit(1)
+	}
+	if err := setupLogging(); err != nil {
+		slog.Error("Unable to set up logging", "err", err)
+		os.Exit(1)
+	}
+	if err := validateConfig(); err != nil {
+		slog.Error("Invalid config", "err", err)
+		os.Exit(1)
+	}
+
+	if flag.Arg(0) == "migrate-storage" {
+		if err := runMigrateStorage(flag.Args()[1:]); err != nil {
+			slog.Error("Migration failed", "err", err)
+			os.Exit(1)
 		}
+		return
+	}
 
-        // TODO: Hash images to prevent repeats
-        
-        
-        // TODO: Compress files
+	rawStorage, err := newStorage(context.Background())
+	if err != nil {
+		slog.Error("Unable to set up storage", "err", err)
+		os.Exit(1)
+	}
+	storage, err := withEncryption(rawStorage)
+	if err != nil {
+		slog.Error("Unable to set up encryption", "err", err)
+		os.Exit(1)
+	}
+	photos, err := openPhotoStore()
+	if err != nil {
+		slog.Error("Unable to load photo index", "err", err)
+		os.Exit(1)
+	}
+	if err := migrateFlatLayout(context.Background(), storage, photos); err != nil {
+		slog.Error("Unable to move photos into the storage layout", "err", err)
+		os.Exit(1)
+	}
+	tus, err := newTusStore(filepath.Join(*uploadDir, ".tus"))
+	if err != nil {
+		slog.Error("Unable to create resumable upload directory", "err", err)
+		os.Exit(1)
+	}
+	quotas, err := openQuotaStore(filepath.Join(*uploadDir, "quotas.json"), *guestMaxBytes, *guestMaxPhotos)
+	if err != nil {
+		slog.Error("Unable to load upload quotas", "err", err)
+		os.Exit(1)
+	}
+	guests, err := openGuestStore(dataFile(*guestsFile, "guests.json"))
+	if err != nil {
+		slog.Error("Unable to load guest list", "err", err)
+		os.Exit(1)
+	}
+	rsvps, err := openRSVPStore(photos)
+	if err != nil {
+		slog.Error("Unable to load RSVPs", "err", err)
+		os.Exit(1)
+	}
+	late, err := openJSONRSVPStore(filepath.Join(*uploadDir, "late-rsvps.json"))
+	if err != nil {
+		slog.Error("Unable to load late RSVPs", "err", err)
+		os.Exit(1)
+	}
+	deadline, err := newRSVPDeadline(*rsvpDeadlineDate, *lateRSVPMode)
+	if err != nil {
+		slog.Error("Unable to set up RSVP deadline", "err", err)
+		os.Exit(1)
+	}
+	albums, err := openAlbumStore(filepath.Join(*uploadDir, "albums.json"))
+	if err != nil {
+		slog.Error("Unable to load albums", "err", err)
+		os.Exit(1)
+	}
+	seating, err := openSeatingStore(filepath.Join(*uploadDir, "seating.json"))
+	if err != nil {
+		slog.Error("Unable to load seating chart", "err", err)
+		os.Exit(1)
+	}
+	songs, err := openSongStore(filepath.Join(*uploadDir, "songs.json"))
+	if err != nil {
+		slog.Error("Unable to load song requests", "err", err)
+		os.Exit(1)
+	}
+	guestbook, err := openGuestbookStore(filepath.Join(*uploadDir, "guestbook.json"))
+	if err != nil {
+		slog.Error("Unable to load guestbook", "err", err)
+		os.Exit(1)
+	}
+	registry, err := openRegistryStore(filepath.Join(*uploadDir, "registry.json"))
+	if err != nil {
+		slog.Error("Unable to load registry", "err", err)
+		os.Exit(1)
+	}
+	schedule, err := openScheduleStore(filepath.Join(*uploadDir, "schedule.json"))
+	if err != nil {
+		slog.Error("Unable to load schedule", "err", err)
+		os.Exit(1)
+	}
+	travel, err := openTravelStore(filepath.Join(*uploadDir, "travel.json"))
+	if err != nil {
+		slog.Error("Unable to load travel information", "err", err)
+		os.Exit(1)
+	}
+	shuttles, err := openShuttleStore(filepath.Join(*uploadDir, "shuttles.json"))
+	if err != nil {
+		slog.Error("Unable to load shuttle signups", "err", err)
+		os.Exit(1)
+	}
+	faq, err := openFAQStore(filepath.Join(*uploadDir, "faq.json"))
+	if err != nil {
+		slog.Error("Unable to load FAQ", "err", err)
+		os.Exit(1)
+	}
+	party, err := openPartyStore(filepath.Join(*uploadDir, "party.json"))
+	if err != nil {
+		slog.Error("Unable to load wedding party", "err", err)
+		os.Exit(1)
+	}
+	gifts, err := openGiftStore(filepath.Join(*uploadDir, "gifts.json"))
+	if err != nil {
+		slog.Error("Unable to load gifts", "err", err)
+		os.Exit(1)
+	}
+	checkIns, err := openCheckInStore(filepath.Join(*uploadDir, "checkins.json"))
+	if err != nil {
+		slog.Error("Unable to load check-ins", "err", err)
+		os.Exit(1)
+	}
+	contest, err := openContestStore(filepath.Join(*uploadDir, "contest.json"))
+	if err != nil {
+		slog.Error("Unable to load photo contest", "err", err)
+		os.Exit(1)
+	}
+	advice, err := openAdviceStore(filepath.Join(*uploadDir, "advice.json"), *adviceRelease, *weddingDate)
+	if err != nil {
+		slog.Error("Unable to load advice", "err", err)
+		os.Exit(1)
+	}
+	streaming, err := openLivestreamStore(filepath.Join(*uploadDir, "livestream.json"))
+	if err != nil {
+		slog.Error("Unable to load livestream", "err", err)
+		os.Exit(1)
+	}
+	addresses, err := openAddressStore(filepath.Join(*uploadDir, "addresses.json"))
+	if err != nil {
+		slog.Error("Unable to load addresses", "err", err)
+		os.Exit(1)
+	}
+	twoFactor, err := openTwoFactorStore(filepath.Join(*uploadDir, "admin-2fa.json"))
+	if err != nil {
+		slog.Error("Unable to load two-factor settings", "err", err)
+		os.Exit(1)
+	}
+	revoked, err := openRevokedSessions(filepath.Join(*uploadDir, "revoked-sessions.json"))
+	if err != nil {
+		slog.Error("Unable to load revoked admin sessions", "err", err)
+		os.Exit(1)
+	}
+	retention, err := loadRetentionPolicy(dataFile(*retentionFile, "retention.json"), *weddingDate, *retentionDryRun)
+	if err != nil {
+		slog.Error("Unable to load retention rules", "err", err)
+		os.Exit(1)
+	}
+	backupStorage, err := newBackupStorage(context.Background())
+	if err != nil {
+		slog.Error("Unable to set up backup storage", "err", err)
+		os.Exit(1)
+	}
+	resized, err := newResizeCache()
+	if err != nil {
+		slog.Error("Unable to set up resize cache", "err", err)
+		os.Exit(1)
+	}
+	feed := newPhotoFeed()
+	workers := newWorkerPool(photos, storage, newModerator(), feed, *workerCount, *queueSize)
+	go workers.requeuePending(context.Background())
+	retention.schedule(storage, photos, quotas, *retentionEvery)
 
+	// Stopping the server with Ctrl-C or SIGTERM lets requests in progress
+	// finish first
+	shutdown, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-		
-        // Create a file in the uploads directory
-		destFile, err := os.Create(filepath.Join(uploadPath, time.Now().String()))
+	s := &server{
+		photos:    photos,
+		workers:   workers,
+		tus:       tus,
+		progress:  newProgressHub(),
+		quotas:    quotas,
+		guests:    guests,
+		albums:    albums,
+		rsvps:     rsvps,
+		late:      late,
+		deadline:  deadline,
+		seating:   seating,
+		songs:     songs,
+		storage:   storage,
+		resized:   resized,
+		capacity:  newStorageQuota(storage, *storageLimit),
+		scanner:   newScanner(),
+		comments:  newCommentFilter(),
+		feed:      feed,
+		spotify:   newSpotifyClient(),
+		guestbook: guestbook,
+		registry:  registry,
+		schedule:  schedule,
+		travel:    travel,
+		shuttles:  shuttles,
+		faq:       faq,
+		party:     party,
+		gifts:     gifts,
+		checkIns:  checkIns,
+		contest:   contest,
+		advice:    advice,
+		streaming: streaming,
+		addresses: addresses,
+		audit:     &auditLog{path: filepath.Join(*uploadDir, "admin-audit.jsonl")},
+		mailer:    newMailer(),
+		logins:    newMagicLinkStore(),
+		spam:      newSpamGuard(),
+		twoFactor: twoFactor,
+		revoked:   revoked,
+		guesses:   newAttemptGuard(),
+		shutdown:  shutdown,
+	}
+	if *signingKey != "" {
+		s.signer = newURLSigner(*signingKey)
+	}
+	if *shareKey != "" {
+		s.shares = newURLSigner(*shareKey)
+	}
+	if backupStorage != nil {
+		s.backups, err = newBackupJob(rawStorage, backupStorage, photos, *backupInterval)
 		if err != nil {
-			http.Error(response, "Unable to create file\n", http.StatusInternalServerError)
-			return
+			slog.Error("Unable to set up backups", "err", err)
+			os.Exit(1)
 		}
-		defer destFile.Close()
+	}
 
-        // TODO: Reformat images to webp for size
+	limiter := newRateLimiter(*uploadRate, *uploadBurst, "Too many uploads, please wait a minute and try again")
+	// loginEmails keeps login link requests from flooding the couple's inbox
+	loginEmails := newRateLimiter(loginEmailRate, loginEmailBurst, "Too many login links asked for, please wait a minute and try again")
+	idempotency := newIdempotencyStore()
 
-		// Copy the uploaded file to the destination file
-		_, err = io.Copy(destFile, file)
-		if err != nil {
-			http.Error(response, "Unable to save file\n", http.StatusInternalServerError)
-			return
-		}
+	http.HandleFunc("/uploadimage", idempotency.middleware(limiter.middleware(s.signed(s.uploadHandler))))
+	http.HandleFunc("PUT /upload/raw", idempotency.middleware(limiter.middleware(s.signed(s.rawUploadHandler))))
+	http.HandleFunc("POST /upload/sign", s.signHandler)
+	http.HandleFunc("GET /upload/progress/{uploadID}", s.progressHandler)
+	http.HandleFunc("GET /backup/status", s.admin(s.backupStatusHandler))
 
-		fmt.Fprintf(response, "File successfully uploaded\n")
-	} else {
-		http.Error(response, "Invalid request method\n", http.StatusMethodNotAllowed)
-	}
+	// Admin sessions
+	http.HandleFunc("POST /admin/login", s.adminLoginHandler)
+	http.HandleFunc("POST /admin/login/verify", s.verifyLoginHandler)
+	http.HandleFunc("POST /admin/login/email", loginEmails.middleware(s.emailLoginHandler))
+	http.HandleFunc("GET /admin/login/link", s.loginLinkHandler)
+	http.HandleFunc("POST /admin/logout", s.logoutHandler)
+	http.HandleFunc("GET /admin/audit", s.admin(s.auditHandler))
+	http.HandleFunc("GET /admin/2fa", s.admin(s.twoFactorStatusHandler))
+	http.HandleFunc("POST /admin/2fa/enroll", s.admin(s.enrollTwoFactorHandler))
+	http.HandleFunc("POST /admin/2fa/confirm", s.admin(s.confirmTwoFactorHandler))
+	http.HandleFunc("DELETE /admin/2fa", s.admin(s.disableTwoFactorHandler))
 
-    checkpoint = time.Now()
-    fmt.Printf("Saved to file @ %s\n\tSaved in: %v\n", time.Now().String(), checkpoint.Sub(start));
-}
+	// Gallery
+	http.HandleFunc("GET /photos", s.listPhotosHandler)
+	http.HandleFunc("GET /photos/archive.zip", s.admin(s.archiveHandler))
+	http.HandleFunc("GET /photos/random", s.randomPhotoHandler)
+	http.HandleFunc("GET /photos/search", s.searchPhotosHandler)
+	http.HandleFunc("GET /photos/live", s.liveFeedHandler)
+	http.HandleFunc("GET /photos/mine", s.myUploadsHandler)
+	http.HandleFunc("GET /photos/{id}", s.photoHandler)
+	http.HandleFunc("GET /photos/{id}/thumb/{size}", s.thumbnailHandler)
+	http.HandleFunc("GET /photos/{id}/meta", s.photoMetaHandler)
+	http.HandleFunc("DELETE /photos/{id}", s.admin(s.deletePhotoHandler))
+	http.HandleFunc("POST /photos/{id}/keep", s.admin(s.keepPhotoHandler))
+	http.HandleFunc("POST /photos/{id}/like", s.likeHandler)
+	http.HandleFunc("DELETE /photos/{id}/like", s.unlikeHandler)
+	http.HandleFunc("GET /photos/{id}/comments", s.commentsHandler)
+	http.HandleFunc("POST /photos/{id}/comments", s.postCommentHandler)
+	http.HandleFunc("POST /photos/{id}/report", s.reportHandler)
 
-func main() {
-	http.HandleFunc("/uploadimage", uploadHandler)
-	fmt.Println("Server started at http://localhost:8085")
-	if err := http.ListenAndServe(":8085", nil); err != nil {
-		fmt.Println("Server failed:", err)
+	// Moderation
+	http.HandleFunc("GET /reports", s.admin(s.listReportsHandler))
+	http.HandleFunc("POST /reports/{id}/dismiss", s.admin(s.dismissReportsHandler))
+	http.HandleFunc("GET /review", s.admin(s.reviewQueueHandler))
+	http.HandleFunc("GET /review/{id}/file", s.admin(s.reviewFileHandler))
+	http.HandleFunc("POST /review/{id}/approve", s.admin(s.approvePhotoHandler))
+	http.HandleFunc("POST /review/{id}/reject", s.admin(s.rejectPhotoHandler))
+
+	// Albums
+	http.HandleFunc("GET /albums", s.listAlbumsHandler)
+	http.HandleFunc("POST /albums", s.admin(s.createAlbumHandler))
+	http.HandleFunc("GET /albums/{id}", s.albumHandler)
+	http.HandleFunc("POST /albums/{id}/unlock", s.unlockAlbumHandler)
+	http.HandleFunc("PATCH /albums/{id}", s.admin(s.updateAlbumHandler))
+	http.HandleFunc("DELETE /albums/{id}", s.admin(s.deleteAlbumHandler))
+	http.HandleFunc("POST /albums/{id}/photos", s.admin(s.addAlbumPhotosHandler))
+	http.HandleFunc("DELETE /albums/{id}/photos/{photoID}", s.admin(s.removeAlbumPhotoHandler))
+
+	// Sharing
+	http.HandleFunc("POST /share", s.admin(s.shareHandler))
+	http.HandleFunc("GET /shared/photos/{id}", s.sharedPhotoHandler)
+	http.HandleFunc("GET /shared/albums/{id}", s.sharedAlbumHandler)
+	http.HandleFunc("GET /shared/albums/{id}/photos/{photoID}", s.sharedAlbumPhotoHandler)
+
+	// Guest list
+	http.HandleFunc("GET /households", s.admin(s.listHouseholdsHandler))
+	http.HandleFunc("POST /households", s.admin(s.createHouseholdHandler))
+	http.HandleFunc("GET /households/{id}", s.admin(s.householdHandler))
+	http.HandleFunc("PATCH /households/{id}", s.admin(s.updateHouseholdHandler))
+	http.HandleFunc("DELETE /households/{id}", s.admin(s.deleteHouseholdHandler))
+	http.HandleFunc("POST /households/{id}/guests", s.admin(s.addGuestHandler))
+	http.HandleFunc("PATCH /households/{id}/guests/{guestID}", s.admin(s.updateGuestHandler))
+	http.HandleFunc("DELETE /households/{id}/guests/{guestID}", s.admin(s.deleteGuestHandler))
+
+	// Mailing addresses for the save-the-dates
+	http.HandleFunc("POST /addresses", s.submitAddressHandler)
+	http.HandleFunc("GET /addresses", s.admin(s.listAddressesHandler))
+	http.HandleFunc("POST /addresses/{id}/confirm", s.admin(s.confirmAddressHandler))
+	http.HandleFunc("DELETE /addresses/{id}", s.admin(s.deleteAddressHandler))
+
+	// QR codes for printed invitations and table cards
+	http.HandleFunc("GET /qr/gallery", s.galleryQRHandler)
+	http.HandleFunc("GET /qr/households/{id}", s.admin(s.householdQRHandler))
+
+	// RSVPs
+	http.HandleFunc("GET /rsvp", s.invitationHandler)
+	http.HandleFunc("GET /rsvp/lookup", s.lookupInvitationHandler)
+	http.HandleFunc("POST /rsvp", s.submitRSVPHandler)
+	http.HandleFunc("GET /rsvps", s.admin(s.listRSVPsHandler))
+	http.HandleFunc("GET /rsvps/meals", s.admin(s.mealCountsHandler))
+	http.HandleFunc("GET /rsvps/events", s.admin(s.eventCountsHandler))
+	http.HandleFunc("GET /rsvps/export", s.admin(s.exportRSVPsHandler))
+	http.HandleFunc("GET /rsvps/late", s.admin(s.listLateRSVPsHandler))
+	http.HandleFunc("POST /rsvps/late/{code}/approve", s.admin(s.approveLateRSVPHandler))
+	http.HandleFunc("DELETE /rsvps/late/{code}", s.admin(s.declineLateRSVPHandler))
+
+	// Seating
+	http.HandleFunc("GET /tables", s.admin(s.seatingChartHandler))
+	http.HandleFunc("POST /tables", s.admin(s.createTableHandler))
+	http.HandleFunc("PATCH /tables/{id}", s.admin(s.updateTableHandler))
+	http.HandleFunc("DELETE /tables/{id}", s.admin(s.deleteTableHandler))
+	http.HandleFunc("POST /tables/{id}/seats", s.admin(s.seatAttendeeHandler))
+	http.HandleFunc("DELETE /tables/{id}/seats/{code}/{attendeeID}", s.admin(s.unseatAttendeeHandler))
+	http.HandleFunc("GET /seating", s.guestSeatingHandler)
+
+	// Song requests
+	http.HandleFunc("POST /songs", s.songRequestHandler)
+	http.HandleFunc("GET /songs", s.admin(s.listSongsHandler))
+	http.HandleFunc("DELETE /songs/{id}", s.admin(s.deleteSongHandler))
+
+	// Guestbook
+	http.HandleFunc("GET /forms/token", s.formTokenHandler)
+	http.HandleFunc("GET /guestbook", s.guestbookHandler)
+	http.HandleFunc("POST /guestbook", s.signGuestbookHandler)
+	http.HandleFunc("PATCH /guestbook/{id}", s.admin(s.moderateGuestbookHandler))
+	http.HandleFunc("DELETE /guestbook/{id}", s.admin(s.deleteGuestbookHandler))
+
+	// Registry
+	http.HandleFunc("GET /registry", s.registryHandler)
+	http.HandleFunc("POST /registry", s.admin(s.createRegistryHandler))
+	http.HandleFunc("PATCH /registry/{id}", s.admin(s.updateRegistryHandler))
+	http.HandleFunc("DELETE /registry/{id}", s.admin(s.deleteRegistryHandler))
+
+	// Schedule
+	http.HandleFunc("GET /schedule", s.scheduleHandler)
+	http.HandleFunc("GET /schedule.ics", s.scheduleCalendarHandler)
+	http.HandleFunc("POST /schedule", s.admin(s.createScheduleHandler))
+	http.HandleFunc("PATCH /schedule/{id}", s.admin(s.updateScheduleHandler))
+	http.HandleFunc("DELETE /schedule/{id}", s.admin(s.deleteScheduleHandler))
+
+	// Travel
+	http.HandleFunc("GET /travel", s.travelHandler)
+	http.HandleFunc("POST /travel", s.admin(s.createTravelHandler))
+	http.HandleFunc("PATCH /travel/{id}", s.admin(s.updateTravelHandler))
+	http.HandleFunc("DELETE /travel/{id}", s.admin(s.deleteTravelHandler))
+	http.HandleFunc("POST /travel/{id}/signup", s.shuttleSignupHandler)
+	http.HandleFunc("DELETE /travel/{id}/signup", s.cancelShuttleSignupHandler)
+	http.HandleFunc("GET /shuttles/manifest", s.admin(s.shuttleManifestHandler))
+
+	// FAQ
+	http.HandleFunc("GET /faq", s.faqHandler)
+	http.HandleFunc("POST /faq", s.admin(s.createFAQHandler))
+	http.HandleFunc("PATCH /faq/{key}", s.admin(s.updateFAQHandler))
+	http.HandleFunc("DELETE /faq/{key}", s.admin(s.deleteFAQHandler))
+
+	// Wedding party
+	http.HandleFunc("GET /party", s.partyHandler)
+	http.HandleFunc("POST /party", s.admin(s.createPartyMemberHandler))
+	http.HandleFunc("PATCH /party/{id}", s.admin(s.updatePartyMemberHandler))
+	http.HandleFunc("DELETE /party/{id}", s.admin(s.deletePartyMemberHandler))
+
+	// Gifts and thank-you notes
+	http.HandleFunc("GET /gifts", s.admin(s.listGiftsHandler))
+	http.HandleFunc("POST /gifts", s.admin(s.createGiftHandler))
+	http.HandleFunc("PATCH /gifts/{id}", s.admin(s.updateGiftHandler))
+	http.HandleFunc("DELETE /gifts/{id}", s.admin(s.deleteGiftHandler))
+
+	// Check-in at the venue
+	http.HandleFunc("POST /checkin", s.admin(s.checkInHandler))
+	http.HandleFunc("GET /checkin", s.admin(s.arrivalsHandler))
+	http.HandleFunc("GET /checkin/live", s.liveArrivalsHandler)
+	http.HandleFunc("DELETE /checkin/{id}", s.admin(s.undoCheckInHandler))
+
+	// Photo contest
+	http.HandleFunc("GET /contest", s.contestHandler)
+	http.HandleFunc("POST /contest", s.admin(s.createCategoryHandler))
+	http.HandleFunc("PATCH /contest/{id}", s.admin(s.updateCategoryHandler))
+	http.HandleFunc("DELETE /contest/{id}", s.admin(s.deleteCategoryHandler))
+	http.HandleFunc("POST /contest/{id}/vote", s.voteHandler)
+	http.HandleFunc("DELETE /contest/{id}/vote", s.unvoteHandler)
+	http.HandleFunc("GET /contest/{id}/tally", s.admin(s.tallyHandler))
+	http.HandleFunc("POST /contest/{id}/reveal", s.admin(s.revealHandler))
+
+	// Advice for the couple
+	http.HandleFunc("GET /advice", s.admin(s.adviceHandler))
+	http.HandleFunc("POST /advice", s.leaveAdviceHandler)
+
+	// Livestream
+	http.HandleFunc("GET /livestream", s.livestreamHandler)
+	http.HandleFunc("GET /livestream/live", s.liveStreamEventsHandler)
+	http.HandleFunc("PATCH /livestream", s.admin(s.updateLivestreamHandler))
+
+	// Resumable uploads
+	http.HandleFunc("OPTIONS /upload/tus/", s.tusOptionsHandler)
+	http.HandleFunc("POST /upload/tus/", limiter.middleware(s.signed(s.tusCreateHandler)))
+	http.HandleFunc("HEAD /upload/tus/{id}", s.tusHeadHandler)
+	http.HandleFunc("PATCH /upload/tus/{id}", s.tusPatchHandler)
+	http.HandleFunc("DELETE /upload/tus/{id}", s.tusDeleteHandler)
+	if err := listen(shutdown, logRequests(s.audit.middleware(securityHeaders(newCORSPolicy(*corsOrigins).middleware(http.DefaultServeMux))))); err != nil {
+		// Requests that didn't finish in time may still queue photos, so the
+		// queue is left as it is
+		slog.Error("Server failed", "err", err)
+		return
 	}
+	// Photos that were uploaded are processed before the server exits, so
+	// none are left waiting for variants that never come
+	s.workers.Close()
+	slog.Info("Server stopped")
 }
-
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// runMigrateStorage copies every stored file, and the metadata kept with
+// them, from one storage backend to another, checking each copy against the
+// hash of the original. It is run as
+//
+//	backend migrate-storage -from local -to s3
+//
+// with the backends set up by the usual config. Files are copied as they
+// are stored, so encrypted files stay encrypted. A SQLite photo index is
+// copied from a snapshot, since the database can't be copied safely while
+// the server is using it.
+func runMigrateStorage(args []string) error {
+	flags := flag.NewFlagSet("migrate-storage", flag.ExitOnError)
+	from := flags.String("from", "local", "storage backend to copy from: local, s3 or gcs")
+	to := flags.String("to", "", "storage backend to copy to: local, s3 or gcs")
+	fromDir := flags.String("from-dir", *uploadDir, "directory to copy from with local storage")
+	toDir := flags.String("to-dir", "./migrated", "directory to copy to with local storage")
+	flags.Parse(args)
+
+	if *to == "" {
+		return errors.New("-to must be set")
+	}
+	if *from == *to && (*from != "local" || filepath.Clean(*fromDir) == filepath.Clean(*toDir)) {
+		return errors.New("can't migrate storage onto itself")
+	}
+
+	ctx := context.Background()
+	source, err := openStorage(ctx, *from, *fromDir)
+	if err != nil {
+		return fmt.Errorf("opening %s storage: %w", *from, err)
+	}
+	target, err := openStorage(ctx, *to, *toDir)
+	if err != nil {
+		return fmt.Errorf("opening %s storage: %w", *to, err)
+	}
+
+	listed, err := source.List(ctx, "")
+	if err != nil {
+		return fmt.Errorf("listing %s storage: %w", *from, err)
+	}
+	var objects []ObjectInfo
+	for _, object := range listed {
+		if !isDataFile(object.Name) {
+			objects = append(objects, object)
+		}
+	}
+	for i, object := range objects {
+		fmt.Printf("[%d/%d] %s (%s)\n", i+1, len(objects), object.Name, formatBytes(object.Size))
+		if err := migrateObject(ctx, source, target, object.Name); err != nil {
+			return fmt.Errorf("copying %s: %w", object.Name, err)
+		}
+	}
+
+	// The metadata is kept in the uploads directory whatever the backend, so
+	// a copy goes alongside the files unless that is where they are going
+	if *to != "local" || filepath.Clean(*toDir) != filepath.Clean(*uploadDir) {
+		for _, name := range metadataFiles {
+			file, err := os.Open(filepath.Join(*uploadDir, name))
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			err = putFile(ctx, target, name, file)
+			file.Close()
+			if err != nil {
+				return fmt.Errorf("copying %s: %w", name, err)
+			}
+		}
+		if *metadataBackend == "sqlite" {
+			store, err := openSQLitePhotoStore(dataFile(*sqlitePath, "photos.db"))
+			if err != nil {
+				return fmt.Errorf("opening photo index: %w", err)
+			}
+			err = putSnapshot(ctx, target, store)
+			store.db.Close()
+			if err != nil {
+				return fmt.Errorf("copying photo index: %w", err)
+			}
+		}
+	}
+
+	fmt.Printf("Copied %d files from %s to %s storage\n", len(objects), *from, *to)
+	return nil
+}
+
+// migrateObject copies one file and checks the copy reads back the same
+func migrateObject(ctx context.Context, source, target Storage, name string) error {
+	src, err := source.Get(ctx, name)
+	if err != nil {
+		return err
+	}
+	hash := sha256.New()
+	err = target.Put(ctx, name, io.TeeReader(src, hash))
+	src.Close()
+	if err != nil {
+		return err
+	}
+
+	copied, err := target.Get(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer copied.Close()
+	check := sha256.New()
+	if _, err := io.Copy(check, copied); err != nil {
+		return err
+	}
+	if !bytes.Equal(hash.Sum(nil), check.Sum(nil)) {
+		return errors.New("copy doesn't match the original")
+	}
+	return nil
+}
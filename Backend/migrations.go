@@ -0,0 +1,84 @@
+package main
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path"
+	"strings"
+	"time"
+)
+
+// migrationFiles holds the schema of each database the metadata can be kept
+// in, as numbered SQL files under migrations/<database>/
+//
+//go:embed migrations
+var migrationFiles embed.FS
+
+// runMigrations applies the migrations for database that haven't been
+// applied yet, in order, each in its own transaction
+func runMigrations(db *sql.DB, database string) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		name TEXT PRIMARY KEY,
+		applied_at TIMESTAMP NOT NULL
+	)`); err != nil {
+		return err
+	}
+
+	applied := make(map[string]bool)
+	rows, err := db.Query(`SELECT name FROM schema_migrations`)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		applied[name] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	dir := path.Join("migrations", database)
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, ".sql") || applied[name] {
+			continue
+		}
+		migration, err := fs.ReadFile(migrationFiles, path.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		if err := applyMigration(db, name, string(migration)); err != nil {
+			return fmt.Errorf("migration %s: %w", name, err)
+		}
+		slog.Info("Applied database migration", "migration", name)
+	}
+	return nil
+}
+
+// applyMigration runs one migration and records that it was applied
+func applyMigration(db *sql.DB, name, migration string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migration); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO schema_migrations (name, applied_at) VALUES ($1, $2)`, name, time.Now().UTC()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
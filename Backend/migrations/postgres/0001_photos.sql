@@ -0,0 +1,27 @@
+CREATE TABLE photos (
+    id                TEXT PRIMARY KEY,
+    kind              TEXT NOT NULL,
+    file              TEXT NOT NULL,
+    original_filename TEXT NOT NULL DEFAULT '',
+    directory         TEXT NOT NULL DEFAULT '',
+    uploader          TEXT NOT NULL DEFAULT '',
+    caption           TEXT NOT NULL DEFAULT '',
+    event             TEXT NOT NULL DEFAULT '',
+    hash              TEXT NOT NULL UNIQUE,
+    content_type      TEXT NOT NULL,
+    status            TEXT NOT NULL,
+    size              BIGINT NOT NULL DEFAULT 0,
+    uploaded_at       TIMESTAMPTZ NOT NULL,
+    review_reason     TEXT NOT NULL DEFAULT '',
+    taken_at          TIMESTAMPTZ,
+    camera_make       TEXT NOT NULL DEFAULT '',
+    camera_model      TEXT NOT NULL DEFAULT '',
+    orientation       INTEGER NOT NULL DEFAULT 0,
+    perceptual_hash   TEXT NOT NULL DEFAULT '',
+    photo_group       TEXT NOT NULL DEFAULT '',
+    video             TEXT,
+    variants          TEXT NOT NULL DEFAULT '{}'
+);
+
+CREATE INDEX photos_status ON photos (status);
+CREATE INDEX photos_uploaded_at ON photos (uploaded_at);
@@ -0,0 +1,3 @@
+ALTER TABLE photos ADD COLUMN album TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX photos_album ON photos (album);
@@ -0,0 +1,6 @@
+CREATE TABLE likes (
+    photo_id TEXT NOT NULL,
+    liker    TEXT NOT NULL,
+    liked_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (photo_id, liker)
+);
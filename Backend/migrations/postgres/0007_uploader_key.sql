@@ -0,0 +1,3 @@
+ALTER TABLE photos ADD COLUMN uploader_key TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX photos_uploader_key ON photos (uploader_key);
@@ -0,0 +1,9 @@
+CREATE TABLE rsvps (
+    code         TEXT PRIMARY KEY,
+    name         TEXT NOT NULL,
+    events       TEXT NOT NULL,
+    party_size   INTEGER NOT NULL,
+    notes        TEXT NOT NULL DEFAULT '',
+    submitted_at TIMESTAMP NOT NULL,
+    updated_at   TIMESTAMP NOT NULL
+);
@@ -0,0 +1 @@
+ALTER TABLE rsvps ADD COLUMN attendees TEXT NOT NULL DEFAULT '[]';
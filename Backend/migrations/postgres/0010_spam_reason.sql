@@ -0,0 +1 @@
+ALTER TABLE rsvps ADD COLUMN spam_reason TEXT NOT NULL DEFAULT '';
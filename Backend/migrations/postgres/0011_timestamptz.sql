@@ -0,0 +1,6 @@
+-- Times were always written in UTC, so that is what they are taken to be
+ALTER TABLE likes ALTER COLUMN liked_at TYPE TIMESTAMPTZ USING liked_at AT TIME ZONE 'UTC';
+ALTER TABLE comments ALTER COLUMN created_at TYPE TIMESTAMPTZ USING created_at AT TIME ZONE 'UTC';
+ALTER TABLE reports ALTER COLUMN created_at TYPE TIMESTAMPTZ USING created_at AT TIME ZONE 'UTC';
+ALTER TABLE rsvps ALTER COLUMN submitted_at TYPE TIMESTAMPTZ USING submitted_at AT TIME ZONE 'UTC';
+ALTER TABLE rsvps ALTER COLUMN updated_at TYPE TIMESTAMPTZ USING updated_at AT TIME ZONE 'UTC';
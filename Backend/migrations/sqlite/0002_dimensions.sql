@@ -0,0 +1,2 @@
+ALTER TABLE photos ADD COLUMN width INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE photos ADD COLUMN height INTEGER NOT NULL DEFAULT 0;
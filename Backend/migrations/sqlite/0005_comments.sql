@@ -0,0 +1,9 @@
+CREATE TABLE comments (
+    id         TEXT PRIMARY KEY,
+    photo_id   TEXT NOT NULL,
+    author     TEXT NOT NULL,
+    body       TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX comments_photo_id ON comments (photo_id, created_at);
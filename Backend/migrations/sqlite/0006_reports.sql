@@ -0,0 +1,8 @@
+CREATE TABLE reports (
+    photo_id   TEXT NOT NULL,
+    reporter   TEXT NOT NULL,
+    reason     TEXT NOT NULL,
+    details    TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (photo_id, reporter)
+);
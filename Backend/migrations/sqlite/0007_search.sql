@@ -0,0 +1,35 @@
+-- Captions, uploaders and comments are indexed for searching the gallery.
+-- The triggers keep the index up to date as photos and comments change.
+CREATE VIRTUAL TABLE photo_search USING fts5(
+    photo_id UNINDEXED,
+    caption,
+    uploader,
+    comments,
+    tokenize = 'porter unicode61 remove_diacritics 2'
+);
+
+INSERT INTO photo_search (photo_id, caption, uploader, comments)
+SELECT id, caption, uploader, COALESCE((SELECT group_concat(body, ' ') FROM comments WHERE comments.photo_id = photos.id), '')
+FROM photos;
+
+CREATE TRIGGER photo_search_insert AFTER INSERT ON photos BEGIN
+    INSERT INTO photo_search (photo_id, caption, uploader, comments) VALUES (new.id, new.caption, new.uploader, '');
+END;
+
+CREATE TRIGGER photo_search_update AFTER UPDATE OF caption, uploader ON photos BEGIN
+    UPDATE photo_search SET caption = new.caption, uploader = new.uploader WHERE photo_id = new.id;
+END;
+
+CREATE TRIGGER photo_search_delete AFTER DELETE ON photos BEGIN
+    DELETE FROM photo_search WHERE photo_id = old.id;
+END;
+
+CREATE TRIGGER photo_search_comment_insert AFTER INSERT ON comments BEGIN
+    UPDATE photo_search SET comments = comments || ' ' || new.body WHERE photo_id = new.photo_id;
+END;
+
+CREATE TRIGGER photo_search_comment_delete AFTER DELETE ON comments BEGIN
+    UPDATE photo_search
+    SET comments = COALESCE((SELECT group_concat(body, ' ') FROM comments WHERE photo_id = old.photo_id), '')
+    WHERE photo_id = old.photo_id;
+END;
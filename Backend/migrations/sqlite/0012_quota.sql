@@ -0,0 +1,2 @@
+ALTER TABLE photos ADD COLUMN quota_key TEXT NOT NULL DEFAULT '';
+ALTER TABLE photos ADD COLUMN quota_size INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+)
+
+// myUpload is how a guest's own upload is listed, with how far along
+// processing it is
+type myUpload struct {
+	photoSummary
+	Status string `json:"status"`
+}
+
+// myUploads is every upload of one guest, newest first. Counts has how many
+// of them are in each processing state, so the frontend can say something
+// like "3 of your 5 photos are live, 2 still processing".
+type myUploads struct {
+	Photos []myUpload     `json:"photos"`
+	Counts map[string]int `json:"counts"`
+	Total  int            `json:"total"`
+}
+
+// myUploadsHandler lists the uploads of the guest a request is from, told
+// apart by their guest code or device token the same way as likes, whatever
+// state they are in
+func (s *server) myUploadsHandler(response http.ResponseWriter, request *http.Request) {
+	owner := s.guestKey(request)
+	if owner == "" {
+		writeJSONError(response, http.StatusBadRequest, "a guest code or X-Device-Token header is needed to list your uploads")
+		return
+	}
+	photos, err := s.photos.List(photoQuery{UploaderKey: owner})
+	if err != nil {
+		slog.Error("Unable to list uploads", "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to list photos")
+		return
+	}
+
+	uploads := myUploads{
+		Photos: make([]myUpload, 0, len(photos)),
+		Counts: map[string]int{photoReady: 0, photoProcessing: 0, photoNeedsReview: 0, photoHidden: 0, photoFailed: 0},
+		Total:  len(photos),
+	}
+	for i, summary := range s.summarizePhotos(photos) {
+		uploads.Photos = append(uploads.Photos, myUpload{photoSummary: summary, Status: photos[i].Status})
+		uploads.Counts[photos[i].Status]++
+	}
+	// Processing finishes in the background, so the answer goes stale quickly
+	response.Header().Set("Cache-Control", "no-store")
+	writeJSON(response, http.StatusOK, uploads)
+}
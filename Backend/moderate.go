@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Moderator screens processed photos for inappropriate content. Photos it
+// flags are held for review instead of going straight into the gallery,
+// where the couple can approve or reject them. Videos have no thumbnail to
+// send it, so with moderation on they are all held for review.
+type Moderator interface {
+	// Moderate looks at an image and returns whether it should be held back,
+	// and if so, why
+	Moderate(ctx context.Context, image io.Reader, contentType string) (moderation, error)
+}
+
+// moderation is the verdict on a photo
+type moderation struct {
+	Flagged bool   `json:"flagged"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// newModerator returns the moderator set up in the config, or nil if
+// screening is turned off
+func newModerator() Moderator {
+	if *moderationURL == "" {
+		return nil
+	}
+	return &httpModerator{url: *moderationURL, client: &http.Client{Timeout: 30 * time.Second}}
+}
+
+// httpModerator sends each photo to a moderation service, such as a small
+// local model behind an HTTP wrapper or an external API. The photo is posted
+// as the request body and the service replies with a moderation as JSON.
+type httpModerator struct {
+	url    string
+	client *http.Client
+}
+
+func (moderator *httpModerator) Moderate(ctx context.Context, image io.Reader, contentType string) (moderation, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, moderator.url, image)
+	if err != nil {
+		return moderation{}, err
+	}
+	request.Header.Set("Content-Type", contentType)
+
+	response, err := moderator.client.Do(request)
+	if err != nil {
+		return moderation{}, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return moderation{}, fmt.Errorf("moderation service returned %s", response.Status)
+	}
+
+	var verdict moderation
+	if err := json.NewDecoder(io.LimitReader(response.Body, 1<<20)).Decode(&verdict); err != nil {
+		return moderation{}, fmt.Errorf("moderation service reply: %w", err)
+	}
+	return verdict, nil
+}
+
+// moderatePhoto screens a processed photo, holding it for review if it is
+// flagged. The medium thumbnail is sent rather than the original, which is
+// plenty to judge by and much smaller. If the photo can't be screened it is
+// held as well, so nothing unchecked reaches the gallery.
+func moderatePhoto(ctx context.Context, moderator Moderator, storage Storage, photo *Photo) {
+	thumbnail, err := readStored(ctx, storage, photo.Variants["medium"])
+	if err != nil {
+		slog.Error("Unable to open photo for moderation", "photo", photo.ID, "err", err)
+		photo.Status, photo.ReviewReason = photoNeedsReview, "could not be screened"
+		return
+	}
+
+	verdict, err := moderator.Moderate(ctx, bytes.NewReader(thumbnail), "image/webp")
+	if err != nil {
+		slog.Error("Moderation failed", "photo", photo.ID, "err", err)
+		photo.Status, photo.ReviewReason = photoNeedsReview, "could not be screened"
+		return
+	}
+	if verdict.Flagged {
+		photo.Status, photo.ReviewReason = photoNeedsReview, verdict.Reason
+	}
+}
+
+// unscreenedVideo is the review reason of videos held because moderation
+// can't look at them
+const unscreenedVideo = "videos aren't screened"
+
+// heldPhoto is a photo held for review, as the couple sees it. Its links
+// are to /review, since guests can't see it yet.
+type heldPhoto struct {
+	photoSummary
+	ReviewReason string `json:"reviewReason,omitempty"`
+}
+
+// reviewQueueHandler lists the photos held for review, oldest upload first
+func (s *server) reviewQueueHandler(response http.ResponseWriter, request *http.Request) {
+	held := []heldPhoto{}
+	for _, photo := range s.photos.WithStatus(photoNeedsReview) {
+		summary := summarizePhoto(photo)
+		summary.URL = "/review/" + photo.ID + "/file"
+		if summary.ThumbnailURL != "" {
+			summary.ThumbnailURL = summary.URL + "?variant=thumb"
+		}
+		held = append(held, heldPhoto{photoSummary: summary, ReviewReason: photo.ReviewReason})
+	}
+	writeJSON(response, http.StatusOK, held)
+}
+
+// photoInReview returns the photo with the ID in the path if it is held for
+// review, answering the request if it isn't
+func (s *server) photoInReview(response http.ResponseWriter, request *http.Request) (*Photo, bool) {
+	photo, ok := s.photos.Get(request.PathValue("id"))
+	if !ok || photo.Status != photoNeedsReview {
+		writeJSONError(response, http.StatusNotFound, "Photo isn't held for review")
+		return nil, false
+	}
+	return photo, true
+}
+
+// reviewFileHandler serves a photo held for review, with ?variant= as for
+// photoHandler, so the couple can look at it before deciding
+func (s *server) reviewFileHandler(response http.ResponseWriter, request *http.Request) {
+	photo, ok := s.photoInReview(response, request)
+	if !ok {
+		return
+	}
+	response.Header().Set("Cache-Control", "private, no-store")
+	s.servePhoto(response, request, photo, request.URL.Query().Get("variant"))
+}
+
+// approvePhotoHandler puts a photo held for review into the gallery
+func (s *server) approvePhotoHandler(response http.ResponseWriter, request *http.Request) {
+	photo, ok := s.photoInReview(response, request)
+	if !ok {
+		return
+	}
+	photo.Status, photo.ReviewReason = photoReady, ""
+	if err := s.photos.Update(photo); err != nil {
+		slog.Error("Unable to update photo", "photo", photo.ID, "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to approve photo")
+		return
+	}
+	s.feed.publish(photo)
+	response.WriteHeader(http.StatusNoContent)
+}
+
+// rejectPhotoHandler deletes a photo held for review, along with its files
+func (s *server) rejectPhotoHandler(response http.ResponseWriter, request *http.Request) {
+	photo, ok := s.photoInReview(response, request)
+	if !ok {
+		return
+	}
+	if err := s.photos.Remove(photo.ID); err != nil {
+		slog.Error("Unable to remove photo", "photo", photo.ID, "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to reject photo")
+		return
+	}
+	removePhotoFiles(request.Context(), s.storage, s.photos, photo)
+	s.quotas.ReleasePhoto(photo)
+	response.WriteHeader(http.StatusNoContent)
+}
+
+// keepPhotoHandler keeps a photo out of its group of near duplicates in the
+// gallery, hiding the others in the group. A photo hidden this way can be
+// kept later, which hides the one kept before it.
+func (s *server) keepPhotoHandler(response http.ResponseWriter, request *http.Request) {
+	kept, ok := s.photos.Get(request.PathValue("id"))
+	if !ok {
+		writeJSONError(response, http.StatusNotFound, "Photo not found")
+		return
+	}
+	if kept.Group == "" {
+		writeJSONError(response, http.StatusConflict, "Photo has no near duplicates")
+		return
+	}
+	if kept.Status != photoReady && kept.Status != photoHidden {
+		writeJSONError(response, http.StatusConflict, "Only photos in the gallery can be kept")
+		return
+	}
+
+	hidden := []string{}
+	for _, photo := range s.photos.All() {
+		if photo.Group != kept.Group {
+			continue
+		}
+		status := photoHidden
+		if photo.ID == kept.ID {
+			status = photoReady
+		} else if photo.Status != photoReady {
+			continue
+		}
+		if photo.Status == status {
+			continue
+		}
+		photo.Status = status
+		if err := s.photos.Update(photo); err != nil {
+			slog.Error("Unable to update photo", "photo", photo.ID, "err", err)
+			writeJSONError(response, http.StatusInternalServerError, "Unable to keep photo")
+			return
+		}
+		if status == photoHidden {
+			hidden = append(hidden, photo.ID)
+		} else {
+			s.feed.publish(photo)
+		}
+	}
+	writeJSON(response, http.StatusOK, map[string][]string{"hidden": hidden})
+}
+
+// deletePhotoHandler deletes any photo, along with its files, its likes,
+// comments and reports
+func (s *server) deletePhotoHandler(response http.ResponseWriter, request *http.Request) {
+	photo, ok := s.photos.Get(request.PathValue("id"))
+	if !ok {
+		writeJSONError(response, http.StatusNotFound, "Photo not found")
+		return
+	}
+	if err := s.photos.Remove(photo.ID); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			writeJSONError(response, http.StatusNotFound, "Photo not found")
+			return
+		}
+		slog.Error("Unable to remove photo", "photo", photo.ID, "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to delete photo")
+		return
+	}
+	removePhotoFiles(request.Context(), s.storage, s.photos, photo)
+	s.quotas.ReleasePhoto(photo)
+	response.WriteHeader(http.StatusNoContent)
+}
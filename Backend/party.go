@@ -0,0 +1,303 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Limits on what a wedding party member can have
+const (
+	maxPartyName = 100
+	maxPartyRole = 100
+	maxPartyBio  = 2000
+)
+
+// PartyMember is someone in the wedding party, like the maid of honor or a
+// groomsman, for the "Meet the Party" page
+type PartyMember struct {
+	// ID is made from the name when the member is added, and stays the same
+	// if they are renamed
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Role string `json:"role"`
+	Bio  string `json:"bio,omitempty"`
+	// PhotoID is a photo of them, uploaded like any other
+	PhotoID string `json:"photoId,omitempty"`
+	// Position orders the page, lowest first
+	Position int `json:"position"`
+}
+
+// partyStore keeps the wedding party
+type partyStore struct {
+	mu      sync.Mutex
+	path    string
+	members []*PartyMember
+}
+
+// openPartyStore loads the wedding party saved at path, starting with no one
+// if it doesn't exist
+func openPartyStore(path string) (*partyStore, error) {
+	store := &partyStore{path: path}
+
+	if err := loadJSONFile(path, &store.members); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// All returns a copy of everyone in the wedding party, in the order of the
+// page
+func (store *partyStore) All() []PartyMember {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	members := make([]PartyMember, 0, len(store.members))
+	for _, member := range store.members {
+		members = append(members, *member)
+	}
+	slices.SortStableFunc(members, func(a, b PartyMember) int {
+		return a.Position - b.Position
+	})
+	return members
+}
+
+// find returns the member with the given ID. The caller must hold store.mu.
+func (store *partyStore) find(id string) *PartyMember {
+	for _, member := range store.members {
+		if member.ID == id {
+			return member
+		}
+	}
+	return nil
+}
+
+// Create adds someone to the wedding party, after the others unless they
+// are given a position
+func (store *partyStore) Create(member PartyMember, positioned bool) (PartyMember, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	base := slug(member.Name, "member")
+	member.ID = base
+	for n := 2; store.find(member.ID) != nil; n++ {
+		member.ID = fmt.Sprintf("%s-%d", base, n)
+	}
+	if !positioned {
+		member.Position = 0
+		for _, other := range store.members {
+			member.Position = max(member.Position, other.Position+1)
+		}
+	}
+	store.members = append(store.members, &member)
+	if err := store.save(); err != nil {
+		store.members = store.members[:len(store.members)-1]
+		return PartyMember{}, err
+	}
+	return member, nil
+}
+
+// Update changes the member with the given ID, reporting whether there is
+// one
+func (store *partyStore) Update(id string, change func(*PartyMember)) (PartyMember, bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	member := store.find(id)
+	if member == nil {
+		return PartyMember{}, false, nil
+	}
+	previous := *member
+	change(member)
+	member.ID = previous.ID
+	if err := store.save(); err != nil {
+		*member = previous
+		return PartyMember{}, true, err
+	}
+	return *member, true, nil
+}
+
+// Delete removes the member with the given ID, reporting whether there was
+// one
+func (store *partyStore) Delete(id string) (bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for i, member := range store.members {
+		if member.ID != id {
+			continue
+		}
+		previous := store.members
+		store.members = slices.Concat(previous[:i], previous[i+1:])
+		if err := store.save(); err != nil {
+			store.members = previous
+			return true, err
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// save writes the wedding party to disk. The caller must hold store.mu.
+func (store *partyStore) save() error {
+	return saveJSONFile(store.path, store.members)
+}
+
+// partyMemberRequest is the body of a request to add or change someone in
+// the wedding party. Fields left out of a change are kept as they are, and
+// an empty photoId takes their photo off.
+type partyMemberRequest struct {
+	Name     *string `json:"name"`
+	Role     *string `json:"role"`
+	Bio      *string `json:"bio"`
+	PhotoID  *string `json:"photoId"`
+	Position *int    `json:"position"`
+}
+
+// validate checks the fields that were given, tidying them up. A photo has
+// to be one in the gallery.
+func (body *partyMemberRequest) validate(photos PhotoStore) error {
+	text := func(field **string, name string, limit int, required bool) error {
+		if *field == nil {
+			return nil
+		}
+		trimmed := strings.TrimSpace(**field)
+		if (required && trimmed == "") || utf8.RuneCountInString(trimmed) > limit {
+			if required {
+				return fmt.Errorf("%s must be 1 to %d characters", name, limit)
+			}
+			return fmt.Errorf("%s can be at most %d characters", name, limit)
+		}
+		*field = &trimmed
+		return nil
+	}
+	for _, err := range []error{
+		text(&body.Name, "name", maxPartyName, true),
+		text(&body.Role, "role", maxPartyRole, true),
+		text(&body.Bio, "bio", maxPartyBio, false),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	if body.PhotoID != nil && *body.PhotoID != "" {
+		photoID := strings.TrimSpace(*body.PhotoID)
+		body.PhotoID = &photoID
+		if photo, ok := photos.Get(*body.PhotoID); !ok || photo.Status != photoReady {
+			return errors.New("photoId must be a photo in the gallery")
+		}
+	}
+	return nil
+}
+
+// apply makes the changes in the request to member
+func (body *partyMemberRequest) apply(member *PartyMember) {
+	if body.Name != nil {
+		member.Name = *body.Name
+	}
+	if body.Role != nil {
+		member.Role = *body.Role
+	}
+	if body.Bio != nil {
+		member.Bio = *body.Bio
+	}
+	if body.PhotoID != nil {
+		member.PhotoID = *body.PhotoID
+	}
+	if body.Position != nil {
+		member.Position = *body.Position
+	}
+}
+
+// partyMemberInfo is someone in the wedding party as the page shows them,
+// with their photo
+type partyMemberInfo struct {
+	PartyMember
+	Photo *photoSummary `json:"photo,omitempty"`
+}
+
+// partyHandler lists the wedding party for the "Meet the Party" page. The
+// photos have the gallery's URLs, so they can be shown at any size.
+func (s *server) partyHandler(response http.ResponseWriter, request *http.Request) {
+	members := []partyMemberInfo{}
+	for _, member := range s.party.All() {
+		info := partyMemberInfo{PartyMember: member}
+		if member.PhotoID != "" {
+			if photo, ok := s.photos.Get(member.PhotoID); ok && photo.Status == photoReady {
+				summary := summarizePhoto(photo)
+				info.Photo = &summary
+			}
+		}
+		members = append(members, info)
+	}
+	writeJSON(response, http.StatusOK, members)
+}
+
+// createPartyMemberHandler adds someone to the wedding party
+func (s *server) createPartyMemberHandler(response http.ResponseWriter, request *http.Request) {
+	var body partyMemberRequest
+	if !decodeJSON(response, request, &body) {
+		return
+	}
+	if body.Name == nil || body.Role == nil {
+		writeJSONError(response, http.StatusBadRequest, "name and role are required")
+		return
+	}
+	if err := body.validate(s.photos); err != nil {
+		writeJSONError(response, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var member PartyMember
+	body.apply(&member)
+	added, err := s.party.Create(member, body.Position != nil)
+	if err != nil {
+		slog.Error("Unable to save wedding party", "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to add to the wedding party")
+		return
+	}
+	writeJSON(response, http.StatusCreated, added)
+}
+
+// updatePartyMemberHandler changes someone in the wedding party
+func (s *server) updatePartyMemberHandler(response http.ResponseWriter, request *http.Request) {
+	var body partyMemberRequest
+	if !decodeJSON(response, request, &body) {
+		return
+	}
+	if err := body.validate(s.photos); err != nil {
+		writeJSONError(response, http.StatusBadRequest, err.Error())
+		return
+	}
+	member, ok, err := s.party.Update(request.PathValue("id"), body.apply)
+	if !ok {
+		writeJSONError(response, http.StatusNotFound, "Wedding party member not found")
+		return
+	}
+	if err != nil {
+		slog.Error("Unable to save wedding party", "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to update the wedding party")
+		return
+	}
+	writeJSON(response, http.StatusOK, member)
+}
+
+// deletePartyMemberHandler takes someone off the wedding party page
+func (s *server) deletePartyMemberHandler(response http.ResponseWriter, request *http.Request) {
+	ok, err := s.party.Delete(request.PathValue("id"))
+	if !ok {
+		writeJSONError(response, http.StatusNotFound, "Wedding party member not found")
+		return
+	}
+	if err != nil {
+		slog.Error("Unable to save wedding party", "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to update the wedding party")
+		return
+	}
+	response.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,642 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Photo processing states
+const (
+	photoProcessing = "processing"
+	photoReady      = "ready"
+	photoFailed     = "failed"
+	// photoNeedsReview photos were flagged by moderation and are kept out of
+	// the gallery until someone looks at them
+	photoNeedsReview = "needs_review"
+	// photoHidden photos are near duplicates of a photo the couple chose to
+	// keep instead, and are kept out of the gallery
+	photoHidden = "hidden"
+)
+
+// Kinds of upload
+const (
+	kindImage = "image"
+	kindVideo = "video"
+)
+
+// Photo is the metadata kept for every stored upload, whether it is a photo
+// or a video clip
+type Photo struct {
+	ID   string `json:"id"`
+	Kind string `json:"kind"`
+
+	// File is the name the original is stored under and OriginalFilename is
+	// the name it had on the guest's device
+	File             string `json:"file"`
+	OriginalFilename string `json:"originalFilename,omitempty"`
+
+	// Directory is where the photo's files are kept in storage, such as
+	// "2026/06/20". Photos stored in the flat layout have none.
+	Directory string `json:"directory,omitempty"`
+
+	// Uploader and Caption are optionally given by the guest who shared it
+	Uploader string `json:"uploader,omitempty"`
+	Caption  string `json:"caption,omitempty"`
+
+	// UploaderKey is who shared it as guestKey tells guests apart, so they
+	// can find their own uploads. It isn't shown to other guests.
+	UploaderKey string `json:"uploaderKey,omitempty"`
+
+	// QuotaKey and QuotaSize are who the upload counted against in their
+	// upload quota and by how much, so it can be given back if the photo is
+	// removed
+	QuotaKey  string `json:"quotaKey,omitempty"`
+	QuotaSize int64  `json:"quotaSize,omitempty"`
+
+	// Event is the part of the day, such as the ceremony, the photo is from
+	Event string `json:"event,omitempty"`
+
+	// Album is the ID of the album the couple put the photo in, if any
+	Album string `json:"album,omitempty"`
+
+	Hash        string    `json:"hash"`
+	ContentType string    `json:"contentType"`
+	Size        int64     `json:"size,omitempty"`
+	Status      string    `json:"status"`
+	UploadedAt  time.Time `json:"uploadedAt"`
+
+	// ReviewReason says why moderation held the photo for review
+	ReviewReason string `json:"reviewReason,omitempty"`
+
+	// Capture details read from EXIF before it is stripped, so photos can be
+	// ordered by when they were taken rather than when they were uploaded
+	TakenAt     *time.Time `json:"takenAt,omitempty"`
+	CameraMake  string     `json:"cameraMake,omitempty"`
+	CameraModel string     `json:"cameraModel,omitempty"`
+
+	// Width and Height are the size in pixels of the photo the right way up,
+	// as it was taken. They are filled in by processing.
+	Width  int `json:"width,omitempty"`
+	Height int `json:"height,omitempty"`
+
+	// Orientation is the EXIF orientation of the original, which processing
+	// applies to the variants so none of them show up sideways
+	Orientation int `json:"orientation,omitempty"`
+
+	// PerceptualHash is the difference hash of what the photo looks like and
+	// Group is the ID of the first photo of its near duplicates, if it has any
+	PerceptualHash string `json:"perceptualHash,omitempty"`
+	Group          string `json:"group,omitempty"`
+
+	// Video holds the duration and codec of video clips
+	Video *VideoInfo `json:"video,omitempty"`
+
+	// Variants maps a variant name, such as "web" for the WebP copy, to the
+	// name of its file in the uploads directory
+	Variants map[string]string `json:"variants,omitempty"`
+}
+
+// clone returns a copy of photo that can be changed without affecting the
+// one held by the store
+func (photo *Photo) clone() *Photo {
+	copied := *photo
+	if photo.Video != nil {
+		video := *photo.Video
+		copied.Video = &video
+	}
+	copied.Variants = make(map[string]string, len(photo.Variants))
+	for name, file := range photo.Variants {
+		copied.Variants[name] = file
+	}
+	return &copied
+}
+
+// originalName is the storage name of the uploaded file itself
+func (photo *Photo) originalName() string {
+	if photo.Kind == kindVideo {
+		return photo.storageName(videoDirectory + "/" + photo.File)
+	}
+	return photo.storageName(photo.File)
+}
+
+// archived reports whether photo has been moved to the archive
+func (photo *Photo) archived() bool {
+	return photo.Directory == archiveDirectory || strings.HasPrefix(photo.Directory, archiveDirectory+"/")
+}
+
+// storageName returns the storage name for a file of photo's called name
+func (photo *Photo) storageName(name string) string {
+	return path.Join(photo.Directory, name)
+}
+
+// setProcessed copies what processing finds out about a photo from
+// processed: the files it is kept as, what was read from the image, and its
+// status if it is still being processed. A status the couple gave it in the
+// meantime, such as by rejecting or hiding it, is kept. It reports whether
+// the status was copied.
+func (photo *Photo) setProcessed(processed *Photo) bool {
+	photo.File, photo.Directory, photo.ContentType = processed.File, processed.Directory, processed.ContentType
+	photo.Width, photo.Height, photo.Orientation = processed.Width, processed.Height, processed.Orientation
+	photo.PerceptualHash = processed.PerceptualHash
+	photo.Variants = maps.Clone(processed.Variants)
+	if photo.Status != photoProcessing {
+		return false
+	}
+	photo.Status, photo.ReviewReason = processed.Status, processed.ReviewReason
+	return true
+}
+
+// files returns the storage names of the original and every variant of photo
+func (photo *Photo) files() []string {
+	names := []string{photo.originalName()}
+	for _, name := range photo.Variants {
+		names = append(names, name)
+	}
+	return names
+}
+
+// removePhotoFiles deletes the original and every variant of photo from
+// storage. Files that another photo in photos is also made of, which the
+// content layout shares between photos, are kept.
+func removePhotoFiles(ctx context.Context, storage Storage, photos PhotoStore, photo *Photo) {
+	for _, name := range photo.files() {
+		if photos.Uses(name, photo.ID) {
+			continue
+		}
+		if err := storage.Delete(ctx, name); err != nil {
+			slog.Error("Unable to remove file", "file", name, "err", err)
+		}
+	}
+}
+
+// PhotoStore is the index of every stored photo, and the source of truth for
+// what has been uploaded. Photos are handed out as copies, so changes only
+// take effect once they are passed to Update.
+type PhotoStore interface {
+	// Get returns the photo with the given ID
+	Get(id string) (*Photo, bool)
+	// All returns every photo, oldest upload first
+	All() []*Photo
+	// WithStatus returns every photo in the given processing state
+	WithStatus(status string) []*Photo
+	// FindByHash returns the photo whose upload hashed to hash
+	FindByHash(hash string) (*Photo, bool)
+	// Add records photo unless another photo with the same hash was added
+	// first, in which case that photo is returned and added is false
+	Add(photo *Photo) (existing *Photo, added bool, err error)
+	// Update replaces an existing photo
+	Update(photo *Photo) error
+	// UpdateProcessed saves what processing found out about an existing
+	// photo, as setProcessed copies it, leaving the rest as it is stored,
+	// since the couple may have changed it while the photo was processed.
+	// It reports whether the photo was still being processed, so its status
+	// was saved too.
+	UpdateProcessed(photo *Photo) (bool, error)
+	// Remove deletes a photo, returning os.ErrNotExist if there isn't one
+	Remove(id string) error
+	// Uses reports whether a photo other than the one with ID except is
+	// made of the stored file name
+	Uses(name, except string) bool
+	// GroupSimilar puts photo in a group with its near duplicates
+	GroupSimilar(photo *Photo, maxDistance int) error
+	// List returns a page of the photos matching query
+	List(query photoQuery) ([]*Photo, error)
+	// Like records that liker likes a photo, reporting whether they hadn't
+	// already. Unlike takes it back, reporting whether they had.
+	Like(photoID, liker string) (bool, error)
+	Unlike(photoID, liker string) (bool, error)
+	// LikeCounts returns how many likes each of the given photos has.
+	// Photos without any are left out.
+	LikeCounts(photoIDs []string) (map[string]int, error)
+	// AddComment records a comment on a photo
+	AddComment(comment *Comment) error
+	// Comments returns the comments on a photo, oldest first
+	Comments(photoID string) ([]*Comment, error)
+	// AddReport records a guest's report of a photo, reporting whether they
+	// hadn't already reported it
+	AddReport(report *Report) (bool, error)
+	// Reports returns the reports of a photo, or of every photo if photoID
+	// is empty, oldest first
+	Reports(photoID string) ([]*Report, error)
+	// ClearReports removes every report of a photo
+	ClearReports(photoID string) error
+}
+
+// Orders photos can be listed in
+const (
+	// sortUploaded lists the newest uploads first
+	sortUploaded = "uploaded"
+	// sortTaken lists photos in the order they were taken, so a slideshow
+	// runs through the day
+	sortTaken = "taken"
+)
+
+// photoQuery selects a page of photos
+type photoQuery struct {
+	// Status limits the page to photos in that processing state, Event and
+	// Uploader to photos from that part of the day or by that guest, and
+	// Album to the photos in that album
+	Status   string
+	Event    string
+	Uploader string
+	Album    string
+	// HiddenAlbums leaves out the photos in those albums, such as private
+	// albums the guest hasn't unlocked
+	HiddenAlbums []string
+	// UploaderKey limits the page to the uploads of one guest, as guestKey
+	// tells them apart
+	UploaderKey string
+	// Text limits the page to photos with every word of it in their caption,
+	// uploader's name or comments
+	Text string
+	// From and To, if set, limit the page to photos taken in that range.
+	// Photos without a capture time count as taken when they were uploaded.
+	From time.Time
+	To   time.Time
+	// Sort is the order photos are listed in, sortUploaded if it is empty
+	Sort string
+	// After is where the previous page ended, if this isn't the first page
+	After *photoCursor
+	Limit int
+}
+
+// takenOrUploaded is when photo was taken, or when it was uploaded if that
+// isn't known
+func (photo *Photo) takenOrUploaded() time.Time {
+	if photo.TakenAt != nil {
+		return *photo.TakenAt
+	}
+	return photo.UploadedAt
+}
+
+// matches reports whether photo passes the query's filters
+func (query photoQuery) matches(photo *Photo) bool {
+	taken := photo.takenOrUploaded()
+	return (query.Status == "" || photo.Status == query.Status) &&
+		(query.Event == "" || photo.Event == query.Event) &&
+		(query.Album == "" || photo.Album == query.Album) &&
+		!slices.Contains(query.HiddenAlbums, photo.Album) &&
+		(query.Uploader == "" || strings.EqualFold(photo.Uploader, query.Uploader)) &&
+		(query.UploaderKey == "" || photo.UploaderKey == query.UploaderKey) &&
+		(query.From.IsZero() || !taken.Before(query.From)) &&
+		(query.To.IsZero() || taken.Before(query.To))
+}
+
+// sortTime is the time photo is sorted by
+func (query photoQuery) sortTime(photo *Photo) time.Time {
+	if query.Sort == sortTaken {
+		return photo.takenOrUploaded()
+	}
+	return photo.UploadedAt
+}
+
+// compare orders photos for the query, going by ID between photos from the
+// same moment
+func (query photoQuery) compare(a, b *Photo) int {
+	order := query.sortTime(a).Compare(query.sortTime(b))
+	if order == 0 {
+		order = strings.Compare(a.ID, b.ID)
+	}
+	// Uploads are listed newest first
+	if query.Sort != sortTaken {
+		order = -order
+	}
+	return order
+}
+
+// photoCursor marks a place in the list of photos, by the time the last
+// photo listed is sorted by and its ID
+type photoCursor struct {
+	Time time.Time
+	ID   string
+}
+
+// listed reports whether photo comes at or before the cursor of the query,
+// so it has already been listed
+func (query photoQuery) listed(photo *Photo) bool {
+	if query.After == nil {
+		return false
+	}
+	last := &Photo{ID: query.After.ID, UploadedAt: query.After.Time, TakenAt: &query.After.Time}
+	return query.compare(photo, last) <= 0
+}
+
+// openPhotoStore opens the photo index chosen in the config
+func openPhotoStore() (PhotoStore, error) {
+	jsonPath := filepath.Join(*uploadDir, "photos.json")
+	switch *metadataBackend {
+	case "json":
+		return openJSONPhotoStore(jsonPath)
+	case "sqlite":
+		store, err := openSQLitePhotoStore(dataFile(*sqlitePath, "photos.db"))
+		if err != nil {
+			return nil, err
+		}
+		return store, importJSONPhotos(store.sqlPhotoStore, jsonPath)
+	case "postgres":
+		store, err := openPostgresPhotoStore(*databaseURL)
+		if err != nil {
+			return nil, err
+		}
+		return store, importJSONPhotos(store, jsonPath)
+	}
+	return nil, fmt.Errorf("unknown metadata backend %q", *metadataBackend)
+}
+
+// jsonPhotoStore is a small JSON file backed index of every stored photo. The
+// whole index is kept in memory and rewritten on every change.
+type jsonPhotoStore struct {
+	mu     sync.Mutex
+	path   string
+	photos map[string]*Photo
+	byHash map[string]string
+	// likes maps a photo ID to who likes it and when, and is kept in its own
+	// file next to the index
+	likes map[string]map[string]time.Time
+	// comments maps a photo ID to the comments on it, oldest first, and is
+	// kept in its own file too
+	comments map[string][]*Comment
+	// reports maps a photo ID to the reports of it, oldest first, in a file
+	// of its own as well
+	reports map[string][]*Report
+}
+
+// openJSONPhotoStore loads the index at path, starting empty if it doesn't exist
+func openJSONPhotoStore(path string) (*jsonPhotoStore, error) {
+	store := &jsonPhotoStore{
+		path:     path,
+		photos:   make(map[string]*Photo),
+		byHash:   make(map[string]string),
+		likes:    make(map[string]map[string]time.Time),
+		comments: make(map[string][]*Comment),
+		reports:  make(map[string][]*Report),
+	}
+	if err := store.loadLikes(); err != nil {
+		return nil, err
+	}
+	if err := store.loadComments(); err != nil {
+		return nil, err
+	}
+	if err := store.loadReports(); err != nil {
+		return nil, err
+	}
+
+	var photos []*Photo
+	if err := loadJSONFile(path, &photos); err != nil {
+		return nil, err
+	}
+	for _, photo := range photos {
+		// Photos from before background processing are already done
+		if photo.Status == "" {
+			photo.Status = photoReady
+		}
+		if photo.Kind == "" {
+			photo.Kind = kindImage
+		}
+		// Photos from before UUID names were stored under their ID
+		if photo.File == "" {
+			photo.File = photo.ID
+		}
+		store.photos[photo.ID] = photo
+		store.byHash[photo.Hash] = photo.ID
+	}
+	return store, nil
+}
+
+// Get returns a copy of the photo with the given ID
+func (store *jsonPhotoStore) Get(id string) (*Photo, bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	photo, ok := store.photos[id]
+	if !ok {
+		return nil, false
+	}
+	return photo.clone(), true
+}
+
+// All returns copies of every photo
+func (store *jsonPhotoStore) All() []*Photo {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	photos := make([]*Photo, 0, len(store.photos))
+	for _, photo := range store.photos {
+		photos = append(photos, photo.clone())
+	}
+	slices.SortFunc(photos, func(a, b *Photo) int {
+		return a.UploadedAt.Compare(b.UploadedAt)
+	})
+	return photos
+}
+
+// WithStatus returns copies of every photo in the given processing state
+func (store *jsonPhotoStore) WithStatus(status string) []*Photo {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var photos []*Photo
+	for _, photo := range store.photos {
+		if photo.Status == status {
+			photos = append(photos, photo.clone())
+		}
+	}
+	return photos
+}
+
+// FindByHash returns the photo whose content hashes to hash, if there is one
+func (store *jsonPhotoStore) FindByHash(hash string) (*Photo, bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	id, ok := store.byHash[hash]
+	if !ok {
+		return nil, false
+	}
+	return store.photos[id].clone(), true
+}
+
+// Add records photo unless another photo with the same hash was added first,
+// in which case that photo is returned and added is false
+func (store *jsonPhotoStore) Add(photo *Photo) (existing *Photo, added bool, err error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if id, ok := store.byHash[photo.Hash]; ok {
+		return store.photos[id].clone(), false, nil
+	}
+
+	store.photos[photo.ID] = photo.clone()
+	store.byHash[photo.Hash] = photo.ID
+	if err := store.save(); err != nil {
+		delete(store.photos, photo.ID)
+		delete(store.byHash, photo.Hash)
+		return nil, false, err
+	}
+	return photo, true, nil
+}
+
+// Update replaces the stored copy of an existing photo
+func (store *jsonPhotoStore) Update(photo *Photo) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	previous, ok := store.photos[photo.ID]
+	if !ok {
+		return os.ErrNotExist
+	}
+	store.photos[photo.ID] = photo.clone()
+	if err := store.save(); err != nil {
+		store.photos[photo.ID] = previous
+		return err
+	}
+	return nil
+}
+
+func (store *jsonPhotoStore) UpdateProcessed(photo *Photo) (bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	previous, ok := store.photos[photo.ID]
+	if !ok {
+		return false, os.ErrNotExist
+	}
+	updated := previous.clone()
+	processing := updated.setProcessed(photo)
+	store.photos[photo.ID] = updated
+	if err := store.save(); err != nil {
+		store.photos[photo.ID] = previous
+		return false, err
+	}
+	return processing, nil
+}
+
+// Uses reports whether a photo other than the one with ID except is made of
+// the stored file name
+func (store *jsonPhotoStore) Uses(name, except string) bool {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for id, photo := range store.photos {
+		if id != except && slices.Contains(photo.files(), name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Remove deletes a photo from the index
+func (store *jsonPhotoStore) Remove(id string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	photo, ok := store.photos[id]
+	if !ok {
+		return os.ErrNotExist
+	}
+	delete(store.photos, id)
+	delete(store.byHash, photo.Hash)
+	if err := store.save(); err != nil {
+		store.photos[id] = photo
+		store.byHash[photo.Hash] = id
+		return err
+	}
+	if _, ok := store.likes[id]; ok {
+		delete(store.likes, id)
+		if err := store.saveLikes(); err != nil {
+			slog.Error("Unable to save likes", "err", err)
+		}
+	}
+	if _, ok := store.comments[id]; ok {
+		delete(store.comments, id)
+		if err := store.saveComments(); err != nil {
+			slog.Error("Unable to save comments", "err", err)
+		}
+	}
+	if _, ok := store.reports[id]; ok {
+		delete(store.reports, id)
+		if err := store.saveReports(); err != nil {
+			slog.Error("Unable to save reports", "err", err)
+		}
+	}
+	return nil
+}
+
+// List returns a page of the photos matching query
+func (store *jsonPhotoStore) List(query photoQuery) ([]*Photo, error) {
+	store.mu.Lock()
+	var photos []*Photo
+	words := searchWords(query.Text)
+	for _, photo := range store.photos {
+		if !query.matches(photo) || !store.containsWords(photo, words) {
+			continue
+		}
+		if query.listed(photo) {
+			continue
+		}
+		photos = append(photos, photo.clone())
+	}
+	store.mu.Unlock()
+
+	slices.SortFunc(photos, query.compare)
+	if query.Limit > 0 && len(photos) > query.Limit {
+		photos = photos[:query.Limit]
+	}
+	return photos, nil
+}
+
+// GroupSimilar puts photo in the same group as the closest other photo whose
+// perceptual hash is within maxDistance of its own, if there is one. The
+// first photo of a group is its leader and the group is named after it.
+func (store *jsonPhotoStore) GroupSimilar(photo *Photo, maxDistance int) error {
+	hash, ok := parsePerceptualHash(photo.PerceptualHash)
+	if !ok {
+		return nil
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var closest *Photo
+	closestDistance := maxDistance + 1
+	for _, other := range store.photos {
+		otherHash, ok := parsePerceptualHash(other.PerceptualHash)
+		if !ok || other.ID == photo.ID {
+			continue
+		}
+		if distance := hashDistance(hash, otherHash); distance < closestDistance {
+			closest, closestDistance = other, distance
+		}
+	}
+	if closest == nil {
+		return nil
+	}
+
+	if closest.Group == "" {
+		closest.Group = closest.ID
+	}
+	photo.Group = closest.Group
+	if stored, ok := store.photos[photo.ID]; ok {
+		stored.Group = photo.Group
+	}
+	return store.save()
+}
+
+// save writes the index to disk. The caller must hold store.mu.
+func (store *jsonPhotoStore) save() error {
+	photos := make([]*Photo, 0, len(store.photos))
+	for _, photo := range store.photos {
+		photos = append(photos, photo)
+	}
+
+	return saveJSONFile(store.path, photos)
+}
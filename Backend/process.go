@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"log/slog"
+	"path"
+
+	"github.com/gen2brain/webp"
+	"golang.org/x/image/draw"
+)
+
+// convertibleTypes are the upload types that get a full size WebP copy for
+// the gallery
+var convertibleTypes = map[string]bool{
+	"image/heic": true,
+	"image/jpeg": true,
+	"image/png":  true,
+}
+
+// thumbnailSizes maps each thumbnail variant to the length in pixels of its
+// longest side
+var thumbnailSizes = map[string]int{
+	"small":  320,
+	"medium": 800,
+	"large":  1600,
+}
+
+// processImage decodes the original of photo and stores the WebP copy and
+// thumbnails alongside it, recording each one in photo.Variants
+func processImage(ctx context.Context, storage Storage, photo *Photo) error {
+	src, err := storage.Get(ctx, photo.originalName())
+	if err != nil {
+		return err
+	}
+	img, _, err := image.Decode(src)
+	src.Close()
+	if err != nil {
+		return err
+	}
+
+	// The HEIC decoder already applies the rotation stored in the file's own
+	// transform properties, which take precedence over EXIF
+	if photo.ContentType != "image/heic" {
+		img = applyOrientation(img, photo.Orientation)
+	}
+	photo.Width, photo.Height = img.Bounds().Dx(), img.Bounds().Dy()
+	photo.PerceptualHash = formatPerceptualHash(differenceHash(img))
+
+	// Full size copies are capped at the configured size, since nobody needs
+	// a 50 megapixel photo to look at the cake
+	if *maxDimension > 0 {
+		img = resizeToFit(img, *maxDimension)
+	}
+
+	// Most browsers can't display HEIC, so keep a JPEG copy that anyone can
+	// download and open
+	if photo.ContentType == "image/heic" {
+		name, err := writeJPEG(ctx, storage, photo, photo.ID+".jpg", img, *jpegQuality)
+		if err != nil {
+			return fmt.Errorf("jpeg conversion: %w", err)
+		}
+		photo.Variants["jpeg"] = name
+	}
+
+	// Reformat images to webp for size, keeping the original as well
+	if convertibleTypes[photo.ContentType] {
+		web, err := stampVariant("web", img)
+		if err != nil {
+			return fmt.Errorf("watermark: %w", err)
+		}
+		name, err := writeWebP(ctx, storage, photo, photo.ID+".webp", web, *webpQuality)
+		if err != nil {
+			return fmt.Errorf("webp conversion: %w", err)
+		}
+		photo.Variants["web"] = name
+	}
+
+	for size, longest := range thumbnailSizes {
+		thumbnail, err := stampVariant(size, resizeToFit(img, longest))
+		if err != nil {
+			return fmt.Errorf("watermark: %w", err)
+		}
+		name, err := writeWebP(ctx, storage, photo, photo.ID+"_"+size+".webp", thumbnail, *webpQuality)
+		if err != nil {
+			return fmt.Errorf("%s thumbnail: %w", size, err)
+		}
+		photo.Variants[size] = name
+	}
+	return nil
+}
+
+// stampVariant adds the configured watermark to img if the variant is one
+// that gets it
+func stampVariant(variant string, img image.Image) (image.Image, error) {
+	if *watermarkText == "" || !watermarkedVariants[variant] {
+		return img, nil
+	}
+	return addWatermark(img, *watermarkText)
+}
+
+// discardOriginal replaces the original of a processed photo with its full
+// size copy, to save space when the originals aren't wanted. Photos that
+// have no full size copy without a watermark, such as GIFs, keep their
+// original. The file is left alone if another photo in photos shares it.
+func discardOriginal(ctx context.Context, storage Storage, photos PhotoStore, photo *Photo) {
+	variant := "web"
+	contentType := "image/webp"
+	if _, ok := photo.Variants["jpeg"]; ok {
+		variant, contentType = "jpeg", "image/jpeg"
+	}
+	replacement := photo.Variants[variant]
+	if replacement == "" || (*watermarkText != "" && watermarkedVariants[variant]) {
+		return
+	}
+
+	if !photos.Uses(photo.originalName(), photo.ID) {
+		if err := storage.Delete(ctx, photo.originalName()); err != nil {
+			slog.Error("Unable to remove original", "photo", photo.ID, "err", err)
+			return
+		}
+	}
+	photo.File = path.Base(replacement)
+	photo.Directory = path.Dir(replacement)
+	if photo.Directory == "." {
+		photo.Directory = ""
+	}
+	photo.ContentType = contentType
+	// The copy has already been turned the right way up
+	photo.Orientation = 0
+}
+
+// resizeToFit scales img down so its longest side is at most longest pixels.
+// Images that already fit are returned unchanged.
+func resizeToFit(img image.Image, longest int) image.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= longest && height <= longest {
+		return img
+	}
+
+	if width >= height {
+		height = max(1, height*longest/width)
+		width = longest
+	} else {
+		width = max(1, width*longest/height)
+		height = longest
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Src, nil)
+	return dst
+}
+
+// applyOrientation turns img the right way up according to its EXIF
+// orientation. Orientations 2 to 8 are the combinations of mirroring and
+// rotating by quarter turns; 1 and 0 (unset) leave the image alone.
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+
+	bounds := img.Bounds()
+	src := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+
+	width, height := bounds.Dx(), bounds.Dy()
+	dstWidth, dstHeight := width, height
+	if orientation >= 5 {
+		dstWidth, dstHeight = height, width
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+
+	for y := 0; y < dstHeight; y++ {
+		for x := 0; x < dstWidth; x++ {
+			// Find the source pixel that ends up at x, y
+			var sx, sy int
+			switch orientation {
+			case 2: // mirrored
+				sx, sy = width-1-x, y
+			case 3: // upside down
+				sx, sy = width-1-x, height-1-y
+			case 4: // mirrored upside down
+				sx, sy = x, height-1-y
+			case 5: // mirrored and turned a quarter anticlockwise
+				sx, sy = y, x
+			case 6: // turned a quarter anticlockwise, so turn it clockwise
+				sx, sy = y, height-1-x
+			case 7: // mirrored and turned a quarter clockwise
+				sx, sy = width-1-y, height-1-x
+			case 8: // turned a quarter clockwise, so turn it anticlockwise
+				sx, sy = width-1-y, x
+			}
+			copy(dst.Pix[dst.PixOffset(x, y):dst.PixOffset(x, y)+4], src.Pix[src.PixOffset(sx, sy):src.PixOffset(sx, sy)+4])
+		}
+	}
+	return dst
+}
+
+// writeWebP encodes img as a WebP at the given quality and stores it as the
+// variant of photo called name, returning the name it was stored under
+func writeWebP(ctx context.Context, storage Storage, photo *Photo, name string, img image.Image, quality int) (string, error) {
+	var encoded bytes.Buffer
+	if err := webp.Encode(&encoded, img, webp.Options{Quality: quality}); err != nil {
+		return "", err
+	}
+	return putVariant(ctx, storage, photo, name, bytes.NewReader(encoded.Bytes()))
+}
+
+// writeJPEG encodes img as a JPEG at the given quality and stores it as the
+// variant of photo called name, returning the name it was stored under
+func writeJPEG(ctx context.Context, storage Storage, photo *Photo, name string, img image.Image, quality int) (string, error) {
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, img, &jpeg.Options{Quality: quality}); err != nil {
+		return "", err
+	}
+	return putVariant(ctx, storage, photo, name, bytes.NewReader(encoded.Bytes()))
+}
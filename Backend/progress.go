@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Upload progress is reported over Server-Sent Events. The client picks an
+// upload ID, sends it with the upload as an X-Upload-Id header (or uploadId
+// query parameter), and listens on /upload/progress/{uploadID} for events as
+// the body arrives.
+
+// Progress states reported to the client
+const (
+	progressUploading  = "uploading"
+	progressProcessing = "processing"
+	progressDone       = "done"
+	progressFailed     = "failed"
+)
+
+// progressLinger is how long a finished upload's progress is kept around for
+// clients that connect late
+const progressLinger = time.Minute
+
+// progressEvent is a snapshot of an upload's progress
+type progressEvent struct {
+	Received int64  `json:"received"`
+	Total    int64  `json:"total"`
+	State    string `json:"state"`
+}
+
+// uploadProgress tracks one upload and the clients watching it
+type uploadProgress struct {
+	event       progressEvent
+	subscribers map[chan progressEvent]struct{}
+}
+
+// progressHub fans progress updates out to subscribed clients
+type progressHub struct {
+	mu      sync.Mutex
+	uploads map[string]*uploadProgress
+}
+
+func newProgressHub() *progressHub {
+	return &progressHub{uploads: make(map[string]*uploadProgress)}
+}
+
+// entry returns the progress for id, creating it if needed. The caller must
+// hold hub.mu.
+func (hub *progressHub) entry(id string) *uploadProgress {
+	progress, ok := hub.uploads[id]
+	if !ok {
+		progress = &uploadProgress{
+			event:       progressEvent{State: progressUploading},
+			subscribers: make(map[chan progressEvent]struct{}),
+		}
+		hub.uploads[id] = progress
+	}
+	return progress
+}
+
+// update changes the progress of id and notifies its subscribers
+func (hub *progressHub) update(id string, change func(*progressEvent)) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	progress := hub.entry(id)
+	change(&progress.event)
+	for subscriber := range progress.subscribers {
+		// Subscribers only care about the latest state, so replace anything
+		// they haven't read yet rather than blocking the upload
+		select {
+		case <-subscriber:
+		default:
+		}
+		subscriber <- progress.event
+	}
+
+	if progress.event.State == progressDone || progress.event.State == progressFailed {
+		time.AfterFunc(progressLinger, func() { hub.forget(id) })
+	}
+}
+
+// setState moves an upload on to the next stage
+func (hub *progressHub) setState(id, state string) {
+	hub.update(id, func(event *progressEvent) {
+		event.State = state
+	})
+}
+
+// subscribe returns a channel of progress events for id along with the
+// current state
+func (hub *progressHub) subscribe(id string) (chan progressEvent, progressEvent) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	progress := hub.entry(id)
+	subscriber := make(chan progressEvent, 1)
+	progress.subscribers[subscriber] = struct{}{}
+	return subscriber, progress.event
+}
+
+func (hub *progressHub) unsubscribe(id string, subscriber chan progressEvent) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	if progress, ok := hub.uploads[id]; ok {
+		delete(progress.subscribers, subscriber)
+	}
+}
+
+// forget drops a finished upload once nobody is watching it
+func (hub *progressHub) forget(id string) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	if progress, ok := hub.uploads[id]; ok && len(progress.subscribers) == 0 {
+		delete(hub.uploads, id)
+	}
+}
+
+// countingReader reports how many bytes have been read from an upload body
+type countingReader struct {
+	reader io.Reader
+	hub    *progressHub
+	id     string
+}
+
+func (counter *countingReader) Read(p []byte) (int, error) {
+	n, err := counter.reader.Read(p)
+	if n > 0 {
+		counter.hub.update(counter.id, func(event *progressEvent) {
+			event.Received += int64(n)
+		})
+	}
+	return n, err
+}
+
+// trackProgress wraps body so reads are reported under id. received is the
+// number of bytes that arrived before this body, for resumed uploads.
+func (hub *progressHub) trackProgress(id string, body io.ReadCloser, received, total int64) io.ReadCloser {
+	hub.update(id, func(event *progressEvent) {
+		event.Received = received
+		event.Total = total
+		event.State = progressUploading
+	})
+	return struct {
+		io.Reader
+		io.Closer
+	}{&countingReader{reader: body, hub: hub, id: id}, body}
+}
+
+// uploadID returns the client chosen progress ID of an upload request, if any
+func uploadID(request *http.Request) string {
+	id := request.Header.Get("X-Upload-Id")
+	if id == "" {
+		id = request.URL.Query().Get("uploadId")
+	}
+	if len(id) > 64 {
+		return ""
+	}
+	return id
+}
+
+// progressHandler streams an upload's progress as Server-Sent Events until it
+// is done or the client goes away
+func (s *server) progressHandler(response http.ResponseWriter, request *http.Request) {
+	flusher, ok := response.(http.Flusher)
+	if !ok {
+		http.Error(response, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	id := request.PathValue("uploadID")
+	if id == "" || len(id) > 64 {
+		http.Error(response, "invalid upload ID", http.StatusBadRequest)
+		return
+	}
+
+	keepWriting(response)
+	response.Header().Set("Content-Type", "text/event-stream")
+	response.Header().Set("Cache-Control", "no-cache")
+	response.Header().Set("Connection", "keep-alive")
+
+	subscriber, event := s.progress.subscribe(id)
+	defer s.progress.unsubscribe(id, subscriber)
+
+	for {
+		data, _ := json.Marshal(event)
+		fmt.Fprintf(response, "event: progress\ndata: %s\n\n", data)
+		flusher.Flush()
+		if event.State == progressDone || event.State == progressFailed {
+			return
+		}
+
+		select {
+		case event = <-subscriber:
+		case <-request.Context().Done():
+			return
+		case <-s.shutdown.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// Limits on the size of QR code images, in pixels
+const (
+	defaultQRSize = 512
+	minQRSize     = 128
+	maxQRSize     = 2048
+)
+
+// Pages of the site that QR codes link to
+const (
+	rsvpPage    = "/rsvp.html"
+	galleryPage = "/gallery.html"
+)
+
+// siteAddress returns the address of the site QR codes link to: the one
+// configured, or else the one request came in on
+func siteAddress(request *http.Request) string {
+	if *siteURL != "" {
+		return strings.TrimRight(*siteURL, "/")
+	}
+	return apiAddress(request)
+}
+
+// writeQR answers a request with a PNG of a QR code for link, as many
+// pixels across as ?size= asks for
+func writeQR(response http.ResponseWriter, request *http.Request, link string) {
+	size := defaultQRSize
+	if value := request.URL.Query().Get("size"); value != "" {
+		var err error
+		size, err = strconv.Atoi(value)
+		if err != nil || size < minQRSize || size > maxQRSize {
+			writeJSONError(response, http.StatusBadRequest, fmt.Sprintf("size must be %d to %d", minQRSize, maxQRSize))
+			return
+		}
+	}
+	png, err := qrcode.Encode(link, qrcode.Medium, size)
+	if err != nil {
+		slog.Error("Unable to make QR code", "link", link, "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to make QR code")
+		return
+	}
+	response.Header().Set("Content-Type", "image/png")
+	response.Header().Set("Cache-Control", "no-store")
+	response.Write(png)
+}
+
+// galleryQRHandler makes a QR code linking to the gallery, for table cards
+func (s *server) galleryQRHandler(response http.ResponseWriter, request *http.Request) {
+	writeQR(response, request, siteAddress(request)+galleryPage)
+}
+
+// householdQRHandler makes a QR code for a household's invitation that
+// links to the RSVP page with their guest code filled in, or with
+// ?page=upload to the gallery so they can share photos without typing it
+func (s *server) householdQRHandler(response http.ResponseWriter, request *http.Request) {
+	household, ok := s.guests.Get(request.PathValue("id"))
+	if !ok {
+		writeJSONError(response, http.StatusNotFound, "Household not found")
+		return
+	}
+	page := rsvpPage
+	switch request.URL.Query().Get("page") {
+	case "", "rsvp":
+	case "upload":
+		page = galleryPage
+	default:
+		writeJSONError(response, http.StatusBadRequest, "page must be rsvp or upload")
+		return
+	}
+	writeQR(response, request, siteAddress(request)+page+"?code="+url.QueryEscape(household.Code))
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+)
+
+// quotaUsage is how much one guest has uploaded
+type quotaUsage struct {
+	Bytes  int64 `json:"bytes"`
+	Photos int   `json:"photos"`
+}
+
+// quotaStore tracks what each guest has uploaded so nobody can fill the disk
+// on their own. Guests are told apart by their guest code, or by their IP
+// address if they uploaded without one. Usage is saved so limits survive
+// restarts.
+type quotaStore struct {
+	mu        sync.Mutex
+	path      string
+	maxBytes  int64
+	maxPhotos int
+	usage     map[string]*quotaUsage
+}
+
+// openQuotaStore loads the usage recorded at path. A limit of 0 means there is
+// no limit.
+func openQuotaStore(path string, maxBytes int64, maxPhotos int) (*quotaStore, error) {
+	store := &quotaStore{
+		path:      path,
+		maxBytes:  maxBytes,
+		maxPhotos: maxPhotos,
+		usage:     make(map[string]*quotaUsage),
+	}
+
+	if err := loadJSONFile(path, &store.usage); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// quotaError is an upload turned away because the guest has used up their
+// quota. Unlike other upload errors it is sent to the client as JSON, so the
+// page can show the message nicely.
+type quotaError struct {
+	message string
+}
+
+func (err *quotaError) Error() string {
+	return err.message
+}
+
+// Reserve counts an upload of size bytes against guest's quota, or returns a
+// quotaError if it would take them over
+func (store *quotaStore) Reserve(guest string, size int64) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	usage, ok := store.usage[guest]
+	if !ok {
+		usage = &quotaUsage{}
+		store.usage[guest] = usage
+	}
+	if store.maxPhotos > 0 && usage.Photos+1 > store.maxPhotos {
+		return &quotaError{fmt.Sprintf("You've shared %d photos, which is as many as we can take from one guest. Thank you!", usage.Photos)}
+	}
+	if store.maxBytes > 0 && usage.Bytes+size > store.maxBytes {
+		return &quotaError{fmt.Sprintf("This would take you over the %s each guest can share. Thank you for all the photos!", formatBytes(store.maxBytes))}
+	}
+
+	usage.Bytes += size
+	usage.Photos++
+	if err := store.save(); err != nil {
+		usage.Bytes -= size
+		usage.Photos--
+		return err
+	}
+	return nil
+}
+
+// Release gives back a reservation for an upload that wasn't kept
+func (store *quotaStore) Release(guest string, size int64) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	usage, ok := store.usage[guest]
+	if !ok {
+		return
+	}
+	usage.Bytes = max(0, usage.Bytes-size)
+	usage.Photos = max(0, usage.Photos-1)
+	if err := store.save(); err != nil {
+		slog.Error("Unable to save upload quotas", "err", err)
+	}
+}
+
+// ReleasePhoto gives back what photo counted against its uploader's quota,
+// once it has been removed
+func (store *quotaStore) ReleasePhoto(photo *Photo) {
+	if photo.QuotaKey != "" {
+		store.Release(photo.QuotaKey, photo.QuotaSize)
+	}
+}
+
+// save writes the usage to disk. The caller must hold store.mu.
+func (store *quotaStore) save() error {
+	return saveJSONFile(store.path, store.usage)
+}
+
+// formatBytes writes a size the way a guest would expect to read it
+func formatBytes(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	value, suffix := float64(size)/unit, "KB"
+	for _, next := range []string{"MB", "GB", "TB"} {
+		if value < unit {
+			break
+		}
+		value, suffix = value/unit, next
+	}
+	return fmt.Sprintf("%.0f %s", value, suffix)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// clientIdle is how long a client's limiter is kept after its last request
+const clientIdle = 10 * time.Minute
+
+// rateLimiter gives each client IP its own token bucket
+type rateLimiter struct {
+	mu      sync.Mutex
+	limit   rate.Limit
+	burst   int
+	clients map[string]*client
+	// message is what clients over their limit are told
+	message string
+}
+
+// client is the bucket of one IP and when it was last used
+type client struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// newRateLimiter returns a limiter allowing perMinute requests a minute from
+// each IP, with bursts of up to burst requests, telling clients over the limit
+// message
+func newRateLimiter(perMinute, burst int, message string) *rateLimiter {
+	limiter := &rateLimiter{
+		limit:   rate.Limit(float64(perMinute) / 60),
+		burst:   burst,
+		clients: make(map[string]*client),
+		message: message,
+	}
+	go limiter.cleanup()
+	return limiter
+}
+
+// allow reports whether ip may make another request now
+func (limiter *rateLimiter) allow(ip string) bool {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	c, ok := limiter.clients[ip]
+	if !ok {
+		c = &client{limiter: rate.NewLimiter(limiter.limit, limiter.burst)}
+		limiter.clients[ip] = c
+	}
+	c.lastSeen = time.Now()
+	return c.limiter.Allow()
+}
+
+// cleanup forgets clients that have gone quiet, so the map doesn't grow with
+// every guest's phone for the whole reception
+func (limiter *rateLimiter) cleanup() {
+	for range time.Tick(clientIdle) {
+		limiter.mu.Lock()
+		for ip, c := range limiter.clients {
+			if time.Since(c.lastSeen) > clientIdle {
+				delete(limiter.clients, ip)
+			}
+		}
+		limiter.mu.Unlock()
+	}
+}
+
+// middleware rejects requests from clients that are over their limit with 429
+// Too Many Requests. Preflight requests are never limited.
+func (limiter *rateLimiter) middleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(response http.ResponseWriter, request *http.Request) {
+		if request.Method != http.MethodOptions && !limiter.allow(clientIP(request)) {
+			response.Header().Set("Retry-After", "60")
+			http.Error(response, limiter.message, http.StatusTooManyRequests)
+			return
+		}
+		next(response, request)
+	}
+}
+
+// clientIP returns the IP address a request came from. X-Forwarded-For is
+// only believed when the server is set up to run behind a proxy, since
+// otherwise anyone could set it. Even then the client can put whatever it
+// likes at the start of the list, so the address used is the one the
+// proxies in front of the server added: the last one, or further back with
+// more than one proxy.
+func clientIP(request *http.Request) string {
+	if *trustProxy {
+		var forwarded []string
+		for _, header := range request.Header.Values("X-Forwarded-For") {
+			forwarded = append(forwarded, commaList(header)...)
+		}
+		if len(forwarded) > 0 {
+			return forwarded[max(len(forwarded)-*proxyHops, 0)]
+		}
+	}
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return request.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// rawUploadHandler takes a single file as the whole request body, for clients
+// such as a photo booth script that would rather not build a multipart form.
+// The file name comes from the X-Filename header, and an uploader name,
+// caption, and event can be sent as X-Uploader, X-Caption, and X-Event. Any of them can be URL
+// encoded to carry characters headers can't.
+func (s *server) rawUploadHandler(response http.ResponseWriter, request *http.Request) {
+	start := time.Now()
+
+	// The content is sniffed like any other upload, so the declared type only
+	// has to be one that could be accepted
+	if declared := request.Header.Get("Content-Type"); declared != "" {
+		mediaType, _, err := mime.ParseMediaType(declared)
+		_, image := allowedImageTypes[mediaType]
+		_, video := videoTypes[mediaType]
+		if err != nil || !(image || video || mediaType == "application/octet-stream") {
+			http.Error(response, "invalid file type", http.StatusUnsupportedMediaType)
+			return
+		}
+	}
+	if request.ContentLength > maxRequestSize() {
+		http.Error(response, "file is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	details, err := newUploadDetails(headerValue(request, "X-Uploader"), headerValue(request, "X-Caption"), headerValue(request, "X-Event"), start)
+	if err != nil {
+		writeUploadError(response, "", err)
+		return
+	}
+	details.Filename = headerValue(request, "X-Filename")
+	household, err := s.authorizeGuest(request, guestCode(request))
+	if err != nil {
+		writeUploadError(response, details.Filename, err)
+		return
+	}
+	details.identify(household, request)
+
+	request.Body = http.MaxBytesReader(response, request.Body, maxRequestSize())
+	progressID := uploadID(request)
+	if progressID != "" {
+		request.Body = s.progress.trackProgress(progressID, request.Body, 0, request.ContentLength)
+	}
+
+	result, err := s.receiveRawUpload(request, details)
+	if progressID != "" {
+		if err != nil {
+			s.progress.setState(progressID, progressFailed)
+		} else {
+			s.progress.setState(progressID, progressDone)
+		}
+	}
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(response, "file is too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		writeUploadError(response, details.Filename, err)
+		return
+	}
+
+	writeJSON(response, http.StatusOK, result)
+	slog.Info("Saved raw upload", "duration", time.Since(start))
+}
+
+// receiveRawUpload streams a raw upload body to a temporary file and saves it
+func (s *server) receiveRawUpload(request *http.Request, details uploadDetails) (uploadResult, error) {
+	temp, err := createIncomingFile()
+	if err != nil {
+		return uploadResult{}, err
+	}
+	defer os.Remove(temp.Name())
+	defer temp.Close()
+
+	details.Size, err = io.Copy(temp, request.Body)
+	if err != nil {
+		return uploadResult{}, err
+	}
+	if details.Size == 0 {
+		return uploadResult{}, &uploadError{http.StatusBadRequest, "the request body is empty"}
+	}
+	if _, err := temp.Seek(0, io.SeekStart); err != nil {
+		return uploadResult{}, err
+	}
+	if progressID := uploadID(request); progressID != "" {
+		s.progress.setState(progressID, progressProcessing)
+	}
+	return s.saveUpload(request.Context(), temp, details)
+}
+
+// headerValue returns a header that may be URL encoded
+func headerValue(request *http.Request, name string) string {
+	value := request.Header.Get(name)
+	if decoded, err := url.PathUnescape(value); err == nil {
+		return decoded
+	}
+	return value
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Limits on what a registry entry can hold
+const (
+	maxRegistryTitle       = 100
+	maxRegistryDescription = 1000
+	maxRegistryURL         = 2000
+)
+
+// Kinds of registry entry
+const (
+	// registryLink entries link to a registry at a store
+	registryLink = "link"
+	// registryFund entries are cash funds, like for the honeymoon, which
+	// can have a goal
+	registryFund = "fund"
+)
+
+// RegistryEntry is one place guests can give the couple a gift: a registry
+// at a store, or a cash fund
+type RegistryEntry struct {
+	// ID is made from the title when the entry is added, and stays the same
+	// if it is renamed
+	ID          string `json:"id"`
+	Kind        string `json:"kind"`
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	URL         string `json:"url"`
+	ImageURL    string `json:"imageUrl,omitempty"`
+	// GoalCents is how much a fund is hoping to raise, and RaisedCents how
+	// much the couple says it has so far, both in cents
+	GoalCents   int64 `json:"goalCents,omitempty"`
+	RaisedCents int64 `json:"raisedCents,omitempty"`
+	// Position orders the registry page, lowest first
+	Position  int       `json:"position"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// registryStore keeps the registry
+type registryStore struct {
+	mu      sync.Mutex
+	path    string
+	entries []*RegistryEntry
+}
+
+// openRegistryStore loads the registry saved at path, starting empty if it
+// doesn't exist
+func openRegistryStore(path string) (*registryStore, error) {
+	store := &registryStore{path: path}
+
+	if err := loadJSONFile(path, &store.entries); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// All returns a copy of every registry entry, in the order of the registry
+// page
+func (store *registryStore) All() []RegistryEntry {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	entries := make([]RegistryEntry, 0, len(store.entries))
+	for _, entry := range store.entries {
+		entries = append(entries, *entry)
+	}
+	slices.SortStableFunc(entries, func(a, b RegistryEntry) int {
+		return a.Position - b.Position
+	})
+	return entries
+}
+
+// find returns the entry with the given ID. The caller must hold store.mu.
+func (store *registryStore) find(id string) *RegistryEntry {
+	for _, entry := range store.entries {
+		if entry.ID == id {
+			return entry
+		}
+	}
+	return nil
+}
+
+// Create adds an entry to the registry, after the others unless it is given
+// a position
+func (store *registryStore) Create(entry RegistryEntry, positioned bool) (RegistryEntry, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	base := slug(entry.Title, "gift")
+	entry.ID = base
+	for n := 2; store.find(entry.ID) != nil; n++ {
+		entry.ID = fmt.Sprintf("%s-%d", base, n)
+	}
+	if !positioned {
+		entry.Position = 0
+		for _, other := range store.entries {
+			entry.Position = max(entry.Position, other.Position+1)
+		}
+	}
+	entry.CreatedAt = time.Now().UTC()
+	store.entries = append(store.entries, &entry)
+	if err := store.save(); err != nil {
+		store.entries = store.entries[:len(store.entries)-1]
+		return RegistryEntry{}, err
+	}
+	return entry, nil
+}
+
+// Update changes the entry with the given ID, reporting whether there is one
+func (store *registryStore) Update(id string, change func(*RegistryEntry)) (RegistryEntry, bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	entry := store.find(id)
+	if entry == nil {
+		return RegistryEntry{}, false, nil
+	}
+	previous := *entry
+	change(entry)
+	entry.ID = previous.ID
+	if err := store.save(); err != nil {
+		*entry = previous
+		return RegistryEntry{}, true, err
+	}
+	return *entry, true, nil
+}
+
+// Delete removes the entry with the given ID, reporting whether there was one
+func (store *registryStore) Delete(id string) (bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for i, entry := range store.entries {
+		if entry.ID != id {
+			continue
+		}
+		previous := store.entries
+		store.entries = slices.Concat(previous[:i], previous[i+1:])
+		if err := store.save(); err != nil {
+			store.entries = previous
+			return true, err
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// save writes the registry to disk. The caller must hold store.mu.
+func (store *registryStore) save() error {
+	return saveJSONFile(store.path, store.entries)
+}
+
+// registryRequest is the body of a request to add or change a registry
+// entry. Fields left out of a change are kept as they are.
+type registryRequest struct {
+	Kind        *string `json:"kind"`
+	Title       *string `json:"title"`
+	Description *string `json:"description"`
+	URL         *string `json:"url"`
+	ImageURL    *string `json:"imageUrl"`
+	GoalCents   *int64  `json:"goalCents"`
+	RaisedCents *int64  `json:"raisedCents"`
+	Position    *int    `json:"position"`
+}
+
+// webURL checks that value is an http or https URL, as links to stores and
+// images have to be
+func webURL(value string) bool {
+	parsed, err := url.Parse(value)
+	return err == nil && (parsed.Scheme == "http" || parsed.Scheme == "https") && parsed.Host != "" && len(value) <= maxRegistryURL
+}
+
+// validate checks the fields that were given, tidying them up
+func (body *registryRequest) validate() error {
+	trim := func(field *string) *string {
+		if field == nil {
+			return nil
+		}
+		trimmed := strings.TrimSpace(*field)
+		return &trimmed
+	}
+	body.Kind, body.Title, body.Description = trim(body.Kind), trim(body.Title), trim(body.Description)
+	body.URL, body.ImageURL = trim(body.URL), trim(body.ImageURL)
+
+	if body.Kind != nil && *body.Kind != registryLink && *body.Kind != registryFund {
+		return errors.New("kind must be link or fund")
+	}
+	if body.Title != nil && (*body.Title == "" || utf8.RuneCountInString(*body.Title) > maxRegistryTitle) {
+		return fmt.Errorf("title must be 1 to %d characters", maxRegistryTitle)
+	}
+	if body.Description != nil && utf8.RuneCountInString(*body.Description) > maxRegistryDescription {
+		return fmt.Errorf("description can be at most %d characters", maxRegistryDescription)
+	}
+	if body.URL != nil && !webURL(*body.URL) {
+		return errors.New("url must be a web address starting with http:// or https://")
+	}
+	if body.ImageURL != nil && *body.ImageURL != "" && !webURL(*body.ImageURL) {
+		return errors.New("imageUrl must be a web address starting with http:// or https://")
+	}
+	if body.GoalCents != nil && *body.GoalCents < 0 {
+		return errors.New("goalCents can't be negative")
+	}
+	if body.RaisedCents != nil && *body.RaisedCents < 0 {
+		return errors.New("raisedCents can't be negative")
+	}
+	return nil
+}
+
+// apply makes the changes in the request to entry
+func (body *registryRequest) apply(entry *RegistryEntry) {
+	if body.Kind != nil {
+		entry.Kind = *body.Kind
+	}
+	if body.Title != nil {
+		entry.Title = *body.Title
+	}
+	if body.Description != nil {
+		entry.Description = *body.Description
+	}
+	if body.URL != nil {
+		entry.URL = *body.URL
+	}
+	if body.ImageURL != nil {
+		entry.ImageURL = *body.ImageURL
+	}
+	if body.GoalCents != nil {
+		entry.GoalCents = *body.GoalCents
+	}
+	if body.RaisedCents != nil {
+		entry.RaisedCents = *body.RaisedCents
+	}
+	if body.Position != nil {
+		entry.Position = *body.Position
+	}
+	// Only funds raise money
+	if entry.Kind == registryLink {
+		entry.GoalCents, entry.RaisedCents = 0, 0
+	}
+}
+
+// registryHandler lists the registry for the registry page
+func (s *server) registryHandler(response http.ResponseWriter, request *http.Request) {
+	writeJSON(response, http.StatusOK, s.registry.All())
+}
+
+// createRegistryHandler adds a registry link or cash fund
+func (s *server) createRegistryHandler(response http.ResponseWriter, request *http.Request) {
+	var body registryRequest
+	if !decodeJSON(response, request, &body) {
+		return
+	}
+	if body.Title == nil || body.URL == nil {
+		writeJSONError(response, http.StatusBadRequest, "title and url are required")
+		return
+	}
+	if err := body.validate(); err != nil {
+		writeJSONError(response, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	entry := RegistryEntry{Kind: registryLink}
+	body.apply(&entry)
+	added, err := s.registry.Create(entry, body.Position != nil)
+	if err != nil {
+		slog.Error("Unable to save registry", "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to add registry entry")
+		return
+	}
+	writeJSON(response, http.StatusCreated, added)
+}
+
+// updateRegistryHandler changes a registry entry, such as to move it on the
+// page or note how much a fund has raised
+func (s *server) updateRegistryHandler(response http.ResponseWriter, request *http.Request) {
+	var body registryRequest
+	if !decodeJSON(response, request, &body) {
+		return
+	}
+	if err := body.validate(); err != nil {
+		writeJSONError(response, http.StatusBadRequest, err.Error())
+		return
+	}
+	entry, ok, err := s.registry.Update(request.PathValue("id"), body.apply)
+	if !ok {
+		writeJSONError(response, http.StatusNotFound, "Registry entry not found")
+		return
+	}
+	if err != nil {
+		slog.Error("Unable to save registry", "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to update registry entry")
+		return
+	}
+	writeJSON(response, http.StatusOK, entry)
+}
+
+// deleteRegistryHandler takes an entry off the registry
+func (s *server) deleteRegistryHandler(response http.ResponseWriter, request *http.Request) {
+	ok, err := s.registry.Delete(request.PathValue("id"))
+	if !ok {
+		writeJSONError(response, http.StatusNotFound, "Registry entry not found")
+		return
+	}
+	if err != nil {
+		slog.Error("Unable to save registry", "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to delete registry entry")
+		return
+	}
+	response.WriteHeader(http.StatusNoContent)
+}
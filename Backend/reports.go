@@ -0,0 +1,280 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// reportReasons are why a guest can report a photo
+var reportReasons = []string{"wrong-person", "embarrassing", "inappropriate", "other"}
+
+// maxReportDetails is how long the note a guest adds to a report can be
+const maxReportDetails = 500
+
+// reportedReview is the review reason of photos hidden because enough guests
+// reported them, so dismissing the reports knows to show them again
+const reportedReview = "reported by guests"
+
+// Report is a guest asking for a photo to be looked at
+type Report struct {
+	PhotoID string `json:"photoId"`
+	// Reporter is who sent the report, as guestKey tells them apart
+	Reporter  string    `json:"reporter"`
+	Reason    string    `json:"reason"`
+	Details   string    `json:"details,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// reportRequest is the body of a request to report a photo
+type reportRequest struct {
+	Reason  string `json:"reason"`
+	Details string `json:"details"`
+}
+
+// reportResponse is the result of reporting a photo
+type reportResponse struct {
+	Reported bool `json:"reported"`
+	// Hidden is whether the photo has been taken out of the gallery until
+	// it is reviewed
+	Hidden bool `json:"hidden"`
+}
+
+// reportHandler records a guest's report of a photo. Reports are listed for
+// the couple to review, and once enough guests have reported a photo it is
+// hidden from the gallery until they do.
+func (s *server) reportHandler(response http.ResponseWriter, request *http.Request) {
+	photo, ok := s.servedPhoto(request)
+	if !ok {
+		writeJSONError(response, http.StatusNotFound, "Photo not found")
+		return
+	}
+	reporter := s.guestKey(request)
+	if reporter == "" {
+		writeJSONError(response, http.StatusBadRequest, "a guest code or X-Device-Token header is needed to report photos")
+		return
+	}
+	var body reportRequest
+	if !decodeJSON(response, request, &body) {
+		return
+	}
+	if !slices.Contains(reportReasons, body.Reason) {
+		writeJSONError(response, http.StatusBadRequest, "reason must be one of "+strings.Join(reportReasons, ", "))
+		return
+	}
+	details := strings.TrimSpace(body.Details)
+	if utf8.RuneCountInString(details) > maxReportDetails {
+		writeJSONError(response, http.StatusBadRequest, fmt.Sprintf("details can be at most %d characters", maxReportDetails))
+		return
+	}
+
+	report := &Report{PhotoID: photo.ID, Reporter: reporter, Reason: body.Reason, Details: details, CreatedAt: time.Now().UTC()}
+	if _, err := s.photos.AddReport(report); err != nil {
+		slog.Error("Unable to save report", "photo", photo.ID, "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to save report")
+		return
+	}
+
+	reports, err := s.photos.Reports(photo.ID)
+	if err != nil {
+		slog.Error("Unable to read reports", "photo", photo.ID, "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to save report")
+		return
+	}
+	hidden := false
+	if *reportHideAfter > 0 && len(reports) >= *reportHideAfter {
+		photo.Status, photo.ReviewReason = photoNeedsReview, reportedReview
+		if err := s.photos.Update(photo); err != nil {
+			slog.Error("Unable to hide reported photo", "photo", photo.ID, "err", err)
+		} else {
+			slog.Info("Hid reported photo", "photo", photo.ID, "reports", len(reports))
+			hidden = true
+		}
+	}
+	writeJSON(response, http.StatusOK, reportResponse{Reported: true, Hidden: hidden})
+}
+
+// reportedPhoto is a photo with the reports of it, for review
+type reportedPhoto struct {
+	PhotoID      string    `json:"photoId"`
+	Status       string    `json:"status"`
+	ReviewReason string    `json:"reviewReason,omitempty"`
+	Reports      []*Report `json:"reports"`
+}
+
+// listReportsHandler lists every reported photo, the most reported first
+func (s *server) listReportsHandler(response http.ResponseWriter, request *http.Request) {
+	reports, err := s.photos.Reports("")
+	if err != nil {
+		slog.Error("Unable to read reports", "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to read reports")
+		return
+	}
+
+	byPhoto := make(map[string]*reportedPhoto)
+	reported := []*reportedPhoto{}
+	for _, report := range reports {
+		entry, ok := byPhoto[report.PhotoID]
+		if !ok {
+			photo, ok := s.photos.Get(report.PhotoID)
+			if !ok {
+				continue
+			}
+			entry = &reportedPhoto{PhotoID: photo.ID, Status: photo.Status, ReviewReason: photo.ReviewReason}
+			byPhoto[report.PhotoID] = entry
+			reported = append(reported, entry)
+		}
+		entry.Reports = append(entry.Reports, report)
+	}
+	slices.SortStableFunc(reported, func(a, b *reportedPhoto) int {
+		return cmp.Compare(len(b.Reports), len(a.Reports))
+	})
+	writeJSON(response, http.StatusOK, reported)
+}
+
+// dismissReportsHandler clears the reports of a photo once it has been
+// looked at, putting it back in the gallery if the reports hid it
+func (s *server) dismissReportsHandler(response http.ResponseWriter, request *http.Request) {
+	photo, ok := s.photos.Get(request.PathValue("id"))
+	if !ok {
+		writeJSONError(response, http.StatusNotFound, "Photo not found")
+		return
+	}
+	if err := s.photos.ClearReports(photo.ID); err != nil {
+		slog.Error("Unable to clear reports", "photo", photo.ID, "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to dismiss reports")
+		return
+	}
+	if photo.Status == photoNeedsReview && photo.ReviewReason == reportedReview {
+		photo.Status, photo.ReviewReason = photoReady, ""
+		if err := s.photos.Update(photo); err != nil {
+			slog.Error("Unable to update photo", "photo", photo.ID, "err", err)
+			writeJSONError(response, http.StatusInternalServerError, "Unable to dismiss reports")
+			return
+		}
+	}
+	response.WriteHeader(http.StatusNoContent)
+}
+
+// reportsPath is where a JSON index keeps its reports
+func (store *jsonPhotoStore) reportsPath() string {
+	return filepath.Join(filepath.Dir(store.path), "reports.json")
+}
+
+// loadReports reads the reports saved next to the index, if there are any
+func (store *jsonPhotoStore) loadReports() error {
+	return loadJSONFile(store.reportsPath(), &store.reports)
+}
+
+func (store *jsonPhotoStore) AddReport(report *Report) (bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if _, ok := store.photos[report.PhotoID]; !ok {
+		return false, os.ErrNotExist
+	}
+	for _, existing := range store.reports[report.PhotoID] {
+		if existing.Reporter == report.Reporter {
+			return false, nil
+		}
+	}
+	copied := *report
+	store.reports[report.PhotoID] = append(store.reports[report.PhotoID], &copied)
+	if err := store.saveReports(); err != nil {
+		reports := store.reports[report.PhotoID]
+		store.reports[report.PhotoID] = reports[:len(reports)-1]
+		return false, err
+	}
+	return true, nil
+}
+
+func (store *jsonPhotoStore) Reports(photoID string) ([]*Report, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var reports []*Report
+	for id, photoReports := range store.reports {
+		if photoID != "" && id != photoID {
+			continue
+		}
+		for _, report := range photoReports {
+			copied := *report
+			reports = append(reports, &copied)
+		}
+	}
+	slices.SortFunc(reports, func(a, b *Report) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+	return reports, nil
+}
+
+func (store *jsonPhotoStore) ClearReports(photoID string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	previous, ok := store.reports[photoID]
+	if !ok {
+		return nil
+	}
+	delete(store.reports, photoID)
+	if err := store.saveReports(); err != nil {
+		store.reports[photoID] = previous
+		return err
+	}
+	return nil
+}
+
+// saveReports writes the reports to disk. The caller must hold store.mu.
+func (store *jsonPhotoStore) saveReports() error {
+	return saveJSONFile(store.reportsPath(), store.reports)
+}
+
+func (store *sqlPhotoStore) AddReport(report *Report) (bool, error) {
+	if _, ok := store.Get(report.PhotoID); !ok {
+		return false, os.ErrNotExist
+	}
+	result, err := store.db.Exec(`INSERT INTO reports (photo_id, reporter, reason, details, created_at) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (photo_id, reporter) DO NOTHING`,
+		report.PhotoID, report.Reporter, report.Reason, report.Details, report.CreatedAt.UTC())
+	if err != nil {
+		return false, err
+	}
+	added, err := result.RowsAffected()
+	return added > 0, err
+}
+
+func (store *sqlPhotoStore) Reports(photoID string) ([]*Report, error) {
+	query := `SELECT photo_id, reporter, reason, details, created_at FROM reports`
+	var args []any
+	if photoID != "" {
+		query += ` WHERE photo_id = $1`
+		args = append(args, photoID)
+	}
+	rows, err := store.db.Query(query+` ORDER BY created_at`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var reports []*Report
+	for rows.Next() {
+		var report Report
+		if err := rows.Scan(&report.PhotoID, &report.Reporter, &report.Reason, &report.Details, &report.CreatedAt); err != nil {
+			return nil, err
+		}
+		reports = append(reports, &report)
+	}
+	return reports, rows.Err()
+}
+
+func (store *sqlPhotoStore) ClearReports(photoID string) error {
+	_, err := store.db.Exec(`DELETE FROM reports WHERE photo_id = $1`, photoID)
+	return err
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/gen2brain/webp"
+	"golang.org/x/image/draw"
+)
+
+// resizeStep is what requested widths are rounded up to a multiple of, so
+// there are only a few sizes of each photo to cache
+const resizeStep = 100
+
+// newResizeCache returns the store resized photos are cached in. It is
+// encrypted like the uploads are, if they are.
+func newResizeCache() (Storage, error) {
+	return withEncryption(&localStorage{dir: *resizeCacheDir})
+}
+
+// resizeWidth parses the width asked for with ?w=, rounded up to the next
+// resizeStep and capped at the largest size photos are kept at
+func resizeWidth(value string) (int, bool) {
+	width, err := strconv.Atoi(value)
+	if err != nil || width < 1 {
+		return 0, false
+	}
+	width = (width + resizeStep - 1) / resizeStep * resizeStep
+	if *maxDimension > 0 {
+		width = min(width, *maxDimension)
+	}
+	return width, true
+}
+
+// serveResized serves photo scaled down to width pixels wide, making and
+// caching that size the first time it is asked for. Photos that are already
+// no wider are served at their full size.
+func (s *server) serveResized(response http.ResponseWriter, request *http.Request, photo *Photo, width int) {
+	source, ok := photo.Variants["web"]
+	if photo.Kind != kindImage || !ok {
+		writeJSONError(response, http.StatusBadRequest, "this photo can't be resized")
+		return
+	}
+
+	key := sha256.Sum256(fmt.Appendf(nil, "%s %d", source, width))
+	name := hex.EncodeToString(key[:1]) + "/" + hex.EncodeToString(key[1:16]) + ".webp"
+	if _, err := s.resized.Stat(request.Context(), name); err == nil {
+		s.serveStored(response, request, s.resized, name, "image/webp")
+		return
+	}
+
+	resized, err := resizeStored(request.Context(), s.storage, source, width)
+	if err != nil {
+		slog.Error("Unable to resize photo", "photo", photo.ID, "err", err)
+		http.Error(response, "Unable to resize photo", http.StatusInternalServerError)
+		return
+	}
+	if resized == nil {
+		s.serveStored(response, request, s.storage, source, "image/webp")
+		return
+	}
+	if err := s.resized.Put(request.Context(), name, bytes.NewReader(resized)); err != nil {
+		slog.Error("Unable to cache resized photo", "photo", photo.ID, "err", err)
+		http.Error(response, "Unable to resize photo", http.StatusInternalServerError)
+		return
+	}
+	s.serveStored(response, request, s.resized, name, "image/webp")
+}
+
+// resizeStored scales the stored image name down to width pixels wide and
+// encodes it as a WebP. It returns nil if the image is no wider than that.
+func resizeStored(ctx context.Context, storage Storage, name string, width int) ([]byte, error) {
+	src, err := storage.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(src)
+	src.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := img.Bounds()
+	if bounds.Dx() <= width {
+		return nil, nil
+	}
+	height := max(1, bounds.Dy()*width/bounds.Dx())
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Src, nil)
+
+	var encoded bytes.Buffer
+	if err := webp.Encode(&encoded, dst, webp.Options{Quality: *webpQuality}); err != nil {
+		return nil, err
+	}
+	return encoded.Bytes(), nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+)
+
+// writeJSON sends value as a JSON response with the given status code
+func writeJSON(response http.ResponseWriter, status int, value any) {
+	response.Header().Set("Content-Type", "application/json")
+	response.WriteHeader(status)
+	if err := json.NewEncoder(response).Encode(value); err != nil {
+		slog.Error("Failed to write response", "err", err)
+	}
+}
+
+// errorResponse is the body of a JSON error response
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// writeJSONError sends message as a JSON error response
+func writeJSONError(response http.ResponseWriter, status int, message string) {
+	writeJSON(response, status, errorResponse{Error: message})
+}
+
+// maxJSONBody is the largest JSON request body the API reads
+const maxJSONBody = 64 << 10
+
+// decodeJSON reads the JSON body of request into value, sending a 400
+// response and returning false if it isn't valid
+func decodeJSON(response http.ResponseWriter, request *http.Request, value any) bool {
+	decoder := json.NewDecoder(http.MaxBytesReader(response, request.Body, maxJSONBody))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(value); err != nil {
+		writeJSONError(response, http.StatusBadRequest, "invalid request body")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Retention actions
+const (
+	retentionDelete  = "delete"
+	retentionArchive = "archive"
+)
+
+// archiveDirectory is where archived photos are moved to in storage, so a
+// bucket lifecycle rule can put them in a cheaper storage class
+const archiveDirectory = "archive"
+
+// retentionRule is one lifecycle rule, such as deleting photos held for
+// review a week after they were uploaded. Rules are loaded from a JSON list:
+//
+//	[
+//	  {"action": "delete", "status": "needs_review", "after": "7d"},
+//	  {"action": "archive", "after": "365d", "from": "wedding"}
+//	]
+type retentionRule struct {
+	// Action is what happens to matching photos, delete or archive
+	Action string `json:"action"`
+	// Status and Kind limit the rule to photos in that processing state or
+	// of that kind; empty matches every photo
+	Status string `json:"status,omitempty"`
+	Kind   string `json:"kind,omitempty"`
+	// After is how long after From the rule applies, such as "72h" or "7d"
+	After string `json:"after"`
+	// From is what After is counted from: "upload", the default, or
+	// "wedding" for the configured wedding date
+	From string `json:"from,omitempty"`
+
+	after time.Duration
+}
+
+// retentionRecord is an audit entry for a photo a rule was applied to
+type retentionRecord struct {
+	Time    time.Time `json:"time"`
+	Action  string    `json:"action"`
+	Rule    int       `json:"rule"`
+	PhotoID string    `json:"photoId"`
+	File    string    `json:"file"`
+	Status  string    `json:"status"`
+	DryRun  bool      `json:"dryRun,omitempty"`
+}
+
+// retentionPolicy applies lifecycle rules to the stored photos
+type retentionPolicy struct {
+	rules     []retentionRule
+	wedding   time.Time
+	dryRun    bool
+	auditPath string
+
+	// mu stops two runs overlapping
+	mu sync.Mutex
+}
+
+// loadRetentionPolicy reads the rules at path. A missing file means there
+// are no rules.
+func loadRetentionPolicy(path, weddingDate string, dryRun bool) (*retentionPolicy, error) {
+	policy := &retentionPolicy{dryRun: dryRun, auditPath: filepath.Join(*uploadDir, "retention-audit.jsonl")}
+	if weddingDate != "" {
+		wedding, err := time.Parse("2006-01-02", weddingDate)
+		if err != nil {
+			return nil, fmt.Errorf("wedding date must look like 2006-01-02: %w", err)
+		}
+		policy.wedding = wedding
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return policy, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &policy.rules); err != nil {
+		return nil, err
+	}
+
+	for i := range policy.rules {
+		rule := &policy.rules[i]
+		if rule.Action != retentionDelete && rule.Action != retentionArchive {
+			return nil, fmt.Errorf("rule %d: unknown action %q", i+1, rule.Action)
+		}
+		switch rule.From {
+		case "", "upload":
+		case "wedding":
+			if policy.wedding.IsZero() {
+				return nil, fmt.Errorf("rule %d: counts from the wedding but WEDDING_DATE isn't set", i+1)
+			}
+		default:
+			return nil, fmt.Errorf("rule %d: unknown from %q", i+1, rule.From)
+		}
+		if rule.after, err = parseRetentionAge(rule.After); err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i+1, err)
+		}
+	}
+	return policy, nil
+}
+
+// parseRetentionAge parses a duration, which unlike time.ParseDuration may
+// also be a whole number of days such as "7d"
+func parseRetentionAge(age string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(age, "d"); ok {
+		count, err := strconv.Atoi(days)
+		if err != nil || count < 0 {
+			return 0, fmt.Errorf("invalid age %q", age)
+		}
+		return time.Duration(count) * 24 * time.Hour, nil
+	}
+	duration, err := time.ParseDuration(age)
+	if err != nil || duration < 0 {
+		return 0, fmt.Errorf("invalid age %q", age)
+	}
+	return duration, nil
+}
+
+// schedule applies the rules every interval, if there are any. Deleted
+// photos are taken off their uploaders' quotas.
+func (policy *retentionPolicy) schedule(storage Storage, photos PhotoStore, quotas *quotaStore, interval time.Duration) {
+	if len(policy.rules) == 0 {
+		return
+	}
+	if policy.dryRun {
+		slog.Info("Retention rules are in dry run mode, nothing will be removed")
+	}
+	go func() {
+		policy.run(context.Background(), storage, photos, quotas, time.Now())
+		for now := range time.Tick(interval) {
+			policy.run(context.Background(), storage, photos, quotas, now)
+		}
+	}()
+}
+
+// matches reports whether rule applies to photo at now
+func (policy *retentionPolicy) matches(rule retentionRule, photo *Photo, now time.Time) bool {
+	if rule.Status != "" && photo.Status != rule.Status {
+		return false
+	}
+	if rule.Kind != "" && photo.Kind != rule.Kind {
+		return false
+	}
+	// Photos are left alone while they are being processed, and archived
+	// photos can only be deleted
+	if photo.Status == photoProcessing || (rule.Action == retentionArchive && photo.archived()) {
+		return false
+	}
+	from := photo.UploadedAt
+	if rule.From == "wedding" {
+		from = policy.wedding
+	}
+	return !now.Before(from.Add(rule.after))
+}
+
+// run applies the first matching rule to every photo
+func (policy *retentionPolicy) run(ctx context.Context, storage Storage, photos PhotoStore, quotas *quotaStore, now time.Time) {
+	policy.mu.Lock()
+	defer policy.mu.Unlock()
+
+	for _, photo := range photos.All() {
+		for i, rule := range policy.rules {
+			if !policy.matches(rule, photo, now) {
+				continue
+			}
+			record := retentionRecord{
+				Time:    now,
+				Action:  rule.Action,
+				Rule:    i + 1,
+				PhotoID: photo.ID,
+				File:    photo.originalName(),
+				Status:  photo.Status,
+				DryRun:  policy.dryRun,
+			}
+			if !policy.dryRun {
+				if err := applyRetention(ctx, storage, photos, quotas, photo, rule.Action); err != nil {
+					slog.Error("Unable to apply retention rule", "action", rule.Action, "photo", photo.ID, "err", err)
+					break
+				}
+			}
+			if err := policy.audit(record); err != nil {
+				slog.Error("Unable to write retention audit record", "err", err)
+			}
+			break
+		}
+	}
+}
+
+// applyRetention deletes or archives photo
+func applyRetention(ctx context.Context, storage Storage, photos PhotoStore, quotas *quotaStore, photo *Photo, action string) error {
+	if action == retentionDelete {
+		if err := photos.Remove(photo.ID); err != nil {
+			return err
+		}
+		removePhotoFiles(ctx, storage, photos, photo)
+		quotas.ReleasePhoto(photo)
+		return nil
+	}
+
+	// The variants are moved first and the original last, so the photo only
+	// counts as archived once all of it is, and a later run picks up where
+	// a failed one stopped. The index is updated with whatever was moved
+	// even if a move fails, so it never points at a file that has gone.
+	archived := photo.clone()
+	var err error
+	for variant, name := range photo.Variants {
+		if strings.HasPrefix(name, archiveDirectory+"/") {
+			continue
+		}
+		newName := path.Join(archiveDirectory, name)
+		if err = moveStored(ctx, storage, name, newName); err != nil {
+			break
+		}
+		archived.Variants[variant] = newName
+	}
+	if err == nil {
+		archived.Directory = path.Join(archiveDirectory, photo.Directory)
+		if err = moveStored(ctx, storage, photo.originalName(), archived.originalName()); err != nil {
+			archived.Directory = photo.Directory
+		}
+	}
+	if updateErr := photos.Update(archived); err == nil {
+		err = updateErr
+	}
+	return err
+}
+
+// audit appends record to the audit log
+func (policy *retentionPolicy) audit(record retentionRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(policy.auditPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(data, '\n'))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		slog.Info("Applied retention rule", "rule", record.Rule, "action", record.Action, "photo", record.PhotoID, "dryRun", record.DryRun)
+	}
+	return err
+}
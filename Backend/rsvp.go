@@ -0,0 +1,782 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Limits on what a guest can send with their RSVP
+const (
+	// maxPartySize is the most people one RSVP can be for, when the guest
+	// list doesn't give the invitation a party size of its own
+	maxPartySize  = 20
+	maxRSVPNotes  = 1000
+	maxMealLength = 100
+	maxAllergies  = 300
+)
+
+// RSVP is a household's answer to their invitation. Each guest code has
+// one, which is replaced if they answer again.
+type RSVP struct {
+	Code string `json:"code"`
+	// Name is the name on the invitation, kept so the list reads well even
+	// if the household is later taken off it
+	Name string `json:"name"`
+	// Events maps each event the household answered for to whether they
+	// are coming to it
+	Events map[string]bool `json:"events"`
+	// PartySize is how many people are coming. It is 0 when they are
+	// declining everything.
+	PartySize int `json:"partySize"`
+	// Attendees are who is coming, if the household named them
+	Attendees   []Attendee `json:"attendees,omitempty"`
+	Notes       string     `json:"notes,omitempty"`
+	SubmittedAt time.Time  `json:"submittedAt"`
+	UpdatedAt   time.Time  `json:"updatedAt"`
+	// SpamReason is why screening took the RSVP for spam, if it did. RSVPs
+	// need a guest code, so they are saved anyway for the couple to judge.
+	SpamReason string `json:"spamReason,omitempty"`
+}
+
+// Attendee is someone coming to the wedding on an RSVP: one of the
+// household's guests, or a plus-one they are bringing
+type Attendee struct {
+	// ID is the guest's ID, or for a plus-one an ID of its own that is kept
+	// while their name stays the same
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	PlusOne bool   `json:"plusOne,omitempty"`
+	// Meal is what the attendee is having, from the menu if there is one,
+	// and Allergies anything the caterer needs to know about what they eat
+	Meal      string `json:"meal,omitempty"`
+	Allergies string `json:"allergies,omitempty"`
+	// Events are the events the attendee is coming to, or every event the
+	// RSVP is coming to if there are none
+	Events []string `json:"events,omitempty"`
+}
+
+// clone returns a copy of rsvp that can be changed without affecting the
+// one held by a store
+func (rsvp *RSVP) clone() *RSVP {
+	copied := *rsvp
+	copied.Events = maps.Clone(rsvp.Events)
+	copied.Attendees = slices.Clone(rsvp.Attendees)
+	for i := range copied.Attendees {
+		copied.Attendees[i].Events = slices.Clone(rsvp.Attendees[i].Events)
+	}
+	return &copied
+}
+
+// attending reports whether anyone is coming to any of the events
+func (rsvp *RSVP) attending() bool {
+	for _, coming := range rsvp.Events {
+		if coming {
+			return true
+		}
+	}
+	return false
+}
+
+// comingTo returns the attendees coming to event. It is nil if the RSVP
+// only gave a party size.
+func (rsvp *RSVP) comingTo(event string) []Attendee {
+	if !rsvp.Events[event] {
+		return nil
+	}
+	var coming []Attendee
+	for _, attendee := range rsvp.Attendees {
+		if len(attendee.Events) == 0 || slices.Contains(attendee.Events, event) {
+			coming = append(coming, attendee)
+		}
+	}
+	return coming
+}
+
+// headcount returns how many people are coming to event
+func (rsvp *RSVP) headcount(event string) int {
+	if !rsvp.Events[event] {
+		return 0
+	}
+	if len(rsvp.Attendees) == 0 {
+		return rsvp.PartySize
+	}
+	return len(rsvp.comingTo(event))
+}
+
+// RSVPStore keeps the RSVPs, in the same place as the photo index
+type RSVPStore interface {
+	// Get returns the RSVP sent with a guest code, if there is one
+	Get(code string) (*RSVP, bool, error)
+	// Save adds or replaces the RSVP of rsvp.Code
+	Save(rsvp *RSVP) error
+	// All returns every RSVP, the first sent first
+	All() ([]*RSVP, error)
+	// Delete removes the RSVP sent with a guest code, if there is one
+	Delete(code string) error
+}
+
+// openRSVPStore opens the RSVPs kept alongside photos: in the same database
+// if the index is in one, and otherwise in a JSON file next to it
+func openRSVPStore(photos PhotoStore) (RSVPStore, error) {
+	switch store := photos.(type) {
+	case *sqlitePhotoStore:
+		return &sqlRSVPStore{db: store.db}, nil
+	case *sqlPhotoStore:
+		return &sqlRSVPStore{db: store.db}, nil
+	}
+	return openJSONRSVPStore(filepath.Join(*uploadDir, "rsvps.json"))
+}
+
+// invitation is what a guest looking up their RSVP is shown
+type invitation struct {
+	Code string `json:"code"`
+	Name string `json:"name"`
+	// PartySize is the most people the household can RSVP for
+	PartySize int `json:"partySize"`
+	// Guests are the household's guests on the guest list, and PlusOnes how
+	// many more people they can bring
+	Guests   []invitedGuest `json:"guests"`
+	PlusOnes int            `json:"plusOnes"`
+	// Events are the events the household is invited to
+	Events []string `json:"events"`
+	// Menu is what attendees can choose to eat, or empty if they can ask
+	// for anything
+	Menu []string `json:"menu"`
+	// RSVP is the household's answer so far, if they have sent one
+	RSVP *RSVP `json:"rsvp"`
+	// Deadline is the last day to RSVP, if there is one, and Closed is set
+	// once it has passed. LateRSVP is an answer sent after it that the
+	// couple hasn't approved yet.
+	Deadline *time.Time `json:"deadline,omitempty"`
+	Closed   bool       `json:"closed,omitempty"`
+	LateRSVP *RSVP      `json:"lateRsvp,omitempty"`
+}
+
+// invitedGuest is a guest on an invitation, as guests are shown it, with
+// the events they are invited to
+type invitedGuest struct {
+	ID     string   `json:"id"`
+	Name   string   `json:"name"`
+	Events []string `json:"events"`
+}
+
+// rsvpRequest is the body of an RSVP. The guest code can be sent as an
+// X-Guest-Code header instead. Households can say who is coming as
+// attendees rather than just how many as partySize.
+type rsvpRequest struct {
+	Code      string            `json:"code"`
+	Events    map[string]bool   `json:"events"`
+	PartySize int               `json:"partySize"`
+	Attendees []attendeeRequest `json:"attendees"`
+	Notes     string            `json:"notes"`
+	spamFields
+}
+
+// attendeeRequest is someone coming on an RSVP: a guest on the invitation
+// by guestId, or a plus-one by name. Events are the events they are coming
+// to, if not all of those the RSVP is coming to.
+type attendeeRequest struct {
+	GuestID   string   `json:"guestId"`
+	Name      string   `json:"name"`
+	Meal      string   `json:"meal"`
+	Allergies string   `json:"allergies"`
+	Events    []string `json:"events"`
+}
+
+// chooseMeal checks the meal an attendee asked for. With a menu set, they
+// have to pick one of its meals.
+func chooseMeal(requested string) (string, error) {
+	requested = strings.TrimSpace(requested)
+	menu := meals()
+	if len(menu) == 0 {
+		if utf8.RuneCountInString(requested) > maxMealLength {
+			return "", fmt.Errorf("meal can be at most %d characters", maxMealLength)
+		}
+		return requested, nil
+	}
+	meal, ok := findItem(menu, requested)
+	if !ok {
+		return "", errors.New("meal must be one of " + strings.Join(menu, ", "))
+	}
+	return meal, nil
+}
+
+// partySize is the most people a household's RSVP can be for: the party size
+// on the guest list, or else its guests and plus-ones if it has named guests
+func partySize(household *Household) int {
+	if household.PartySize > 0 {
+		return household.PartySize
+	}
+	if len(household.Guests) > 0 {
+		return len(household.Guests) + household.PlusOnes
+	}
+	return maxPartySize
+}
+
+// attendees checks who an RSVP says is coming against the invitation and
+// the events it is coming to, keeping the IDs plus-ones had on the
+// household's previous RSVP
+func (body *rsvpRequest) attendees(household *Household, coming map[string]bool, previous *RSVP) ([]Attendee, error) {
+	plusOneIDs := map[string]string{}
+	if previous != nil {
+		for _, attendee := range previous.Attendees {
+			if attendee.PlusOne {
+				plusOneIDs[strings.ToLower(attendee.Name)] = attendee.ID
+			}
+		}
+	}
+
+	attendees := make([]Attendee, 0, len(body.Attendees))
+	seen := map[string]bool{}
+	plusOnes := 0
+	var attending []string
+	for _, event := range household.invitedEvents() {
+		if coming[event] {
+			attending = append(attending, event)
+		}
+	}
+	for _, requested := range body.Attendees {
+		attendee := Attendee{Allergies: strings.TrimSpace(requested.Allergies)}
+		if utf8.RuneCountInString(attendee.Allergies) > maxAllergies {
+			return nil, fmt.Errorf("allergies can be at most %d characters", maxAllergies)
+		}
+		invited := attending
+		if requested.GuestID != "" {
+			guest := household.guest(requested.GuestID)
+			if guest == nil {
+				return nil, errors.New("guestId must be one of the guests on the invitation")
+			}
+			attendee.ID, attendee.Name = guest.ID, guest.Name
+			invited = slices.DeleteFunc(household.guestEvents(guest), func(event string) bool {
+				return !coming[event]
+			})
+		} else {
+			plusOnes++
+			switch {
+			case household.PlusOnes == 0 && plusOnes > 0:
+				return nil, errors.New("the invitation doesn't include plus-ones")
+			case household.PlusOnes == 1 && plusOnes > 1:
+				return nil, errors.New("the invitation allows one plus-one")
+			case plusOnes > household.PlusOnes:
+				return nil, fmt.Errorf("the invitation allows %d plus-ones", household.PlusOnes)
+			}
+			attendee.Name = strings.Join(strings.Fields(requested.Name), " ")
+			if attendee.Name == "" || utf8.RuneCountInString(attendee.Name) > maxGuestName {
+				return nil, fmt.Errorf("plus-ones need a name of 1 to %d characters", maxGuestName)
+			}
+			attendee.PlusOne = true
+			attendee.ID = plusOneIDs[strings.ToLower(attendee.Name)]
+			if attendee.ID == "" {
+				attendee.ID = "plus-" + randomHex(4)
+			}
+		}
+		if seen[attendee.ID] {
+			return nil, errors.New(attendee.Name + " is listed more than once")
+		}
+		meal, err := chooseMeal(requested.Meal)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", attendee.Name, err)
+		}
+		attendee.Meal = meal
+		if len(invited) == 0 {
+			return nil, errors.New(attendee.Name + " isn't invited to any of the events you're coming to")
+		}
+		if len(requested.Events) > 0 {
+			for _, name := range requested.Events {
+				event, ok := findEvent(name)
+				if !ok || !slices.Contains(invited, event) {
+					return nil, fmt.Errorf("%s can only come to %s", attendee.Name, strings.Join(invited, ", "))
+				}
+				if !slices.Contains(attendee.Events, event) {
+					attendee.Events = append(attendee.Events, event)
+				}
+			}
+		}
+		// Guests only invited to some of the events the RSVP is coming to
+		// are kept to those
+		if len(attendee.Events) == 0 && len(invited) < len(attending) {
+			attendee.Events = invited
+		}
+		seen[attendee.ID] = true
+		attendees = append(attendees, attendee)
+	}
+	return attendees, nil
+}
+
+// invitationHandler looks up an invitation by ?code=, or by ?name= as the
+// household or one of its guests is written on the guest list, with any
+// RSVP they have sent
+func (s *server) invitationHandler(response http.ResponseWriter, request *http.Request) {
+	query := request.URL.Query()
+	var household *Household
+	var ok bool
+	var wait time.Duration
+	switch {
+	case query.Get("code") != "":
+		household, ok, wait = s.lookupCode(request, query.Get("code"))
+	case query.Get("name") != "":
+		household, ok, wait = s.findHousehold(request, func() (*Household, bool) {
+			return s.guests.FindByName(query.Get("name"))
+		})
+	default:
+		writeJSONError(response, http.StatusBadRequest, "code or name is required")
+		return
+	}
+	if wait > 0 {
+		writeLockedOut(response, wait)
+		return
+	}
+	if !ok {
+		writeJSONError(response, http.StatusNotFound, "We couldn't find that invitation")
+		return
+	}
+	s.writeInvitation(response, household)
+}
+
+// writeInvitation answers a request with household's invitation
+func (s *server) writeInvitation(response http.ResponseWriter, household *Household) {
+	rsvp, _, err := s.rsvps.Get(household.Code)
+	if err != nil {
+		slog.Error("Unable to read RSVP", "code", household.Code, "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to read RSVP")
+		return
+	}
+	late, _, err := s.late.Get(household.Code)
+	if err != nil {
+		slog.Error("Unable to read late RSVP", "code", household.Code, "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to read RSVP")
+		return
+	}
+	guests := make([]invitedGuest, 0, len(household.Guests))
+	for _, guest := range household.Guests {
+		guests = append(guests, invitedGuest{ID: guest.ID, Name: guest.Name, Events: household.guestEvents(guest)})
+	}
+	answer := invitation{
+		Code:      household.Code,
+		Name:      household.Name,
+		PartySize: partySize(household),
+		Guests:    guests,
+		PlusOnes:  household.PlusOnes,
+		Events:    household.invitedEvents(),
+		Menu:      meals(),
+		RSVP:      rsvp,
+		LateRSVP:  late,
+	}
+	if s.deadline != nil {
+		answer.Deadline = &s.deadline.lastDay
+		answer.Closed = s.deadline.closed(time.Now())
+	}
+	response.Header().Set("Cache-Control", "no-store")
+	writeJSON(response, http.StatusOK, answer)
+}
+
+// submitRSVPHandler records a household's answer to their invitation:
+// whether they are coming to each event, how many or which of them are,
+// and any notes for the couple. After the deadline it is turned away, or
+// held for the couple to approve if they review late RSVPs.
+func (s *server) submitRSVPHandler(response http.ResponseWriter, request *http.Request) {
+	var body rsvpRequest
+	if !decodeJSON(response, request, &body) {
+		return
+	}
+	code := body.Code
+	if code == "" {
+		code = guestCode(request)
+	}
+	household, ok, wait := s.lookupCode(request, code)
+	if wait > 0 {
+		writeLockedOut(response, wait)
+		return
+	}
+	if !ok {
+		writeJSONError(response, http.StatusUnauthorized, "Please enter the code from your invitation to RSVP")
+		return
+	}
+
+	now := time.Now().UTC()
+	late := s.deadline.closed(now)
+	if late && !s.deadline.review {
+		writeJSONError(response, http.StatusForbidden, s.deadline.message())
+		return
+	}
+	rsvp := &RSVP{
+		Code:        household.Code,
+		Name:        household.Name,
+		Events:      make(map[string]bool, len(body.Events)),
+		PartySize:   body.PartySize,
+		Notes:       strings.TrimSpace(body.Notes),
+		SubmittedAt: now,
+		UpdatedAt:   now,
+	}
+	if len(body.Events) == 0 {
+		writeJSONError(response, http.StatusBadRequest, "events must say whether you are coming to at least one event")
+		return
+	}
+	invited := household.invitedEvents()
+	for name, coming := range body.Events {
+		event, ok := findEvent(name)
+		if !ok || !slices.Contains(invited, event) {
+			writeJSONError(response, http.StatusBadRequest, "events must be among "+strings.Join(invited, ", "))
+			return
+		}
+		rsvp.Events[event] = coming
+	}
+	if utf8.RuneCountInString(rsvp.Notes) > maxRSVPNotes {
+		writeJSONError(response, http.StatusBadRequest, fmt.Sprintf("notes can be at most %d characters", maxRSVPNotes))
+		return
+	}
+	// RSVPs need a guest code, so anything caught here is far more likely
+	// a guest than a bot. The RSVP is kept, with the reason for the couple.
+	rsvp.SpamReason = s.spam.check(request, "rsvp", body.spamFields, household.Name, rsvp.Notes).Reason
+
+	previous, _, err := s.rsvps.Get(household.Code)
+	if err != nil {
+		slog.Error("Unable to read RSVP", "code", household.Code, "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to save RSVP")
+		return
+	}
+	if previous != nil {
+		rsvp.SubmittedAt = previous.SubmittedAt
+	}
+	if rsvp.attending() && len(body.Attendees) > 0 {
+		rsvp.Attendees, err = body.attendees(household, rsvp.Events, previous)
+		if err != nil {
+			writeJSONError(response, http.StatusBadRequest, err.Error())
+			return
+		}
+		if body.PartySize != 0 && body.PartySize != len(rsvp.Attendees) {
+			writeJSONError(response, http.StatusBadRequest, "partySize must be the number of attendees")
+			return
+		}
+		rsvp.PartySize = len(rsvp.Attendees)
+	}
+	if !rsvp.attending() {
+		rsvp.PartySize = 0
+	} else if most := partySize(household); rsvp.PartySize < 1 || rsvp.PartySize > most {
+		writeJSONError(response, http.StatusBadRequest, fmt.Sprintf("partySize must be 1 to %d", most))
+		return
+	}
+
+	if late {
+		s.holdLateRSVP(response, rsvp)
+		return
+	}
+	if err := s.rsvps.Save(rsvp); err != nil {
+		slog.Error("Unable to save RSVP", "code", household.Code, "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to save RSVP")
+		return
+	}
+	writeJSON(response, http.StatusOK, rsvp)
+}
+
+// listRSVPsHandler lists every RSVP for the couple
+func (s *server) listRSVPsHandler(response http.ResponseWriter, request *http.Request) {
+	rsvps, err := s.rsvps.All()
+	if err != nil {
+		slog.Error("Unable to read RSVPs", "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to read RSVPs")
+		return
+	}
+	if rsvps == nil {
+		rsvps = []*RSVP{}
+	}
+	writeJSON(response, http.StatusOK, rsvps)
+}
+
+// mealCounts is the caterer's headcount: how many attendees are having each
+// meal, and what they need to know about each attendee with allergies
+type mealCounts struct {
+	Meals map[string]int `json:"meals"`
+	// Unnamed is how many are coming on RSVPs that only gave a party size,
+	// so haven't chosen meals
+	Unnamed   int           `json:"unnamed"`
+	Total     int           `json:"total"`
+	Allergies []allergyNote `json:"allergies"`
+}
+
+// allergyNote is an attendee's allergies, for the caterer
+type allergyNote struct {
+	Name      string `json:"name"`
+	Household string `json:"household"`
+	Meal      string `json:"meal,omitempty"`
+	Allergies string `json:"allergies"`
+}
+
+// mealCountsHandler counts the meals chosen on every RSVP of people coming,
+// for the caterer, or with ?event= only of those coming to that event.
+// Attendees who didn't choose are counted under "".
+func (s *server) mealCountsHandler(response http.ResponseWriter, request *http.Request) {
+	event := ""
+	if name := request.URL.Query().Get("event"); name != "" {
+		var ok bool
+		if event, ok = findEvent(name); !ok {
+			writeJSONError(response, http.StatusBadRequest, "event must be one of "+strings.Join(events(), ", "))
+			return
+		}
+	}
+	rsvps, err := s.rsvps.All()
+	if err != nil {
+		slog.Error("Unable to read RSVPs", "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to read RSVPs")
+		return
+	}
+
+	counts := mealCounts{Meals: map[string]int{}, Allergies: []allergyNote{}}
+	for _, meal := range meals() {
+		counts.Meals[meal] = 0
+	}
+	for _, rsvp := range rsvps {
+		partySize, attendees := rsvp.PartySize, rsvp.Attendees
+		if event != "" {
+			partySize, attendees = rsvp.headcount(event), rsvp.comingTo(event)
+		}
+		if !rsvp.attending() || partySize == 0 {
+			continue
+		}
+		counts.Total += partySize
+		if len(rsvp.Attendees) == 0 {
+			counts.Unnamed += partySize
+			continue
+		}
+		for _, attendee := range attendees {
+			counts.Meals[attendee.Meal]++
+			if attendee.Allergies != "" {
+				counts.Allergies = append(counts.Allergies, allergyNote{
+					Name:      attendee.Name,
+					Household: rsvp.Name,
+					Meal:      attendee.Meal,
+					Allergies: attendee.Allergies,
+				})
+			}
+		}
+	}
+	writeJSON(response, http.StatusOK, counts)
+}
+
+// eventCount is the headcount for one event
+type eventCount struct {
+	Event string `json:"event"`
+	// Invited counts the households invited to the event, Coming and
+	// Declined those that have answered, and Guests the people coming
+	Invited  int `json:"invited"`
+	Coming   int `json:"coming"`
+	Declined int `json:"declined"`
+	Guests   int `json:"guests"`
+}
+
+// eventCountsHandler counts who is coming to each event of the weekend,
+// in the order the events are configured
+func (s *server) eventCountsHandler(response http.ResponseWriter, request *http.Request) {
+	rsvps, err := s.rsvps.All()
+	if err != nil {
+		slog.Error("Unable to read RSVPs", "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to read RSVPs")
+		return
+	}
+	households := s.guests.All()
+
+	counts := []eventCount{}
+	for _, event := range events() {
+		count := eventCount{Event: event}
+		for _, household := range households {
+			if slices.Contains(household.invitedEvents(), event) {
+				count.Invited++
+			}
+		}
+		for _, rsvp := range rsvps {
+			coming, answered := rsvp.Events[event]
+			switch {
+			case !answered:
+			case coming:
+				count.Coming++
+				count.Guests += rsvp.headcount(event)
+			default:
+				count.Declined++
+			}
+		}
+		counts = append(counts, count)
+	}
+	writeJSON(response, http.StatusOK, counts)
+}
+
+// jsonRSVPStore keeps the RSVPs in a JSON file next to a JSON photo index
+type jsonRSVPStore struct {
+	mu     sync.Mutex
+	path   string
+	byCode map[string]*RSVP
+}
+
+// openJSONRSVPStore loads the RSVPs saved at path, starting with none if it
+// doesn't exist
+func openJSONRSVPStore(path string) (*jsonRSVPStore, error) {
+	store := &jsonRSVPStore{path: path, byCode: make(map[string]*RSVP)}
+
+	var rsvps []*RSVP
+	if err := loadJSONFile(path, &rsvps); err != nil {
+		return nil, err
+	}
+	for _, rsvp := range rsvps {
+		store.byCode[rsvp.Code] = rsvp
+	}
+	return store, nil
+}
+
+func (store *jsonRSVPStore) Get(code string) (*RSVP, bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	rsvp, ok := store.byCode[code]
+	if !ok {
+		return nil, false, nil
+	}
+	return rsvp.clone(), true, nil
+}
+
+func (store *jsonRSVPStore) Save(rsvp *RSVP) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	previous, existed := store.byCode[rsvp.Code]
+	store.byCode[rsvp.Code] = rsvp.clone()
+	if err := store.save(); err != nil {
+		if existed {
+			store.byCode[rsvp.Code] = previous
+		} else {
+			delete(store.byCode, rsvp.Code)
+		}
+		return err
+	}
+	return nil
+}
+
+func (store *jsonRSVPStore) Delete(code string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	previous, ok := store.byCode[code]
+	if !ok {
+		return nil
+	}
+	delete(store.byCode, code)
+	if err := store.save(); err != nil {
+		store.byCode[code] = previous
+		return err
+	}
+	return nil
+}
+
+func (store *jsonRSVPStore) All() ([]*RSVP, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	return store.sorted(), nil
+}
+
+// sorted returns copies of the RSVPs, the first sent first. The caller must
+// hold store.mu.
+func (store *jsonRSVPStore) sorted() []*RSVP {
+	rsvps := make([]*RSVP, 0, len(store.byCode))
+	for _, rsvp := range store.byCode {
+		rsvps = append(rsvps, rsvp.clone())
+	}
+	slices.SortFunc(rsvps, func(a, b *RSVP) int {
+		if order := a.SubmittedAt.Compare(b.SubmittedAt); order != 0 {
+			return order
+		}
+		return strings.Compare(a.Code, b.Code)
+	})
+	return rsvps
+}
+
+// save writes the RSVPs to disk. The caller must hold store.mu.
+func (store *jsonRSVPStore) save() error {
+	return saveJSONFile(store.path, store.sorted())
+}
+
+// sqlRSVPStore keeps the RSVPs in the database the photo index is in
+type sqlRSVPStore struct {
+	db *sql.DB
+}
+
+// rsvpColumns are the columns of the rsvps table, in the order scanRSVP
+// reads them
+const rsvpColumns = `code, name, events, party_size, attendees, notes, spam_reason, submitted_at, updated_at`
+
+// scanRSVP reads an RSVP from a row of rsvpColumns
+func scanRSVP(row rowScanner) (*RSVP, error) {
+	var rsvp RSVP
+	var events, attendees string
+	if err := row.Scan(&rsvp.Code, &rsvp.Name, &events, &rsvp.PartySize, &attendees, &rsvp.Notes, &rsvp.SpamReason, &rsvp.SubmittedAt, &rsvp.UpdatedAt); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(events), &rsvp.Events); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(attendees), &rsvp.Attendees); err != nil {
+		return nil, err
+	}
+	return &rsvp, nil
+}
+
+func (store *sqlRSVPStore) Get(code string) (*RSVP, bool, error) {
+	rsvp, err := scanRSVP(store.db.QueryRow(`SELECT `+rsvpColumns+` FROM rsvps WHERE code = $1`, code))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return rsvp, true, nil
+}
+
+func (store *sqlRSVPStore) Save(rsvp *RSVP) error {
+	events, err := json.Marshal(rsvp.Events)
+	if err != nil {
+		return err
+	}
+	attendees := []byte("[]")
+	if len(rsvp.Attendees) > 0 {
+		if attendees, err = json.Marshal(rsvp.Attendees); err != nil {
+			return err
+		}
+	}
+	_, err = store.db.Exec(`INSERT INTO rsvps (`+rsvpColumns+`) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (code) DO UPDATE SET name = excluded.name, events = excluded.events, party_size = excluded.party_size,
+			attendees = excluded.attendees, notes = excluded.notes, spam_reason = excluded.spam_reason, updated_at = excluded.updated_at`,
+		rsvp.Code, rsvp.Name, string(events), rsvp.PartySize, string(attendees), rsvp.Notes, rsvp.SpamReason, rsvp.SubmittedAt.UTC(), rsvp.UpdatedAt.UTC())
+	return err
+}
+
+func (store *sqlRSVPStore) All() ([]*RSVP, error) {
+	rows, err := store.db.Query(`SELECT ` + rsvpColumns + ` FROM rsvps ORDER BY submitted_at, code`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rsvps []*RSVP
+	for rows.Next() {
+		rsvp, err := scanRSVP(rows)
+		if err != nil {
+			return nil, err
+		}
+		rsvps = append(rsvps, rsvp)
+	}
+	return rsvps, rows.Err()
+}
+
+func (store *sqlRSVPStore) Delete(code string) error {
+	_, err := store.db.Exec(`DELETE FROM rsvps WHERE code = $1`, code)
+	return err
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+)
+
+// s3Storage keeps files in an S3 bucket, under an optional key prefix.
+// Credentials and the region come from the usual AWS environment variables
+// (AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, AWS_REGION) or the shared AWS
+// config files. With S3_ENDPOINT set it talks to an S3-compatible service
+// such as MinIO or Backblaze B2 instead of AWS.
+type s3Storage struct {
+	client *s3.Client
+	bucket string
+	prefix string
+}
+
+// newS3Storage connects to the bucket set up in the config
+func newS3Storage(ctx context.Context) (*s3Storage, error) {
+	if *s3Bucket == "" {
+		return nil, errors.New("S3_BUCKET must be set to use S3 storage")
+	}
+
+	var options []func(*awsconfig.LoadOptions) error
+	if *s3Region != "" {
+		options = append(options, awsconfig.WithRegion(*s3Region))
+	}
+	if *s3Endpoint != "" {
+		// MinIO and B2 don't care about the region but the signature does, so
+		// fall back to the one most S3-compatible services expect
+		if *s3Region == "" {
+			options = append(options, awsconfig.WithRegion("us-east-1"))
+		}
+		// Services other than AWS don't all understand the checksums the SDK
+		// adds to every request by default
+		options = append(options,
+			awsconfig.WithRequestChecksumCalculation(aws.RequestChecksumCalculationWhenRequired),
+			awsconfig.WithResponseChecksumValidation(aws.ResponseChecksumValidationWhenRequired),
+		)
+	}
+	cfg, err := awsconfig.LoadDefaultConfig(ctx, options...)
+	if err != nil {
+		return nil, fmt.Errorf("loading AWS config: %w", err)
+	}
+
+	client := s3.NewFromConfig(cfg, func(options *s3.Options) {
+		if *s3Endpoint != "" {
+			options.BaseEndpoint = aws.String(*s3Endpoint)
+		}
+		options.UsePathStyle = *s3PathStyle
+	})
+
+	prefix := strings.Trim(*s3Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return &s3Storage{client: client, bucket: *s3Bucket, prefix: prefix}, nil
+}
+
+// key returns the object key name is stored under
+func (storage *s3Storage) key(name string) (string, error) {
+	cleaned, err := cleanStorageName(name)
+	if err != nil {
+		return "", err
+	}
+	return storage.prefix + cleaned, nil
+}
+
+// s3Error turns S3's not found errors into fs.ErrNotExist
+func s3Error(name string, err error) error {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "NoSuchKey", "NotFound":
+			return fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+		}
+	}
+	return err
+}
+
+// Put uploads content in a single request. Content that can seek, like the
+// files and buffers the upload pipeline stores, is signed as it is sent.
+// Anything else, such as a file streamed from another store, is spooled to
+// a temporary file first since S3 needs to know its length.
+func (storage *s3Storage) Put(ctx context.Context, name string, content io.Reader) error {
+	key, err := storage.key(name)
+	if err != nil {
+		return err
+	}
+	if _, ok := content.(io.Seeker); !ok {
+		spooled, err := os.CreateTemp("", "s3-put-*")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(spooled.Name())
+		defer spooled.Close()
+		if _, err := io.Copy(spooled, content); err != nil {
+			return err
+		}
+		if _, err := spooled.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		content = spooled
+	}
+	_, err = storage.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(storage.bucket),
+		Key:         aws.String(key),
+		Body:        content,
+		ContentType: aws.String(storageContentType(name)),
+	})
+	return err
+}
+
+func (storage *s3Storage) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	key, err := storage.key(name)
+	if err != nil {
+		return nil, err
+	}
+	output, err := storage.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(storage.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, s3Error(name, err)
+	}
+	return output.Body, nil
+}
+
+func (storage *s3Storage) GetRange(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	key, err := storage.key(name)
+	if err != nil {
+		return nil, err
+	}
+	byteRange := fmt.Sprintf("bytes=%d-", offset)
+	if length >= 0 {
+		byteRange += strconv.FormatInt(offset+length-1, 10)
+	}
+	output, err := storage.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(storage.bucket),
+		Key:    aws.String(key),
+		Range:  aws.String(byteRange),
+	})
+	if err != nil {
+		return nil, s3Error(name, err)
+	}
+	return output.Body, nil
+}
+
+func (storage *s3Storage) Stat(ctx context.Context, name string) (ObjectInfo, error) {
+	key, err := storage.key(name)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	output, err := storage.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(storage.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return ObjectInfo{}, s3Error(name, err)
+	}
+	return ObjectInfo{Name: name, Size: aws.ToInt64(output.ContentLength), ModTime: aws.ToTime(output.LastModified)}, nil
+}
+
+func (storage *s3Storage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	paginator := s3.NewListObjectsV2Paginator(storage.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(storage.bucket),
+		Prefix: aws.String(storage.prefix + prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range page.Contents {
+			objects = append(objects, ObjectInfo{
+				Name:    strings.TrimPrefix(aws.ToString(object.Key), storage.prefix),
+				Size:    aws.ToInt64(object.Size),
+				ModTime: aws.ToTime(object.LastModified),
+			})
+		}
+	}
+	return objects, nil
+}
+
+func (storage *s3Storage) Delete(ctx context.Context, name string) error {
+	key, err := storage.key(name)
+	if err != nil {
+		return err
+	}
+	_, err = storage.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(storage.bucket),
+		Key:    aws.String(key),
+	})
+	return err
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// Scanner checks uploads for malware before they are stored
+type Scanner interface {
+	// Scan reads the whole of file and returns the name of the threat found
+	// in it, or "" if it is clean
+	Scan(ctx context.Context, file io.Reader) (string, error)
+}
+
+// newScanner returns the scanner set up in the config, or nil if scanning is
+// turned off
+func newScanner() Scanner {
+	if *clamdAddress == "" {
+		return nil
+	}
+	return &clamdScanner{address: *clamdAddress, timeout: time.Minute}
+}
+
+// clamdChunkSize is the size of the chunks uploads are streamed to clamd in
+const clamdChunkSize = 64 << 10
+
+// clamdScanner scans files with a ClamAV daemon using its INSTREAM command.
+// address is either host:port or unix:/path/to/clamd.sock.
+type clamdScanner struct {
+	address string
+	timeout time.Duration
+}
+
+func (scanner *clamdScanner) Scan(ctx context.Context, file io.Reader) (string, error) {
+	network, address := "tcp", scanner.address
+	if path, ok := strings.CutPrefix(address, "unix:"); ok {
+		network, address = "unix", path
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return "", fmt.Errorf("connecting to clamd: %w", err)
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(scanner.timeout)); err != nil {
+		return "", err
+	}
+
+	// The file is sent as chunks each prefixed with their length, ending with
+	// an empty chunk
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return "", err
+	}
+	chunk := make([]byte, 4+clamdChunkSize)
+	for {
+		n, readErr := io.ReadFull(file, chunk[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(chunk, uint32(n))
+			if _, err := conn.Write(chunk[:4+n]); err != nil {
+				return "", err
+			}
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			return "", readErr
+		}
+	}
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return "", err
+	}
+
+	// With the z prefix, the reply ends with a null byte
+	reply, err := bufio.NewReader(conn).ReadBytes(0)
+	if err != nil && !(err == io.EOF && len(reply) > 0) {
+		return "", err
+	}
+	return parseClamdReply(reply)
+}
+
+// parseClamdReply reads the result of an INSTREAM scan, which is
+// "stream: OK" or "stream: <threat> FOUND"
+func parseClamdReply(reply []byte) (string, error) {
+	result := string(bytes.TrimRight(reply, "\x00\n"))
+	result = strings.TrimPrefix(result, "stream: ")
+	switch {
+	case result == "OK":
+		return "", nil
+	case strings.HasSuffix(result, " FOUND"):
+		return strings.TrimSuffix(result, " FOUND"), nil
+	case strings.HasSuffix(result, " ERROR"):
+		return "", errors.New("clamd: " + strings.TrimSuffix(result, " ERROR"))
+	}
+	return "", fmt.Errorf("clamd: unexpected reply %q", result)
+}
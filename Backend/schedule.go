@@ -0,0 +1,408 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Limits on what an item on the schedule can hold
+const (
+	maxScheduleName        = 100
+	maxScheduleLocation    = 200
+	maxScheduleDescription = 1000
+	maxDressCode           = 100
+)
+
+// ScheduleItem is something happening over the wedding weekend, like the
+// ceremony or the welcome drinks
+type ScheduleItem struct {
+	// ID is made from the name when the item is added, and stays the same if
+	// it is renamed. It is also what calendars know the item by.
+	ID          string     `json:"id"`
+	Name        string     `json:"name"`
+	StartsAt    time.Time  `json:"startsAt"`
+	EndsAt      *time.Time `json:"endsAt,omitempty"`
+	Location    string     `json:"location,omitempty"`
+	Address     string     `json:"address,omitempty"`
+	DressCode   string     `json:"dressCode,omitempty"`
+	Description string     `json:"description,omitempty"`
+	// Event is the event from the config the item is part of. Invitations
+	// only see the items of events they are invited to.
+	Event string `json:"event,omitempty"`
+}
+
+// scheduleStore keeps the schedule
+type scheduleStore struct {
+	mu    sync.Mutex
+	path  string
+	items []*ScheduleItem
+}
+
+// openScheduleStore loads the schedule saved at path, starting empty if it
+// doesn't exist
+func openScheduleStore(path string) (*scheduleStore, error) {
+	store := &scheduleStore{path: path}
+
+	if err := loadJSONFile(path, &store.items); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// All returns a copy of everything on the schedule, the soonest first
+func (store *scheduleStore) All() []ScheduleItem {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	items := make([]ScheduleItem, 0, len(store.items))
+	for _, item := range store.items {
+		items = append(items, *item)
+	}
+	slices.SortStableFunc(items, func(a, b ScheduleItem) int {
+		return a.StartsAt.Compare(b.StartsAt)
+	})
+	return items
+}
+
+// find returns the item with the given ID. The caller must hold store.mu.
+func (store *scheduleStore) find(id string) *ScheduleItem {
+	for _, item := range store.items {
+		if item.ID == id {
+			return item
+		}
+	}
+	return nil
+}
+
+// Create adds an item to the schedule
+func (store *scheduleStore) Create(item ScheduleItem) (ScheduleItem, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	base := slug(item.Name, "event")
+	item.ID = base
+	for n := 2; store.find(item.ID) != nil; n++ {
+		item.ID = fmt.Sprintf("%s-%d", base, n)
+	}
+	store.items = append(store.items, &item)
+	if err := store.save(); err != nil {
+		store.items = store.items[:len(store.items)-1]
+		return ScheduleItem{}, err
+	}
+	return item, nil
+}
+
+// Update changes the item with the given ID, reporting whether there is one.
+// Changes that change returns an error for are thrown away.
+func (store *scheduleStore) Update(id string, change func(*ScheduleItem) error) (ScheduleItem, bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	item := store.find(id)
+	if item == nil {
+		return ScheduleItem{}, false, nil
+	}
+	changed := *item
+	if err := change(&changed); err != nil {
+		return ScheduleItem{}, true, err
+	}
+	changed.ID = item.ID
+
+	previous := *item
+	*item = changed
+	if err := store.save(); err != nil {
+		*item = previous
+		return ScheduleItem{}, true, err
+	}
+	return *item, true, nil
+}
+
+// Delete removes the item with the given ID, reporting whether there was one
+func (store *scheduleStore) Delete(id string) (bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for i, item := range store.items {
+		if item.ID != id {
+			continue
+		}
+		previous := store.items
+		store.items = slices.Concat(previous[:i], previous[i+1:])
+		if err := store.save(); err != nil {
+			store.items = previous
+			return true, err
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// save writes the schedule to disk. The caller must hold store.mu.
+func (store *scheduleStore) save() error {
+	return saveJSONFile(store.path, store.items)
+}
+
+// scheduleRequest is the body of a request to add or change an item on the
+// schedule. Fields left out of a change are kept as they are, and an empty
+// endsAt takes the end time off.
+type scheduleRequest struct {
+	Name        *string    `json:"name"`
+	StartsAt    *time.Time `json:"startsAt"`
+	EndsAt      *string    `json:"endsAt"`
+	Location    *string    `json:"location"`
+	Address     *string    `json:"address"`
+	DressCode   *string    `json:"dressCode"`
+	Description *string    `json:"description"`
+	Event       *string    `json:"event"`
+}
+
+// apply checks the fields that were given and makes the changes to item
+func (body *scheduleRequest) apply(item *ScheduleItem) error {
+	text := func(field *string, name string, limit int, required bool, value *string) error {
+		if field == nil {
+			return nil
+		}
+		trimmed := strings.TrimSpace(*field)
+		if (required && trimmed == "") || utf8.RuneCountInString(trimmed) > limit {
+			if required {
+				return fmt.Errorf("%s must be 1 to %d characters", name, limit)
+			}
+			return fmt.Errorf("%s can be at most %d characters", name, limit)
+		}
+		*value = trimmed
+		return nil
+	}
+	for _, err := range []error{
+		text(body.Name, "name", maxScheduleName, true, &item.Name),
+		text(body.Location, "location", maxScheduleLocation, false, &item.Location),
+		text(body.Address, "address", maxScheduleLocation, false, &item.Address),
+		text(body.DressCode, "dressCode", maxDressCode, false, &item.DressCode),
+		text(body.Description, "description", maxScheduleDescription, false, &item.Description),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	if body.StartsAt != nil {
+		item.StartsAt = body.StartsAt.UTC()
+	}
+	if body.EndsAt != nil {
+		item.EndsAt = nil
+		if *body.EndsAt != "" {
+			ends, err := time.Parse(time.RFC3339, *body.EndsAt)
+			if err != nil {
+				return errors.New("endsAt must be a time like 2026-06-20T16:00:00-04:00")
+			}
+			ends = ends.UTC()
+			item.EndsAt = &ends
+		}
+	}
+	if item.EndsAt != nil && !item.EndsAt.After(item.StartsAt) {
+		return errors.New("endsAt must be after startsAt")
+	}
+	if body.Event != nil {
+		item.Event = ""
+		if name := strings.TrimSpace(*body.Event); name != "" {
+			event, ok := findEvent(name)
+			if !ok {
+				return errors.New("event must be one of " + strings.Join(events(), ", "))
+			}
+			item.Event = event
+		}
+	}
+	return nil
+}
+
+// guestSchedule returns the schedule a request is shown: all of it, or with
+// ?code= only what the invitation is invited to. It answers the request
+// itself if the code isn't one on the guest list.
+func (s *server) guestSchedule(response http.ResponseWriter, request *http.Request) ([]ScheduleItem, bool) {
+	items := s.schedule.All()
+	code := request.URL.Query().Get("code")
+	if code == "" {
+		return items, true
+	}
+	household, ok, wait := s.lookupCode(request, code)
+	if wait > 0 {
+		writeLockedOut(response, wait)
+		return nil, false
+	}
+	if !ok {
+		writeJSONError(response, http.StatusNotFound, "We couldn't find that invitation")
+		return nil, false
+	}
+	invited := household.invitedEvents()
+	return slices.DeleteFunc(items, func(item ScheduleItem) bool {
+		return item.Event != "" && !slices.Contains(invited, item.Event)
+	}), true
+}
+
+// scheduleHandler lists the schedule, the soonest first
+func (s *server) scheduleHandler(response http.ResponseWriter, request *http.Request) {
+	items, ok := s.guestSchedule(response, request)
+	if !ok {
+		return
+	}
+	writeJSON(response, http.StatusOK, items)
+}
+
+// scheduleCalendarHandler serves the schedule as an iCalendar feed that
+// guests can add to the calendar on their phone
+func (s *server) scheduleCalendarHandler(response http.ResponseWriter, request *http.Request) {
+	items, ok := s.guestSchedule(response, request)
+	if !ok {
+		return
+	}
+	response.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	response.Header().Set("Content-Disposition", `inline; filename="wedding.ics"`)
+	response.Write([]byte(iCalendar(items, request.Host, time.Now())))
+}
+
+// createScheduleHandler adds an item to the schedule
+func (s *server) createScheduleHandler(response http.ResponseWriter, request *http.Request) {
+	var body scheduleRequest
+	if !decodeJSON(response, request, &body) {
+		return
+	}
+	if body.Name == nil || body.StartsAt == nil {
+		writeJSONError(response, http.StatusBadRequest, "name and startsAt are required")
+		return
+	}
+	var item ScheduleItem
+	if err := body.apply(&item); err != nil {
+		writeJSONError(response, http.StatusBadRequest, err.Error())
+		return
+	}
+	added, err := s.schedule.Create(item)
+	if err != nil {
+		slog.Error("Unable to save schedule", "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to add to the schedule")
+		return
+	}
+	writeJSON(response, http.StatusCreated, added)
+}
+
+// errInvalidSchedule wraps the reason a change to the schedule was turned
+// away
+type errInvalidSchedule struct{ err error }
+
+func (e errInvalidSchedule) Error() string { return e.err.Error() }
+
+// updateScheduleHandler changes an item on the schedule
+func (s *server) updateScheduleHandler(response http.ResponseWriter, request *http.Request) {
+	var body scheduleRequest
+	if !decodeJSON(response, request, &body) {
+		return
+	}
+	item, ok, err := s.schedule.Update(request.PathValue("id"), func(item *ScheduleItem) error {
+		if err := body.apply(item); err != nil {
+			return errInvalidSchedule{err}
+		}
+		return nil
+	})
+	if !ok {
+		writeJSONError(response, http.StatusNotFound, "Schedule item not found")
+		return
+	}
+	var invalid errInvalidSchedule
+	if errors.As(err, &invalid) {
+		writeJSONError(response, http.StatusBadRequest, invalid.Error())
+		return
+	}
+	if err != nil {
+		slog.Error("Unable to save schedule", "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to update the schedule")
+		return
+	}
+	writeJSON(response, http.StatusOK, item)
+}
+
+// deleteScheduleHandler takes an item off the schedule
+func (s *server) deleteScheduleHandler(response http.ResponseWriter, request *http.Request) {
+	ok, err := s.schedule.Delete(request.PathValue("id"))
+	if !ok {
+		writeJSONError(response, http.StatusNotFound, "Schedule item not found")
+		return
+	}
+	if err != nil {
+		slog.Error("Unable to save schedule", "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to update the schedule")
+		return
+	}
+	response.WriteHeader(http.StatusNoContent)
+}
+
+// iCalendar writes the schedule as an iCalendar (RFC 5545) feed. The items'
+// UIDs are made from their IDs and host, so calendars that already have an
+// item update it rather than adding it again.
+func iCalendar(items []ScheduleItem, host string, now time.Time) string {
+	var calendar strings.Builder
+	line := func(name, value string) {
+		calendar.WriteString(foldICalLine(name + ":" + value))
+	}
+	line("BEGIN", "VCALENDAR")
+	line("VERSION", "2.0")
+	line("PRODID", "-//WeddingSite//Schedule//EN")
+	line("CALSCALE", "GREGORIAN")
+	line("METHOD", "PUBLISH")
+	line("X-WR-CALNAME", "Wedding schedule")
+	for _, item := range items {
+		line("BEGIN", "VEVENT")
+		line("UID", item.ID+"@"+host)
+		line("DTSTAMP", iCalTime(now))
+		line("DTSTART", iCalTime(item.StartsAt))
+		if item.EndsAt != nil {
+			line("DTEND", iCalTime(*item.EndsAt))
+		}
+		line("SUMMARY", iCalText(item.Name))
+		if location := strings.Join(slices.DeleteFunc([]string{item.Location, item.Address}, func(part string) bool {
+			return part == ""
+		}), ", "); location != "" {
+			line("LOCATION", iCalText(location))
+		}
+		description := item.Description
+		if item.DressCode != "" {
+			description = strings.TrimSpace(description + "\n\nDress code: " + item.DressCode)
+		}
+		if description != "" {
+			line("DESCRIPTION", iCalText(description))
+		}
+		line("END", "VEVENT")
+	}
+	line("END", "VCALENDAR")
+	return calendar.String()
+}
+
+// iCalTime writes a time in UTC the way iCalendar does
+func iCalTime(t time.Time) string {
+	return t.UTC().Format("20060102T150405Z")
+}
+
+// iCalText escapes text for an iCalendar property value
+var iCalText = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace
+
+// foldICalLine ends a content line, folding it onto continuation lines so
+// none is longer than the 75 bytes iCalendar allows, without splitting a
+// character
+func foldICalLine(line string) string {
+	var folded strings.Builder
+	width := 0
+	for _, r := range line {
+		size := utf8.RuneLen(r)
+		if width+size > 75 {
+			folded.WriteString("\r\n ")
+			width = 1
+		}
+		folded.WriteRune(r)
+		width += size
+	}
+	folded.WriteString("\r\n")
+	return folded.String()
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Searches are limited to maxSearchLength bytes and their first
+// maxSearchWords words
+const (
+	maxSearchLength = 200
+	maxSearchWords  = 10
+)
+
+// searchWords splits a search into the lower cased words every result must
+// contain
+func searchWords(text string) []string {
+	words := strings.Fields(strings.ToLower(text))
+	if len(words) > maxSearchWords {
+		words = words[:maxSearchWords]
+	}
+	return words
+}
+
+// ftsQuery turns search words into an SQLite full text query matching
+// photos with every word, or words starting with it so "danc" finds
+// "dancing". Each word is quoted so nothing a guest types is read as query
+// syntax.
+func ftsQuery(words []string) string {
+	terms := make([]string, len(words))
+	for i, word := range words {
+		terms[i] = `"` + strings.ReplaceAll(word, `"`, `""`) + `"*`
+	}
+	return strings.Join(terms, " ")
+}
+
+// likePattern returns a LIKE pattern, escaped with a backslash, that matches
+// text containing word
+func likePattern(word string) string {
+	escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(word)
+	return "%" + escaped + "%"
+}
+
+// containsWords reports whether photo's caption, uploader's name or comments
+// contain every one of words. The caller must hold store.mu.
+func (store *jsonPhotoStore) containsWords(photo *Photo, words []string) bool {
+	if len(words) == 0 {
+		return true
+	}
+	texts := []string{strings.ToLower(photo.Caption), strings.ToLower(photo.Uploader)}
+	for _, comment := range store.comments[photo.ID] {
+		texts = append(texts, strings.ToLower(comment.Body))
+	}
+	for _, word := range words {
+		found := false
+		for _, text := range texts {
+			if strings.Contains(text, word) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// searchPhotosHandler finds the photos in the gallery whose caption,
+// uploader or comments mention every word of ?q=, newest first. It takes the
+// gallery's other filters and pages the same way.
+func (s *server) searchPhotosHandler(response http.ResponseWriter, request *http.Request) {
+	if len(searchWords(request.URL.Query().Get("q"))) == 0 {
+		writeJSONError(response, http.StatusBadRequest, "q is required")
+		return
+	}
+	s.listPhotosHandler(response, request)
+}
@@ -0,0 +1,531 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Limits on the seating chart
+const (
+	maxTableName     = 100
+	maxTableCapacity = 50
+)
+
+// Table is a table at the reception and who is sitting at it
+type Table struct {
+	// ID is made from the name when the table is added, and stays the same
+	// if it is renamed
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Capacity int    `json:"capacity"`
+	Seats    []Seat `json:"seats"`
+}
+
+// Seat is an attendee of an RSVP seated at a table
+type Seat struct {
+	Code       string `json:"code"`
+	AttendeeID string `json:"attendeeId"`
+	// Name is the attendee's name when they were seated, kept so the chart
+	// reads well if their RSVP changes
+	Name string `json:"name"`
+}
+
+// clone returns a copy of table that can be changed without affecting the
+// one held by the store
+func (table *Table) clone() *Table {
+	copied := *table
+	copied.Seats = slices.Clone(table.Seats)
+	if copied.Seats == nil {
+		copied.Seats = []Seat{}
+	}
+	return &copied
+}
+
+// seatIndex returns where the attendee of an RSVP sits at table, or -1 if
+// they don't
+func (table *Table) seatIndex(code, attendeeID string) int {
+	return slices.IndexFunc(table.Seats, func(seat Seat) bool {
+		return seat.Code == code && seat.AttendeeID == attendeeID
+	})
+}
+
+// errTableFull is returned when someone is seated at a table with no seats
+// left, or a table is made smaller than the people sitting at it
+var errTableFull = errors.New("that table is full")
+
+// seatingStore keeps the seating chart, with the tables in the order they
+// were added
+type seatingStore struct {
+	mu     sync.Mutex
+	path   string
+	tables []*Table
+}
+
+// openSeatingStore loads the seating chart saved at path, starting with no
+// tables if it doesn't exist
+func openSeatingStore(path string) (*seatingStore, error) {
+	store := &seatingStore{path: path}
+
+	if err := loadJSONFile(path, &store.tables); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// All returns a copy of every table
+func (store *seatingStore) All() []*Table {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	tables := make([]*Table, 0, len(store.tables))
+	for _, table := range store.tables {
+		tables = append(tables, table.clone())
+	}
+	return tables
+}
+
+// find returns the table with the given ID. The caller must hold store.mu.
+func (store *seatingStore) find(id string) *Table {
+	for _, table := range store.tables {
+		if table.ID == id {
+			return table
+		}
+	}
+	return nil
+}
+
+// Create adds a table with no one sitting at it
+func (store *seatingStore) Create(name string, capacity int) (*Table, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	base := slug(name, "table")
+	id := base
+	for n := 2; store.find(id) != nil; n++ {
+		id = fmt.Sprintf("%s-%d", base, n)
+	}
+	table := &Table{ID: id, Name: name, Capacity: capacity, Seats: []Seat{}}
+	store.tables = append(store.tables, table)
+	if err := store.save(); err != nil {
+		store.tables = store.tables[:len(store.tables)-1]
+		return nil, err
+	}
+	return table.clone(), nil
+}
+
+// Update changes the table with the given ID, reporting whether there is
+// one. Changes that change returns an error for, or that leave more people
+// at the table than it seats, are thrown away.
+func (store *seatingStore) Update(id string, change func(*Table) error) (*Table, bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	table := store.find(id)
+	if table == nil {
+		return nil, false, nil
+	}
+	changed := table.clone()
+	if err := change(changed); err != nil {
+		return nil, true, err
+	}
+	changed.ID = table.ID
+	if len(changed.Seats) > changed.Capacity {
+		return nil, true, errTableFull
+	}
+
+	previous := *table
+	*table = *changed
+	if err := store.save(); err != nil {
+		*table = previous
+		return nil, true, err
+	}
+	return table.clone(), true, nil
+}
+
+// Seat sits an attendee of an RSVP at the table with the given ID, moving
+// them from any other table, and reports whether there is one
+func (store *seatingStore) Seat(id string, seat Seat) (*Table, bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	table := store.find(id)
+	if table == nil {
+		return nil, false, nil
+	}
+	if i := table.seatIndex(seat.Code, seat.AttendeeID); i >= 0 {
+		table.Seats[i].Name = seat.Name
+		return table.clone(), true, store.save()
+	}
+	if len(table.Seats) >= table.Capacity {
+		return nil, true, errTableFull
+	}
+
+	previous := make([][]Seat, len(store.tables))
+	for i, other := range store.tables {
+		previous[i] = other.Seats
+		if j := other.seatIndex(seat.Code, seat.AttendeeID); j >= 0 {
+			other.Seats = slices.Delete(slices.Clone(other.Seats), j, j+1)
+		}
+	}
+	table.Seats = append(slices.Clip(table.Seats), seat)
+	if err := store.save(); err != nil {
+		for i, other := range store.tables {
+			other.Seats = previous[i]
+		}
+		return nil, true, err
+	}
+	return table.clone(), true, nil
+}
+
+// Delete removes the table with the given ID, reporting whether there was
+// one. The people sitting at it are left without a seat.
+func (store *seatingStore) Delete(id string) (bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for i, table := range store.tables {
+		if table.ID != id {
+			continue
+		}
+		previous := store.tables
+		store.tables = slices.Concat(previous[:i], previous[i+1:])
+		if err := store.save(); err != nil {
+			store.tables = previous
+			return true, err
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// save writes the seating chart to disk. The caller must hold store.mu.
+func (store *seatingStore) save() error {
+	return saveJSONFile(store.path, store.tables)
+}
+
+// tableRequest is the body of a request to add or change a table. Fields
+// left out of a change are kept as they are.
+type tableRequest struct {
+	Name     *string `json:"name"`
+	Capacity *int    `json:"capacity"`
+}
+
+// validate checks the fields that were given, trimming the name
+func (body *tableRequest) validate() error {
+	if body.Name != nil {
+		name := strings.TrimSpace(*body.Name)
+		if name == "" || len(name) > maxTableName {
+			return fmt.Errorf("name must be 1 to %d characters", maxTableName)
+		}
+		body.Name = &name
+	}
+	if body.Capacity != nil && (*body.Capacity < 1 || *body.Capacity > maxTableCapacity) {
+		return fmt.Errorf("capacity must be 1 to %d", maxTableCapacity)
+	}
+	return nil
+}
+
+// seatingChart is the whole seating chart for the couple: the tables, and
+// the attendees still to be given a seat
+type seatingChart struct {
+	Tables []*chartTable `json:"tables"`
+	// Unseated are the attendees of RSVPs saying they are coming who don't
+	// have a seat yet
+	Unseated []Seat `json:"unseated"`
+}
+
+// chartTable is a table on the seating chart
+type chartTable struct {
+	*Table
+	// NotComing are the seats of attendees whose RSVP no longer has them
+	// coming, so can be given to someone else
+	NotComing []Seat `json:"notComing,omitempty"`
+}
+
+// comingAttendees returns the named attendees of every RSVP saying they are
+// coming, by guest code and attendee ID
+func (s *server) comingAttendees() (map[string]map[string]Attendee, []*RSVP, error) {
+	rsvps, err := s.rsvps.All()
+	if err != nil {
+		return nil, nil, err
+	}
+	coming := make(map[string]map[string]Attendee)
+	for _, rsvp := range rsvps {
+		if !rsvp.attending() {
+			continue
+		}
+		coming[rsvp.Code] = make(map[string]Attendee, len(rsvp.Attendees))
+		for _, attendee := range rsvp.Attendees {
+			coming[rsvp.Code][attendee.ID] = attendee
+		}
+	}
+	return coming, rsvps, nil
+}
+
+// seatingChartHandler shows every table and who is sitting at it, along
+// with the attendees not yet seated and seats kept for people no longer
+// coming
+func (s *server) seatingChartHandler(response http.ResponseWriter, request *http.Request) {
+	coming, rsvps, err := s.comingAttendees()
+	if err != nil {
+		slog.Error("Unable to read RSVPs", "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to read RSVPs")
+		return
+	}
+
+	chart := seatingChart{Tables: []*chartTable{}, Unseated: []Seat{}}
+	seated := make(map[Seat]bool)
+	for _, table := range s.seating.All() {
+		listed := &chartTable{Table: table}
+		for i, seat := range table.Seats {
+			attendee, ok := coming[seat.Code][seat.AttendeeID]
+			if !ok {
+				listed.NotComing = append(listed.NotComing, seat)
+				continue
+			}
+			table.Seats[i].Name = attendee.Name
+			seated[Seat{Code: seat.Code, AttendeeID: seat.AttendeeID}] = true
+		}
+		chart.Tables = append(chart.Tables, listed)
+	}
+	for _, rsvp := range rsvps {
+		if !rsvp.attending() {
+			continue
+		}
+		for _, attendee := range rsvp.Attendees {
+			if !seated[Seat{Code: rsvp.Code, AttendeeID: attendee.ID}] {
+				chart.Unseated = append(chart.Unseated, Seat{Code: rsvp.Code, AttendeeID: attendee.ID, Name: attendee.Name})
+			}
+		}
+	}
+	writeJSON(response, http.StatusOK, chart)
+}
+
+// createTableHandler adds a table to the seating chart
+func (s *server) createTableHandler(response http.ResponseWriter, request *http.Request) {
+	var body tableRequest
+	if !decodeJSON(response, request, &body) {
+		return
+	}
+	if body.Name == nil || body.Capacity == nil {
+		writeJSONError(response, http.StatusBadRequest, "name and capacity are required")
+		return
+	}
+	if err := body.validate(); err != nil {
+		writeJSONError(response, http.StatusBadRequest, err.Error())
+		return
+	}
+	table, err := s.seating.Create(*body.Name, *body.Capacity)
+	if err != nil {
+		slog.Error("Unable to save seating chart", "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to add table")
+		return
+	}
+	writeJSON(response, http.StatusCreated, table)
+}
+
+// updateTableHandler renames a table or changes how many it seats
+func (s *server) updateTableHandler(response http.ResponseWriter, request *http.Request) {
+	var body tableRequest
+	if !decodeJSON(response, request, &body) {
+		return
+	}
+	if err := body.validate(); err != nil {
+		writeJSONError(response, http.StatusBadRequest, err.Error())
+		return
+	}
+	table, ok, err := s.seating.Update(request.PathValue("id"), func(table *Table) error {
+		if body.Name != nil {
+			table.Name = *body.Name
+		}
+		if body.Capacity != nil {
+			table.Capacity = *body.Capacity
+		}
+		return nil
+	})
+	s.writeTableChange(response, table, ok, err)
+}
+
+// deleteTableHandler takes a table off the seating chart, leaving the people
+// sitting at it without a seat
+func (s *server) deleteTableHandler(response http.ResponseWriter, request *http.Request) {
+	ok, err := s.seating.Delete(request.PathValue("id"))
+	if !ok {
+		writeJSONError(response, http.StatusNotFound, "Table not found")
+		return
+	}
+	if err != nil {
+		slog.Error("Unable to save seating chart", "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to delete table")
+		return
+	}
+	response.WriteHeader(http.StatusNoContent)
+}
+
+// seatRequest is the body of a request to seat an attendee of an RSVP
+type seatRequest struct {
+	Code       string `json:"code"`
+	AttendeeID string `json:"attendeeId"`
+}
+
+// seatAttendeeHandler sits an attendee at a table, moving them from the one
+// they were at. They have to be on an RSVP saying they are coming.
+func (s *server) seatAttendeeHandler(response http.ResponseWriter, request *http.Request) {
+	var body seatRequest
+	if !decodeJSON(response, request, &body) {
+		return
+	}
+	if body.Code == "" || body.AttendeeID == "" {
+		writeJSONError(response, http.StatusBadRequest, "code and attendeeId are required")
+		return
+	}
+	rsvp, ok, err := s.rsvps.Get(normalizeGuestCode(body.Code))
+	if err != nil {
+		slog.Error("Unable to read RSVP", "code", body.Code, "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to read RSVP")
+		return
+	}
+	if !ok || !rsvp.attending() {
+		writeJSONError(response, http.StatusConflict, "that invitation has no RSVP saying they are coming")
+		return
+	}
+	i := slices.IndexFunc(rsvp.Attendees, func(attendee Attendee) bool {
+		return attendee.ID == body.AttendeeID
+	})
+	if i < 0 {
+		writeJSONError(response, http.StatusConflict, "that attendee isn't on the RSVP")
+		return
+	}
+
+	seat := Seat{Code: rsvp.Code, AttendeeID: body.AttendeeID, Name: rsvp.Attendees[i].Name}
+	table, ok, err := s.seating.Seat(request.PathValue("id"), seat)
+	s.writeTableChange(response, table, ok, err)
+}
+
+// unseatAttendeeHandler takes an attendee away from a table
+func (s *server) unseatAttendeeHandler(response http.ResponseWriter, request *http.Request) {
+	code := normalizeGuestCode(request.PathValue("code"))
+	attendeeID := request.PathValue("attendeeID")
+	_, ok, err := s.seating.Update(request.PathValue("id"), func(table *Table) error {
+		i := table.seatIndex(code, attendeeID)
+		if i < 0 {
+			return errSeatNotFound
+		}
+		table.Seats = slices.Delete(table.Seats, i, i+1)
+		return nil
+	})
+	if !ok {
+		writeJSONError(response, http.StatusNotFound, "Table not found")
+		return
+	}
+	if errors.Is(err, errSeatNotFound) {
+		writeJSONError(response, http.StatusNotFound, "That attendee isn't at this table")
+		return
+	}
+	if err != nil {
+		slog.Error("Unable to save seating chart", "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to update table")
+		return
+	}
+	response.WriteHeader(http.StatusNoContent)
+}
+
+// errSeatNotFound is returned when an attendee is taken from a table they
+// aren't sitting at
+var errSeatNotFound = errors.New("seat not found")
+
+// writeTableChange answers a request that changed a table
+func (s *server) writeTableChange(response http.ResponseWriter, table *Table, ok bool, err error) {
+	if !ok {
+		writeJSONError(response, http.StatusNotFound, "Table not found")
+		return
+	}
+	if errors.Is(err, errTableFull) {
+		writeJSONError(response, http.StatusConflict, "That table doesn't seat that many")
+		return
+	}
+	if err != nil {
+		slog.Error("Unable to save seating chart", "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to update table")
+		return
+	}
+	writeJSON(response, http.StatusOK, table)
+}
+
+// guestSeating is where a household is sitting, as guests are shown it
+type guestSeating struct {
+	Name  string       `json:"name"`
+	Seats []guestTable `json:"seats"`
+}
+
+// guestTable is the table an attendee is sitting at
+type guestTable struct {
+	Name  string `json:"name"`
+	Table string `json:"table"`
+}
+
+// guestSeatingHandler tells guests which table they are at, finding their
+// invitation by ?code=, or by ?name= the way /rsvp/lookup does. Only
+// attendees still coming are shown.
+func (s *server) guestSeatingHandler(response http.ResponseWriter, request *http.Request) {
+	query := request.URL.Query()
+	var household *Household
+	switch {
+	case query.Get("code") != "":
+		found, ok, wait := s.lookupCode(request, query.Get("code"))
+		if wait > 0 {
+			writeLockedOut(response, wait)
+			return
+		}
+		if !ok {
+			writeJSONError(response, http.StatusNotFound, "We couldn't find that invitation")
+			return
+		}
+		household = found
+	case query.Get("name") != "":
+		if len(nameWords(query.Get("name"))) < 2 {
+			writeJSONError(response, http.StatusBadRequest, "Please enter your first and last name")
+			return
+		}
+		matches, wait := s.matchName(request, query.Get("name"))
+		if wait > 0 {
+			writeLockedOut(response, wait)
+			return
+		}
+		if len(matches) == 0 {
+			writeJSONError(response, http.StatusNotFound, "We couldn't find that invitation")
+			return
+		}
+		if len(matches) > 1 {
+			writeJSONError(response, http.StatusConflict, "More than one invitation matches that name. Please enter your full name as it is on your invitation")
+			return
+		}
+		household = matches[0]
+	default:
+		writeJSONError(response, http.StatusBadRequest, "code or name is required")
+		return
+	}
+
+	coming, _, err := s.comingAttendees()
+	if err != nil {
+		slog.Error("Unable to read RSVPs", "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to read RSVPs")
+		return
+	}
+	seating := guestSeating{Name: household.Name, Seats: []guestTable{}}
+	for _, table := range s.seating.All() {
+		for _, seat := range table.Seats {
+			attendee, ok := coming[household.Code][seat.AttendeeID]
+			if seat.Code == household.Code && ok {
+				seating.Seats = append(seating.Seats, guestTable{Name: attendee.Name, Table: table.Name})
+			}
+		}
+	}
+	response.Header().Set("Cache-Control", "no-store")
+	writeJSON(response, http.StatusOK, seating)
+}
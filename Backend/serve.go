@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// photoCacheControl lets browsers and CDNs keep photos for an hour. Photos
+// can still be removed or replaced by their processed copy, so they aren't
+// cached for longer than that without checking the ETag.
+const photoCacheControl = "public, max-age=3600"
+
+// servedPhoto returns the photo with the ID in the path, if it is one the
+// gallery shows. Photos in a private album are only served with a token
+// unlocking it.
+func (s *server) servedPhoto(request *http.Request) (*Photo, bool) {
+	photo, ok := s.readyPhoto(request.PathValue("id"))
+	if !ok || !s.canSeeAlbum(request, photo.Album) {
+		return nil, false
+	}
+	return photo, true
+}
+
+// keepPrivate keeps shared caches from handing a photo in a private album to
+// guests who haven't unlocked it
+func (s *server) keepPrivate(response http.ResponseWriter, photo *Photo) {
+	if album, ok := s.albums.Get(photo.Album); ok && album.Private {
+		response.Header().Set("Cache-Control", "private, max-age=3600")
+	}
+}
+
+// readyPhoto returns the photo with the given ID if it has been processed
+func (s *server) readyPhoto(id string) (*Photo, bool) {
+	photo, ok := s.photos.Get(id)
+	if !ok || photo.Status != photoReady {
+		return nil, false
+	}
+	return photo, true
+}
+
+// photoHandler serves a photo or video. Guests get the WebP copy made for
+// the gallery, or the original if none was made, such as for videos.
+// ?variant= picks a copy: web for that one, thumb for the medium thumbnail,
+// or original for the file as it was uploaded, which only the couple can
+// download with the admin token. ?w= instead serves a copy of a photo scaled
+// down to that width.
+func (s *server) photoHandler(response http.ResponseWriter, request *http.Request) {
+	photo, ok := s.servedPhoto(request)
+	if !ok {
+		http.NotFound(response, request)
+		return
+	}
+	s.keepPrivate(response, photo)
+	variant := request.URL.Query().Get("variant")
+	if value := request.URL.Query().Get("w"); value != "" {
+		if variant != "" {
+			writeJSONError(response, http.StatusBadRequest, "w can't be used with variant")
+			return
+		}
+		width, ok := resizeWidth(value)
+		if !ok {
+			writeJSONError(response, http.StatusBadRequest, "w must be a positive number of pixels")
+			return
+		}
+		s.serveResized(response, request, photo, width)
+		return
+	}
+
+	s.servePhoto(response, request, photo, variant)
+}
+
+// servePhoto serves the copy of photo picked by a ?variant= value, as
+// photoHandler describes
+func (s *server) servePhoto(response http.ResponseWriter, request *http.Request, photo *Photo, variant string) {
+	switch variant {
+	case "", "web":
+		if name, ok := photo.Variants["web"]; ok {
+			if photo.OriginalFilename != "" {
+				filename := strings.TrimSuffix(photo.OriginalFilename, path.Ext(photo.OriginalFilename)) + ".webp"
+				response.Header().Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": filename}))
+			}
+			s.serveStored(response, request, s.storage, name, "image/webp")
+			return
+		}
+	case "thumb":
+		name, ok := photo.Variants["medium"]
+		if !ok {
+			http.NotFound(response, request)
+			return
+		}
+		s.serveStored(response, request, s.storage, name, "image/webp")
+		return
+	case "original":
+		if !s.authorizeAdmin(response, request) {
+			return
+		}
+		// Keep shared caches from handing the original to guests
+		response.Header().Set("Cache-Control", "private, max-age=3600")
+	default:
+		writeJSONError(response, http.StatusBadRequest, "variant must be original, web or thumb")
+		return
+	}
+
+	if photo.OriginalFilename != "" {
+		response.Header().Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": photo.OriginalFilename}))
+	}
+	s.serveStored(response, request, s.storage, photo.originalName(), photo.ContentType)
+}
+
+// thumbnailHandler serves one of the thumbnails of a photo
+func (s *server) thumbnailHandler(response http.ResponseWriter, request *http.Request) {
+	photo, ok := s.servedPhoto(request)
+	if !ok {
+		http.NotFound(response, request)
+		return
+	}
+	s.keepPrivate(response, photo)
+	size := request.PathValue("size")
+	name, ok := photo.Variants[size]
+	if _, known := thumbnailSizes[size]; !known || !ok {
+		http.NotFound(response, request)
+		return
+	}
+	s.serveStored(response, request, s.storage, name, "image/webp")
+}
+
+// serveStored sends a file from storage, handling conditional and range
+// requests. Ranges are read from storage on their own, so a browser seeking
+// through a video only fetches the part it plays. Files are cached for
+// photoCacheControl unless the caller has set a Cache-Control of its own.
+func (s *server) serveStored(response http.ResponseWriter, request *http.Request, storage Storage, name, contentType string) {
+	info, err := storage.Stat(request.Context(), name)
+	if err != nil {
+		http.NotFound(response, request)
+		return
+	}
+	content := &rangeSeeker{ctx: request.Context(), storage: storage, name: name, size: info.Size}
+	defer content.Close()
+
+	// Stored files never change once written, so their name and size are
+	// enough to tell one version from another
+	etag := sha256.Sum256(fmt.Appendf(nil, "%s %d", name, info.Size))
+	response.Header().Set("ETag", `"`+hex.EncodeToString(etag[:8])+`"`)
+	if response.Header().Get("Cache-Control") == "" {
+		response.Header().Set("Cache-Control", photoCacheControl)
+	}
+	response.Header().Set("Content-Type", contentType)
+	http.ServeContent(response, request, "", info.ModTime, content)
+}
+
+// rangeGetter is implemented by stores that can read part of a file without
+// reading everything before it
+type rangeGetter interface {
+	// GetRange opens the file stored under name from offset, for length
+	// bytes or to the end if length is negative
+	GetRange(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error)
+}
+
+// getRange opens part of a stored file. Stores that can't read a range are
+// read from the start, skipping everything before offset.
+func getRange(ctx context.Context, storage Storage, name string, offset, length int64) (io.ReadCloser, error) {
+	if ranged, ok := storage.(rangeGetter); ok {
+		return ranged.GetRange(ctx, name, offset, length)
+	}
+	content, err := storage.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.CopyN(io.Discard, content, offset); err != nil {
+		content.Close()
+		return nil, err
+	}
+	if length < 0 {
+		return content, nil
+	}
+	return readCloser{io.LimitReader(content, length), content}, nil
+}
+
+// rangeSeeker is a stored file of known size as an io.ReadSeeker for
+// http.ServeContent. Seeking costs nothing, and reading opens the file at
+// wherever it was seeked to.
+type rangeSeeker struct {
+	ctx     context.Context
+	storage Storage
+	name    string
+	size    int64
+	offset  int64
+	// body is the file opened at bodyOffset, if it has been opened
+	body       io.ReadCloser
+	bodyOffset int64
+}
+
+func (seeker *rangeSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += seeker.offset
+	case io.SeekEnd:
+		offset += seeker.size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative seek offset")
+	}
+	seeker.offset = offset
+	return offset, nil
+}
+
+func (seeker *rangeSeeker) Read(p []byte) (int, error) {
+	if seeker.offset >= seeker.size {
+		return 0, io.EOF
+	}
+	if seeker.body != nil && seeker.bodyOffset != seeker.offset {
+		seeker.body.Close()
+		seeker.body = nil
+	}
+	if seeker.body == nil {
+		body, err := getRange(seeker.ctx, seeker.storage, seeker.name, seeker.offset, -1)
+		if err != nil {
+			slog.Error("Unable to read file", "file", seeker.name, "err", err)
+			return 0, err
+		}
+		seeker.body, seeker.bodyOffset = body, seeker.offset
+	}
+	n, err := seeker.body.Read(p)
+	seeker.bodyOffset += int64(n)
+	seeker.offset = seeker.bodyOffset
+	return n, err
+}
+
+func (seeker *rangeSeeker) Close() error {
+	if seeker.body == nil {
+		return nil
+	}
+	return seeker.body.Close()
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Share links let the couple show a photo or an album to someone who isn't
+// a guest, like the photographer or a grandparent, without a guest code.
+// They are signed the same way as upload links, with their own key, and
+// stop working when they expire. Links to an album also open each of its
+// photos. Originals still need the admin token.
+
+// Limits on how long a share link can last
+const (
+	defaultShareLifetime = 7 * 24 * time.Hour
+	maxShareLifetime     = 90 * 24 * time.Hour
+)
+
+// shareRequest is the body of a request for a share link, to either a photo
+// or an album
+type shareRequest struct {
+	PhotoID   string `json:"photoId"`
+	AlbumID   string `json:"albumId"`
+	ExpiresIn string `json:"expiresIn"`
+}
+
+// shareResponse is a freshly signed share link
+type shareResponse struct {
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// sharedAlbum is an album opened through a share link. The URLs of its
+// photos carry the link's signature so they open too.
+type sharedAlbum struct {
+	Album
+	Photos []photoSummary `json:"photos"`
+}
+
+// shareHandler makes a share link to a photo or album. By default the link
+// lasts a week.
+func (s *server) shareHandler(response http.ResponseWriter, request *http.Request) {
+	if s.shares == nil {
+		writeJSONError(response, http.StatusNotFound, "share links aren't set up")
+		return
+	}
+	var body shareRequest
+	if !decodeJSON(response, request, &body) {
+		return
+	}
+
+	var path string
+	switch {
+	case body.PhotoID != "" && body.AlbumID != "":
+		writeJSONError(response, http.StatusBadRequest, "a share link is for either a photo or an album")
+		return
+	case body.PhotoID != "":
+		photo, ok := s.photos.Get(body.PhotoID)
+		if !ok || photo.Status != photoReady {
+			writeJSONError(response, http.StatusNotFound, "Photo not found")
+			return
+		}
+		path = "/shared/photos/" + photo.ID
+	case body.AlbumID != "":
+		album, ok := s.albums.Get(body.AlbumID)
+		if !ok {
+			writeJSONError(response, http.StatusNotFound, "Album not found")
+			return
+		}
+		path = "/shared/albums/" + album.ID
+	default:
+		writeJSONError(response, http.StatusBadRequest, "photoId or albumId is required")
+		return
+	}
+
+	lifetime := defaultShareLifetime
+	if body.ExpiresIn != "" {
+		var err error
+		lifetime, err = time.ParseDuration(body.ExpiresIn)
+		if err != nil || lifetime <= 0 || lifetime > maxShareLifetime {
+			writeJSONError(response, http.StatusBadRequest, "expiresIn must be a duration of at most "+maxShareLifetime.String())
+			return
+		}
+	}
+	expires := time.Now().Add(lifetime).Truncate(time.Second)
+	query := s.shares.sign(path, expires, false)
+	writeJSON(response, http.StatusOK, shareResponse{URL: path + "?" + query.Encode(), ExpiresAt: expires})
+}
+
+// verifyShare checks the share link a request came through was signed for
+// path and hasn't expired, answering the request if it wasn't
+func (s *server) verifyShare(response http.ResponseWriter, request *http.Request, path string) bool {
+	if s.shares == nil || !s.shares.verifyPath(path, request.URL.Query()) {
+		writeJSONError(response, http.StatusForbidden, "This share link has expired or isn't valid")
+		return false
+	}
+	return true
+}
+
+// sharedPhotoHandler serves a photo through a share link. It takes
+// ?variant=web or thumb like the gallery does.
+func (s *server) sharedPhotoHandler(response http.ResponseWriter, request *http.Request) {
+	if !s.verifyShare(response, request, request.URL.Path) {
+		return
+	}
+	// The couple made the link, so it opens photos in private albums too
+	photo, ok := s.readyPhoto(request.PathValue("id"))
+	if !ok {
+		http.NotFound(response, request)
+		return
+	}
+	s.servePhoto(response, request, photo, request.URL.Query().Get("variant"))
+}
+
+// sharedAlbumHandler lists the photos of an album opened through a share
+// link
+func (s *server) sharedAlbumHandler(response http.ResponseWriter, request *http.Request) {
+	if !s.verifyShare(response, request, request.URL.Path) {
+		return
+	}
+	album, ok := s.albums.Get(request.PathValue("id"))
+	if !ok {
+		writeJSONError(response, http.StatusNotFound, "Album not found")
+		return
+	}
+	photos, err := s.photos.List(photoQuery{Status: photoReady, Album: album.ID, Sort: sortTaken})
+	if err != nil {
+		writeJSONError(response, http.StatusInternalServerError, "Unable to list photos")
+		return
+	}
+
+	// The photos are opened with the album's signature, so hand it on
+	signature := url.Values{}
+	for _, name := range []string{"expires", "nonce", "signature"} {
+		signature.Set(name, request.URL.Query().Get(name))
+	}
+	shared := sharedAlbum{Album: album.forGuests(), Photos: s.summarizePhotos(photos)}
+	for i, summary := range shared.Photos {
+		base := "/shared/albums/" + album.ID + "/photos/" + summary.ID + "?" + signature.Encode()
+		shared.Photos[i].URL = base
+		if summary.ThumbnailURL != "" {
+			shared.Photos[i].ThumbnailURL = base + "&variant=thumb"
+		}
+	}
+	response.Header().Set("Cache-Control", "no-store")
+	writeJSON(response, http.StatusOK, shared)
+}
+
+// sharedAlbumPhotoHandler serves a photo of an album opened through a share
+// link
+func (s *server) sharedAlbumPhotoHandler(response http.ResponseWriter, request *http.Request) {
+	albumID := request.PathValue("id")
+	if !s.verifyShare(response, request, "/shared/albums/"+albumID) {
+		return
+	}
+	photo, ok := s.photos.Get(request.PathValue("photoID"))
+	if !ok || photo.Status != photoReady || photo.Album != albumID {
+		http.NotFound(response, request)
+		return
+	}
+	s.servePhoto(response, request, photo, request.URL.Query().Get("variant"))
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ShuttleSignup is the seats a household has reserved on a shuttle
+type ShuttleSignup struct {
+	ShuttleID   string `json:"shuttleId"`
+	HouseholdID string `json:"householdId"`
+	// Name is the household's name when it signed up, for the manifest
+	Name       string    `json:"name"`
+	Seats      int       `json:"seats"`
+	SignedUpAt time.Time `json:"signedUpAt"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+}
+
+// errShuttleFull is returned when a shuttle doesn't have the seats left that
+// a household asked for
+var errShuttleFull = errors.New("there aren't enough seats left on that shuttle")
+
+// shuttleStore keeps who has signed up for each shuttle, in the order they
+// signed up
+type shuttleStore struct {
+	mu      sync.Mutex
+	path    string
+	signups []*ShuttleSignup
+}
+
+// openShuttleStore loads the shuttle signups saved at path, starting with
+// none if it doesn't exist
+func openShuttleStore(path string) (*shuttleStore, error) {
+	store := &shuttleStore{path: path}
+
+	if err := loadJSONFile(path, &store.signups); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// All returns a copy of every signup
+func (store *shuttleStore) All() []ShuttleSignup {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	signups := make([]ShuttleSignup, 0, len(store.signups))
+	for _, signup := range store.signups {
+		signups = append(signups, *signup)
+	}
+	return signups
+}
+
+// Taken counts the seats reserved on a shuttle, leaving out those of the
+// household with the ID except, if it is given
+func (store *shuttleStore) Taken(shuttleID, except string) int {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	return store.taken(shuttleID, except)
+}
+
+// taken counts the seats reserved on a shuttle. The caller must hold
+// store.mu.
+func (store *shuttleStore) taken(shuttleID, except string) int {
+	seats := 0
+	for _, signup := range store.signups {
+		if signup.ShuttleID == shuttleID && (except == "" || signup.HouseholdID != except) {
+			seats += signup.Seats
+		}
+	}
+	return seats
+}
+
+// Reserved returns how many seats a household has on a shuttle
+func (store *shuttleStore) Reserved(shuttleID, householdID string) int {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if signup := store.find(shuttleID, householdID); signup != nil {
+		return signup.Seats
+	}
+	return 0
+}
+
+// find returns a household's signup for a shuttle. The caller must hold
+// store.mu.
+func (store *shuttleStore) find(shuttleID, householdID string) *ShuttleSignup {
+	for _, signup := range store.signups {
+		if signup.ShuttleID == shuttleID && signup.HouseholdID == householdID {
+			return signup
+		}
+	}
+	return nil
+}
+
+// Reserve signs a household up for seats on a shuttle that holds capacity,
+// or any number if it is 0, replacing the seats it had. It returns
+// errShuttleFull if the others signed up leave too few.
+func (store *shuttleStore) Reserve(signup ShuttleSignup, capacity int) (ShuttleSignup, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if capacity > 0 && store.taken(signup.ShuttleID, signup.HouseholdID)+signup.Seats > capacity {
+		return ShuttleSignup{}, errShuttleFull
+	}
+	existing := store.find(signup.ShuttleID, signup.HouseholdID)
+	if existing == nil {
+		store.signups = append(store.signups, &signup)
+		if err := store.save(); err != nil {
+			store.signups = store.signups[:len(store.signups)-1]
+			return ShuttleSignup{}, err
+		}
+		return signup, nil
+	}
+	previous := *existing
+	signup.SignedUpAt = previous.SignedUpAt
+	*existing = signup
+	if err := store.save(); err != nil {
+		*existing = previous
+		return ShuttleSignup{}, err
+	}
+	return signup, nil
+}
+
+// Cancel gives up a household's seats on a shuttle, reporting whether it had
+// any
+func (store *shuttleStore) Cancel(shuttleID, householdID string) (bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for i, signup := range store.signups {
+		if signup.ShuttleID != shuttleID || signup.HouseholdID != householdID {
+			continue
+		}
+		previous := store.signups
+		store.signups = slices.Concat(previous[:i], previous[i+1:])
+		if err := store.save(); err != nil {
+			store.signups = previous
+			return true, err
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// save writes the shuttle signups to disk. The caller must hold store.mu.
+func (store *shuttleStore) save() error {
+	return saveJSONFile(store.path, store.signups)
+}
+
+// shuttleSignupRequest is the body of a household's shuttle signup. The
+// guest code can be sent as an X-Guest-Code header instead.
+type shuttleSignupRequest struct {
+	Code  string `json:"code"`
+	Seats *int   `json:"seats"`
+}
+
+// shuttleSignupResult is a household's signup, with how many seats are left
+// on the shuttle if it is limited
+type shuttleSignupResult struct {
+	ShuttleSignup
+	SeatsLeft *int `json:"seatsLeft,omitempty"`
+}
+
+// signupShuttle returns the shuttle with the ID in the request path, if it
+// is one guests can still sign up for, answering the request if it isn't
+func (s *server) signupShuttle(response http.ResponseWriter, request *http.Request) (TravelItem, bool) {
+	shuttle, ok := s.travel.Get(request.PathValue("id"))
+	if !ok || shuttle.Kind != travelShuttle {
+		writeJSONError(response, http.StatusNotFound, "Shuttle not found")
+		return TravelItem{}, false
+	}
+	if shuttle.DepartsAt != nil && !time.Now().Before(*shuttle.DepartsAt) {
+		writeJSONError(response, http.StatusConflict, "That shuttle has already left")
+		return TravelItem{}, false
+	}
+	return shuttle, true
+}
+
+// shuttleSignupHandler reserves seats on a shuttle for a household, one
+// each unless it says how many. Signing up again changes how many seats it
+// has.
+func (s *server) shuttleSignupHandler(response http.ResponseWriter, request *http.Request) {
+	var body shuttleSignupRequest
+	if !decodeJSON(response, request, &body) {
+		return
+	}
+	code := body.Code
+	if code == "" {
+		code = guestCode(request)
+	}
+	household, ok, wait := s.lookupCode(request, code)
+	if wait > 0 {
+		writeLockedOut(response, wait)
+		return
+	}
+	if !ok {
+		writeJSONError(response, http.StatusUnauthorized, "Please enter the code from your invitation to sign up for a shuttle")
+		return
+	}
+	shuttle, ok := s.signupShuttle(response, request)
+	if !ok {
+		return
+	}
+	seats := 1
+	if body.Seats != nil {
+		seats = *body.Seats
+	}
+	if most := partySize(household); seats < 1 || seats > most {
+		writeJSONError(response, http.StatusBadRequest, fmt.Sprintf("seats must be 1 to %d", most))
+		return
+	}
+
+	now := time.Now().UTC()
+	signup, err := s.shuttles.Reserve(ShuttleSignup{
+		ShuttleID:   shuttle.ID,
+		HouseholdID: household.ID,
+		Name:        household.Name,
+		Seats:       seats,
+		SignedUpAt:  now,
+		UpdatedAt:   now,
+	}, shuttle.Seats)
+	if errors.Is(err, errShuttleFull) {
+		left := max(shuttle.Seats-s.shuttles.Taken(shuttle.ID, household.ID), 0)
+		writeJSONError(response, http.StatusConflict, fmt.Sprintf("Only %d seats are left on that shuttle", left))
+		return
+	}
+	if err != nil {
+		slog.Error("Unable to save shuttle signups", "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to sign up for shuttle")
+		return
+	}
+	result := shuttleSignupResult{ShuttleSignup: signup}
+	if shuttle.Seats > 0 {
+		left := max(shuttle.Seats-s.shuttles.Taken(shuttle.ID, ""), 0)
+		result.SeatsLeft = &left
+	}
+	writeJSON(response, http.StatusOK, result)
+}
+
+// cancelShuttleSignupHandler gives up the seats the household with the
+// X-Guest-Code has on a shuttle
+func (s *server) cancelShuttleSignupHandler(response http.ResponseWriter, request *http.Request) {
+	household, ok, wait := s.lookupCode(request, guestCode(request))
+	if wait > 0 {
+		writeLockedOut(response, wait)
+		return
+	}
+	if !ok {
+		writeJSONError(response, http.StatusUnauthorized, "Please enter the code from your invitation")
+		return
+	}
+	shuttle, ok := s.signupShuttle(response, request)
+	if !ok {
+		return
+	}
+	ok, err := s.shuttles.Cancel(shuttle.ID, household.ID)
+	if !ok {
+		writeJSONError(response, http.StatusNotFound, "You aren't signed up for that shuttle")
+		return
+	}
+	if err != nil {
+		slog.Error("Unable to save shuttle signups", "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to cancel shuttle signup")
+		return
+	}
+	response.WriteHeader(http.StatusNoContent)
+}
+
+// shuttleManifest is who is riding one shuttle, for the planner
+type shuttleManifest struct {
+	ID          string          `json:"id"`
+	Name        string          `json:"name"`
+	DepartsAt   *time.Time      `json:"departsAt,omitempty"`
+	Pickup      string          `json:"pickup,omitempty"`
+	Destination string          `json:"destination,omitempty"`
+	Seats       int             `json:"seats,omitempty"`
+	Taken       int             `json:"taken"`
+	Riders      []ShuttleSignup `json:"riders"`
+}
+
+// shuttleManifestHandler lists who has signed up for each shuttle, in the
+// order they leave, as JSON or with ?format=csv as a spreadsheet
+func (s *server) shuttleManifestHandler(response http.ResponseWriter, request *http.Request) {
+	manifests := []shuttleManifest{}
+	index := map[string]int{}
+	for _, item := range s.travel.All() {
+		if item.Kind != travelShuttle {
+			continue
+		}
+		index[item.ID] = len(manifests)
+		manifests = append(manifests, shuttleManifest{
+			ID:          item.ID,
+			Name:        item.Name,
+			DepartsAt:   item.DepartsAt,
+			Pickup:      item.Pickup,
+			Destination: item.Destination,
+			Seats:       item.Seats,
+			Riders:      []ShuttleSignup{},
+		})
+	}
+	for _, signup := range s.shuttles.All() {
+		i, ok := index[signup.ShuttleID]
+		if !ok {
+			continue
+		}
+		manifests[i].Taken += signup.Seats
+		manifests[i].Riders = append(manifests[i].Riders, signup)
+	}
+
+	switch request.URL.Query().Get("format") {
+	case "", "json":
+		writeJSON(response, http.StatusOK, manifests)
+	case "csv":
+		response.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		response.Header().Set("Content-Disposition", `attachment; filename="shuttle-manifest.csv"`)
+		out := csv.NewWriter(response)
+		out.Write([]string{"Shuttle", "Departs", "Pickup", "Destination", "Household", "Seats"})
+		for _, manifest := range manifests {
+			departs := ""
+			if manifest.DepartsAt != nil {
+				departs = manifest.DepartsAt.Format(time.RFC3339)
+			}
+			for _, rider := range manifest.Riders {
+				out.Write(csvRow(manifest.Name, departs, manifest.Pickup, manifest.Destination, rider.Name, strconv.Itoa(rider.Seats)))
+			}
+		}
+		out.Flush()
+		if err := out.Error(); err != nil {
+			slog.Error("Unable to write shuttle manifest", "err", err)
+		}
+	default:
+		writeJSONError(response, http.StatusBadRequest, "format must be json or csv")
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Signed upload URLs let someone hand out upload access without handing out
+// a guest code, for example on QR cards at the tables. A URL carries its
+// expiry, a nonce, and whether it can only be used once, all signed with an
+// HMAC so none of them can be changed. Once a signing key is set, uploads are
+// only accepted through signed URLs or with a guest code.
+
+// Limits on how long a signed URL can last
+const (
+	defaultSignedURLLifetime = time.Hour
+	maxSignedURLLifetime     = 7 * 24 * time.Hour
+)
+
+// signablePaths are the upload endpoints a signed URL can be made for
+var signablePaths = map[string]bool{
+	"/uploadimage": true,
+	"/upload/tus/": true,
+	"/upload/raw":  true,
+}
+
+// signedRequestKey marks the context of requests with a valid signature
+type signedRequestKey struct{}
+
+// urlSigner makes and checks signed upload URLs, remembering which one-time
+// URLs have been used until they expire
+type urlSigner struct {
+	key  []byte
+	mu   sync.Mutex
+	used map[string]time.Time
+}
+
+func newURLSigner(key string) *urlSigner {
+	return &urlSigner{key: []byte(key), used: make(map[string]time.Time)}
+}
+
+// signature is the HMAC of everything a signed URL grants
+func (signer *urlSigner) signature(path string, expires int64, nonce string, once bool) string {
+	mac := hmac.New(sha256.New, signer.key)
+	mac.Write([]byte(path + "\n" + strconv.FormatInt(expires, 10) + "\n" + nonce + "\n" + strconv.FormatBool(once)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// sign returns the query string of a signed URL for path
+func (signer *urlSigner) sign(path string, expires time.Time, once bool) url.Values {
+	nonce := randomHex(16)
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	query.Set("nonce", nonce)
+	if once {
+		query.Set("once", "true")
+	}
+	query.Set("signature", signer.signature(path, expires.Unix(), nonce, once))
+	return query
+}
+
+// verify checks the signature on a request, using up one-time URLs
+func (signer *urlSigner) verify(request *http.Request) bool {
+	return signer.verifyPath(request.URL.Path, request.URL.Query())
+}
+
+// verifyPath checks that query holds a valid signature for path, using up
+// one-time URLs
+func (signer *urlSigner) verifyPath(path string, query url.Values) bool {
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+	nonce := query.Get("nonce")
+	once := query.Get("once") == "true"
+	expected := signer.signature(path, expires, nonce, once)
+	if !hmac.Equal([]byte(expected), []byte(query.Get("signature"))) {
+		return false
+	}
+	if !once {
+		return true
+	}
+
+	signer.mu.Lock()
+	defer signer.mu.Unlock()
+	for usedNonce, expiry := range signer.used {
+		if time.Now().After(expiry) {
+			delete(signer.used, usedNonce)
+		}
+	}
+	if _, ok := signer.used[nonce]; ok {
+		return false
+	}
+	signer.used[nonce] = time.Unix(expires, 0)
+	return true
+}
+
+// middleware marks requests to a signed URL so they are let through without
+// a guest code. Requests with a signature that doesn't check out are turned
+// away. Preflight requests are never checked.
+func (signer *urlSigner) middleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(response http.ResponseWriter, request *http.Request) {
+		if request.Method == http.MethodOptions || !request.URL.Query().Has("signature") {
+			next(response, request)
+			return
+		}
+		if !signer.verify(request) {
+			http.Error(response, "This upload link has expired or was already used", http.StatusForbidden)
+			return
+		}
+		next(response, request.WithContext(context.WithValue(request.Context(), signedRequestKey{}, true)))
+	}
+}
+
+// signed checks signed URLs on requests to an upload endpoint, if signing is
+// set up
+func (s *server) signed(next http.HandlerFunc) http.HandlerFunc {
+	if s.signer == nil {
+		return next
+	}
+	return s.signer.middleware(next)
+}
+
+// isSignedRequest reports whether a request came through a valid signed URL
+func isSignedRequest(ctx context.Context) bool {
+	signed, _ := ctx.Value(signedRequestKey{}).(bool)
+	return signed
+}
+
+// signRequest is the body of a request for a signed upload URL
+type signRequest struct {
+	Path      string `json:"path"`
+	ExpiresIn string `json:"expiresIn"`
+	OneTime   *bool  `json:"oneTime"`
+}
+
+// signResponse is a freshly signed upload URL
+type signResponse struct {
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	OneTime   bool      `json:"oneTime"`
+}
+
+// signHandler hands a guest with a valid code a signed upload URL. By default
+// the URL is for /uploadimage, lasts an hour, and works once.
+func (s *server) signHandler(response http.ResponseWriter, request *http.Request) {
+	if s.signer == nil {
+		writeJSONError(response, http.StatusNotFound, "signed upload URLs aren't set up")
+		return
+	}
+
+	_, ok, wait := s.lookupCode(request, guestCode(request))
+	if wait > 0 {
+		writeLockedOut(response, wait)
+		return
+	}
+	if !ok {
+		writeJSONError(response, http.StatusUnauthorized, "a valid guest code is needed to make upload links")
+		return
+	}
+
+	var body signRequest
+	if request.ContentLength != 0 {
+		if err := json.NewDecoder(http.MaxBytesReader(response, request.Body, 4<<10)).Decode(&body); err != nil {
+			writeJSONError(response, http.StatusBadRequest, "invalid request body")
+			return
+		}
+	}
+	if body.Path == "" {
+		body.Path = "/uploadimage"
+	}
+	if !signablePaths[body.Path] {
+		writeJSONError(response, http.StatusBadRequest, "upload links can only be made for /uploadimage, /upload/tus/, and /upload/raw")
+		return
+	}
+	lifetime := defaultSignedURLLifetime
+	if body.ExpiresIn != "" {
+		var err error
+		lifetime, err = time.ParseDuration(body.ExpiresIn)
+		if err != nil || lifetime <= 0 || lifetime > maxSignedURLLifetime {
+			writeJSONError(response, http.StatusBadRequest, "expiresIn must be a duration of at most "+maxSignedURLLifetime.String())
+			return
+		}
+	}
+	once := body.OneTime == nil || *body.OneTime
+
+	expires := time.Now().Add(lifetime).Truncate(time.Second)
+	query := s.signer.sign(body.Path, expires, once)
+	writeJSON(response, http.StatusOK, signResponse{
+		URL:       body.Path + "?" + query.Encode(),
+		ExpiresAt: expires,
+		OneTime:   once,
+	})
+}
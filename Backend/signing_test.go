@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestVerifySignedPath(t *testing.T) {
+	signer := newURLSigner("signing-key")
+	later := time.Now().Add(time.Hour)
+
+	// changed returns a copy of query with one value set
+	changed := func(query url.Values, name, value string) url.Values {
+		copied := url.Values{}
+		for key, values := range query {
+			copied[key] = append([]string(nil), values...)
+		}
+		copied.Set(name, value)
+		return copied
+	}
+	reusable := signer.sign("/uploadimage", later, false)
+	share := signer.sign("/shared/photos/abc", later, false)
+	withoutSignature := changed(reusable, "signature", "")
+	withoutSignature.Del("signature")
+
+	tests := []struct {
+		name  string
+		path  string
+		query url.Values
+		want  bool
+	}{
+		{name: "valid", path: "/uploadimage", query: reusable, want: true},
+		{name: "share link", path: "/shared/photos/abc", query: share, want: true},
+		{name: "other path", path: "/upload/raw", query: reusable},
+		{name: "share link for another photo", path: "/shared/photos/abd", query: share},
+		{name: "expired", path: "/uploadimage", query: signer.sign("/uploadimage", time.Now().Add(-time.Second), false)},
+		{name: "expiry pushed back", path: "/uploadimage", query: changed(reusable, "expires", strconv.FormatInt(later.Add(time.Hour).Unix(), 10))},
+		{name: "expiry not a number", path: "/uploadimage", query: changed(reusable, "expires", "soon")},
+		{name: "other nonce", path: "/uploadimage", query: changed(reusable, "nonce", "0000")},
+		{name: "made one-time", path: "/uploadimage", query: changed(reusable, "once", "true")},
+		{name: "wrong signature", path: "/uploadimage", query: changed(reusable, "signature", "00")},
+		{name: "no signature", path: "/uploadimage", query: withoutSignature},
+		{name: "other key", path: "/uploadimage", query: newURLSigner("another-key").sign("/uploadimage", later, false)},
+		{name: "empty", path: "/uploadimage", query: url.Values{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if ok := signer.verifyPath(test.path, test.query); ok != test.want {
+				t.Errorf("verifyPath(%q, %v) = %v, want %v", test.path, test.query, ok, test.want)
+			}
+		})
+	}
+
+	// Reusable URLs work every time, one-time URLs only once
+	for i := range 2 {
+		if !signer.verifyPath("/uploadimage", reusable) {
+			t.Errorf("reusable URL turned away on use %d", i+1)
+		}
+	}
+	once := signer.sign("/uploadimage", later, true)
+	if !signer.verifyPath("/uploadimage", once) {
+		t.Error("one-time URL turned away on first use")
+	}
+	if signer.verifyPath("/uploadimage", once) {
+		t.Error("one-time URL let through twice")
+	}
+	if signer.verifyPath("/uploadimage", changed(once, "once", "false")) {
+		t.Error("one-time URL let through again once made reusable")
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"math/rand/v2"
+	"net/http"
+	"strings"
+)
+
+// maxExcluded is how many recently shown photos a slideshow can ask to skip
+const maxExcluded = 500
+
+// randomPhotoHandler returns one photo from the gallery picked at random, for
+// the slideshow on the screen at the reception. It takes the same filters as
+// the gallery, and ?exclude= with a comma separated list of photo IDs the
+// screen has shown recently. Once every photo has been shown the excluded
+// ones are picked from again, so the slideshow never runs dry.
+func (s *server) randomPhotoHandler(response http.ResponseWriter, request *http.Request) {
+	query, err := s.galleryQuery(request)
+	if err != nil {
+		writeQueryError(response, err)
+		return
+	}
+
+	excluded := map[string]bool{}
+	for _, value := range request.URL.Query()["exclude"] {
+		for _, id := range strings.Split(value, ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				excluded[id] = true
+			}
+		}
+	}
+	if len(excluded) > maxExcluded {
+		writeJSONError(response, http.StatusBadRequest, "exclude can list at most 500 photos")
+		return
+	}
+
+	photos, err := s.photos.List(query)
+	if err != nil {
+		writeJSONError(response, http.StatusInternalServerError, "Unable to list photos")
+		return
+	}
+	if len(photos) == 0 {
+		writeJSONError(response, http.StatusNotFound, "No photos yet")
+		return
+	}
+
+	candidates := make([]*Photo, 0, len(photos))
+	for _, photo := range photos {
+		if !excluded[photo.ID] {
+			candidates = append(candidates, photo)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = photos
+	}
+
+	// Don't let the cache at the venue show the same photo over and over
+	response.Header().Set("Cache-Control", "no-store")
+	picked := candidates[rand.IntN(len(candidates))]
+	writeJSON(response, http.StatusOK, s.summarizePhotos([]*Photo{picked})[0])
+}
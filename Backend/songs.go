@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Limits on what a guest can send with a song request
+const (
+	maxSongTitle  = 200
+	maxSongArtist = 200
+)
+
+// Song is a song guests have asked the DJ to play. Asking for one that has
+// already been asked for adds to its requests rather than listing it twice.
+type Song struct {
+	ID     string `json:"id"`
+	Title  string `json:"title"`
+	Artist string `json:"artist,omitempty"`
+	// The Spotify IDs and link of the song, if it was found there
+	SpotifyTrackID  string `json:"spotifyTrackId,omitempty"`
+	SpotifyArtistID string `json:"spotifyArtistId,omitempty"`
+	SpotifyURL      string `json:"spotifyUrl,omitempty"`
+	// RequestedBy are the names of the guests who asked for it, where they
+	// gave them
+	RequestedBy []string `json:"requestedBy,omitempty"`
+	// Requesters are who asked for it, by the same keys likes use, so each
+	// guest counts once
+	Requesters  []string  `json:"requesters"`
+	RequestedAt time.Time `json:"requestedAt"`
+}
+
+// clone returns a copy of song that can be changed without affecting the
+// one held by the store
+func (song *Song) clone() *Song {
+	copied := *song
+	copied.RequestedBy = slices.Clone(song.RequestedBy)
+	copied.Requesters = slices.Clone(song.Requesters)
+	return &copied
+}
+
+// sameSong reports whether two requests are for the same song: the same
+// Spotify track, or the same title and artist however they were typed
+func sameSong(a, b *Song) bool {
+	if a.SpotifyTrackID != "" && b.SpotifyTrackID != "" {
+		return a.SpotifyTrackID == b.SpotifyTrackID
+	}
+	return slices.Equal(nameWords(a.Title), nameWords(b.Title)) &&
+		(a.Artist == "" || b.Artist == "" || slices.Equal(nameWords(a.Artist), nameWords(b.Artist)))
+}
+
+// songStore keeps the song requests, in the order they were first asked for
+type songStore struct {
+	mu    sync.Mutex
+	path  string
+	songs []*Song
+}
+
+// openSongStore loads the song requests saved at path, starting with none if
+// it doesn't exist
+func openSongStore(path string) (*songStore, error) {
+	store := &songStore{path: path}
+
+	if err := loadJSONFile(path, &store.songs); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// All returns a copy of every song requested
+func (store *songStore) All() []*Song {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	songs := make([]*Song, 0, len(store.songs))
+	for _, song := range store.songs {
+		songs = append(songs, song.clone())
+	}
+	return songs
+}
+
+// Request adds a request for song by requester, who may have given their
+// name. It returns the song as it is now listed, and whether it had been
+// asked for already.
+func (store *songStore) Request(song *Song, requester, name string) (*Song, bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var existing *Song
+	for _, other := range store.songs {
+		if sameSong(other, song) {
+			existing = other
+			break
+		}
+	}
+	if existing == nil {
+		added := song.clone()
+		added.ID = newUUID()
+		added.Requesters = []string{requester}
+		if name != "" {
+			added.RequestedBy = []string{name}
+		}
+		store.songs = append(store.songs, added)
+		if err := store.save(); err != nil {
+			store.songs = store.songs[:len(store.songs)-1]
+			return nil, false, err
+		}
+		return added.clone(), false, nil
+	}
+	if slices.Contains(existing.Requesters, requester) {
+		return existing.clone(), true, nil
+	}
+
+	previous := existing.clone()
+	existing.Requesters = append(existing.Requesters, requester)
+	if name != "" && !slices.Contains(existing.RequestedBy, name) {
+		existing.RequestedBy = append(existing.RequestedBy, name)
+	}
+	// A request found on Spotify fills in one that wasn't
+	if existing.SpotifyTrackID == "" && song.SpotifyTrackID != "" {
+		existing.Title, existing.Artist = song.Title, song.Artist
+		existing.SpotifyTrackID, existing.SpotifyArtistID, existing.SpotifyURL = song.SpotifyTrackID, song.SpotifyArtistID, song.SpotifyURL
+	}
+	if err := store.save(); err != nil {
+		*existing = *previous
+		return nil, true, err
+	}
+	return existing.clone(), true, nil
+}
+
+// Delete removes the song with the given ID, reporting whether there was one
+func (store *songStore) Delete(id string) (bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for i, song := range store.songs {
+		if song.ID != id {
+			continue
+		}
+		previous := store.songs
+		store.songs = slices.Concat(previous[:i], previous[i+1:])
+		if err := store.save(); err != nil {
+			store.songs = previous
+			return true, err
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// save writes the song requests to disk. The caller must hold store.mu.
+func (store *songStore) save() error {
+	return saveJSONFile(store.path, store.songs)
+}
+
+// songRequest is the body of a guest's song request
+type songRequest struct {
+	Title  string `json:"title"`
+	Artist string `json:"artist"`
+	// Name is who is asking, for guests without a guest code
+	Name string `json:"name"`
+}
+
+// requestedSong is a song request as guests are shown it
+type requestedSong struct {
+	ID         string `json:"id"`
+	Title      string `json:"title"`
+	Artist     string `json:"artist,omitempty"`
+	SpotifyURL string `json:"spotifyUrl,omitempty"`
+	Requests   int    `json:"requests"`
+	// AlreadyRequested is set when someone had asked for the song before
+	AlreadyRequested bool `json:"alreadyRequested"`
+}
+
+// songRequestHandler takes a guest's request for a song. It is looked up on
+// Spotify if an app is set up, so different spellings of the same song are
+// counted together; if Spotify can't be reached the request is kept as
+// typed.
+func (s *server) songRequestHandler(response http.ResponseWriter, request *http.Request) {
+	var body songRequest
+	if !decodeJSON(response, request, &body) {
+		return
+	}
+	song := &Song{
+		Title:       strings.TrimSpace(body.Title),
+		Artist:      strings.TrimSpace(body.Artist),
+		RequestedAt: time.Now().UTC(),
+	}
+	if song.Title == "" || utf8.RuneCountInString(song.Title) > maxSongTitle {
+		writeJSONError(response, http.StatusBadRequest, fmt.Sprintf("title must be 1 to %d characters", maxSongTitle))
+		return
+	}
+	if utf8.RuneCountInString(song.Artist) > maxSongArtist {
+		writeJSONError(response, http.StatusBadRequest, fmt.Sprintf("artist can be at most %d characters", maxSongArtist))
+		return
+	}
+	name := strings.TrimSpace(body.Name)
+	if utf8.RuneCountInString(name) > maxAuthorLength {
+		writeJSONError(response, http.StatusBadRequest, fmt.Sprintf("name can be at most %d characters", maxAuthorLength))
+		return
+	}
+	if code := guestCode(request); code != "" {
+		household, ok, wait := s.lookupCode(request, code)
+		if wait > 0 {
+			writeLockedOut(response, wait)
+			return
+		}
+		if !ok {
+			writeJSONError(response, http.StatusUnauthorized, "unknown guest code")
+			return
+		}
+		name = household.Name
+	}
+	requester := s.guestKey(request)
+	if requester == "" {
+		requester = "ip:" + clientIP(request)
+	}
+
+	if s.spotify != nil {
+		ctx, cancel := context.WithTimeout(request.Context(), 5*time.Second)
+		track, err := s.spotify.Find(ctx, song.Title, song.Artist)
+		cancel()
+		if err != nil {
+			slog.Error("Unable to look up song on Spotify", "title", song.Title, "err", err)
+		} else if track != nil {
+			song.Title, song.Artist = track.Title, track.Artist
+			song.SpotifyTrackID, song.SpotifyArtistID, song.SpotifyURL = track.ID, track.ArtistID, track.URL
+		}
+	}
+
+	listed, again, err := s.songs.Request(song, requester, name)
+	if err != nil {
+		slog.Error("Unable to save song requests", "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to save song request")
+		return
+	}
+	status := http.StatusCreated
+	if again {
+		status = http.StatusOK
+	}
+	writeJSON(response, status, requestedSong{
+		ID:               listed.ID,
+		Title:            listed.Title,
+		Artist:           listed.Artist,
+		SpotifyURL:       listed.SpotifyURL,
+		Requests:         len(listed.Requesters),
+		AlreadyRequested: again,
+	})
+}
+
+// djSong is a song request as the DJ is given it
+type djSong struct {
+	ID              string    `json:"id"`
+	Title           string    `json:"title"`
+	Artist          string    `json:"artist,omitempty"`
+	SpotifyTrackID  string    `json:"spotifyTrackId,omitempty"`
+	SpotifyArtistID string    `json:"spotifyArtistId,omitempty"`
+	SpotifyURL      string    `json:"spotifyUrl,omitempty"`
+	Requests        int       `json:"requests"`
+	RequestedBy     []string  `json:"requestedBy"`
+	RequestedAt     time.Time `json:"requestedAt"`
+}
+
+// listSongsHandler exports the song requests for the DJ, the most asked for
+// first, as JSON or with ?format=csv as a spreadsheet
+func (s *server) listSongsHandler(response http.ResponseWriter, request *http.Request) {
+	songs := []djSong{}
+	for _, song := range s.songs.All() {
+		requestedBy := song.RequestedBy
+		if requestedBy == nil {
+			requestedBy = []string{}
+		}
+		songs = append(songs, djSong{
+			ID:              song.ID,
+			Title:           song.Title,
+			Artist:          song.Artist,
+			SpotifyTrackID:  song.SpotifyTrackID,
+			SpotifyArtistID: song.SpotifyArtistID,
+			SpotifyURL:      song.SpotifyURL,
+			Requests:        len(song.Requesters),
+			RequestedBy:     requestedBy,
+			RequestedAt:     song.RequestedAt,
+		})
+	}
+	slices.SortStableFunc(songs, func(a, b djSong) int {
+		return b.Requests - a.Requests
+	})
+
+	switch request.URL.Query().Get("format") {
+	case "", "json":
+		writeJSON(response, http.StatusOK, songs)
+	case "csv":
+		response.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		response.Header().Set("Content-Disposition", `attachment; filename="song-requests.csv"`)
+		out := csv.NewWriter(response)
+		out.Write([]string{"Title", "Artist", "Requests", "Requested by", "Spotify track ID", "Spotify URL"})
+		for _, song := range songs {
+			out.Write(csvRow(song.Title, song.Artist, strconv.Itoa(song.Requests), strings.Join(song.RequestedBy, ", "), song.SpotifyTrackID, song.SpotifyURL))
+		}
+		out.Flush()
+		if err := out.Error(); err != nil {
+			slog.Error("Unable to write song requests", "err", err)
+		}
+	default:
+		writeJSONError(response, http.StatusBadRequest, "format must be json or csv")
+	}
+}
+
+// deleteSongHandler takes a song off the requests
+func (s *server) deleteSongHandler(response http.ResponseWriter, request *http.Request) {
+	ok, err := s.songs.Delete(request.PathValue("id"))
+	if !ok {
+		writeJSONError(response, http.StatusNotFound, "Song not found")
+		return
+	}
+	if err != nil {
+		slog.Error("Unable to save song requests", "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to delete song")
+		return
+	}
+	response.WriteHeader(http.StatusNoContent)
+}
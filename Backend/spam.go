@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The guestbook and RSVP forms are open to anyone who finds the site, so
+// bots find them too. Messages are screened before they are saved: bots
+// give themselves away by filling in a field the form hides, or by sending
+// the form faster than a person could fill it in, and their messages are
+// dropped. Messages that only look like spam, with lots of links or flagged
+// by the spam check service, are held for the couple to look at. A form
+// without a current token, such as one shown before a restart, can't be
+// timed, and if the spam check service is down messages aren't checked by
+// it, so neither keeps a guest's message out.
+//
+// RSVPs need a guest code, so they are never dropped or held: what
+// screening made of one is kept on it for the couple to see.
+
+// maxFormAge is how long a form token stays good, for a form left open
+const maxFormAge = 24 * time.Hour
+
+// How sure the screening is that a message is spam
+const (
+	// spamBot messages are from a bot, and are dropped
+	spamBot = "bot"
+	// spamSuspect messages look like spam, and are held for review
+	spamSuspect = "suspect"
+)
+
+// spamVerdict is what screening made of a message. Kind is empty for
+// messages that look fine.
+type spamVerdict struct {
+	Kind   string
+	Reason string
+}
+
+// spamFields are the fields the forms send to tell guests from bots
+type spamFields struct {
+	// Website is a honeypot: the form hides it, so only bots fill it in
+	Website string `json:"website"`
+	// FormToken is from /forms/token when the form was shown, to tell how
+	// long it took to fill in
+	FormToken string `json:"formToken"`
+}
+
+// linkPattern matches the start of a link in a message
+var linkPattern = regexp.MustCompile(`(?i)\bhttps?://|\bwww\.|\[url`)
+
+// SpamChecker asks a spam check service, such as Akismet behind a small
+// wrapper, about a message
+type SpamChecker interface {
+	// Check returns whether a message is spam, and if so, why
+	Check(ctx context.Context, message spamCheck) (spamReply, error)
+}
+
+// spamCheck is a message sent to the spam check service
+type spamCheck struct {
+	Form    string `json:"form"`
+	Author  string `json:"author"`
+	Message string `json:"message"`
+	IP      string `json:"ip"`
+	// UserAgent is the browser the message was sent from
+	UserAgent string `json:"userAgent"`
+}
+
+// spamReply is the spam check service's verdict on a message
+type spamReply struct {
+	Spam   bool   `json:"spam"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// newSpamChecker returns the spam check service set up in the config, or
+// nil if there isn't one
+func newSpamChecker() SpamChecker {
+	if *spamCheckURL == "" {
+		return nil
+	}
+	return &httpSpamChecker{url: *spamCheckURL, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// httpSpamChecker posts each message to a spam check service as JSON, and
+// the service replies with a spamReply as JSON
+type httpSpamChecker struct {
+	url    string
+	client *http.Client
+}
+
+func (checker *httpSpamChecker) Check(ctx context.Context, message spamCheck) (spamReply, error) {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return spamReply{}, err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, checker.url, bytes.NewReader(body))
+	if err != nil {
+		return spamReply{}, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := checker.client.Do(request)
+	if err != nil {
+		return spamReply{}, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return spamReply{}, fmt.Errorf("spam check service returned %s", response.Status)
+	}
+
+	var reply spamReply
+	if err := json.NewDecoder(io.LimitReader(response.Body, 1<<20)).Decode(&reply); err != nil {
+		return spamReply{}, fmt.Errorf("spam check service reply: %w", err)
+	}
+	return reply, nil
+}
+
+// spamGuard screens messages sent through the forms
+type spamGuard struct {
+	// key signs form tokens. It is made afresh on every start, so a form
+	// shown before a restart just isn't timed.
+	key     []byte
+	checker SpamChecker
+}
+
+// newSpamGuard returns the screening set up in the config
+func newSpamGuard() *spamGuard {
+	return &spamGuard{key: []byte(randomHex(32)), checker: newSpamChecker()}
+}
+
+// formSignature returns the signature of a form token issued at issued
+func (guard *spamGuard) formSignature(issued string) string {
+	mac := hmac.New(sha256.New, guard.key)
+	mac.Write([]byte(issued))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// formToken returns a token for a form shown at now
+func (guard *spamGuard) formToken(now time.Time) string {
+	issued := strconv.FormatInt(now.UnixMilli(), 10)
+	return issued + "." + guard.formSignature(issued)
+}
+
+// formShownAt returns when the form with token was shown, if token is one
+// this server issued
+func (guard *spamGuard) formShownAt(token string) (time.Time, bool) {
+	issued, signature, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(guard.formSignature(issued))) {
+		return time.Time{}, false
+	}
+	millis, err := strconv.ParseInt(issued, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.UnixMilli(millis), true
+}
+
+// check screens a message sent through form by author. A message the spam
+// check service couldn't be asked about is let through.
+func (guard *spamGuard) check(request *http.Request, form string, fields spamFields, author, message string) spamVerdict {
+	if fields.Website != "" {
+		return spamVerdict{Kind: spamBot, Reason: "filled in the hidden field"}
+	}
+	if *formMinTime > 0 {
+		// Without a current token there is no telling how long the form
+		// took, so it isn't counted against the message
+		if shown, ok := guard.formShownAt(fields.FormToken); ok {
+			if age := time.Since(shown); age >= 0 && age <= maxFormAge && age < *formMinTime {
+				return spamVerdict{Kind: spamBot, Reason: "sent too quickly"}
+			}
+		}
+	}
+	if links := len(linkPattern.FindAllStringIndex(message, -1)); *maxLinks >= 0 && links > *maxLinks {
+		return spamVerdict{Kind: spamSuspect, Reason: fmt.Sprintf("has %d links", links)}
+	}
+	if guard.checker != nil {
+		reply, err := guard.checker.Check(request.Context(), spamCheck{
+			Form:      form,
+			Author:    author,
+			Message:   message,
+			IP:        clientIP(request),
+			UserAgent: request.UserAgent(),
+		})
+		if err != nil {
+			slog.Warn("Unable to check message for spam", "form", form, "err", err)
+			return spamVerdict{}
+		}
+		if reply.Spam {
+			reason := reply.Reason
+			if reason == "" {
+				reason = "flagged by the spam check"
+			}
+			return spamVerdict{Kind: spamSuspect, Reason: reason}
+		}
+	}
+	return spamVerdict{}
+}
+
+// formToken is what a form is given when it is shown
+type formToken struct {
+	Token string `json:"token"`
+}
+
+// formTokenHandler hands a form the token it sends back as formToken
+func (s *server) formTokenHandler(response http.ResponseWriter, request *http.Request) {
+	response.Header().Set("Cache-Control", "no-store")
+	writeJSON(response, http.StatusOK, formToken{Token: s.spam.formToken(time.Now())})
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Where the Spotify Web API is
+const (
+	spotifyTokenURL  = "https://accounts.spotify.com/api/token"
+	spotifySearchURL = "https://api.spotify.com/v1/search"
+)
+
+// spotifyTrack is a song found on Spotify
+type spotifyTrack struct {
+	ID       string
+	Title    string
+	Artist   string
+	ArtistID string
+	URL      string
+}
+
+// spotifyClient looks songs up on Spotify with the app's client
+// credentials, which only reach the public catalogue
+type spotifyClient struct {
+	id     string
+	secret string
+	client *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// newSpotifyClient returns a client for the Spotify app set up in the
+// config, or nil if there isn't one
+func newSpotifyClient() *spotifyClient {
+	if *spotifyClientID == "" || *spotifySecret == "" {
+		return nil
+	}
+	return &spotifyClient{id: *spotifyClientID, secret: *spotifySecret, client: &http.Client{Timeout: 5 * time.Second}}
+}
+
+// accessToken returns a token for the API, fetching a new one when the last
+// has run out
+func (spotify *spotifyClient) accessToken(ctx context.Context) (string, error) {
+	spotify.mu.Lock()
+	defer spotify.mu.Unlock()
+
+	if spotify.token != "" && time.Now().Before(spotify.expires) {
+		return spotify.token, nil
+	}
+	form := url.Values{"grant_type": {"client_credentials"}}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, spotifyTokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.SetBasicAuth(spotify.id, spotify.secret)
+
+	response, err := spotify.client.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("spotify token request returned %s", response.Status)
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(io.LimitReader(response.Body, 1<<20)).Decode(&token); err != nil {
+		return "", fmt.Errorf("spotify token reply: %w", err)
+	}
+	spotify.token = token.AccessToken
+	// Renew a minute early so a token doesn't run out on the way
+	spotify.expires = time.Now().Add(time.Duration(token.ExpiresIn)*time.Second - time.Minute)
+	return spotify.token, nil
+}
+
+// Find returns the best match on Spotify for a song, or nil if there is
+// none
+func (spotify *spotifyClient) Find(ctx context.Context, title, artist string) (*spotifyTrack, error) {
+	token, err := spotify.accessToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	search := "track:" + title
+	if artist != "" {
+		search += " artist:" + artist
+	}
+	query := url.Values{"q": {search}, "type": {"track"}, "limit": {"1"}}
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, spotifySearchURL+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Authorization", "Bearer "+token)
+
+	response, err := spotify.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("spotify search returned %s", response.Status)
+	}
+	var results struct {
+		Tracks struct {
+			Items []struct {
+				ID           string `json:"id"`
+				Name         string `json:"name"`
+				ExternalURLs struct {
+					Spotify string `json:"spotify"`
+				} `json:"external_urls"`
+				Artists []struct {
+					ID   string `json:"id"`
+					Name string `json:"name"`
+				} `json:"artists"`
+			} `json:"items"`
+		} `json:"tracks"`
+	}
+	if err := json.NewDecoder(io.LimitReader(response.Body, 1<<20)).Decode(&results); err != nil {
+		return nil, fmt.Errorf("spotify search reply: %w", err)
+	}
+	if len(results.Tracks.Items) == 0 {
+		return nil, nil
+	}
+	item := results.Tracks.Items[0]
+	track := &spotifyTrack{ID: item.ID, Title: item.Name, URL: item.ExternalURLs.Spotify}
+	if len(item.Artists) > 0 {
+		track.Artist, track.ArtistID = item.Artists[0].Name, item.Artists[0].ID
+	}
+	return track, nil
+}
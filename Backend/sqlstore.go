@@ -0,0 +1,550 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+	_ "modernc.org/sqlite"
+)
+
+// photoColumns are the columns of the photos table, in the order
+// scanPhoto and photoValues use
+const photoColumns = `id, kind, file, original_filename, directory, uploader, uploader_key, caption, event, album,
+	hash, content_type, status, size, uploaded_at, review_reason, taken_at,
+	camera_make, camera_model, width, height, orientation, perceptual_hash, photo_group, video, variants,
+	quota_key, quota_size`
+
+// sqlPhotoStore keeps the photo index in a SQL database. The same queries
+// work on SQLite and PostgreSQL, and each has its own migrations.
+type sqlPhotoStore struct {
+	db *sql.DB
+	// fts is whether the database has a full text index of the photos,
+	// which only the SQLite schema does
+	fts bool
+
+	// mu stops two photos being grouped at once, since grouping reads every
+	// photo and then updates two of them
+	mu sync.Mutex
+}
+
+// sqlitePhotoStore is a sqlPhotoStore in a SQLite database file
+type sqlitePhotoStore struct {
+	*sqlPhotoStore
+}
+
+// openSQLitePhotoStore opens the SQLite database at path, creating it and
+// bringing its schema up to date as needed
+func openSQLitePhotoStore(path string) (*sqlitePhotoStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_time_format=sqlite")
+	if err != nil {
+		return nil, err
+	}
+	// SQLite only allows one writer at a time anyway, and a single
+	// connection means writes queue up here rather than failing as busy
+	db.SetMaxOpenConns(1)
+	if err := runMigrations(db, "sqlite"); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqlitePhotoStore{&sqlPhotoStore{db: db, fts: true}}, nil
+}
+
+// openPostgresPhotoStore connects to the PostgreSQL database at url and
+// brings its schema up to date
+func openPostgresPhotoStore(url string) (*sqlPhotoStore, error) {
+	if url == "" {
+		return nil, errors.New("DATABASE_URL must be set to keep metadata in PostgreSQL")
+	}
+	db, err := sql.Open("pgx", url)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := runMigrations(db, "postgres"); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqlPhotoStore{db: db}, nil
+}
+
+// rowScanner is a *sql.Row or *sql.Rows
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// scanPhoto reads a photo from a row of photoColumns
+func scanPhoto(row rowScanner) (*Photo, error) {
+	var photo Photo
+	var takenAt sql.NullTime
+	var video sql.NullString
+	var variants string
+	err := row.Scan(&photo.ID, &photo.Kind, &photo.File, &photo.OriginalFilename, &photo.Directory,
+		&photo.Uploader, &photo.UploaderKey, &photo.Caption, &photo.Event, &photo.Album, &photo.Hash, &photo.ContentType, &photo.Status,
+		&photo.Size, &photo.UploadedAt, &photo.ReviewReason, &takenAt, &photo.CameraMake,
+		&photo.CameraModel, &photo.Width, &photo.Height, &photo.Orientation, &photo.PerceptualHash, &photo.Group, &video, &variants,
+		&photo.QuotaKey, &photo.QuotaSize)
+	if err != nil {
+		return nil, err
+	}
+
+	if takenAt.Valid {
+		photo.TakenAt = &takenAt.Time
+	}
+	if video.Valid {
+		photo.Video = &VideoInfo{}
+		if err := json.Unmarshal([]byte(video.String), photo.Video); err != nil {
+			return nil, err
+		}
+	}
+	if err := json.Unmarshal([]byte(variants), &photo.Variants); err != nil {
+		return nil, err
+	}
+	if photo.Variants == nil {
+		photo.Variants = map[string]string{}
+	}
+	return &photo, nil
+}
+
+// photoValues returns the values of photoColumns for photo
+func photoValues(photo *Photo) ([]any, error) {
+	var takenAt sql.NullTime
+	if photo.TakenAt != nil {
+		takenAt = sql.NullTime{Time: photo.TakenAt.UTC(), Valid: true}
+	}
+	var video sql.NullString
+	if photo.Video != nil {
+		data, err := json.Marshal(photo.Video)
+		if err != nil {
+			return nil, err
+		}
+		video = sql.NullString{String: string(data), Valid: true}
+	}
+	variants, err := json.Marshal(photo.Variants)
+	if err != nil {
+		return nil, err
+	}
+	if photo.Variants == nil {
+		variants = []byte("{}")
+	}
+
+	return []any{photo.ID, photo.Kind, photo.File, photo.OriginalFilename, photo.Directory,
+		photo.Uploader, photo.UploaderKey, photo.Caption, photo.Event, photo.Album, photo.Hash, photo.ContentType, photo.Status,
+		photo.Size, photo.UploadedAt.UTC(), photo.ReviewReason, takenAt, photo.CameraMake,
+		photo.CameraModel, photo.Width, photo.Height, photo.Orientation, photo.PerceptualHash, photo.Group, video, string(variants),
+		photo.QuotaKey, photo.QuotaSize}, nil
+}
+
+// getPhoto returns the first photo matching a query with a WHERE clause
+func (store *sqlPhotoStore) getPhoto(where string, args ...any) (*Photo, bool) {
+	row := store.db.QueryRow(`SELECT `+photoColumns+` FROM photos WHERE `+where, args...)
+	photo, err := scanPhoto(row)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			slog.Error("Unable to read photo index", "err", err)
+		}
+		return nil, false
+	}
+	return photo, true
+}
+
+// queryPhotos returns the photos matching a query that follows the SELECT
+func (store *sqlPhotoStore) queryPhotos(query string, args ...any) []*Photo {
+	rows, err := store.db.Query(`SELECT `+photoColumns+` FROM photos `+query, args...)
+	if err != nil {
+		slog.Error("Unable to read photo index", "err", err)
+		return nil
+	}
+	defer rows.Close()
+
+	var photos []*Photo
+	for rows.Next() {
+		photo, err := scanPhoto(rows)
+		if err != nil {
+			slog.Error("Unable to read photo index", "err", err)
+			return photos
+		}
+		photos = append(photos, photo)
+	}
+	if err := rows.Err(); err != nil {
+		slog.Error("Unable to read photo index", "err", err)
+	}
+	return photos
+}
+
+func (store *sqlPhotoStore) Get(id string) (*Photo, bool) {
+	return store.getPhoto(`id = $1`, id)
+}
+
+func (store *sqlPhotoStore) All() []*Photo {
+	return store.queryPhotos(`ORDER BY uploaded_at, id`)
+}
+
+func (store *sqlPhotoStore) WithStatus(status string) []*Photo {
+	return store.queryPhotos(`WHERE status = $1 ORDER BY uploaded_at, id`, status)
+}
+
+func (store *sqlPhotoStore) FindByHash(hash string) (*Photo, bool) {
+	return store.getPhoto(`hash = $1`, hash)
+}
+
+func (store *sqlPhotoStore) Add(photo *Photo) (*Photo, bool, error) {
+	values, err := photoValues(photo)
+	if err != nil {
+		return nil, false, err
+	}
+	placeholders := make([]string, len(values))
+	for i := range values {
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+	}
+
+	result, err := store.db.Exec(`INSERT INTO photos (`+photoColumns+`) VALUES (`+strings.Join(placeholders, ", ")+`)
+		ON CONFLICT (hash) DO NOTHING`, values...)
+	if err != nil {
+		return nil, false, err
+	}
+	if inserted, err := result.RowsAffected(); err != nil || inserted > 0 {
+		return photo, err == nil, err
+	}
+
+	existing, ok := store.FindByHash(photo.Hash)
+	if !ok {
+		return nil, false, errors.New("photo with the same hash has gone")
+	}
+	return existing, false, nil
+}
+
+func (store *sqlPhotoStore) Update(photo *Photo) error {
+	values, err := photoValues(photo)
+	if err != nil {
+		return err
+	}
+	columns := strings.Split(photoColumns, ",")
+	assignments := make([]string, 0, len(columns)-1)
+	for i, column := range columns[1:] {
+		assignments = append(assignments, fmt.Sprintf("%s = $%d", strings.TrimSpace(column), i+2))
+	}
+
+	result, err := store.db.Exec(`UPDATE photos SET `+strings.Join(assignments, ", ")+` WHERE id = $1`, values...)
+	if err != nil {
+		return err
+	}
+	if updated, err := result.RowsAffected(); err != nil || updated == 0 {
+		if err == nil {
+			err = os.ErrNotExist
+		}
+		return err
+	}
+	return nil
+}
+
+func (store *sqlPhotoStore) UpdateProcessed(photo *Photo) (bool, error) {
+	variants, err := json.Marshal(photo.Variants)
+	if err != nil {
+		return false, err
+	}
+	if photo.Variants == nil {
+		variants = []byte("{}")
+	}
+	tx, err := store.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`UPDATE photos SET file = $2, directory = $3, content_type = $4,
+		width = $5, height = $6, orientation = $7, perceptual_hash = $8, variants = $9 WHERE id = $1`,
+		photo.ID, photo.File, photo.Directory, photo.ContentType,
+		photo.Width, photo.Height, photo.Orientation, photo.PerceptualHash, string(variants))
+	if err != nil {
+		return false, err
+	}
+	if updated, err := result.RowsAffected(); err != nil || updated == 0 {
+		if err == nil {
+			err = os.ErrNotExist
+		}
+		return false, err
+	}
+	// The status is only set if the couple hasn't given the photo one while
+	// it was processed
+	result, err = tx.Exec(`UPDATE photos SET status = $2, review_reason = $3 WHERE id = $1 AND status = $4`,
+		photo.ID, photo.Status, photo.ReviewReason, photoProcessing)
+	if err != nil {
+		return false, err
+	}
+	processing, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return processing > 0, tx.Commit()
+}
+
+func (store *sqlPhotoStore) Remove(id string) error {
+	result, err := store.db.Exec(`DELETE FROM photos WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if removed, err := result.RowsAffected(); err != nil || removed == 0 {
+		if err == nil {
+			err = os.ErrNotExist
+		}
+		return err
+	}
+	if _, err := store.db.Exec(`DELETE FROM likes WHERE photo_id = $1`, id); err != nil {
+		slog.Error("Unable to remove likes", "photo", id, "err", err)
+	}
+	if _, err := store.db.Exec(`DELETE FROM comments WHERE photo_id = $1`, id); err != nil {
+		slog.Error("Unable to remove comments", "photo", id, "err", err)
+	}
+	if err := store.ClearReports(id); err != nil {
+		slog.Error("Unable to remove reports", "photo", id, "err", err)
+	}
+	return nil
+}
+
+func (store *sqlPhotoStore) Uses(name, except string) bool {
+	// Narrow it down in the database, then check the files properly. A
+	// variant name is matched inside the JSON of the variants column.
+	quoted, _ := json.Marshal(name)
+	candidates := store.queryPhotos(`WHERE id != $1 AND (file = $2 OR variants LIKE $3)`,
+		except, filepath.Base(name), "%"+string(quoted)+"%")
+	for _, photo := range candidates {
+		for _, file := range photo.files() {
+			if file == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (store *sqlPhotoStore) GroupSimilar(photo *Photo, maxDistance int) error {
+	hash, ok := parsePerceptualHash(photo.PerceptualHash)
+	if !ok {
+		return nil
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	rows, err := store.db.Query(`SELECT id, perceptual_hash, photo_group FROM photos WHERE perceptual_hash != '' AND id != $1`, photo.ID)
+	if err != nil {
+		return err
+	}
+	var closestID, closestGroup string
+	closestDistance := maxDistance + 1
+	for rows.Next() {
+		var id, perceptualHash, group string
+		if err := rows.Scan(&id, &perceptualHash, &group); err != nil {
+			rows.Close()
+			return err
+		}
+		otherHash, ok := parsePerceptualHash(perceptualHash)
+		if !ok {
+			continue
+		}
+		if distance := hashDistance(hash, otherHash); distance < closestDistance {
+			closestID, closestGroup, closestDistance = id, group, distance
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if closestID == "" {
+		return nil
+	}
+
+	if closestGroup == "" {
+		closestGroup = closestID
+		if _, err := store.db.Exec(`UPDATE photos SET photo_group = $1 WHERE id = $1`, closestID); err != nil {
+			return err
+		}
+	}
+	photo.Group = closestGroup
+	_, err = store.db.Exec(`UPDATE photos SET photo_group = $1 WHERE id = $2`, photo.Group, photo.ID)
+	return err
+}
+
+// Snapshot writes a consistent copy of the database to path, which must not
+// exist yet
+func (store *sqlitePhotoStore) Snapshot(path string) error {
+	_, err := store.db.Exec(`VACUUM INTO $1`, path)
+	return err
+}
+
+func (store *sqlPhotoStore) List(query photoQuery) ([]*Photo, error) {
+	var conditions []string
+	var args []any
+	where := func(condition string, values ...any) {
+		for _, value := range values {
+			args = append(args, value)
+			condition = strings.Replace(condition, "?", fmt.Sprintf("$%d", len(args)), 1)
+		}
+		conditions = append(conditions, condition)
+	}
+	if query.Status != "" {
+		where(`status = ?`, query.Status)
+	}
+	if query.Event != "" {
+		where(`event = ?`, query.Event)
+	}
+	if query.Uploader != "" {
+		where(`LOWER(uploader) = LOWER(?)`, query.Uploader)
+	}
+	if query.UploaderKey != "" {
+		where(`uploader_key = ?`, query.UploaderKey)
+	}
+	if query.Album != "" {
+		where(`album = ?`, query.Album)
+	}
+	if len(query.HiddenAlbums) > 0 {
+		values := make([]any, len(query.HiddenAlbums))
+		for i, album := range query.HiddenAlbums {
+			values[i] = album
+		}
+		where(`album NOT IN (?`+strings.Repeat(`, ?`, len(values)-1)+`)`, values...)
+	}
+	if words := searchWords(query.Text); len(words) > 0 {
+		if store.fts {
+			where(`id IN (SELECT photo_id FROM photo_search WHERE photo_search MATCH ?)`, ftsQuery(words))
+		} else {
+			for _, word := range words {
+				pattern := likePattern(word)
+				where(`(LOWER(caption) LIKE ? ESCAPE '\' OR LOWER(uploader) LIKE ? ESCAPE '\'
+					OR id IN (SELECT photo_id FROM comments WHERE LOWER(body) LIKE ? ESCAPE '\'))`, pattern, pattern, pattern)
+			}
+		}
+	}
+	if !query.From.IsZero() {
+		where(`COALESCE(taken_at, uploaded_at) >= ?`, query.From.UTC())
+	}
+	if !query.To.IsZero() {
+		where(`COALESCE(taken_at, uploaded_at) < ?`, query.To.UTC())
+	}
+	sortColumn, direction, comparison := `uploaded_at`, `DESC`, `<`
+	if query.Sort == sortTaken {
+		sortColumn, direction, comparison = `COALESCE(taken_at, uploaded_at)`, `ASC`, `>`
+	}
+	if query.After != nil {
+		last := query.After.Time.UTC()
+		where(`(`+sortColumn+` `+comparison+` ? OR (`+sortColumn+` = ? AND id `+comparison+` ?))`, last, last, query.After.ID)
+	}
+
+	statement := `SELECT ` + photoColumns + ` FROM photos`
+	if len(conditions) > 0 {
+		statement += ` WHERE ` + strings.Join(conditions, ` AND `)
+	}
+	statement += ` ORDER BY ` + sortColumn + ` ` + direction + `, id ` + direction
+	if query.Limit > 0 {
+		statement += fmt.Sprintf(` LIMIT %d`, query.Limit)
+	}
+
+	rows, err := store.db.Query(statement, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var photos []*Photo
+	for rows.Next() {
+		photo, err := scanPhoto(rows)
+		if err != nil {
+			return nil, err
+		}
+		photos = append(photos, photo)
+	}
+	return photos, rows.Err()
+}
+
+// importJSONPhotos moves the photos of a JSON index at jsonPath into store,
+// along with their likes, comments and reports, if store is still empty. The
+// JSON files are renamed once they are imported so they aren't mistaken for
+// the current index.
+func importJSONPhotos(store *sqlPhotoStore, jsonPath string) error {
+	if _, err := os.Stat(jsonPath); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	var count int
+	if err := store.db.QueryRow(`SELECT COUNT(*) FROM photos`).Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	old, err := openJSONPhotoStore(jsonPath)
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", jsonPath, err)
+	}
+	started := time.Now()
+	photos := old.All()
+	for _, photo := range photos {
+		if _, _, err := store.Add(photo); err != nil {
+			return fmt.Errorf("importing %s: %w", photo.ID, err)
+		}
+	}
+	// Likes, comments and reports of photos that are no longer in the index
+	// are left behind
+	likes := 0
+	for photoID, likers := range old.likes {
+		if _, ok := old.photos[photoID]; !ok {
+			continue
+		}
+		for liker, likedAt := range likers {
+			if _, err := store.db.Exec(`INSERT INTO likes (photo_id, liker, liked_at) VALUES ($1, $2, $3)
+				ON CONFLICT (photo_id, liker) DO NOTHING`, photoID, liker, likedAt.UTC()); err != nil {
+				return fmt.Errorf("importing likes of %s: %w", photoID, err)
+			}
+			likes++
+		}
+	}
+	comments := 0
+	for photoID, photoComments := range old.comments {
+		for _, comment := range photoComments {
+			err := store.AddComment(comment)
+			if errors.Is(err, os.ErrNotExist) {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("importing comments on %s: %w", photoID, err)
+			}
+			comments++
+		}
+	}
+	reports := 0
+	for photoID, photoReports := range old.reports {
+		for _, report := range photoReports {
+			_, err := store.AddReport(report)
+			if errors.Is(err, os.ErrNotExist) {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("importing reports of %s: %w", photoID, err)
+			}
+			reports++
+		}
+	}
+	slog.Info("Imported photos", "photos", len(photos), "likes", likes, "comments", comments, "reports", reports,
+		"file", jsonPath, "duration", time.Since(started))
+
+	for _, path := range []string{old.likesPath(), old.commentsPath(), old.reportsPath()} {
+		if err := os.Rename(path, path+".imported"); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return os.Rename(jsonPath, jsonPath+".imported")
+}
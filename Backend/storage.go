@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Storage is where uploaded files and their variants are kept. Files are
+// named with slash separated keys relative to the root of the store, such as
+// "videos/<id>.mov". Missing files are reported with errors matching
+// fs.ErrNotExist.
+type Storage interface {
+	// Put stores content under name, replacing anything already there
+	Put(ctx context.Context, name string, content io.Reader) error
+	// Get opens the file stored under name
+	Get(ctx context.Context, name string) (io.ReadCloser, error)
+	// Stat describes the file stored under name
+	Stat(ctx context.Context, name string) (ObjectInfo, error)
+	// List describes every file whose name starts with prefix
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+	// Delete removes the file stored under name. Deleting a file that
+	// doesn't exist is not an error.
+	Delete(ctx context.Context, name string) error
+}
+
+// ObjectInfo describes a stored file
+type ObjectInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// errInvalidName is returned for storage keys that could escape the store
+var errInvalidName = errors.New("invalid storage name")
+
+// newStorage returns the storage backend chosen in the config
+func newStorage(ctx context.Context) (Storage, error) {
+	return openStorage(ctx, *storageBackend, *uploadDir)
+}
+
+// openStorage returns a store of the given backend. Local stores keep their
+// files in dir, the others are set up from their own config.
+func openStorage(ctx context.Context, backend, dir string) (Storage, error) {
+	switch backend {
+	case "local":
+		return &localStorage{dir: dir}, nil
+	case "s3":
+		return newS3Storage(ctx)
+	case "gcs":
+		return newGCSStorage(ctx)
+	}
+	return nil, fmt.Errorf("unknown storage backend %q", backend)
+}
+
+// storageContentType is the content type a stored file should be served
+// with, going by its extension
+func storageContentType(name string) string {
+	if contentType := mime.TypeByExtension(path.Ext(name)); contentType != "" {
+		return contentType
+	}
+	switch strings.ToLower(path.Ext(name)) {
+	case ".heic":
+		return "image/heic"
+	case ".webp":
+		return "image/webp"
+	}
+	return "application/octet-stream"
+}
+
+// cleanStorageName checks that name is a relative key that stays inside the
+// store. Every backend goes through it, so it is the one place names are
+// checked before they reach a disk path or a bucket. Names are made by the
+// server rather than taken from requests, so anything unusual is turned away
+// rather than made safe: ".." anywhere, even percent-encoded, absolute paths,
+// drive letters, and control characters such as NUL.
+func cleanStorageName(name string) (string, error) {
+	if name == "" {
+		return "", errInvalidName
+	}
+	// A name that still decodes to something else could be decoded again on
+	// its way to a disk path or a URL, so each decoding is checked too
+	for candidate := name; ; {
+		if unsafeStorageName(candidate) {
+			return "", errInvalidName
+		}
+		decoded, err := url.PathUnescape(candidate)
+		if err != nil || decoded == candidate {
+			break
+		}
+		candidate = decoded
+	}
+	cleaned := path.Clean(strings.ReplaceAll(name, "\\", "/"))
+	if cleaned == "." {
+		return "", errInvalidName
+	}
+	return cleaned, nil
+}
+
+// unsafeStorageName reports whether name could point outside the store
+func unsafeStorageName(name string) bool {
+	if strings.ContainsFunc(name, unicode.IsControl) {
+		return true
+	}
+	slashed := strings.ReplaceAll(name, "\\", "/")
+	if path.IsAbs(slashed) || (len(slashed) >= 2 && slashed[1] == ':') {
+		return true
+	}
+	for _, segment := range strings.Split(slashed, "/") {
+		if segment == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// localStorage keeps files in a directory on the local disk
+type localStorage struct {
+	dir string
+}
+
+// path returns where name is kept on disk
+func (storage *localStorage) path(name string) (string, error) {
+	cleaned, err := cleanStorageName(name)
+	if err != nil {
+		return "", err
+	}
+	// Checked again once it is a disk path, in case the name slipped past
+	full := filepath.Join(storage.dir, filepath.FromSlash(cleaned))
+	relative, err := filepath.Rel(storage.dir, full)
+	if err != nil || !filepath.IsLocal(relative) {
+		return "", errInvalidName
+	}
+	return full, nil
+}
+
+func (storage *localStorage) Put(ctx context.Context, name string, content io.Reader) error {
+	destPath, err := storage.path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(destPath), os.ModePerm); err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so readers never see half a file
+	tmp, err := os.CreateTemp(filepath.Dir(destPath), ".put-*")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmp, content)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), destPath)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func (storage *localStorage) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	srcPath, err := storage.path(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(srcPath)
+}
+
+func (storage *localStorage) GetRange(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	file, err := storage.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.(*os.File).Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if length < 0 {
+		return file, nil
+	}
+	return readCloser{io.LimitReader(file, length), file}, nil
+}
+
+func (storage *localStorage) Stat(ctx context.Context, name string) (ObjectInfo, error) {
+	srcPath, err := storage.path(name)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	info, err := os.Stat(srcPath)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if info.IsDir() {
+		return ObjectInfo{}, fs.ErrNotExist
+	}
+	return ObjectInfo{Name: name, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+// List walks the directory for files under prefix. Hidden files and
+// directories, which hold uploads in progress, are skipped.
+func (storage *localStorage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	err := filepath.WalkDir(storage.dir, func(walkPath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if walkPath != storage.dir && strings.HasPrefix(entry.Name(), ".") {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+
+		relative, err := filepath.Rel(storage.dir, walkPath)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(relative)
+		if !strings.HasPrefix(name, prefix) {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		objects = append(objects, ObjectInfo{Name: name, Size: info.Size(), ModTime: info.ModTime()})
+		return ctx.Err()
+	})
+	return objects, err
+}
+
+func (storage *localStorage) Delete(ctx context.Context, name string) error {
+	destPath, err := storage.path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(destPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// readStored reads the whole of a stored file
+func readStored(ctx context.Context, storage Storage, name string) ([]byte, error) {
+	file, err := storage.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+// putFile stores the content of a local file, from its start
+func putFile(ctx context.Context, storage Storage, name string, file *os.File) error {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return storage.Put(ctx, name, file)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// storageRescan is how often the size of everything stored is measured
+// again, to pick up the variants made in the background and anything removed
+const storageRescan = time.Minute
+
+// storageQuota caps the total size of everything stored, so uploads are
+// turned away cleanly once the cap is reached rather than failing at random
+// when the disk fills up
+type storageQuota struct {
+	mu      sync.Mutex
+	storage Storage
+	limit   int64
+	used    int64
+}
+
+// newStorageQuota measures storage and keeps measuring it in the background.
+// A limit of 0 means there is no cap.
+func newStorageQuota(storage Storage, limit int64) *storageQuota {
+	quota := &storageQuota{storage: storage, limit: limit}
+	if limit > 0 {
+		quota.measure()
+		go func() {
+			for range time.Tick(storageRescan) {
+				quota.measure()
+			}
+		}()
+	}
+	return quota
+}
+
+// measure adds up the size of every stored file
+func (quota *storageQuota) measure() {
+	objects, err := quota.storage.List(context.Background(), "")
+	if err != nil {
+		slog.Error("Unable to measure storage", "err", err)
+		return
+	}
+	var used int64
+	for _, object := range objects {
+		used += object.Size
+	}
+
+	quota.mu.Lock()
+	quota.used = used
+	quota.mu.Unlock()
+}
+
+// Reserve counts size bytes as used, or reports false if they don't fit.
+// Uploads that fail after reserving are corrected by the next measurement.
+func (quota *storageQuota) Reserve(size int64) bool {
+	if quota.limit <= 0 {
+		return true
+	}
+
+	quota.mu.Lock()
+	defer quota.mu.Unlock()
+
+	if quota.used+size > quota.limit {
+		return false
+	}
+	quota.used += size
+	return true
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestStorageNames(t *testing.T) {
+	root := t.TempDir()
+	storage := &localStorage{dir: root}
+
+	tests := []struct {
+		name string
+		// unsafe is what unsafeStorageName says of the name as it is
+		unsafe bool
+		// want is where the name is kept under root, or empty if it is
+		// rejected
+		want string
+	}{
+		{name: "2024/photo.jpg", want: "2024/photo.jpg"},
+		{name: "a//b/./photo.jpg", want: "a/b/photo.jpg"},
+		{name: `thumbs\medium.webp`, want: "thumbs/medium.webp"},
+		{name: "100%25.jpg", want: "100%25.jpg"},
+		{name: ""},
+		{name: "."},
+		{name: "../x", unsafe: true},
+		{name: "a/../../x", unsafe: true},
+		{name: "..", unsafe: true},
+		{name: "..%2fx"},
+		{name: "..%2Fx"},
+		{name: "%2e%2e/x"},
+		{name: "%252e%252e/x"},
+		{name: "a/%252e%252e%252f%252e%252e/x"},
+		{name: `..\x`, unsafe: true},
+		{name: `a\..\..\x`, unsafe: true},
+		{name: `..%5cx`},
+		{name: "/etc/passwd", unsafe: true},
+		{name: `\etc\passwd`, unsafe: true},
+		{name: `\\server\share\x`, unsafe: true},
+		{name: "C:/Windows/x", unsafe: true},
+		{name: `C:\Windows\x`, unsafe: true},
+		{name: "%2fetc/passwd"},
+		{name: "photo.jpg\x00.txt", unsafe: true},
+		{name: "photo.jpg%00.txt"},
+		{name: "line\nbreak.jpg", unsafe: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if unsafe := unsafeStorageName(test.name); unsafe != test.unsafe {
+				t.Errorf("unsafeStorageName(%q) = %v, want %v", test.name, unsafe, test.unsafe)
+			}
+
+			cleaned, err := cleanStorageName(test.name)
+			if test.want == "" {
+				if !errors.Is(err, errInvalidName) {
+					t.Errorf("cleanStorageName(%q) = %q, %v, want errInvalidName", test.name, cleaned, err)
+				}
+			} else if err != nil || cleaned != test.want {
+				t.Errorf("cleanStorageName(%q) = %q, %v, want %q", test.name, cleaned, err, test.want)
+			}
+
+			full, err := storage.path(test.name)
+			if test.want == "" {
+				if !errors.Is(err, errInvalidName) {
+					t.Errorf("path(%q) = %q, %v, want errInvalidName", test.name, full, err)
+				}
+				return
+			}
+			if want := filepath.Join(root, filepath.FromSlash(test.want)); err != nil || full != want {
+				t.Errorf("path(%q) = %q, %v, want %q", test.name, full, err, want)
+			}
+			if relative, err := filepath.Rel(root, full); err != nil || !filepath.IsLocal(relative) {
+				t.Errorf("path(%q) = %q, which isn't under %q", test.name, full, root)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// With domains in the config the site serves HTTPS itself, with certificates
+// from Let's Encrypt fetched and renewed as they are needed, so it can face
+// guests without a reverse proxy in front of it. Plain HTTP is then only
+// answered to prove the domains are ours and to send guests to HTTPS.
+//
+// Either way, when the server is asked to stop it stops taking new
+// connections and gives the requests in progress, such as uploads from the
+// venue, a while to finish so a restart on the day doesn't cut files short.
+
+// Addresses listened on for HTTPS
+const (
+	httpAddress  = ":80"
+	httpsAddress = ":443"
+)
+
+// newHTTPServer returns a server for handler on address, with the timeouts
+// in the config
+func newHTTPServer(address string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              address,
+		Handler:           handler,
+		ReadHeaderTimeout: *headerTimeout,
+		ReadTimeout:       *readTimeout,
+		WriteTimeout:      *writeTimeout,
+		IdleTimeout:       *idleTimeout,
+	}
+}
+
+// listen serves handler until the server fails or ctx is done: over HTTPS
+// for the domains in the config, or else over plain HTTP on the listen
+// address. Once ctx is done it waits up to the shutdown timeout for the
+// requests in progress to finish.
+func listen(ctx context.Context, handler http.Handler) error {
+	var servers []*http.Server
+	var serve func() error
+	if domains := commaList(*tlsDomains); len(domains) == 0 {
+		server := newHTTPServer(*listenAddress, handler)
+		servers, serve = []*http.Server{server}, server.ListenAndServe
+		address := *listenAddress
+		if strings.HasPrefix(address, ":") {
+			address = "localhost" + address
+		}
+		slog.Info("Server started", "address", "http://"+address)
+	} else {
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(domains...),
+			Cache:      autocert.DirCache(*tlsCacheDir),
+			Email:      *tlsEmail,
+		}
+		// The manager answers Let's Encrypt's challenges on plain HTTP and
+		// redirects every other request to HTTPS
+		redirect := newHTTPServer(httpAddress, manager.HTTPHandler(nil))
+		go func() {
+			if err := redirect.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("HTTP redirect listener failed", "err", err)
+			}
+		}()
+
+		server := newHTTPServer(httpsAddress, handler)
+		server.TLSConfig = manager.TLSConfig()
+		servers = []*http.Server{server, redirect}
+		serve = func() error { return server.ListenAndServeTLS("", "") }
+		slog.Info("Server started", "address", "https://"+domains[0])
+	}
+
+	failed := make(chan error, 1)
+	go func() {
+		failed <- serve()
+	}()
+	select {
+	case err := <-failed:
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("Shutting down, waiting for requests in progress to finish", "timeout", *shutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	var errs []error
+	for _, server := range servers {
+		errs = append(errs, server.Shutdown(shutdownCtx))
+	}
+	return errors.Join(errs...)
+}
+
+// keepWriting lifts the write timeout from a response that takes longer to
+// send than it allows, such as a live stream that lasts as long as the page
+// is open or a zip of the whole gallery
+func keepWriting(response http.ResponseWriter) {
+	// Responses that can't have their deadline changed just keep it
+	_ = http.NewResponseController(response).SetWriteDeadline(time.Time{})
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Limits on what travel information can hold
+const (
+	maxTravelName    = 100
+	maxTravelText    = 200
+	maxTravelDetails = 2000
+)
+
+// Kinds of travel information
+const (
+	// travelHotel is a hotel, usually with a block of rooms held for guests
+	travelHotel = "hotel"
+	// travelShuttle is a shuttle run, such as from the hotel to the venue
+	travelShuttle = "shuttle"
+	// travelParking is somewhere guests can park
+	travelParking = "parking"
+)
+
+// TravelItem is something guests need to know to get to the wedding and
+// stay over: a hotel, a shuttle, or parking
+type TravelItem struct {
+	// ID is made from the name when the item is added, and stays the same if
+	// it is renamed
+	ID      string `json:"id"`
+	Kind    string `json:"kind"`
+	Name    string `json:"name"`
+	Details string `json:"details,omitempty"`
+	Address string `json:"address,omitempty"`
+	URL     string `json:"url,omitempty"`
+	Phone   string `json:"phone,omitempty"`
+	// BookingCode, Rate and BookBy are for hotels with a room block: what to
+	// quote when booking, what a room costs, and when the block is released
+	BookingCode string     `json:"bookingCode,omitempty"`
+	Rate        string     `json:"rate,omitempty"`
+	BookBy      *time.Time `json:"bookBy,omitempty"`
+	// DepartsAt, Pickup and Destination are for shuttles, along with Seats,
+	// how many guests can sign up for one, if it is limited
+	DepartsAt   *time.Time `json:"departsAt,omitempty"`
+	Pickup      string     `json:"pickup,omitempty"`
+	Destination string     `json:"destination,omitempty"`
+	Seats       int        `json:"seats,omitempty"`
+	// Position orders items of the same kind, lowest first. Shuttles are
+	// listed by when they leave.
+	Position int `json:"position"`
+}
+
+// travelStore keeps the travel information
+type travelStore struct {
+	mu    sync.Mutex
+	path  string
+	items []*TravelItem
+}
+
+// openTravelStore loads the travel information saved at path, starting
+// with none if it doesn't exist
+func openTravelStore(path string) (*travelStore, error) {
+	store := &travelStore{path: path}
+
+	if err := loadJSONFile(path, &store.items); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// All returns a copy of every item, in the order they are listed
+func (store *travelStore) All() []TravelItem {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	items := make([]TravelItem, 0, len(store.items))
+	for _, item := range store.items {
+		items = append(items, *item)
+	}
+	slices.SortStableFunc(items, func(a, b TravelItem) int {
+		if a.DepartsAt != nil && b.DepartsAt != nil {
+			if order := a.DepartsAt.Compare(*b.DepartsAt); order != 0 {
+				return order
+			}
+		}
+		return a.Position - b.Position
+	})
+	return items
+}
+
+// Get returns the item with the given ID
+func (store *travelStore) Get(id string) (TravelItem, bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	item := store.find(id)
+	if item == nil {
+		return TravelItem{}, false
+	}
+	return *item, true
+}
+
+// find returns the item with the given ID. The caller must hold store.mu.
+func (store *travelStore) find(id string) *TravelItem {
+	for _, item := range store.items {
+		if item.ID == id {
+			return item
+		}
+	}
+	return nil
+}
+
+// Create adds an item, after the others of its kind unless it is given a
+// position
+func (store *travelStore) Create(item TravelItem, positioned bool) (TravelItem, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	base := slug(item.Name, "travel")
+	item.ID = base
+	for n := 2; store.find(item.ID) != nil; n++ {
+		item.ID = fmt.Sprintf("%s-%d", base, n)
+	}
+	if !positioned {
+		item.Position = 0
+		for _, other := range store.items {
+			if other.Kind == item.Kind {
+				item.Position = max(item.Position, other.Position+1)
+			}
+		}
+	}
+	store.items = append(store.items, &item)
+	if err := store.save(); err != nil {
+		store.items = store.items[:len(store.items)-1]
+		return TravelItem{}, err
+	}
+	return item, nil
+}
+
+// Update changes the item with the given ID, reporting whether there is one.
+// Changes that change returns an error for are thrown away.
+func (store *travelStore) Update(id string, change func(*TravelItem) error) (TravelItem, bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	item := store.find(id)
+	if item == nil {
+		return TravelItem{}, false, nil
+	}
+	changed := *item
+	if err := change(&changed); err != nil {
+		return TravelItem{}, true, err
+	}
+	changed.ID = item.ID
+
+	previous := *item
+	*item = changed
+	if err := store.save(); err != nil {
+		*item = previous
+		return TravelItem{}, true, err
+	}
+	return *item, true, nil
+}
+
+// Delete removes the item with the given ID, reporting whether there was one
+func (store *travelStore) Delete(id string) (bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for i, item := range store.items {
+		if item.ID != id {
+			continue
+		}
+		previous := store.items
+		store.items = slices.Concat(previous[:i], previous[i+1:])
+		if err := store.save(); err != nil {
+			store.items = previous
+			return true, err
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// save writes the travel information to disk. The caller must hold store.mu.
+func (store *travelStore) save() error {
+	return saveJSONFile(store.path, store.items)
+}
+
+// travelRequest is the body of a request to add or change travel
+// information. Fields left out of a change are kept as they are, and empty
+// times are taken off.
+type travelRequest struct {
+	Kind        *string `json:"kind"`
+	Name        *string `json:"name"`
+	Details     *string `json:"details"`
+	Address     *string `json:"address"`
+	URL         *string `json:"url"`
+	Phone       *string `json:"phone"`
+	BookingCode *string `json:"bookingCode"`
+	Rate        *string `json:"rate"`
+	BookBy      *string `json:"bookBy"`
+	DepartsAt   *string `json:"departsAt"`
+	Pickup      *string `json:"pickup"`
+	Destination *string `json:"destination"`
+	Seats       *int    `json:"seats"`
+	Position    *int    `json:"position"`
+}
+
+// apply checks the fields that were given and makes the changes to item
+func (body *travelRequest) apply(item *TravelItem) error {
+	if body.Kind != nil {
+		switch kind := strings.TrimSpace(*body.Kind); kind {
+		case travelHotel, travelShuttle, travelParking:
+			item.Kind = kind
+		default:
+			return errors.New("kind must be hotel, shuttle or parking")
+		}
+	}
+	text := func(field *string, name string, limit int, value *string) error {
+		if field == nil {
+			return nil
+		}
+		trimmed := strings.TrimSpace(*field)
+		if utf8.RuneCountInString(trimmed) > limit {
+			return fmt.Errorf("%s can be at most %d characters", name, limit)
+		}
+		*value = trimmed
+		return nil
+	}
+	for _, err := range []error{
+		text(body.Name, "name", maxTravelName, &item.Name),
+		text(body.Details, "details", maxTravelDetails, &item.Details),
+		text(body.Address, "address", maxTravelText, &item.Address),
+		text(body.Phone, "phone", maxTravelText, &item.Phone),
+		text(body.BookingCode, "bookingCode", maxTravelText, &item.BookingCode),
+		text(body.Rate, "rate", maxTravelText, &item.Rate),
+		text(body.Pickup, "pickup", maxTravelText, &item.Pickup),
+		text(body.Destination, "destination", maxTravelText, &item.Destination),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	if item.Name == "" {
+		return fmt.Errorf("name must be 1 to %d characters", maxTravelName)
+	}
+	if body.URL != nil {
+		item.URL = strings.TrimSpace(*body.URL)
+		if item.URL != "" && !webURL(item.URL) {
+			return errors.New("url must be a web address starting with http:// or https://")
+		}
+	}
+	optionalTime := func(field *string, name string, value **time.Time) error {
+		if field == nil {
+			return nil
+		}
+		*value = nil
+		if *field == "" {
+			return nil
+		}
+		parsed, err := time.Parse(time.RFC3339, *field)
+		if err != nil {
+			return fmt.Errorf("%s must be a time like 2026-06-20T16:00:00-04:00", name)
+		}
+		parsed = parsed.UTC()
+		*value = &parsed
+		return nil
+	}
+	if err := optionalTime(body.BookBy, "bookBy", &item.BookBy); err != nil {
+		return err
+	}
+	if err := optionalTime(body.DepartsAt, "departsAt", &item.DepartsAt); err != nil {
+		return err
+	}
+	if body.Seats != nil {
+		if *body.Seats < 0 {
+			return errors.New("seats can't be negative")
+		}
+		item.Seats = *body.Seats
+	}
+	if body.Position != nil {
+		item.Position = *body.Position
+	}
+
+	// Keep only what goes with the kind of item
+	if item.Kind != travelHotel {
+		item.BookingCode, item.Rate, item.BookBy = "", "", nil
+	}
+	if item.Kind != travelShuttle {
+		item.DepartsAt, item.Pickup, item.Destination, item.Seats = nil, "", "", 0
+	} else if item.DepartsAt == nil {
+		return errors.New("departsAt is required for a shuttle")
+	}
+	return nil
+}
+
+// travelInfo is the travel page: the hotels, shuttles and parking
+type travelInfo struct {
+	Hotels   []travelHotelInfo   `json:"hotels"`
+	Shuttles []travelShuttleInfo `json:"shuttles"`
+	Parking  []TravelItem        `json:"parking"`
+}
+
+// travelHotelInfo is a hotel on the travel page, with how long is left to
+// book a room in its block
+type travelHotelInfo struct {
+	TravelItem
+	// DaysLeft counts down the whole or part days until the room block is
+	// released, and BlockClosed is set once it has been
+	DaysLeft    *int `json:"daysLeft,omitempty"`
+	BlockClosed bool `json:"blockClosed,omitempty"`
+}
+
+// travelShuttleInfo is a shuttle on the travel page, with how many seats
+// are left on it and, for a guest who sent their code, how many they have
+type travelShuttleInfo struct {
+	TravelItem
+	SeatsLeft *int `json:"seatsLeft,omitempty"`
+	Reserved  int  `json:"reserved,omitempty"`
+}
+
+// travelHandler lists the travel information for the travel page. Guests
+// who send their X-Guest-Code are shown the shuttle seats they have.
+func (s *server) travelHandler(response http.ResponseWriter, request *http.Request) {
+	info := travelInfo{Hotels: []travelHotelInfo{}, Shuttles: []travelShuttleInfo{}, Parking: []TravelItem{}}
+	now := time.Now()
+	var household *Household
+	if code := guestCode(request); code != "" {
+		household, _ = s.guests.Lookup(code)
+	}
+	for _, item := range s.travel.All() {
+		switch item.Kind {
+		case travelHotel:
+			hotel := travelHotelInfo{TravelItem: item}
+			if item.BookBy != nil {
+				if left := item.BookBy.Sub(now); left > 0 {
+					days := int(math.Ceil(left.Hours() / 24))
+					hotel.DaysLeft = &days
+				} else {
+					hotel.BlockClosed = true
+				}
+			}
+			info.Hotels = append(info.Hotels, hotel)
+		case travelShuttle:
+			shuttle := travelShuttleInfo{TravelItem: item}
+			if item.Seats > 0 {
+				left := max(item.Seats-s.shuttles.Taken(item.ID, ""), 0)
+				shuttle.SeatsLeft = &left
+			}
+			if household != nil {
+				shuttle.Reserved = s.shuttles.Reserved(item.ID, household.ID)
+			}
+			info.Shuttles = append(info.Shuttles, shuttle)
+		case travelParking:
+			info.Parking = append(info.Parking, item)
+		}
+	}
+	writeJSON(response, http.StatusOK, info)
+}
+
+// errInvalidTravel wraps the reason a change to the travel information was
+// turned away
+type errInvalidTravel struct{ err error }
+
+func (e errInvalidTravel) Error() string { return e.err.Error() }
+
+// createTravelHandler adds a hotel, shuttle, or parking
+func (s *server) createTravelHandler(response http.ResponseWriter, request *http.Request) {
+	var body travelRequest
+	if !decodeJSON(response, request, &body) {
+		return
+	}
+	if body.Kind == nil || body.Name == nil {
+		writeJSONError(response, http.StatusBadRequest, "kind and name are required")
+		return
+	}
+	var item TravelItem
+	if err := body.apply(&item); err != nil {
+		writeJSONError(response, http.StatusBadRequest, err.Error())
+		return
+	}
+	added, err := s.travel.Create(item, body.Position != nil)
+	if err != nil {
+		slog.Error("Unable to save travel information", "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to add travel information")
+		return
+	}
+	writeJSON(response, http.StatusCreated, added)
+}
+
+// updateTravelHandler changes a hotel, shuttle, or parking
+func (s *server) updateTravelHandler(response http.ResponseWriter, request *http.Request) {
+	var body travelRequest
+	if !decodeJSON(response, request, &body) {
+		return
+	}
+	item, ok, err := s.travel.Update(request.PathValue("id"), func(item *TravelItem) error {
+		if err := body.apply(item); err != nil {
+			return errInvalidTravel{err}
+		}
+		return nil
+	})
+	if !ok {
+		writeJSONError(response, http.StatusNotFound, "Travel information not found")
+		return
+	}
+	var invalid errInvalidTravel
+	if errors.As(err, &invalid) {
+		writeJSONError(response, http.StatusBadRequest, invalid.Error())
+		return
+	}
+	if err != nil {
+		slog.Error("Unable to save travel information", "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to update travel information")
+		return
+	}
+	writeJSON(response, http.StatusOK, item)
+}
+
+// deleteTravelHandler takes a hotel, shuttle, or parking off the travel page
+func (s *server) deleteTravelHandler(response http.ResponseWriter, request *http.Request) {
+	ok, err := s.travel.Delete(request.PathValue("id"))
+	if !ok {
+		writeJSONError(response, http.StatusNotFound, "Travel information not found")
+		return
+	}
+	if err != nil {
+		slog.Error("Unable to save travel information", "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to delete travel information")
+		return
+	}
+	response.WriteHeader(http.StatusNoContent)
+}
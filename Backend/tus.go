@@ -0,0 +1,342 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Resumable uploads follow the core tus 1.0.0 protocol (https://tus.io) with
+// the creation and termination extensions. A client creates an upload with
+// POST, sends the bytes with one or more PATCH requests, and after a dropped
+// connection asks for the current offset with HEAD and carries on from there.
+// Once every byte has arrived the file goes through the same pipeline as a
+// regular upload.
+
+const tusVersion = "1.0.0"
+
+// tusInfo is the state of a resumable upload, saved next to its partial data
+type tusInfo struct {
+	ID        string            `json:"id"`
+	Length    int64             `json:"length"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	CreatedAt time.Time         `json:"createdAt"`
+}
+
+// tusStore keeps partial uploads on disk so they survive a server restart
+type tusStore struct {
+	dir string
+
+	mu     sync.Mutex
+	locked map[string]bool
+}
+
+// newTusStore creates a store for partial uploads under dir
+func newTusStore(dir string) (*tusStore, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	return &tusStore{dir: dir, locked: make(map[string]bool)}, nil
+}
+
+func (store *tusStore) dataPath(id string) string {
+	return filepath.Join(store.dir, id)
+}
+
+func (store *tusStore) infoPath(id string) string {
+	return filepath.Join(store.dir, id+".json")
+}
+
+// create starts a new empty upload
+func (store *tusStore) create(info tusInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(store.infoPath(info.ID), data, 0o644); err != nil {
+		return err
+	}
+	return os.WriteFile(store.dataPath(info.ID), nil, 0o644)
+}
+
+// get returns an upload's info and how many bytes of it have been received
+func (store *tusStore) get(id string) (tusInfo, int64, error) {
+	var info tusInfo
+	if !validTusID(id) {
+		return info, 0, os.ErrNotExist
+	}
+	data, err := os.ReadFile(store.infoPath(id))
+	if err != nil {
+		return info, 0, err
+	}
+	if err := json.Unmarshal(data, &info); err != nil {
+		return info, 0, err
+	}
+	stat, err := os.Stat(store.dataPath(id))
+	if err != nil {
+		return info, 0, err
+	}
+	return info, stat.Size(), nil
+}
+
+// remove deletes an upload's partial data and info
+func (store *tusStore) remove(id string) {
+	os.Remove(store.dataPath(id))
+	os.Remove(store.infoPath(id))
+}
+
+// lock claims an upload so two PATCH requests can't write to it at once
+func (store *tusStore) lock(id string) bool {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.locked[id] {
+		return false
+	}
+	store.locked[id] = true
+	return true
+}
+
+func (store *tusStore) unlock(id string) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	delete(store.locked, id)
+}
+
+// validTusID reports whether id could have come from randomHex, so it is
+// safe to use as a file name
+func validTusID(id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, c := range id {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// setTusHeaders adds the headers every tus response carries
+func setTusHeaders(response http.ResponseWriter) {
+	response.Header().Set("Tus-Resumable", tusVersion)
+}
+
+// tusOptionsHandler describes what the server supports
+func (s *server) tusOptionsHandler(response http.ResponseWriter, request *http.Request) {
+	setTusHeaders(response)
+	response.Header().Set("Tus-Version", tusVersion)
+	response.Header().Set("Tus-Extension", "creation,termination")
+	response.Header().Set("Tus-Max-Size", strconv.FormatInt(maxRequestSize(), 10))
+	response.WriteHeader(http.StatusNoContent)
+}
+
+// tusCreateHandler starts a resumable upload and returns its URL in the
+// Location header
+func (s *server) tusCreateHandler(response http.ResponseWriter, request *http.Request) {
+	setTusHeaders(response)
+
+	length, err := strconv.ParseInt(request.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(response, "missing or invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+	if length > maxRequestSize() {
+		http.Error(response, "file is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// The code is checked when the upload is created, and kept with it so
+	// the finished upload is credited to the right guest
+	metadata := parseTusMetadata(request.Header.Get("Upload-Metadata"))
+	code := guestCode(request)
+	if code == "" {
+		code = metadata["code"]
+	}
+	household, err := s.authorizeGuest(request, code)
+	if err != nil {
+		writeUploadError(response, metadata["filename"], err)
+		return
+	}
+	delete(metadata, "code")
+	if household != nil {
+		metadata["code"] = household.Code
+	}
+
+	info := tusInfo{
+		ID:        randomHex(16),
+		Length:    length,
+		Metadata:  metadata,
+		CreatedAt: time.Now(),
+	}
+	if err := s.tus.create(info); err != nil {
+		http.Error(response, "Unable to create upload", http.StatusInternalServerError)
+		return
+	}
+
+	response.Header().Set("Location", strings.TrimSuffix(request.URL.Path, "/")+"/"+info.ID)
+	response.WriteHeader(http.StatusCreated)
+}
+
+// tusHeadHandler reports how much of an upload the server has
+func (s *server) tusHeadHandler(response http.ResponseWriter, request *http.Request) {
+	setTusHeaders(response)
+	response.Header().Set("Cache-Control", "no-store")
+
+	info, offset, err := s.tus.get(request.PathValue("id"))
+	if err != nil {
+		response.WriteHeader(http.StatusNotFound)
+		return
+	}
+	response.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	response.Header().Set("Upload-Length", strconv.FormatInt(info.Length, 10))
+	response.WriteHeader(http.StatusOK)
+}
+
+// tusPatchHandler appends bytes to an upload. When the last byte arrives the
+// finished file is processed like any other upload.
+func (s *server) tusPatchHandler(response http.ResponseWriter, request *http.Request) {
+	start := time.Now()
+	setTusHeaders(response)
+
+	id := request.PathValue("id")
+	if request.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(response, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	if !s.tus.lock(id) {
+		http.Error(response, "upload is already in progress", http.StatusConflict)
+		return
+	}
+	defer s.tus.unlock(id)
+
+	info, offset, err := s.tus.get(id)
+	if err != nil {
+		http.Error(response, "upload not found", http.StatusNotFound)
+		return
+	}
+	clientOffset, err := strconv.ParseInt(request.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || clientOffset != offset {
+		http.Error(response, "Upload-Offset does not match", http.StatusConflict)
+		return
+	}
+
+	file, err := os.OpenFile(s.tus.dataPath(id), os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		http.Error(response, "Unable to open upload", http.StatusInternalServerError)
+		return
+	}
+
+	// Keep whatever arrived even if the connection drops part way through,
+	// that is what lets the client resume
+	body := http.MaxBytesReader(response, request.Body, info.Length-offset)
+	if progressID := uploadID(request); progressID != "" {
+		body = s.progress.trackProgress(progressID, body, offset, info.Length)
+	}
+	written, copyErr := io.Copy(file, body)
+	closeErr := file.Close()
+	offset += written
+	response.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(copyErr, &maxBytesErr) {
+		http.Error(response, "more data than Upload-Length", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if copyErr != nil || closeErr != nil {
+		http.Error(response, "Unable to save upload", http.StatusInternalServerError)
+		return
+	}
+
+	if offset < info.Length {
+		response.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// The upload is complete, so hand it over to the regular pipeline
+	data, err := os.Open(s.tus.dataPath(id))
+	if err != nil {
+		http.Error(response, "Unable to open upload", http.StatusInternalServerError)
+		return
+	}
+	progressID := uploadID(request)
+	if progressID != "" {
+		s.progress.setState(progressID, progressProcessing)
+	}
+	var result uploadResult
+	details, err := newUploadDetails(info.Metadata["uploader"], info.Metadata["caption"], info.Metadata["event"], start)
+	if err == nil {
+		details.Filename = info.Metadata["filename"]
+		details.Size = info.Length
+		var household *Household
+		if code := info.Metadata["code"]; code != "" {
+			household, _ = s.guests.Lookup(code)
+		}
+		details.identify(household, request)
+		result, err = s.saveUpload(request.Context(), data, details)
+	}
+	data.Close()
+	s.tus.remove(id)
+	if progressID != "" {
+		if err != nil {
+			s.progress.setState(progressID, progressFailed)
+		} else {
+			s.progress.setState(progressID, progressDone)
+		}
+	}
+	if err != nil {
+		writeUploadError(response, details.Filename, err)
+		return
+	}
+
+	response.Header().Set("X-Photo-Id", result.ID)
+	response.Header().Set("X-Photo-Duplicate", strconv.FormatBool(result.Duplicate))
+	response.WriteHeader(http.StatusNoContent)
+	slog.Info("Saved resumable upload", "upload", id, "duration", time.Since(start))
+}
+
+// tusDeleteHandler abandons an upload
+func (s *server) tusDeleteHandler(response http.ResponseWriter, request *http.Request) {
+	setTusHeaders(response)
+
+	id := request.PathValue("id")
+	if !s.tus.lock(id) {
+		http.Error(response, "upload is in progress", http.StatusConflict)
+		return
+	}
+	defer s.tus.unlock(id)
+
+	if _, _, err := s.tus.get(id); err != nil {
+		http.Error(response, "upload not found", http.StatusNotFound)
+		return
+	}
+	s.tus.remove(id)
+	response.WriteHeader(http.StatusNoContent)
+}
+
+// parseTusMetadata decodes an Upload-Metadata header, a comma separated list
+// of keys with base64 encoded values
+func parseTusMetadata(header string) map[string]string {
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			continue
+		}
+		metadata[key] = string(decoded)
+	}
+	return metadata
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The admin area shows guests' addresses, emails and dietary and medical
+// notes, so the couple can turn on two-factor authentication: a six digit
+// code from an authenticator app (TOTP, RFC 6238) is then needed on top of
+// the admin token or a login link to start a session. Once it is on, only
+// sessions started with a code are let in, and the admin token on its own
+// only works at /admin/login. If the authenticator is lost, deleting
+// admin-2fa.json on the server turns it off.
+
+// TOTP parameters, the ones every authenticator app uses by default
+const (
+	totpDigits = 6
+	totpPeriod = 30 * time.Second
+	// totpSkew is how many periods either side of now a code is still
+	// accepted, for clocks that have drifted
+	totpSkew = 1
+	// totpIssuer names the site in authenticator apps
+	totpIssuer = "Wedding Site"
+)
+
+// twoFactorSettings is what is saved of two-factor authentication
+type twoFactorSettings struct {
+	// Secret is the key codes are made from, once enrollment is confirmed
+	Secret string `json:"secret,omitempty"`
+	// Pending is the key of an enrollment that hasn't been confirmed with a
+	// code yet
+	Pending string `json:"pending,omitempty"`
+}
+
+// twoFactorStore keeps the two-factor settings, in a file only the server
+// can read since they hold the secret codes are made from
+type twoFactorStore struct {
+	mu       sync.Mutex
+	path     string
+	settings twoFactorSettings
+	// lastStep is the period of the last code used, so a code seen over
+	// someone's shoulder can't be used again
+	lastStep int64
+}
+
+// openTwoFactorStore loads the settings saved at path, starting with
+// two-factor authentication off if it doesn't exist
+func openTwoFactorStore(path string) (*twoFactorStore, error) {
+	store := &twoFactorStore{path: path}
+
+	if err := loadJSONFile(path, &store.settings); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Enabled reports whether a code is needed to log in
+func (store *twoFactorStore) Enabled() bool {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	return store.settings.Secret != ""
+}
+
+// Enroll starts enrolling a new authenticator, returning its key. Codes are
+// only needed once the enrollment is confirmed.
+func (store *twoFactorStore) Enroll() (string, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	key := make([]byte, 20)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(key)
+	previous := store.settings.Pending
+	store.settings.Pending = secret
+	if err := store.save(); err != nil {
+		store.settings.Pending = previous
+		return "", err
+	}
+	return secret, nil
+}
+
+// Confirm finishes enrolling the pending authenticator if code is right
+// for it at now, replacing any enrolled before
+func (store *twoFactorStore) Confirm(code string, now time.Time) (bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	step, ok := totpMatch(store.settings.Pending, code, now)
+	if !ok {
+		return false, nil
+	}
+	previous := store.settings
+	store.settings = twoFactorSettings{Secret: store.settings.Pending}
+	if err := store.save(); err != nil {
+		store.settings = previous
+		return false, err
+	}
+	store.lastStep = step
+	return true, nil
+}
+
+// Verify reports whether code is right for the enrolled authenticator at
+// now, and hasn't been used before
+func (store *twoFactorStore) Verify(code string, now time.Time) bool {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	step, ok := totpMatch(store.settings.Secret, code, now)
+	if !ok || step <= store.lastStep {
+		return false
+	}
+	store.lastStep = step
+	return true
+}
+
+// Disable turns two-factor authentication off if code is right for the
+// enrolled authenticator at now
+func (store *twoFactorStore) Disable(code string, now time.Time) (bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	step, ok := totpMatch(store.settings.Secret, code, now)
+	if !ok || step <= store.lastStep {
+		return false, nil
+	}
+	previous := store.settings
+	store.settings = twoFactorSettings{}
+	if err := store.save(); err != nil {
+		store.settings = previous
+		return false, err
+	}
+	store.lastStep = step
+	return true, nil
+}
+
+// save writes the settings to disk. The caller must hold store.mu.
+func (store *twoFactorStore) save() error {
+	// Anyone who can read the key can make codes, so only the server can
+	return savePrivateJSONFile(store.path, store.settings)
+}
+
+// totpCode returns the code secret makes for the period step
+func totpCode(key []byte, step int64) string {
+	mac := hmac.New(sha1.New, key)
+	binary.Write(mac, binary.BigEndian, step)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1_000_000)
+}
+
+// totpMatch returns the period code is for, reporting whether it is right
+// for secret within totpSkew periods of now
+func totpMatch(secret, code string, now time.Time) (int64, bool) {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if secret == "" || len(code) != totpDigits {
+		return 0, false
+	}
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		return 0, false
+	}
+	current := now.Unix() / int64(totpPeriod/time.Second)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if hmac.Equal([]byte(totpCode(key, step)), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totpURI returns the otpauth:// link authenticator apps enroll secret from,
+// usually shown as a QR code
+func totpURI(secret string) string {
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", totpIssuer)
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(int(totpPeriod.Seconds())))
+	return "otpauth://totp/" + url.PathEscape(totpIssuer+":admin") + "?" + query.Encode()
+}
+
+// twoFactorCode is the body of requests that need a code
+type twoFactorCode struct {
+	Code string `json:"code"`
+}
+
+// twoFactorStatus says whether two-factor authentication is on
+type twoFactorStatus struct {
+	Enabled bool `json:"enabled"`
+}
+
+// twoFactorEnrollment is what an authenticator app is set up with
+type twoFactorEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// twoFactorStatusHandler says whether two-factor authentication is on
+func (s *server) twoFactorStatusHandler(response http.ResponseWriter, request *http.Request) {
+	writeJSON(response, http.StatusOK, twoFactorStatus{Enabled: s.twoFactor.Enabled()})
+}
+
+// enrollTwoFactorHandler starts enrolling an authenticator app, handing back
+// the key to scan into it. Nothing changes until it is confirmed.
+func (s *server) enrollTwoFactorHandler(response http.ResponseWriter, request *http.Request) {
+	secret, err := s.twoFactor.Enroll()
+	if err != nil {
+		slog.Error("Unable to start two-factor enrollment", "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to start two-factor enrollment")
+		return
+	}
+	response.Header().Set("Cache-Control", "no-store")
+	writeJSON(response, http.StatusOK, twoFactorEnrollment{Secret: secret, URI: totpURI(secret)})
+}
+
+// confirmTwoFactorHandler turns two-factor authentication on with a code
+// from the authenticator being enrolled. Every earlier session ends, so the
+// answer is a new session to carry on with, in the session cookie too if
+// that is how the request was sent.
+func (s *server) confirmTwoFactorHandler(response http.ResponseWriter, request *http.Request) {
+	var body twoFactorCode
+	if !decodeJSON(response, request, &body) {
+		return
+	}
+	ok, err := s.twoFactor.Confirm(body.Code, time.Now())
+	if err != nil {
+		slog.Error("Unable to save two-factor enrollment", "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to turn on two-factor authentication")
+		return
+	}
+	if !ok {
+		writeJSONError(response, http.StatusBadRequest, "That code doesn't match, check the authenticator app was set up with the latest key")
+		return
+	}
+
+	token, _ := adminCredential(request)
+	claims, _ := verifySessionToken(token, time.Now())
+	session, expires := issueSessionToken(time.Now(), *adminSessionTTL, sessionOptions{Email: claims.Email, TwoFactor: true})
+	if _, err := request.Cookie(sessionCookie); err == nil {
+		setSessionCookie(response, request, session, expires)
+	}
+	response.Header().Set("Cache-Control", "no-store")
+	writeJSON(response, http.StatusOK, sessionResponse{Token: session, ExpiresAt: expires})
+}
+
+// disableTwoFactorHandler turns two-factor authentication off, with a
+// current code so a stolen session can't do it
+func (s *server) disableTwoFactorHandler(response http.ResponseWriter, request *http.Request) {
+	var body twoFactorCode
+	if !decodeJSON(response, request, &body) {
+		return
+	}
+	ok, err := s.twoFactor.Disable(body.Code, time.Now())
+	if err != nil {
+		slog.Error("Unable to turn off two-factor authentication", "err", err)
+		writeJSONError(response, http.StatusInternalServerError, "Unable to turn off two-factor authentication")
+		return
+	}
+	if !ok {
+		writeJSONError(response, http.StatusBadRequest, "That code doesn't match")
+		return
+	}
+	response.WriteHeader(http.StatusNoContent)
+}
+
+// verifyLoginHandler finishes logging in with a login link when two-factor
+// authentication is on, trading the half-finished session in the cookie and
+// a code for a full one
+func (s *server) verifyLoginHandler(response http.ResponseWriter, request *http.Request) {
+	var body twoFactorCode
+	if !decodeJSON(response, request, &body) {
+		return
+	}
+	cookie, err := request.Cookie(sessionCookie)
+	if err != nil {
+		writeJSONError(response, http.StatusUnauthorized, "Log in with a login link first")
+		return
+	}
+	claims, ok := verifySessionToken(cookie.Value, time.Now())
+	if !ok || !claims.Pending || s.revoked.Revoked(claims.ID) {
+		writeJSONError(response, http.StatusUnauthorized, "Log in with a login link first")
+		return
+	}
+	ok, wait := s.guesses.guess(request, guessAdmin, func() bool {
+		return s.twoFactor.Verify(body.Code, time.Now())
+	})
+	if wait > 0 {
+		writeLockedOut(response, wait)
+		return
+	}
+	if !ok {
+		writeJSONError(response, http.StatusUnauthorized, "That code doesn't match")
+		return
+	}
+	session, expires := issueSessionToken(time.Now(), *adminSessionTTL, sessionOptions{Email: claims.Email, TwoFactor: true})
+	setSessionCookie(response, request, session, expires)
+	response.Header().Set("Cache-Control", "no-store")
+	writeJSON(response, http.StatusOK, sessionResponse{Token: session, ExpiresAt: expires})
+}
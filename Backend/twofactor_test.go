@@ -0,0 +1,83 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA-1 key from the test vectors in RFC 6238, base32
+// encoded
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPMatch(t *testing.T) {
+	at := time.Unix(1_111_111_109, 0)
+	period := totpPeriod
+	tests := []struct {
+		name   string
+		secret string
+		code   string
+		now    time.Time
+		want   bool
+	}{
+		// The last six digits of the RFC 6238 test vectors
+		{name: "rfc 59", secret: rfcSecret, code: "287082", now: time.Unix(59, 0), want: true},
+		{name: "rfc 1111111109", secret: rfcSecret, code: "081804", now: at, want: true},
+		{name: "rfc 1234567890", secret: rfcSecret, code: "005924", now: time.Unix(1_234_567_890, 0), want: true},
+		{name: "rfc 2000000000", secret: rfcSecret, code: "279037", now: time.Unix(2_000_000_000, 0), want: true},
+		{name: "spaced", secret: rfcSecret, code: " 081 804 ", now: at, want: true},
+		{name: "one period early", secret: rfcSecret, code: "081804", now: at.Add(-period), want: true},
+		{name: "one period late", secret: rfcSecret, code: "081804", now: at.Add(period), want: true},
+		{name: "two periods early", secret: rfcSecret, code: "081804", now: at.Add(-2 * period)},
+		{name: "two periods late", secret: rfcSecret, code: "081804", now: at.Add(2 * period)},
+		{name: "wrong code", secret: rfcSecret, code: "081805", now: at},
+		{name: "too short", secret: rfcSecret, code: "81804", now: at},
+		{name: "too long", secret: rfcSecret, code: "0081804", now: at},
+		{name: "empty", secret: rfcSecret, code: "", now: at},
+		{name: "no secret", secret: "", code: "081804", now: at},
+		{name: "bad secret", secret: "not base32!", code: "081804", now: at},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, ok := totpMatch(test.secret, test.code, test.now); ok != test.want {
+				t.Errorf("totpMatch(%q) = %v, want %v", test.code, ok, test.want)
+			}
+		})
+	}
+}
+
+func TestTwoFactorReplay(t *testing.T) {
+	store, err := openTwoFactorStore(filepath.Join(t.TempDir(), "admin-2fa.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.settings.Secret = rfcSecret
+	at := time.Unix(1_111_111_109, 0)
+	next := totpCode([]byte("12345678901234567890"), at.Unix()/30+1)
+
+	steps := []struct {
+		name string
+		code string
+		now  time.Time
+		want bool
+	}{
+		{name: "first use", code: "081804", now: at, want: true},
+		{name: "same code again", code: "081804", now: at},
+		{name: "same code a period later", code: "081804", now: at.Add(totpPeriod)},
+		{name: "next code", code: next, now: at.Add(totpPeriod), want: true},
+		{name: "earlier code after a later one", code: "081804", now: at.Add(-time.Second)},
+	}
+	for _, step := range steps {
+		if ok := store.Verify(step.code, step.now); ok != step.want {
+			t.Fatalf("%s: Verify(%q) = %v, want %v", step.name, step.code, ok, step.want)
+		}
+	}
+
+	// A code already used to log in can't turn two-factor authentication off
+	if ok, err := store.Disable(next, at.Add(totpPeriod)); err != nil || ok {
+		t.Fatalf("Disable() with a used code = %v, %v, want false", ok, err)
+	}
+	if !store.Enabled() {
+		t.Fatal("Disable() with a used code turned two-factor authentication off")
+	}
+}
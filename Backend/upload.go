@@ -0,0 +1,586 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// uploadResult is the JSON response sent after an upload
+type uploadResult struct {
+	Filename  string `json:"filename,omitempty"`
+	ID        string `json:"id,omitempty"`
+	Status    string `json:"status,omitempty"`
+	Uploader  string `json:"uploader,omitempty"`
+	Caption   string `json:"caption,omitempty"`
+	Event     string `json:"event,omitempty"`
+	Live      bool   `json:"live,omitempty"`
+	Duplicate bool   `json:"duplicate"`
+	Message   string `json:"message,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// batchResult is the JSON response sent after a multi-file upload, with one
+// entry per file in the order they were sent
+type batchResult struct {
+	Results []uploadResult `json:"results"`
+}
+
+// uploadDetails describes an upload besides its content
+type uploadDetails struct {
+	Filename string
+	Size     int64
+	Uploader string
+	Caption  string
+	Event    string
+	Started  time.Time
+	// Live is the clip of a Live Photo, if the upload is the still of one
+	Live     io.ReadSeeker
+	LiveSize int64
+	// Guest identifies who sent the upload for their quota: their guest
+	// code, or their IP address if they didn't need one
+	Guest string
+	// Owner is who sent the upload as guestKey tells them apart, so they can
+	// find their uploads again
+	Owner string
+}
+
+// identify records who sent an upload. Guests who didn't give a name are
+// credited with their household's name on the guest list.
+func (details *uploadDetails) identify(household *Household, request *http.Request) {
+	if household == nil {
+		details.Guest = clientIP(request)
+		details.Owner = deviceKey(request)
+		return
+	}
+	details.Guest = household.Code
+	details.Owner = "guest:" + household.Code
+	if details.Uploader == "" {
+		details.Uploader = household.Name
+	}
+}
+
+// Limits on the optional text sent with uploads
+const (
+	maxUploaderLength = 100
+	maxCaptionLength  = 500
+)
+
+// newUploadDetails checks the optional uploader name, caption, and event
+// fields sent with an upload
+func newUploadDetails(uploader, caption, event string, started time.Time) (uploadDetails, error) {
+	details := uploadDetails{
+		Uploader: strings.TrimSpace(uploader),
+		Caption:  strings.TrimSpace(caption),
+		Started:  started,
+	}
+	if event = strings.TrimSpace(event); event != "" {
+		var ok bool
+		details.Event, ok = findEvent(event)
+		if !ok {
+			return details, &uploadError{http.StatusBadRequest, "event must be one of " + strings.Join(events(), ", ")}
+		}
+	}
+	if utf8.RuneCountInString(details.Uploader) > maxUploaderLength {
+		return details, &uploadError{http.StatusBadRequest, fmt.Sprintf("uploader name must be at most %d characters", maxUploaderLength)}
+	}
+	if utf8.RuneCountInString(details.Caption) > maxCaptionLength {
+		return details, &uploadError{http.StatusBadRequest, fmt.Sprintf("caption must be at most %d characters", maxCaptionLength)}
+	}
+	return details, nil
+}
+
+// uploadError is a rejected upload along with the HTTP status that fits it
+type uploadError struct {
+	status  int
+	message string
+}
+
+func (err *uploadError) Error() string {
+	return err.message
+}
+
+// uploadHandler handles the file upload. A single file can be sent as
+// "image", or a batch as "images[]", in which case the response lists how
+// each file went.
+func (s *server) uploadHandler(response http.ResponseWriter, request *http.Request) {
+	start := time.Now()
+	var checkpoint time.Time
+
+	// Preflight requests are answered by the CORS middleware before they get
+	// here, so this is only a plain OPTIONS request
+	if request.Method == http.MethodOptions {
+		response.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// Reject bodies larger than the configured limit before parsing anything
+	request.Body = http.MaxBytesReader(response, request.Body, maxRequestSize())
+
+	// Report progress to the client if it asked for it
+	progressID := uploadID(request)
+	succeeded := false
+	if progressID != "" {
+		request.Body = s.progress.trackProgress(progressID, request.Body, 0, request.ContentLength)
+		defer func() {
+			if succeeded {
+				s.progress.setState(progressID, progressDone)
+			} else {
+				s.progress.setState(progressID, progressFailed)
+			}
+		}()
+	}
+
+	if request.Method != http.MethodPost {
+		http.Error(response, "Invalid request method\n", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Stream the multipart form to disk
+	files, fields, err := receiveMultipart(request)
+	defer removeReceivedFiles(files)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(response, "file is too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(response, "Could not parse form", http.StatusBadRequest)
+		return
+	}
+
+	if progressID != "" {
+		s.progress.setState(progressID, progressProcessing)
+	}
+
+	details, err := newUploadDetails(fields["uploader"], fields["caption"], fields["event"], start)
+	if err != nil {
+		http.Error(response, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	code := guestCode(request)
+	if code == "" {
+		code = fields["code"]
+	}
+	household, err := s.authorizeGuest(request, code)
+	if err != nil {
+		writeUploadError(response, "", err)
+		return
+	}
+	details.identify(household, request)
+
+	// A Live Photo's clip can be sent as "live" alongside a single image, or
+	// in a batch with the same name as its still
+	var batch []receivedFile
+	var single, live *receivedFile
+	for i, file := range files {
+		switch file.field {
+		case "images[]", "images":
+			batch = append(batch, file)
+		case "image":
+			if single == nil {
+				single = &files[i]
+			}
+		case "live":
+			if live == nil {
+				live = &files[i]
+			}
+		}
+	}
+	batch = pairLivePhotos(batch)
+	if single != nil {
+		single.live = live
+	}
+
+	if len(batch) == 0 {
+		if single == nil {
+			http.Error(response, "Error retrieving the file", http.StatusBadRequest)
+			return
+		}
+
+		result, err := s.saveReceivedFile(request.Context(), *single, details)
+		if err != nil {
+			writeUploadError(response, single.filename, err)
+			return
+		}
+		succeeded = true
+		writeJSON(response, http.StatusOK, result)
+	} else {
+		results := make([]uploadResult, 0, len(batch))
+		for _, file := range batch {
+			result, err := s.saveReceivedFile(request.Context(), file, details)
+			if err != nil {
+				result = uploadResult{Filename: file.filename, Error: err.Error()}
+			}
+			results = append(results, result)
+		}
+		succeeded = true
+		writeJSON(response, http.StatusOK, batchResult{Results: results})
+	}
+
+	checkpoint = time.Now()
+	slog.Info("Saved upload", "duration", checkpoint.Sub(start))
+}
+
+// writeUploadError sends the response for an upload that couldn't be saved
+func writeUploadError(response http.ResponseWriter, filename string, err error) {
+	var quotaErr *quotaError
+	if errors.As(err, &quotaErr) {
+		writeJSON(response, http.StatusTooManyRequests, uploadResult{Filename: filename, Error: quotaErr.message})
+		return
+	}
+	var uploadErr *uploadError
+	if errors.As(err, &uploadErr) {
+		http.Error(response, uploadErr.message, uploadErr.status)
+		return
+	}
+	http.Error(response, "Unable to save file\n", http.StatusInternalServerError)
+}
+
+// receivedFile is a file from a multipart upload that has been streamed to a
+// temporary file
+type receivedFile struct {
+	field    string
+	filename string
+	file     *os.File
+	size     int64
+	// live is the clip of a Live Photo, if this is its still
+	live *receivedFile
+}
+
+// maxFieldSize is the most read from a non-file form field
+const maxFieldSize = 4 << 10
+
+// receiveMultipart reads a multipart upload part by part. Files are streamed
+// straight to temporary files in the uploads directory rather than being
+// buffered, so many guests uploading at once doesn't use up memory. Fields
+// are collected ahead of processing any file, since they may come after the
+// files in the form. The caller must remove the returned files even when
+// there is an error.
+func receiveMultipart(request *http.Request) ([]receivedFile, map[string]string, error) {
+	reader, err := request.MultipartReader()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var files []receivedFile
+	fields := make(map[string]string)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return files, fields, nil
+		}
+		if err != nil {
+			return files, fields, err
+		}
+
+		if part.FileName() == "" {
+			value, err := io.ReadAll(io.LimitReader(part, maxFieldSize))
+			part.Close()
+			if err != nil {
+				return files, fields, err
+			}
+			fields[part.FormName()] = string(value)
+			continue
+		}
+
+		temp, err := createIncomingFile()
+		if err != nil {
+			part.Close()
+			return files, fields, err
+		}
+		files = append(files, receivedFile{field: part.FormName(), filename: part.FileName(), file: temp})
+
+		size, err := io.Copy(temp, part)
+		part.Close()
+		if err != nil {
+			return files, fields, err
+		}
+		files[len(files)-1].size = size
+		if _, err := temp.Seek(0, io.SeekStart); err != nil {
+			return files, fields, err
+		}
+	}
+}
+
+// createIncomingFile creates a temporary file in the uploads directory for an
+// upload that is still arriving
+func createIncomingFile() (*os.File, error) {
+	incoming := filepath.Join(*uploadDir, ".incoming")
+	if err := os.MkdirAll(incoming, os.ModePerm); err != nil {
+		return nil, err
+	}
+	return os.CreateTemp(incoming, "upload-*")
+}
+
+// removeReceivedFiles deletes the temporary files of an upload
+func removeReceivedFiles(files []receivedFile) {
+	for _, received := range files {
+		received.file.Close()
+		os.Remove(received.file.Name())
+	}
+}
+
+// saveReceivedFile saves a file from a multipart upload
+func (s *server) saveReceivedFile(ctx context.Context, received receivedFile, details uploadDetails) (uploadResult, error) {
+	details.Filename = received.filename
+	details.Size = received.size
+	if received.live != nil {
+		details.Live = received.live.file
+		details.LiveSize = received.live.size
+	}
+	return s.saveUpload(ctx, received.file, details)
+}
+
+// saveUpload validates, stores, and processes a single uploaded photo or
+// video clip. Rejected files return an *uploadError.
+func (s *server) saveUpload(ctx context.Context, file io.ReadSeeker, details uploadDetails) (uploadResult, error) {
+	// Restrict file types to images and video clips, based on the file content
+	kind := kindImage
+	contentType, err := detectImageType(file)
+	if errors.Is(err, errUnsupportedType) {
+		kind = kindVideo
+		contentType, err = detectVideoType(file)
+	}
+	if err != nil {
+		if errors.Is(err, errUnsupportedType) {
+			return uploadResult{}, &uploadError{http.StatusUnsupportedMediaType, "invalid file type"}
+		}
+		return uploadResult{}, &uploadError{http.StatusInternalServerError, "Unable to read file"}
+	}
+
+	// Limit file size to the configured maximum for its kind
+	if (kind == kindImage && details.Size > *maxUploadSize) || (kind == kindVideo && details.Size > *maxVideoSize) {
+		return uploadResult{}, &uploadError{http.StatusRequestEntityTooLarge, "file is too large"}
+	}
+
+	// Hash images to prevent repeats
+	hash, err := hashFile(file)
+	if err != nil {
+		return uploadResult{}, &uploadError{http.StatusInternalServerError, "Unable to read file"}
+	}
+	if existing, ok := s.photos.FindByHash(hash); ok {
+		return uploadResult{Filename: details.Filename, ID: existing.ID, Status: existing.Status, Duplicate: true, Message: "Photo was already uploaded"}, nil
+	}
+
+	// Make sure the whole image arrived intact, so broken files never make
+	// it into the gallery
+	if kind == kindImage {
+		if err := verifyImage(file, contentType); err != nil {
+			switch {
+			case errors.Is(err, errCorruptImage):
+				return uploadResult{}, &uploadError{http.StatusBadRequest, "The photo looks damaged or incomplete, please try uploading it again"}
+			case errors.Is(err, errImageTooLarge):
+				return uploadResult{}, &uploadError{http.StatusRequestEntityTooLarge, "photo has too many pixels"}
+			}
+			return uploadResult{}, &uploadError{http.StatusInternalServerError, "Unable to read file"}
+		}
+	}
+
+	// Check for malware before anything is kept
+	if s.scanner != nil {
+		threat, err := s.scanner.Scan(ctx, file)
+		if _, seekErr := file.Seek(0, io.SeekStart); err == nil {
+			err = seekErr
+		}
+		if err != nil {
+			slog.Error("Unable to scan upload", "err", err)
+			return uploadResult{}, &uploadError{http.StatusServiceUnavailable, "Unable to scan file, please try again later"}
+		}
+		if threat != "" {
+			slog.Warn("Rejected infected upload", "file", details.Filename, "threat", threat)
+			return uploadResult{}, &uploadError{http.StatusUnprocessableEntity, "file was rejected by the virus scanner"}
+		}
+	}
+
+	// Name the file after a fresh UUID, so names never collide and are safe
+	// to use in paths and URLs
+	id := newUUID()
+	extension := imageExtensions[contentType]
+	if kind == kindVideo {
+		extension = videoTypes[contentType]
+	}
+	photo := &Photo{
+		ID:               id,
+		Kind:             kind,
+		File:             id + extension,
+		OriginalFilename: cleanFilename(details.Filename),
+		Directory:        shardDirectory(details.Started),
+		Uploader:         details.Uploader,
+		UploaderKey:      details.Owner,
+		Caption:          details.Caption,
+		Event:            details.Event,
+		Hash:             hash,
+		ContentType:      contentType,
+		Status:           photoProcessing,
+		UploadedAt:       details.Started,
+		Variants:         map[string]string{},
+	}
+
+	if kind == kindImage {
+		// Keep when and on what the photo was taken before the EXIF is stripped
+		info, err := readEXIF(file, contentType)
+		if err != nil {
+			slog.Error("Unable to read EXIF data", "err", err)
+		}
+		photo.CameraMake = info.CameraMake
+		photo.CameraModel = info.CameraModel
+		photo.Orientation = info.Orientation
+		if !info.TakenAt.IsZero() {
+			photo.TakenAt = &info.TakenAt
+		}
+	} else {
+		info, recorded, err := readVideoInfo(file)
+		if err != nil {
+			return uploadResult{}, &uploadError{http.StatusBadRequest, "invalid video file"}
+		}
+		if time.Duration(info.DurationSeconds*float64(time.Second)) > *maxVideoDuration {
+			return uploadResult{}, &uploadError{http.StatusRequestEntityTooLarge, fmt.Sprintf("video is longer than %v", *maxVideoDuration)}
+		}
+		photo.Video = &info
+		photo.Width, photo.Height = info.Width, info.Height
+		if !recorded.IsZero() {
+			photo.TakenAt = &recorded
+		}
+		// There is nothing to generate for clips, so they are ready as soon
+		// as they are stored, unless they have to wait for the couple to
+		// look at them since moderation can't
+		photo.Status = photoReady
+		if s.workers.moderator != nil {
+			photo.Status, photo.ReviewReason = photoNeedsReview, unscreenedVideo
+		}
+	}
+
+	// The original is stored as it is. Processing makes the compressed
+	// copies, and replaces the original with one if originals aren't kept.
+
+	size := details.Size + details.LiveSize
+	if !s.capacity.Reserve(size) {
+		return uploadResult{}, &uploadError{http.StatusInsufficientStorage, "The photo album is full, so we can't take any more uploads right now"}
+	}
+	if err := s.quotas.Reserve(details.Guest, size); err != nil {
+		var quotaErr *quotaError
+		if errors.As(err, &quotaErr) {
+			return uploadResult{}, err
+		}
+		return uploadResult{}, &uploadError{http.StatusInternalServerError, "Unable to save file"}
+	}
+	photo.QuotaKey, photo.QuotaSize = details.Guest, size
+	kept := false
+	defer func() {
+		if !kept {
+			s.quotas.Release(details.Guest, size)
+		}
+	}()
+
+	// Stage the file to store, dropping any EXIF data so guests' locations
+	// aren't stored with their photos
+	staged, err := createIncomingFile()
+	if err != nil {
+		return uploadResult{}, &uploadError{http.StatusInternalServerError, "Unable to create file"}
+	}
+	defer os.Remove(staged.Name())
+	defer staged.Close()
+	if *stripEXIF && kind == kindImage {
+		err = stripMetadata(staged, file, contentType)
+	} else {
+		_, err = io.Copy(staged, file)
+		if err == nil && *stripEXIF {
+			err = stripVideoMetadata(staged)
+		}
+	}
+	if err != nil {
+		if errors.Is(err, errMalformedImage) {
+			return uploadResult{}, &uploadError{http.StatusBadRequest, "invalid " + kind + " file"}
+		}
+		return uploadResult{}, &uploadError{http.StatusInternalServerError, "Unable to save file"}
+	}
+	if info, err := staged.Stat(); err == nil {
+		photo.Size = info.Size()
+	}
+	if err := storeOriginal(ctx, s.storage, photo, staged); err != nil {
+		slog.Error("Unable to store upload", "file", photo.originalName(), "err", err)
+		return uploadResult{}, &uploadError{http.StatusInternalServerError, "Unable to save file"}
+	}
+
+	if details.Live != nil && kind == kindImage {
+		// The still is worth keeping even if its clip isn't
+		if err := storeLiveVideo(ctx, s.storage, photo, details.Live, details.LiveSize); err != nil {
+			slog.Error("Unable to store Live Photo video", "photo", photo.ID, "err", err)
+		}
+	}
+
+	// Another guest may have uploaded the same photo while this one was being saved
+	existing, added, err := s.photos.Add(photo)
+	if err != nil {
+		removePhotoFiles(ctx, s.storage, s.photos, photo)
+		return uploadResult{}, &uploadError{http.StatusInternalServerError, "Unable to save file"}
+	}
+	if !added {
+		removePhotoFiles(ctx, s.storage, s.photos, photo)
+		return uploadResult{Filename: details.Filename, ID: existing.ID, Status: existing.Status, Duplicate: true, Message: "Photo was already uploaded"}, nil
+	}
+
+	kept = true
+
+	// Generate the WebP copy and thumbnails in the background
+	if photo.Status == photoProcessing {
+		if err := s.workers.Enqueue(ctx, processingJob{PhotoID: photo.ID}); err != nil {
+			slog.Error("Unable to queue photo for processing", "photo", photo.ID, "err", err)
+		}
+	}
+	s.feed.publish(photo)
+
+	return uploadResult{
+		Filename: details.Filename,
+		ID:       photo.ID,
+		Status:   photo.Status,
+		Uploader: photo.Uploader,
+		Caption:  photo.Caption,
+		Event:    photo.Event,
+		Live:     photo.Variants["live"] != "",
+		Message:  "File successfully uploaded",
+	}, nil
+}
+
+// cleanFilename reduces a client supplied file name to something safe to keep
+// as metadata: no directories and a reasonable length
+func cleanFilename(filename string) string {
+	filename = filepath.Base(strings.ReplaceAll(filename, "\\", "/"))
+	if filename == "." || filename == "/" {
+		return ""
+	}
+	if len(filename) > 255 {
+		filename = filename[:255]
+	}
+	return filename
+}
+
+// maxRequestSize is the largest upload request body accepted, big enough
+// for either a photo or a video clip
+func maxRequestSize() int64 {
+	return max(*maxUploadSize, *maxVideoSize)
+}
+
+// hashFile returns the hex encoded SHA-256 of file and rewinds it
+func hashFile(file io.ReadSeeker) (string, error) {
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"time"
+)
+
+// Video clips are MP4 or QuickTime files, which share the ISO base media box
+// structure used by HEIC. Everything we want to know about a clip is in its
+// moov box, which may come before or after the (much larger) media data.
+
+// videoDirectory is where clips are stored, under the uploads directory
+const videoDirectory = "videos"
+
+// videoTypes are the accepted video content types and their file extensions
+var videoTypes = map[string]string{
+	"video/mp4":       ".mp4",
+	"video/quicktime": ".mov",
+}
+
+// VideoInfo is the metadata recorded for an uploaded clip
+type VideoInfo struct {
+	DurationSeconds float64 `json:"durationSeconds"`
+	Codec           string  `json:"codec,omitempty"`
+	Width           int     `json:"width,omitempty"`
+	Height          int     `json:"height,omitempty"`
+}
+
+// quickTimeAtoms are top level boxes that can start an old QuickTime file
+// without an ftyp box
+var quickTimeAtoms = map[string]bool{
+	"moov": true,
+	"mdat": true,
+	"wide": true,
+	"free": true,
+}
+
+// detectVideoType sniffs the start of file for an MP4 or QuickTime container
+// and rewinds it. Anything else returns errUnsupportedType.
+func detectVideoType(file io.ReadSeeker) (string, error) {
+	header := make([]byte, 12)
+	_, err := io.ReadFull(file, header)
+	if _, seekErr := file.Seek(0, io.SeekStart); seekErr != nil {
+		return "", seekErr
+	}
+	if err != nil {
+		return "", errUnsupportedType
+	}
+
+	kind := string(header[4:8])
+	switch {
+	case kind == "ftyp" && string(header[8:12]) == "qt  ":
+		return "video/quicktime", nil
+	case kind == "ftyp" && !isHEIC(header) && string(header[8:11]) != "avi" && string(header[8:11]) != "mif":
+		return "video/mp4", nil
+	case quickTimeAtoms[kind]:
+		return "video/quicktime", nil
+	}
+	return "", errUnsupportedType
+}
+
+// topLevelBox is the position of a box in a file
+type topLevelBox struct {
+	kind       string
+	offset     int64
+	headerSize int64
+	size       int64
+}
+
+// findTopLevelBox walks the boxes of file looking for kind, seeking over the
+// content of the others
+func findTopLevelBox(file io.ReadSeeker, kind string) (topLevelBox, error) {
+	end, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return topLevelBox{}, err
+	}
+
+	for offset := int64(0); offset+8 <= end; {
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			return topLevelBox{}, err
+		}
+		header := make([]byte, 16)
+		if _, err := io.ReadFull(file, header[:8]); err != nil {
+			return topLevelBox{}, errMalformedImage
+		}
+
+		box := topLevelBox{kind: string(header[4:8]), offset: offset, headerSize: 8}
+		box.size = int64(binary.BigEndian.Uint32(header[:4]))
+		switch box.size {
+		case 0:
+			box.size = end - offset
+		case 1:
+			if _, err := io.ReadFull(file, header[8:16]); err != nil {
+				return topLevelBox{}, errMalformedImage
+			}
+			box.size = int64(binary.BigEndian.Uint64(header[8:16]))
+			box.headerSize = 16
+		}
+		if box.size < box.headerSize || offset+box.size > end {
+			return topLevelBox{}, errMalformedImage
+		}
+
+		if box.kind == kind {
+			return box, nil
+		}
+		offset += box.size
+	}
+	return topLevelBox{}, errMalformedImage
+}
+
+// readMoov returns the children of a file's moov box. The file is rewound
+// afterwards.
+func readMoov(file io.ReadSeeker) ([]isoBox, error) {
+	defer file.Seek(0, io.SeekStart)
+
+	moov, err := findTopLevelBox(file, "moov")
+	if err != nil {
+		return nil, err
+	}
+	body := make([]byte, moov.size-moov.headerSize)
+	if _, err := file.Seek(moov.offset+moov.headerSize, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(file, body); err != nil {
+		return nil, errMalformedImage
+	}
+	return readBoxes(body)
+}
+
+// quickTimeEpoch is the zero time of MP4 and QuickTime timestamps
+var quickTimeEpoch = time.Date(1904, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// readVideoInfo reads the duration, codec, and dimensions of a clip along
+// with when it was recorded, if the camera set that. The file is rewound
+// afterwards.
+func readVideoInfo(file io.ReadSeeker) (VideoInfo, time.Time, error) {
+	var info VideoInfo
+	var recorded time.Time
+
+	children, err := readMoov(file)
+	if err != nil {
+		return info, recorded, err
+	}
+
+	mvhd, ok := findBox(children, "mvhd")
+	if !ok {
+		return info, recorded, errMalformedImage
+	}
+	reader := &byteReader{data: mvhd.body}
+	version := reader.uint(1)
+	reader.skip(3)
+	var created, timescale, duration uint64
+	if version == 1 {
+		created = reader.uint(8)
+		reader.skip(8)
+		timescale = reader.uint(4)
+		duration = reader.uint(8)
+	} else {
+		created = reader.uint(4)
+		reader.skip(4)
+		timescale = reader.uint(4)
+		duration = reader.uint(4)
+	}
+	if reader.err != nil || timescale == 0 {
+		return info, recorded, errMalformedImage
+	}
+	info.DurationSeconds = float64(duration) / float64(timescale)
+	if created > 0 {
+		recorded = quickTimeEpoch.Add(time.Duration(created) * time.Second)
+	}
+
+	// The codec and size come from the first video track
+	for _, trak := range children {
+		if trak.kind != "trak" {
+			continue
+		}
+		trakChildren, err := readBoxes(trak.body)
+		if err != nil {
+			continue
+		}
+		codec, ok := videoTrackCodec(trakChildren)
+		if !ok {
+			continue
+		}
+		info.Codec = codec
+		if tkhd, ok := findBox(trakChildren, "tkhd"); ok && len(tkhd.body) >= 8 {
+			// Width and height are 16.16 fixed point numbers at the end
+			dimensions := tkhd.body[len(tkhd.body)-8:]
+			info.Width = int(binary.BigEndian.Uint32(dimensions[:4]) >> 16)
+			info.Height = int(binary.BigEndian.Uint32(dimensions[4:]) >> 16)
+		}
+		break
+	}
+	return info, recorded, nil
+}
+
+// videoTrackCodec returns the sample format of a track, if it is a video track
+func videoTrackCodec(trak []isoBox) (string, bool) {
+	mdia, ok := findBox(trak, "mdia")
+	if !ok {
+		return "", false
+	}
+	mdiaChildren, err := readBoxes(mdia.body)
+	if err != nil {
+		return "", false
+	}
+
+	// The handler type comes after the version, flags, and predefined field
+	hdlr, ok := findBox(mdiaChildren, "hdlr")
+	if !ok || len(hdlr.body) < 12 || string(hdlr.body[8:12]) != "vide" {
+		return "", false
+	}
+
+	codec := ""
+	if minf, ok := findBox(mdiaChildren, "minf"); ok {
+		if minfChildren, err := readBoxes(minf.body); err == nil {
+			if stbl, ok := findBox(minfChildren, "stbl"); ok {
+				if stblChildren, err := readBoxes(stbl.body); err == nil {
+					// stsd is a full box with an entry count, then the sample entries
+					if stsd, ok := findBox(stblChildren, "stsd"); ok && len(stsd.body) >= 16 {
+						codec = string(stsd.body[12:16])
+					}
+				}
+			}
+		}
+	}
+	return codec, true
+}
+
+// stripVideoMetadata hides the user data and metadata boxes of a stored clip,
+// which is where phones put the recording location. The boxes are renamed to
+// free, which players skip, and zeroed, so nothing else in the file moves.
+func stripVideoMetadata(file *os.File) error {
+	moov, err := findTopLevelBox(file, "moov")
+	if err != nil {
+		return err
+	}
+	bodyOffset := moov.offset + moov.headerSize
+	body := make([]byte, moov.size-moov.headerSize)
+	if _, err := file.ReadAt(body, bodyOffset); err != nil {
+		return errMalformedImage
+	}
+	return blankMetadataBoxes(file, body, bodyOffset)
+}
+
+// blankMetadataBoxes blanks the udta and meta boxes among the boxes in data,
+// which starts at offset in file, looking inside each track as well
+func blankMetadataBoxes(file *os.File, data []byte, offset int64) error {
+	for position := int64(0); position+8 <= int64(len(data)); {
+		size := int64(binary.BigEndian.Uint32(data[position:]))
+		kind := string(data[position+4 : position+8])
+		headerSize := int64(8)
+		switch {
+		case size == 0:
+			size = int64(len(data)) - position
+		case size == 1 && position+16 <= int64(len(data)):
+			size = int64(binary.BigEndian.Uint64(data[position+8:]))
+			headerSize = 16
+		}
+		if size < headerSize || position+size > int64(len(data)) {
+			return errMalformedImage
+		}
+
+		switch kind {
+		case "udta", "meta":
+			if _, err := file.WriteAt([]byte("free"), offset+position+4); err != nil {
+				return err
+			}
+			if _, err := file.WriteAt(make([]byte, size-headerSize), offset+position+headerSize); err != nil {
+				return err
+			}
+		case "trak":
+			start := position + headerSize
+			if err := blankMetadataBoxes(file, data[start:position+size], offset+start); err != nil {
+				return err
+			}
+		}
+		position += size
+	}
+	return nil
+}
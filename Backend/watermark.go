@@ -0,0 +1,67 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"sync"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gomedium"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// watermarkedVariants are the variants stamped with the watermark, which are
+// the ones shown in the gallery. Originals, the JPEG copy of HEIC photos,
+// and the small thumbnails are left alone.
+var watermarkedVariants = map[string]bool{
+	"web":    true,
+	"medium": true,
+	"large":  true,
+}
+
+var (
+	watermarkFontOnce sync.Once
+	watermarkFont     *opentype.Font
+	watermarkFontErr  error
+)
+
+// addWatermark returns a copy of img with text in its bottom right corner,
+// in white over a soft shadow so it reads on light and dark photos alike.
+// The text is scaled to the image so it stays small but legible.
+func addWatermark(img image.Image, text string) (image.Image, error) {
+	watermarkFontOnce.Do(func() {
+		watermarkFont, watermarkFontErr = opentype.Parse(gomedium.TTF)
+	})
+	if watermarkFontErr != nil {
+		return nil, watermarkFontErr
+	}
+
+	bounds := img.Bounds()
+	size := float64(max(10, min(bounds.Dx(), bounds.Dy())/32))
+	face, err := opentype.NewFace(watermarkFont, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingFull})
+	if err != nil {
+		return nil, err
+	}
+	defer face.Close()
+
+	dst := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, bounds.Min, draw.Src)
+
+	drawer := &font.Drawer{Dst: dst, Face: face}
+	margin := int(size)
+	width := drawer.MeasureString(text).Ceil()
+	x := max(margin, dst.Bounds().Dx()-width-margin)
+	y := dst.Bounds().Dy() - margin
+	shadow := max(1, int(size)/16)
+
+	drawer.Src = image.NewUniform(color.NRGBA{0, 0, 0, 120})
+	drawer.Dot = fixed.P(x+shadow, y+shadow)
+	drawer.DrawString(text)
+
+	drawer.Src = image.NewUniform(color.NRGBA{255, 255, 255, 210})
+	drawer.Dot = fixed.P(x, y)
+	drawer.DrawString(text)
+	return dst, nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// errPoolClosed is returned for jobs queued once the server is shutting down
+var errPoolClosed = errors.New("worker pool is closed")
+
+// processingJob asks a worker to generate the variants of a stored photo
+type processingJob struct {
+	PhotoID string
+}
+
+// workerPool runs image processing in the background so uploads can return
+// as soon as the original is on disk. The queue is bounded, so during a burst
+// of uploads handlers wait for room rather than piling up unbounded work.
+type workerPool struct {
+	photos  PhotoStore
+	storage Storage
+	jobs    chan processingJob
+	wg      sync.WaitGroup
+	// mu guards closed, and is held for reading while a job is queued so
+	// jobs is never closed under a sender
+	mu     sync.RWMutex
+	closed bool
+	// moderator screens photos once they are processed, if it is set
+	moderator Moderator
+	// feed announces photos once they are ready
+	feed *photoFeed
+}
+
+// newWorkerPool starts workers goroutines reading from a queue of queueSize
+func newWorkerPool(photos PhotoStore, storage Storage, moderator Moderator, feed *photoFeed, workers, queueSize int) *workerPool {
+	pool := &workerPool{
+		photos:    photos,
+		storage:   storage,
+		jobs:      make(chan processingJob, queueSize),
+		moderator: moderator,
+		feed:      feed,
+	}
+	for i := 0; i < workers; i++ {
+		pool.wg.Add(1)
+		go pool.work()
+	}
+	return pool
+}
+
+// Enqueue adds a job to the queue, waiting for room until ctx is done. Jobs
+// can't be queued once the pool is closed.
+func (pool *workerPool) Enqueue(ctx context.Context, job processingJob) error {
+	pool.mu.RLock()
+	defer pool.mu.RUnlock()
+	if pool.closed {
+		return errPoolClosed
+	}
+	select {
+	case pool.jobs <- job:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close stops accepting jobs and waits for the queued ones to finish
+func (pool *workerPool) Close() {
+	pool.mu.Lock()
+	if !pool.closed {
+		pool.closed = true
+		close(pool.jobs)
+	}
+	pool.mu.Unlock()
+	pool.wg.Wait()
+}
+
+func (pool *workerPool) work() {
+	defer pool.wg.Done()
+	for job := range pool.jobs {
+		pool.process(job)
+	}
+}
+
+// process generates a photo's variants and records the outcome
+func (pool *workerPool) process(job processingJob) {
+	photo, ok := pool.photos.Get(job.PhotoID)
+	if !ok {
+		return
+	}
+
+	// The original is kept even if this fails so the photo isn't lost
+	if err := processImage(context.Background(), pool.storage, photo); err != nil {
+		slog.Error("Image processing failed", "photo", photo.ID, "err", err)
+		photo.Status = photoFailed
+	} else {
+		photo.Status = photoReady
+		if !*keepOriginals {
+			discardOriginal(context.Background(), pool.storage, pool.photos, photo)
+		}
+		if err := pool.photos.GroupSimilar(photo, *nearDupDistance); err != nil {
+			slog.Error("Unable to group photo with similar photos", "photo", photo.ID, "err", err)
+		}
+		if pool.moderator != nil {
+			moderatePhoto(context.Background(), pool.moderator, pool.storage, photo)
+		}
+	}
+
+	processing, err := pool.photos.UpdateProcessed(photo)
+	if errors.Is(err, os.ErrNotExist) {
+		// The photo was deleted while it was processed, so the copies made
+		// of it aren't wanted either
+		removePhotoFiles(context.Background(), pool.storage, pool.photos, photo)
+		return
+	}
+	if err != nil {
+		slog.Error("Unable to update photo", "photo", photo.ID, "err", err)
+		return
+	}
+	// Photos the couple decided on while they were processed were announced,
+	// or not, when they did
+	if !processing {
+		return
+	}
+	if updated, ok := pool.photos.Get(photo.ID); ok {
+		pool.feed.publish(updated)
+	}
+}
+
+// requeuePending queues every photo that was still waiting to be processed
+// when the server last stopped
+func (pool *workerPool) requeuePending(ctx context.Context) {
+	for _, photo := range pool.photos.WithStatus(photoProcessing) {
+		if err := pool.Enqueue(ctx, processingJob{PhotoID: photo.ID}); err != nil {
+			return
+		}
+	}
+}